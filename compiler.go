@@ -1,9 +1,13 @@
 package eval
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"math"
+	"reflect"
 	"sort"
+	"strings"
 )
 
 type CompileOption string
@@ -15,13 +19,29 @@ const (
 	ReduceNesting   CompileOption = "reduce_nesting"
 	ConstantFolding CompileOption = "constant_folding"
 
-	Debug                  CompileOption = "debug"
-	ReportEvent            CompileOption = "report_event"
-	InfixNotation          CompileOption = "infix_notation"
-	AllowUndefinedVariable CompileOption = "allow_undefined_variable"
+	Debug                   CompileOption = "debug"
+	ReportEvent             CompileOption = "report_event"
+	InfixNotation           CompileOption = "infix_notation"
+	AllowUndefinedVariable  CompileOption = "allow_undefined_variable"
+	CaseInsensitiveKeywords CompileOption = "case_insensitive_keywords"
+	ParseRecovery           CompileOption = "parse_recovery"
+	StrictReturns           CompileOption = "strict_returns"
+	RequireAllSelectorsUsed CompileOption = "require_all_selectors_used"
+	OptimizationLog         CompileOption = "optimization_log"
+	AllowEmptyList          CompileOption = "allow_empty_list"
+	TypeCheck               CompileOption = "type_check"
+	CondRequiresElse        CompileOption = "cond_requires_else"
+	NoInlineConfig          CompileOption = "no_inline_config"
+	StrictArity             CompileOption = "strict_arity"
 )
 
-type optimizer func(config *Config, root *astNode)
+// ErrUnusedSelectors is the diagnostic of the selectors registered but not used by the expression
+var ErrUnusedSelectors = errors.New("unused selectors")
+
+// ErrCostExceeded is returned by Compile if the cost of the expression exceeds the CostThreshold
+var ErrCostExceeded = errors.New("cost threshold exceeded")
+
+type optimizer func(config *Config, root *astNode, log *optimizationLog)
 
 var (
 	optimizations = []CompileOption{ConstantFolding, ReduceNesting, FastEvaluation, Reordering}
@@ -61,6 +81,161 @@ func copyConfig(dst, src *Config) {
 	for _, op := range src.StatelessOperators {
 		dst.StatelessOperators = append(dst.StatelessOperators, op)
 	}
+	for k, v := range src.Observers {
+		dst.Observers[k] = v
+	}
+	for k, v := range src.OperatorInfos {
+		dst.OperatorInfos[k] = v
+	}
+	for k, v := range src.VariableInfos {
+		dst.VariableInfos[k] = v
+	}
+	for k, v := range src.Macros {
+		dst.Macros[k] = v
+	}
+	if src.Keywords != nil {
+		dst.Keywords = make(map[string]string, len(src.Keywords))
+		for k, v := range src.Keywords {
+			dst.Keywords[k] = v
+		}
+	}
+	if src.MaxResultLen != 0 {
+		dst.MaxResultLen = src.MaxResultLen
+	}
+	if src.MaxOutputDepth != 0 {
+		dst.MaxOutputDepth = src.MaxOutputDepth
+	}
+	if src.CostThreshold != 0 {
+		dst.CostThreshold = src.CostThreshold
+	}
+	if src.TrailingTokens != TrailingError {
+		dst.TrailingTokens = src.TrailingTokens
+	}
+	if src.DebugOutput != nil {
+		dst.DebugOutput = src.DebugOutput
+	}
+}
+
+// MergeConfigs returns a new config that unions the base config and the overlays,
+// it returns an error if the same name is defined differently in them,
+// e.g. a variable is registered with different keys. The operators and the
+// observers can not be compared, so each of them should be defined in one config.
+func MergeConfigs(base *Config, overlays ...*Config) (*Config, error) {
+	conf := CopyConfig(base)
+	for _, src := range overlays {
+		if src == nil {
+			continue
+		}
+		if err := mergeConfig(conf, src); err != nil {
+			return nil, err
+		}
+	}
+	return conf, nil
+}
+
+func mergeConfig(dst, src *Config) error {
+	conflictErr := func(kind, name string) error {
+		return fmt.Errorf("config conflict error, %s [%s] is defined differently", kind, name)
+	}
+	duplicateErr := func(kind, name string) error {
+		return fmt.Errorf("config conflict error, %s [%s] is defined in more than one config", kind, name)
+	}
+
+	for k, v := range src.ConstantMap {
+		if old, exist := dst.ConstantMap[k]; exist && !reflect.DeepEqual(old, v) {
+			return conflictErr("constant", k)
+		}
+	}
+	for k, v := range src.VariableKeyMap {
+		if old, exist := dst.VariableKeyMap[k]; exist && old != v {
+			return conflictErr("variable", k)
+		}
+	}
+	// the functions can not be compared, e.g. the closures of one function literal share
+	// the code pointer whatever they capture, so an operator or an observer of the same
+	// name in both configs is a conflict
+	for k := range src.OperatorMap {
+		if _, exist := dst.OperatorMap[k]; exist {
+			return duplicateErr("operator", k)
+		}
+	}
+	for k, v := range src.CompileOptions {
+		if old, exist := dst.CompileOptions[k]; exist && old != v {
+			return conflictErr("compile option", string(k))
+		}
+	}
+	for k, v := range src.CostsMap {
+		if old, exist := dst.CostsMap[k]; exist && old != v {
+			return conflictErr("cost", k)
+		}
+	}
+	for k := range src.Observers {
+		if _, exist := dst.Observers[k]; exist {
+			return duplicateErr("observer", k)
+		}
+	}
+	for k, v := range src.OperatorInfos {
+		if old, exist := dst.OperatorInfos[k]; exist && !reflect.DeepEqual(old, v) {
+			return conflictErr("operator info", k)
+		}
+	}
+	for k, v := range src.VariableInfos {
+		if old, exist := dst.VariableInfos[k]; exist && !reflect.DeepEqual(old, v) {
+			return conflictErr("variable info", k)
+		}
+	}
+	for k, v := range src.Macros {
+		if old, exist := dst.Macros[k]; exist && !reflect.DeepEqual(old, v) {
+			return conflictErr("macro", k)
+		}
+	}
+	if dst.Keywords != nil && src.Keywords != nil && !reflect.DeepEqual(dst.Keywords, src.Keywords) {
+		return conflictErr("option", "Keywords")
+	}
+	if dst.MaxResultLen != 0 && src.MaxResultLen != 0 && dst.MaxResultLen != src.MaxResultLen {
+		return conflictErr("option", "MaxResultLen")
+	}
+	if dst.MaxOutputDepth != 0 && src.MaxOutputDepth != 0 && dst.MaxOutputDepth != src.MaxOutputDepth {
+		return conflictErr("option", "MaxOutputDepth")
+	}
+	if dst.CostThreshold != 0 && src.CostThreshold != 0 && dst.CostThreshold != src.CostThreshold {
+		return conflictErr("option", "CostThreshold")
+	}
+	if dst.TrailingTokens != TrailingError && src.TrailingTokens != TrailingError &&
+		dst.TrailingTokens != src.TrailingTokens {
+		return conflictErr("option", "TrailingTokens")
+	}
+
+	stateless := make(map[string]bool, len(dst.StatelessOperators))
+	for _, op := range dst.StatelessOperators {
+		stateless[op] = true
+	}
+	for _, op := range src.StatelessOperators {
+		if !stateless[op] {
+			stateless[op] = true
+			dst.StatelessOperators = append(dst.StatelessOperators, op)
+		}
+	}
+
+	// no conflicts, the stateless operators are already merged
+	copyConfig(dst, &Config{
+		ConstantMap:    src.ConstantMap,
+		OperatorMap:    src.OperatorMap,
+		VariableKeyMap: src.VariableKeyMap,
+		CostsMap:       src.CostsMap,
+		CompileOptions: src.CompileOptions,
+		Observers:      src.Observers,
+		OperatorInfos:  src.OperatorInfos,
+		VariableInfos:  src.VariableInfos,
+		Macros:         src.Macros,
+		Keywords:       src.Keywords,
+		MaxResultLen:   src.MaxResultLen,
+		MaxOutputDepth: src.MaxOutputDepth,
+		CostThreshold:  src.CostThreshold,
+		TrailingTokens: src.TrailingTokens,
+		DebugOutput:    src.DebugOutput,
+	})
+	return nil
 }
 
 type Option func(conf *Config)
@@ -91,6 +266,72 @@ var (
 	EnableInfixNotation Option = func(c *Config) {
 		c.CompileOptions[InfixNotation] = true
 	}
+	// EnableCaseInsensitiveKeywords matches the builtin keywords, operators and constants
+	// in ASCII case-insensitive way, e.g. `IF`, `And` and `TRUE`.
+	// User-defined variables, constants and operators are still case-sensitive.
+	EnableCaseInsensitiveKeywords Option = func(c *Config) {
+		c.CompileOptions[CaseInsensitiveKeywords] = true
+	}
+
+	// EnableParseRecovery replaces the sub-expressions that fail to parse with placeholder nodes
+	// and continues parsing, so that the rest of the expression is still available for editors.
+	// The errors are reported by Expr.ParseErrors, and the placeholder nodes return them when evaluated.
+	// Only the prefix notation is supported.
+	EnableParseRecovery Option = func(c *Config) {
+		c.CompileOptions[ParseRecovery] = true
+	}
+
+	// EnableStrictReturns checks the results of the operators against their declared
+	// return types after each call, see WithReturns. It adds overhead to the evaluations.
+	EnableStrictReturns Option = func(c *Config) {
+		c.CompileOptions[StrictReturns] = true
+	}
+
+	// EnableRequireAllSelectorsUsed reports the selectors registered in the config but not
+	// referenced by the expression as a diagnostic, see Expr.Diagnostics.
+	// The compilation does not fail because of the unused selectors.
+	EnableRequireAllSelectorsUsed Option = func(c *Config) {
+		c.CompileOptions[RequireAllSelectorsUsed] = true
+	}
+
+	// EnableOptimizationLog records the rewrites of the optimizations at compile time,
+	// see Expr.OptimizationLog. It's for debugging, and it slows down the compilation.
+	EnableOptimizationLog Option = func(c *Config) {
+		c.CompileOptions[OptimizationLog] = true
+	}
+
+	// EnableEmptyList allows the empty list literals, e.g. `()`, which are []string.
+	// They are rejected by default, since the type of the elements can not be inferred.
+	EnableEmptyList Option = func(c *Config) {
+		c.CompileOptions[AllowEmptyList] = true
+	}
+
+	// EnableTypeCheck checks the types of the params of the operators at compile time, where
+	// they can be determined statically, e.g. `(+ 1 "a")` or `(if 1 2 3)`. The types of the
+	// variables are declared by RegisterVariable, and the types of the custom operators are
+	// declared by WithParams and WithReturns. The params of unknown types are not checked.
+	EnableTypeCheck Option = func(c *Config) {
+		c.CompileOptions[TypeCheck] = true
+	}
+
+	// EnableCondRequiresElse rejects the cond expressions without the else clause at compile time,
+	// by default an unmatched cond returns nil.
+	EnableCondRequiresElse Option = func(c *Config) {
+		c.CompileOptions[CondRequiresElse] = true
+	}
+
+	// EnableStrictArity checks the counts of the params of the builtin operators at compile time,
+	// e.g. `(!= age 3 4)`. The operators registered with WithArity are always checked.
+	EnableStrictArity Option = func(c *Config) {
+		c.CompileOptions[StrictArity] = true
+	}
+
+	// DisableInlineConfig rejects the compile configs in the leading `;;;;` comments of the
+	// expressions, e.g. `;;;; optimize: false`, so that only the options of the config apply.
+	// It's for the expressions written by untrusted users.
+	DisableInlineConfig Option = func(c *Config) {
+		c.CompileOptions[NoInlineConfig] = true
+	}
 
 	// RegVarAndOp registers variables and operators to config
 	RegVarAndOp = func(vals map[string]interface{}) Option {
@@ -108,6 +349,43 @@ var (
 		}
 	}
 
+	// LimitResultLen limits the length of the lists produced by operators, 0 means no limit
+	LimitResultLen = func(n int) Option {
+		return func(c *Config) {
+			c.MaxResultLen = n
+		}
+	}
+
+	// LimitOutputDepth limits the nesting depth of the structures constructed by
+	// the aggregate operators, such as dict and tuple, and by map, 0 means no limit
+	LimitOutputDepth = func(n int) Option {
+		return func(c *Config) {
+			c.MaxOutputDepth = n
+		}
+	}
+
+	// LimitCost rejects the expressions whose costs exceed the threshold at compile time,
+	// see Expr.Cost for the cost model, 0 means no limit
+	LimitCost = func(threshold float64) Option {
+		return func(c *Config) {
+			c.CostThreshold = threshold
+		}
+	}
+
+	// WriteDebugTo sets the writer of the debug output, see HandleDebugEvent
+	WriteDebugTo = func(w io.Writer) Option {
+		return func(c *Config) {
+			c.DebugOutput = w
+		}
+	}
+
+	// HandleTrailingTokens sets the handling of the content after the first complete expression
+	HandleTrailingTokens = func(mode TrailingMode) Option {
+		return func(c *Config) {
+			c.TrailingTokens = mode
+		}
+	}
+
 	// ExtendConf extends source config
 	ExtendConf = func(src *Config) Option {
 		return func(c *Config) {
@@ -126,6 +404,10 @@ func NewConfig(opts ...Option) *Config {
 		CompileOptions:     make(map[CompileOption]bool),
 		CostsMap:           make(map[string]float64),
 		StatelessOperators: []string{},
+		Observers:          make(map[string]Observer),
+		OperatorInfos:      make(map[string]OperatorInfo),
+		VariableInfos:      make(map[string]VariableInfo),
+		Macros:             make(map[string]Macro),
 	}
 	for _, opt := range opts {
 		opt(conf)
@@ -147,8 +429,59 @@ type Config struct {
 	// StatelessOperators will be used in optimizeConstantFolding,
 	// so please make sure when adding new operators into StatelessOperators
 	StatelessOperators []string
+
+	// Observers are called by the `tap` keyword with the tapped values
+	Observers map[string]Observer
+
+	// OperatorInfos are the metadata of the operators in OperatorMap, see RegisterOperator
+	OperatorInfos map[string]OperatorInfo
+
+	// VariableInfos are the metadata of the variables, see RegisterVariable
+	VariableInfos map[string]VariableInfo
+
+	// Macros are expanded inline at compile time, see RegisterMacro
+	Macros map[string]Macro
+
+	// Keywords maps the keyword names in expressions to the builtin keywords,
+	// nil means the builtin keywords, see RenameKeyword and DisableKeyword
+	Keywords map[string]string
+
+	// MaxResultLen is the max length of the lists produced by operators, and the max
+	// length in bytes of the strings produced by repeat_str, 0 means no limit, except
+	// range and repeat_str, which are limited to 1 << 20 by default
+	MaxResultLen int
+
+	// MaxOutputDepth is the max nesting depth of the structures constructed by
+	// the aggregate operators, such as dict and tuple, and by map, 0 means no limit
+	MaxOutputDepth int
+
+	// CostThreshold is the max static cost of the expressions, the ones exceeding it
+	// are rejected by Compile with ErrCostExceeded, 0 means no limit, see Expr.Cost
+	CostThreshold float64
+
+	// TrailingTokens is the handling of the content after the first complete expression,
+	// TrailingError by default
+	TrailingTokens TrailingMode
+
+	// DebugOutput is the writer of the debug output of the expressions, e.g. io.Discard,
+	// os.Stderr by default, see HandleDebugEvent
+	DebugOutput io.Writer
 }
 
+// TrailingMode is the handling of the content after the first complete expression,
+// only the prefix notation is supported, see Expr.ConsumedLen for where the parsing stopped
+type TrailingMode uint8
+
+const (
+	// TrailingError returns an error if there is any token after the first complete expression
+	TrailingError TrailingMode = iota
+	// TrailingIgnore ignores the content after the first complete expression, it's not even lexed
+	TrailingIgnore
+	// TrailingSequence parses the content as a sequence of expressions,
+	// they're evaluated in order and the result of the last one is returned
+	TrailingSequence
+)
+
 func (cc *Config) getCosts(nodeType uint8, nodeName string) float64 {
 	const (
 		defaultCost  float64 = 5
@@ -180,12 +513,83 @@ func (cc *Config) getCosts(nodeType uint8, nodeName string) float64 {
 }
 
 func Compile(originConf *Config, exprStr string) (*Expr, error) {
-	ast, conf, err := newParser(originConf, exprStr).parse()
+	return NewCompiler(originConf).Compile(exprStr)
+}
+
+// Validate checks the expression without compiling it, it lexes and parses the expression,
+// and checks the types if TypeCheck is enabled. It returns the first error found, which is
+// positioned in the expression, or nil if the expression is valid. The parse errors are
+// returned too when ParseRecovery is enabled. The optimizations and the limits of the
+// compiled expressions, e.g. the max count of the nodes, are not applied.
+func Validate(cc *Config, exprStr string) error {
+	p := newParser(cc, exprStr)
+	if _, _, err := p.parse(); err != nil {
+		return err
+	}
+	if len(p.errs) != 0 {
+		return p.errs[0]
+	}
+	return nil
+}
+
+// Compiler compiles many expressions with the same Config, such as the rules
+// loaded from a file. It reuses the lexer buffers across the sources to reduce
+// the allocations. A Compiler is not safe for concurrent use.
+type Compiler struct {
+	conf *Config
+
+	runes  []rune
+	tokens []token
+}
+
+func NewCompiler(cc *Config) *Compiler {
+	return &Compiler{conf: cc}
+}
+
+// Compile compiles the expression, it's the same as the Compile function
+func (c *Compiler) Compile(exprStr string) (*Expr, error) {
+	p := newParser(c.conf, exprStr)
+	p.runes, p.tokens = c.runes[:0], c.tokens[:0]
+	defer func() {
+		// the buffers are kept for the next source, the tokens are not
+		// referenced by the compiled expression
+		c.runes, c.tokens = p.runes[:0], p.tokens[:0]
+	}()
+
+	ast, conf, err := p.parse()
 	if err != nil {
 		return nil, err
 	}
 
-	optimize(conf, ast)
+	e, err := compileAst(conf, ast)
+	if err != nil {
+		return nil, err
+	}
+	e.parseErrs = p.errs
+	e.conf = conf
+	e.source = exprStr
+	e.consumed = p.consumedLen()
+	e.inputs = referencedInputs(conf, e)
+	e.pure = isPure(conf, e)
+	setStreamRoot(e)
+
+	if conf.CompileOptions[RequireAllSelectorsUsed] {
+		if unused := p.unusedSelectors(); len(unused) != 0 {
+			e.diagnostics = append(e.diagnostics,
+				fmt.Errorf("%w: %v", ErrUnusedSelectors, unused))
+		}
+	}
+	return e, nil
+}
+
+// compileAst compiles the ast to Expr, it's used by both the main expression and lambdas
+func compileAst(conf *Config, ast *astNode) (*Expr, error) {
+	var log *optimizationLog
+	if conf.CompileOptions[OptimizationLog] {
+		// the lambdas are compiled before, their rewrites come first
+		log = &optimizationLog{entries: lambdaOptimizationLogs(ast)}
+	}
+	optimize(conf, ast, log)
 
 	res := check(ast)
 	if res.err != nil {
@@ -193,22 +597,168 @@ func Compile(originConf *Config, exprStr string) (*Expr, error) {
 	}
 
 	expr := buildExpr(conf, ast, res.size)
+	expr.cost = calculateCosts(conf, ast)
+	for _, lambdas := range expr.lambdas {
+		for _, l := range lambdas {
+			expr.cost += l.body.cost
+		}
+	}
+	if conf.CostThreshold > 0 && expr.cost > conf.CostThreshold {
+		return nil, fmt.Errorf("%w (max: %v, got: %v)", ErrCostExceeded, conf.CostThreshold, expr.cost)
+	}
+	expr.intArith = intArithmetic(conf, expr)
+	if log != nil {
+		expr.optimizationLog = log.entries
+	}
 
+	if err := checkStackSize(expr, ast); err != nil {
+		return nil, err
+	}
 	return expr, nil
 }
 
-func optimize(cc *Config, root *astNode) {
+// checkStackSize verifies the stack size computed by calAndSetStackSize is an upper bound
+// of the stack depth, a smaller one is a bug of the compiler, which is reported rather
+// than corrected to keep it visible.
+func checkStackSize(e *Expr, root *astNode) error {
+	bound := stackBound(root)
+	if bound > math.MaxInt16 {
+		return fmt.Errorf("stack size cannot exceed a maximum of 32767, got: [%d]", bound)
+	}
+	if int(e.maxStackSize) < bound {
+		return fmt.Errorf("invalid stack size [%d], the stack depth is [%d]", e.maxStackSize, bound)
+	}
+	return nil
+}
+
+// intArithmetic returns the arithmetic of the operator nodes if the expression is entirely
+// int64 arithmetic, which consists of the int64 constants, the variables registered as IntType,
+// and the arithmetic operators of them. Otherwise, it returns nil.
+func intArithmetic(cc *Config, e *Expr) []arithmetic {
+	res := make([]arithmetic, len(e.nodes))
+	for i, n := range e.nodes {
+		switch n.getNodeType() {
+		case constant:
+			if _, ok := n.value.(int64); !ok {
+				return nil
+			}
+		case variable:
+			// the local variables are not registered, even if they have the same names
+			if n.varKey == localVarKey || cc.VariableInfos[n.value.(string)].Type != IntType {
+				return nil
+			}
+		case operator, fastOperator:
+			name, _ := n.value.(string)
+			m, ok := intArithmeticModes[name]
+			if !ok || n.childCnt < 2 || len(e.lambdas[n]) != 0 {
+				return nil
+			}
+			res[i] = arithmetic{mode: m}
+		default:
+			// the if nodes and the event nodes
+			return nil
+		}
+	}
+	return res
+}
+
+// stackBound returns the max depth of the operand stack when evaluating the ast,
+// it's computed from the ast independently of calAndSetStackSize.
+func stackBound(root *astNode) int {
+	n := root.node
+	switch n.getNodeType() {
+	case constant, variable, fastOperator:
+		// the children of fast operators are not pushed into the stack
+		return 1
+	case cond:
+		// only one of the branches is evaluated, and the condition is popped before them
+		bound := 1
+		for _, child := range root.children {
+			if b := stackBound(child); b > bound {
+				bound = b
+			}
+		}
+		return bound
+	}
+
+	// the i-th child is evaluated on top of the results of the previous children
+	bound := 1
+	for i, child := range root.children {
+		if b := i + stackBound(child); b > bound {
+			bound = b
+		}
+	}
+	return bound
+}
+
+func optimize(cc *Config, root *astNode, log *optimizationLog) {
 	for _, opt := range optimizations {
 		enabled, exist := cc.CompileOptions[opt]
 		if enabled || !exist {
-			optimizerMap[opt](cc, root)
+			optimizerMap[opt](cc, root, log)
 		}
 	}
 }
 
-func optimizeReduceNesting(cc *Config, root *astNode) {
+// optimizationLog records the rewrites of the optimizations, a nil log records nothing
+type optimizationLog struct {
+	entries []string
+}
+
+// add records that the node is rewritten by the optimization, the before is the
+// rendering of the node before the rewrite, e.g. "constant folding: (+ 1 2) at [3:10] => 3"
+func (l *optimizationLog) add(opt CompileOption, root *astNode, before string) {
+	entry := fmt.Sprintf("%s: %s", strings.ReplaceAll(string(opt), "_", " "), before)
+	if root.span.End > root.span.Start {
+		entry += fmt.Sprintf(" at [%d:%d]", root.span.Start, root.span.End)
+	}
+	if after := renderAst(root); after != before {
+		entry += " => " + after
+	}
+	l.entries = append(l.entries, entry)
+}
+
+// render renders the node if the log is enabled, it's called before the rewrites
+func (l *optimizationLog) render(root *astNode) string {
+	if l == nil {
+		return ""
+	}
+	return renderAst(root)
+}
+
+// renderAst renders the ast in one line, e.g. `(and (> age 18) true)`
+func renderAst(root *astNode) string {
+	if len(root.children) == 0 && len(root.lambdas) == 0 {
+		s, _ := dumpLeafNode(root.node)
+		return s
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("(%v", root.node.value))
 	for _, child := range root.children {
-		optimizeReduceNesting(cc, child)
+		sb.WriteString(" " + renderAst(child))
+	}
+	for _, l := range root.lambdas {
+		sb.WriteString(" " + strings.Join(strings.Fields(Dump(l.body)), " "))
+	}
+	sb.WriteString(")")
+	return sb.String()
+}
+
+func lambdaOptimizationLogs(root *astNode) []string {
+	var res []string
+	for _, l := range root.lambdas {
+		res = append(res, l.body.optimizationLog...)
+	}
+	for _, child := range root.children {
+		res = append(res, lambdaOptimizationLogs(child)...)
+	}
+	return res
+}
+
+func optimizeReduceNesting(cc *Config, root *astNode, log *optimizationLog) {
+	for _, child := range root.children {
+		optimizeReduceNesting(cc, child, log)
 	}
 
 	n := root.node
@@ -216,7 +766,10 @@ func optimizeReduceNesting(cc *Config, root *astNode) {
 		return
 	}
 
-	var children []*astNode
+	var (
+		children []*astNode
+		reduced  bool
+	)
 	rootOpType := isAndOpNode(n)
 	for _, child := range root.children {
 		cn := child.node
@@ -229,12 +782,17 @@ func optimizeReduceNesting(cc *Config, root *astNode) {
 		}
 		if isAndOpNode(cn) == rootOpType {
 			children = append(children, child.children...)
+			reduced = true
 			continue
 		}
 		return
 	}
 
+	before := log.render(root)
 	root.children = children
+	if log != nil && reduced {
+		log.add(ReduceNesting, root, before)
+	}
 }
 
 func isBoolOpNode(n *node) bool {
@@ -267,9 +825,9 @@ func parentNode(e *Expr, idx int16) (*node, int16) {
 	return e.nodes[pIdx], pIdx
 }
 
-func optimizeReordering(cc *Config, root *astNode) {
+func optimizeReordering(cc *Config, root *astNode, log *optimizationLog) {
 	for _, child := range root.children {
-		optimizeReordering(cc, child)
+		optimizeReordering(cc, child, log)
 	}
 
 	calculateNodeCosts(cc, root)
@@ -279,9 +837,22 @@ func optimizeReordering(cc *Config, root *astNode) {
 	}
 
 	// reordering child nodes based on node cost
+	before := log.render(root)
 	sort.SliceStable(root.children, func(i, j int) bool {
 		return root.children[i].cost < root.children[j].cost
 	})
+	if log != nil && renderAst(root) != before {
+		log.add(Reordering, root, before)
+	}
+}
+
+// calculateCosts calculates the costs of all the nodes of the ast, and returns the cost of the root
+func calculateCosts(conf *Config, root *astNode) float64 {
+	for _, child := range root.children {
+		calculateCosts(conf, child)
+	}
+	calculateNodeCosts(conf, root)
+	return root.cost
 }
 
 func calculateNodeCosts(conf *Config, root *astNode) {
@@ -337,9 +908,9 @@ func calculateNodeCosts(conf *Config, root *astNode) {
 	root.cost = baseCost + operationCost + childrenCost
 }
 
-func optimizeConstantFolding(cc *Config, root *astNode) {
+func optimizeConstantFolding(cc *Config, root *astNode, log *optimizationLog) {
 	for _, child := range root.children {
-		optimizeConstantFolding(cc, child)
+		optimizeConstantFolding(cc, child, log)
 	}
 
 	n := root.node
@@ -360,11 +931,15 @@ func optimizeConstantFolding(cc *Config, root *astNode) {
 			}
 
 			if (b && isOrOpNode(n)) || (!b && isAndOpNode(n)) {
+				before := log.render(root)
 				root.node = &node{
 					flag:  constant,
 					value: b,
 				}
 				root.children = nil
+				if log != nil {
+					log.add(ConstantFolding, root, before)
+				}
 				return
 			}
 		}
@@ -373,23 +948,84 @@ func optimizeConstantFolding(cc *Config, root *astNode) {
 	params := make([]Value, len(root.children))
 	for i, child := range root.children {
 		if child.node.getNodeType() != constant {
+			// the operator can not be folded, but the constant params may be precomputed
+			if precompute, ok := builtinPrecomputers[n.value.(string)]; ok && isBuiltinOperator(cc, n.value.(string)) {
+				if op := precompute(root.children); op != nil {
+					if root.wrap != nil {
+						op = root.wrap(op)
+					}
+					n.operator = op
+				}
+			}
 			return
 		}
 		params[i] = child.node.value
 	}
 
-	res, err := fn(nil, params)
+	res, err := foldOp(fn, params)
 	if err != nil {
+		// the failures are reported by the evaluations
 		return
 	}
+	if s, ok := res.(string); ok && n.value == "repeat_str" && len(s) > maxFoldedRepeatLen {
+		// the large strings of repeat_str are produced by the evaluations rather than retained by the expression
+		return
+	}
+	before := log.render(root)
 	root.children = nil
 	root.node = &node{
 		flag:  constant,
 		value: res,
 	}
+	if log != nil {
+		log.add(ConstantFolding, root, before)
+	}
 	return
 }
 
+// constantValue returns the value of the ast if it's a constant, or a sub-expression of the constants
+// and the stateless operators, which is folded into a constant by the constant folding. It's used by
+// the builders to check the constant params, since they run before the constant folding.
+// The ast is not changed, so the sub-expression is still folded only if ConstantFolding is enabled.
+func constantValue(cc *Config, root *astNode) (Value, bool) {
+	n := root.node
+	if n.getNodeType() == constant {
+		return n.value, true
+	}
+	stateless, fn := isStatelessOp(cc, n)
+	if !stateless || len(root.lambdas) != 0 {
+		return nil, false
+	}
+
+	params := make([]Value, len(root.children))
+	for i, child := range root.children {
+		v, ok := constantValue(cc, child)
+		if !ok {
+			return nil, false
+		}
+		params[i] = v
+	}
+	res, err := foldOp(fn, params)
+	if err != nil {
+		return nil, false
+	}
+	return res, true
+}
+
+// maxFoldedRepeatLen is the max length in bytes of the repeat_str results folded into constants
+const maxFoldedRepeatLen = 1 << 12
+
+// foldOp calls the operator at compile time, the panics of it are recovered as errors,
+// so the operators failing on the user submitted params don't crash the compilation
+func foldOp(fn Operator, params []Value) (res Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			res, err = nil, fmt.Errorf("constant folding panics: %v", r)
+		}
+	}()
+	return fn(nil, params)
+}
+
 func isStatelessOp(c *Config, n *node) (bool, Operator) {
 	if typ := n.getNodeType(); typ != operator && typ != fastOperator {
 		return false, nil
@@ -402,7 +1038,11 @@ func isStatelessOp(c *Config, n *node) (bool, Operator) {
 
 	// builtinOperators stateless functions
 	for _, so := range builtinStatelessOperations {
-		if so == op {
+		if so == op && isBuiltinOperator(c, op) {
+			// prefer the operator of the node, as it may be built with the config
+			if n.operator != nil {
+				return true, n.operator
+			}
 			return true, builtinOperators[op]
 		}
 	}
@@ -419,12 +1059,14 @@ func isStatelessOp(c *Config, n *node) (bool, Operator) {
 	return false, nil
 }
 
-func optimizeFastEvaluation(cc *Config, root *astNode) {
+func optimizeFastEvaluation(cc *Config, root *astNode, log *optimizationLog) {
 	for _, child := range root.children {
-		optimizeFastEvaluation(cc, child)
+		optimizeFastEvaluation(cc, child, log)
 	}
 	n := root.node
-	if (n.flag&nodeTypeMask) != operator || len(root.children) != 2 {
+	// the unary operators are evaluated fast too, except the keywords with lambdas, e.g. `(map l (+ x 1))`,
+	// whose partial results are only returned by the boxed operator calls
+	if cnt := len(root.children); (n.flag&nodeTypeMask) != operator || cnt < 1 || cnt > 2 || len(root.lambdas) != 0 {
 		return
 	}
 
@@ -439,6 +1081,9 @@ func optimizeFastEvaluation(cc *Config, root *astNode) {
 	otherPartMask := nodeTypeMask ^ uint8(0xFF)
 
 	root.node.flag = fastOperator | (root.node.flag & otherPartMask)
+	if log != nil {
+		log.add(FastEvaluation, root, renderAst(root))
+	}
 }
 
 type checkRes struct {
@@ -485,12 +1130,15 @@ func buildExpr(cc *Config, ast *astNode, size int) *Expr {
 	calAndSetNodes(e, ast)
 	calAndSetParentIndex(e, ast)
 	calAndSetStackSize(e)
-	calAndSetShortCircuit(e)
-	calAndSetShortCircuitForRCO(e)
+	calAndSetShortCircuit(cc, e)
+	calAndSetShortCircuitForRCO(cc, e)
 
 	if cc.CompileOptions[ReportEvent] || cc.CompileOptions[Debug] {
 		calAndSetEventNode(e)
 	}
+	if cc.CompileOptions[Debug] {
+		e.debug = newDebugPrinter(cc)
+	}
 
 	return e
 }
@@ -544,6 +1192,20 @@ func calAndSetNodes(e *Expr, root *astNode) {
 	for _, child := range root.children {
 		child.parentIdx = root.idx
 	}
+
+	if root.span.End != 0 {
+		if e.spans == nil {
+			e.spans = make(map[*node]Span)
+		}
+		e.spans[n] = root.span
+	}
+
+	if len(root.lambdas) != 0 {
+		if e.lambdas == nil {
+			e.lambdas = make(map[*node][]*lambda)
+		}
+		e.lambdas[n] = root.lambdas
+	}
 }
 
 func calAndSetParentIndex(e *Expr, root *astNode) {
@@ -570,7 +1232,7 @@ func calAndSetStackSize(e *Expr) {
 
 	var isEndIfNode = func(e *Expr, idx int16) bool {
 		n := e.nodes[idx]
-		return n.getNodeType() == cond && n.value == "fi"
+		return n.getNodeType() == cond && n.value == endIf
 	}
 
 	f[0] = 1
@@ -612,7 +1274,7 @@ func calAndSetStackSize(e *Expr) {
 	e.maxStackSize = maxStackSize
 }
 
-func calAndSetShortCircuit(e *Expr) {
+func calAndSetShortCircuit(cc *Config, e *Expr) {
 	var (
 		size = int16(len(e.nodes))
 		f    = make([]int16, size)
@@ -622,7 +1284,7 @@ func calAndSetShortCircuit(e *Expr) {
 			nodeType := e.nodes[idx].getNodeType()
 			_, pIdx := parentNode(e, idx)
 			if nodeType == fastOperator {
-				return pIdx == idx+3
+				return pIdx == idx+1+int16(e.nodes[idx].childCnt)
 			} else {
 				return pIdx == idx+1
 			}
@@ -638,10 +1300,10 @@ func calAndSetShortCircuit(e *Expr) {
 		}
 
 		var flag uint8
-		switch {
-		case isAndOpNode(p):
+		switch shortCircuitOf(cc, p) {
+		case ShortCircuitOnFalse:
 			flag |= scIfFalse
-		case isOrOpNode(p):
+		case ShortCircuitOnTrue:
 			flag |= scIfTrue
 		default:
 			f[i] = i
@@ -694,20 +1356,39 @@ func calAndSetShortCircuit(e *Expr) {
 	}
 }
 
-func calAndSetShortCircuitForRCO(e *Expr) {
+func calAndSetShortCircuitForRCO(cc *Config, e *Expr) {
 	for i, n := range e.nodes {
 		p, _ := parentNode(e, int16(i))
-		switch {
-		case p == nil:
+		if p == nil {
 			continue
-		case isAndOpNode(p):
+		}
+		switch shortCircuitOf(cc, p) {
+		case ShortCircuitOnFalse:
 			n.flag |= andOp
-		case isOrOpNode(p):
+		case ShortCircuitOnTrue:
 			n.flag |= orOp
 		}
 	}
 }
 
+// shortCircuitOf returns the short circuit behavior of the operator node, they are
+// the builtin `and`, `or` operators and the operators registered with WithShortCircuit.
+func shortCircuitOf(cc *Config, n *node) ShortCircuit {
+	switch {
+	case isAndOpNode(n):
+		return ShortCircuitOnFalse
+	case isOrOpNode(n):
+		return ShortCircuitOnTrue
+	}
+	if typ := n.getNodeType(); typ != operator && typ != fastOperator {
+		return NoShortCircuit
+	}
+	if _, exist := cc.OperatorMap[n.value.(string)]; !exist {
+		return NoShortCircuit
+	}
+	return cc.OperatorInfos[n.value.(string)].ShortCircuit
+}
+
 type NodeType uint8
 
 const (
@@ -760,7 +1441,10 @@ func calAndSetEventNode(e *Expr) {
 		)
 		return func(ctx *Ctx, params []Value) (res Value, err error) {
 			res, err = op(ctx, params)
-			e.EventChan <- Event{
+			// the params are pooled buffers of the evaluation, while the events may be handled
+			// asynchronously, e.g. by HandleDebugEvent, so the events carry a copy of them
+			params = append([]Value(nil), params...)
+			e.emit(Event{
 				EventType: OpExecEvent,
 				Data: OpEventData{
 					IsFastOp: isFastOp,
@@ -769,7 +1453,7 @@ func calAndSetEventNode(e *Expr) {
 					Res:      res,
 					Err:      err,
 				},
-			}
+			})
 			return
 		}
 	}
@@ -810,11 +1494,12 @@ func calAndSetEventNode(e *Expr) {
 		case fastOperator:
 			realNode.operator = wrapOpEvent(realNode)
 			// append child nodes of fast operator
-			res = append(res, nodes[i+1], nodes[i+2])
-			parents = append(parents, e.parentIdx[i+1], e.parentIdx[i+2])
-			realIdxes[i+1] = int16(len(res) - 2)
-			realIdxes[i+2] = int16(len(res) - 1)
-			i += 2
+			for j := 0; j < int(realNode.childCnt); j++ {
+				i++
+				res = append(res, nodes[i])
+				parents = append(parents, e.parentIdx[i])
+				realIdxes[i] = int16(len(res) - 1)
+			}
 		}
 	}
 
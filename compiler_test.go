@@ -1,6 +1,8 @@
 package eval
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math"
 	"reflect"
@@ -138,6 +140,152 @@ func TestCopyConfig(t *testing.T) {
 	}
 }
 
+func TestMergeConfigs(t *testing.T) {
+	isAdult := func(_ *Ctx, params []Value) (Value, error) {
+		return params[0].(int64) >= 18, nil
+	}
+	isChild := func(_ *Ctx, params []Value) (Value, error) {
+		return params[0].(int64) < 18, nil
+	}
+
+	olderThan := func(age int64) Operator {
+		return func(_ *Ctx, params []Value) (Value, error) {
+			return params[0].(int64) > age, nil
+		}
+	}
+
+	base := NewConfig(EnableDebug)
+	base.VariableKeyMap["age"] = 1
+	base.OperatorMap["is_adult"] = isAdult
+	base.ConstantMap["ADULT_AGE"] = int64(18)
+	base.StatelessOperators = []string{"is_adult"}
+
+	testCases := []struct {
+		name     string
+		overlays []*Config
+		check    func(t *testing.T, cc *Config)
+		errMsg   string
+	}{
+		{
+			name: "disjoint",
+			overlays: []*Config{
+				{
+					VariableKeyMap:     map[string]VariableKey{"gender": 2},
+					OperatorMap:        map[string]Operator{"is_child": isChild},
+					StatelessOperators: []string{"is_child"},
+				},
+				{
+					ConstantMap:    map[string]Value{"MALE": "Male"},
+					CompileOptions: map[CompileOption]bool{ReportEvent: true},
+				},
+			},
+			check: func(t *testing.T, cc *Config) {
+				assertEquals(t, cc.VariableKeyMap, map[string]VariableKey{"age": 1, "gender": 2})
+				assertEquals(t, cc.ConstantMap, map[string]Value{"ADULT_AGE": int64(18), "MALE": "Male"})
+				assertEquals(t, cc.CompileOptions, map[CompileOption]bool{Debug: true, ReportEvent: true})
+				assertEquals(t, cc.StatelessOperators, []string{"is_adult", "is_child"})
+				assertEquals(t, len(cc.OperatorMap), 2)
+			},
+		},
+		{
+			name: "same definitions",
+			overlays: []*Config{
+				{
+					VariableKeyMap: map[string]VariableKey{"age": 1},
+				},
+				{
+					ConstantMap:        map[string]Value{"ADULT_AGE": int64(18)},
+					StatelessOperators: []string{"is_adult"},
+				},
+			},
+			check: func(t *testing.T, cc *Config) {
+				assertEquals(t, cc.VariableKeyMap, map[string]VariableKey{"age": 1})
+				assertEquals(t, cc.ConstantMap, map[string]Value{"ADULT_AGE": int64(18)})
+				assertEquals(t, cc.StatelessOperators, []string{"is_adult"})
+				assertEquals(t, len(cc.OperatorMap), 1)
+			},
+		},
+		{
+			name: "variable conflict",
+			overlays: []*Config{
+				{VariableKeyMap: map[string]VariableKey{"age": 2}},
+			},
+			errMsg: "variable [age] is defined differently",
+		},
+		{
+			name: "operator conflict",
+			overlays: []*Config{
+				{VariableKeyMap: map[string]VariableKey{"gender": 2}},
+				{OperatorMap: map[string]Operator{"is_adult": isChild}},
+			},
+			errMsg: "operator [is_adult] is defined in more than one config",
+		},
+		{
+			// the closures of one factory share the code pointer
+			name: "operators of one factory",
+			overlays: []*Config{
+				{OperatorMap: map[string]Operator{"older_than": olderThan(18)}},
+				{OperatorMap: map[string]Operator{"older_than": olderThan(21)}},
+			},
+			errMsg: "operator [older_than] is defined in more than one config",
+		},
+		{
+			name: "same operator registered twice",
+			overlays: []*Config{
+				{OperatorMap: map[string]Operator{"is_adult": isAdult}},
+			},
+			errMsg: "operator [is_adult] is defined in more than one config",
+		},
+		{
+			name: "constant conflict",
+			overlays: []*Config{
+				{ConstantMap: map[string]Value{"ADULT_AGE": int64(21)}},
+			},
+			errMsg: "constant [ADULT_AGE] is defined differently",
+		},
+		{
+			name: "compile option conflict",
+			overlays: []*Config{
+				{CompileOptions: map[CompileOption]bool{Debug: false}},
+			},
+			errMsg: "compile option [debug] is defined differently",
+		},
+		{
+			name: "cost threshold",
+			overlays: []*Config{
+				{CostThreshold: 100},
+			},
+			check: func(t *testing.T, cc *Config) {
+				assertEquals(t, cc.CostThreshold, float64(100))
+			},
+		},
+		{
+			name: "cost threshold conflict",
+			overlays: []*Config{
+				{CostThreshold: 100},
+				{CostThreshold: 200},
+			},
+			errMsg: "option [CostThreshold] is defined differently",
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			res, err := MergeConfigs(base, c.overlays...)
+			if len(c.errMsg) != 0 {
+				assertErrStrContains(t, err, c.errMsg)
+				return
+			}
+			assertNil(t, err)
+			c.check(t, res)
+
+			// the base config is not modified
+			assertEquals(t, len(base.VariableKeyMap), 1)
+			assertEquals(t, base.StatelessOperators, []string{"is_adult"})
+		})
+	}
+}
+
 func TestGetCosts(t *testing.T) {
 	cc := &Config{
 		VariableKeyMap: map[string]VariableKey{
@@ -407,12 +555,107 @@ func TestOptimizeConstantFolding(t *testing.T) {
 		t.Run(c.expr, func(t *testing.T) {
 			ast, cc, err := newParser(c.cc, c.expr).parse()
 			assertNil(t, err, c)
-			optimizeConstantFolding(cc, ast)
+			optimizeConstantFolding(cc, ast, nil)
 			assertAstTreeIdentical(t, ast, c.ast, c)
 		})
 	}
 }
 
+func TestOptimizeConstantFolding_Precompute(t *testing.T) {
+	testCases := []struct {
+		expr       string
+		precompute bool
+		vals       []interface{}
+		want       []Value
+	}{
+		{
+			expr:       `(in v ("a" "b" "c" "d" "e" "f" "g" "h" "i" "j" "k" "l"))`,
+			precompute: true,
+			vals:       []interface{}{"a", "l", "m", ""},
+			want:       []Value{true, true, false, false},
+		},
+		{
+			expr:       `(in v (1 2 3 4 5 6 7 8 9 10 11 12))`,
+			precompute: true,
+			vals:       []interface{}{1, 12, 13, -1},
+			want:       []Value{true, true, false, false},
+		},
+		{
+			// the shorter lists are searched linearly
+			expr: `(in v ("a" "b"))`,
+			vals: []interface{}{"a", "c"},
+			want: []Value{true, false},
+		},
+		{
+			expr: `(in v (1 "a" 2 "b" 3 "c" 4 "d" 5 "e" 6 "f"))`,
+			vals: []interface{}{1, "f", 7},
+			want: []Value{true, true, false},
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			cc := NewConfig(RegVarAndOp(map[string]interface{}{"v": nil}))
+			ast, _, err := newParser(cc, c.expr).parse()
+			assertNil(t, err)
+			op := reflect.ValueOf(ast.node.operator).Pointer()
+			optimizeConstantFolding(cc, ast, nil)
+			assertEquals(t, reflect.ValueOf(ast.node.operator).Pointer() != op, c.precompute)
+			// the ast is not changed
+			assertEquals(t, len(ast.children), 2)
+
+			var allocs []float64
+			for _, enabled := range []bool{true, false} {
+				cc.CompileOptions[ConstantFolding] = enabled
+				e, err := Compile(cc, c.expr)
+				assertNil(t, err)
+				for i, v := range c.vals {
+					ctx := NewCtxFromVars(cc, map[string]interface{}{"v": v})
+					res, err := e.Eval(ctx)
+					assertNil(t, err)
+					assertEquals(t, res, c.want[i], v)
+				}
+
+				// the wrong type errors are reported as before
+				_, err = e.Eval(NewCtxFromVars(cc, map[string]interface{}{"v": []int{1}}))
+				assertErrStrContains(t, err, "operator: in")
+
+				ctx := NewCtxFromVars(cc, map[string]interface{}{"v": c.vals[0]})
+				allocs = append(allocs, testing.AllocsPerRun(100, func() {
+					_, _ = e.Eval(ctx)
+				}))
+			}
+			assertEquals(t, allocs[0], allocs[1])
+		})
+	}
+}
+
+func TestOptimizeConstantFolding_PrecomputeWrapped(t *testing.T) {
+	cc := NewConfig(RegVarAndOp(map[string]interface{}{"v": nil}))
+	cc.CompileOptions[StrictReturns] = true
+	// the `in` operator misdeclares its results, so the strict returns check fails
+	cc.OperatorInfos = map[string]OperatorInfo{
+		"in": {Returns: IntType, Timeout: time.Second},
+	}
+
+	const expr = `(in v (1 2 3 4 5 6 7 8 9 10 11 12))`
+	e, err := Compile(cc, expr)
+	assertNil(t, err)
+
+	data, err := e.MarshalBinary()
+	assertNil(t, err)
+	unmarshalled, err := UnmarshalExpr(cc, data)
+	assertNil(t, err)
+
+	for _, e := range []*Expr{e, unmarshalled} {
+		ctx := NewCtxFromVars(cc, map[string]interface{}{"v": 3})
+		ctx.Ctx = context.Background()
+		_, err = e.Eval(ctx)
+		assertErrStrContains(t, err, "operator: in, error: unexpected return type (want: int64, got: bool)")
+		assertEquals(t, errors.Is(err, ErrUnexpectedReturnType), true)
+	}
+}
+
 func TestOptimizeFastEvaluation(t *testing.T) {
 	testCases := []struct {
 		cc     *Config
@@ -594,6 +837,48 @@ func TestOptimizeFastEvaluation(t *testing.T) {
 				},
 			},
 		},
+
+		{
+			// the unary operators
+			expr: `(and (not v1) (empty v2))`,
+			cc: &Config{
+				VariableKeyMap: map[string]VariableKey{
+					"v1": VariableKey(1),
+					"v2": VariableKey(2),
+				},
+			},
+			ast: verifyNode{
+				tpy:  operator,
+				data: "and",
+				children: []verifyNode{
+					{
+						tpy:      fastOperator,
+						data:     "not",
+						children: []verifyNode{{tpy: variable, data: "v1"}},
+					},
+					{
+						tpy:      fastOperator,
+						data:     "empty",
+						children: []verifyNode{{tpy: variable, data: "v2"}},
+					},
+				},
+			},
+		},
+
+		{
+			// the keywords with lambdas are not evaluated fast
+			expr: `(map v1 (+ x 1))`,
+			cc: &Config{
+				VariableKeyMap: map[string]VariableKey{
+					"v1": VariableKey(1),
+				},
+			},
+			ast: verifyNode{
+				tpy:      operator,
+				data:     "map",
+				children: []verifyNode{{tpy: variable, data: "v1"}},
+			},
+		},
 	}
 
 	for _, c := range testCases {
@@ -602,7 +887,7 @@ func TestOptimizeFastEvaluation(t *testing.T) {
 			ast, cc, err := newParser(c.cc, c.expr).parse()
 			assertNil(t, err)
 
-			optimizeFastEvaluation(cc, ast)
+			optimizeFastEvaluation(cc, ast, nil)
 			if len(c.errMsg) != 0 {
 				assertErrStrContains(t, err, c.errMsg, c)
 				return
@@ -833,11 +1118,11 @@ func TestReordering(t *testing.T) {
 			assertNil(t, err)
 
 			if c.fastEval {
-				optimizeFastEvaluation(cc, ast)
+				optimizeFastEvaluation(cc, ast, nil)
 			}
 
 			calculateNodeCosts(cc, ast)
-			optimizeReordering(cc, ast)
+			optimizeReordering(cc, ast, nil)
 			if len(c.errMsg) != 0 {
 				assertErrStrContains(t, err, c.errMsg, c)
 				return
@@ -1003,7 +1288,7 @@ func TestOptimize(t *testing.T) {
 			ast, cc, err := newParser(c.cc, c.expr).parse()
 			assertNil(t, err)
 
-			optimize(cc, ast)
+			optimize(cc, ast, nil)
 			if len(c.errMsg) != 0 {
 				assertErrStrContains(t, err, c.errMsg, c)
 			}
@@ -1093,7 +1378,7 @@ func TestCheck(t *testing.T) {
 			assertNil(t, err)
 
 			if c.optimize {
-				optimize(cc, ast)
+				optimize(cc, ast, nil)
 			}
 
 			res := check(ast)
@@ -1391,3 +1676,657 @@ func TestCompile(t *testing.T) {
 		})
 	}
 }
+
+func TestCompile_MaxResultLen(t *testing.T) {
+	testCases := []struct {
+		expr   string
+		vals   map[string]interface{}
+		want   Value
+		errMsg string
+	}{
+		{
+			expr: `(range 0 5)`,
+			want: []int64{0, 1, 2, 3, 4},
+		},
+		{
+			expr:   `(range 0 6)`,
+			errMsg: "result length exceeded (max: 5, got: 6) occurs at line 1, col 2: ([r]ange 0 6)",
+		},
+		{
+			expr: `(range n 10 2)`,
+			vals: map[string]interface{}{
+				"n": 0,
+			},
+			want: []int64{0, 2, 4, 6, 8},
+		},
+		{
+			expr: `(range n 11 2)`,
+			vals: map[string]interface{}{
+				"n": 0,
+			},
+			errMsg: "result length exceeded (max: 5, got: 6) occurs at",
+		},
+		{
+			// the length of the repeated string is counted in bytes
+			expr: `(repeat_str "ab" 2)`,
+			want: "abab",
+		},
+		{
+			expr: `(repeat_str "ab" n)`,
+			vals: map[string]interface{}{
+				"n": 3,
+			},
+			errMsg: "operator: repeat_str, error: result length exceeded (max: 5, got: 6) occurs at",
+		},
+		{
+			expr: `(find_all items (> x 0))`,
+			vals: map[string]interface{}{
+				"items": []int{1, 2, 3, 4, 5, 6},
+			},
+			errMsg: "operator: find_all, error: result length exceeded (max: 5, got: 6) occurs at",
+		},
+		{
+			expr: `(find_all items (> x 1))`,
+			vals: map[string]interface{}{
+				"items": []int{1, 2, 3, 4, 5, 6},
+			},
+			want: []interface{}{
+				[]interface{}{int64(1), int64(2)},
+				[]interface{}{int64(2), int64(3)},
+				[]interface{}{int64(3), int64(4)},
+				[]interface{}{int64(4), int64(5)},
+				[]interface{}{int64(5), int64(6)},
+			},
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			for _, opt := range []Option{Optimizations(true), Optimizations(false)} {
+				cc := NewConfig(opt, LimitResultLen(5), RegVarAndOp(c.vals))
+				e, err := Compile(cc, c.expr)
+				assertNil(t, err)
+
+				res, err := e.Eval(NewCtxFromVars(cc, c.vals))
+				if len(c.errMsg) != 0 {
+					assertErrStrContains(t, err, c.errMsg)
+					continue
+				}
+				assertNil(t, err)
+				assertEquals(t, res, c.want)
+			}
+		})
+	}
+}
+
+func TestCompile_HugeResults(t *testing.T) {
+	cc := NewConfig()
+	cc.OperatorMap["must_positive"] = func(_ *Ctx, params []Value) (Value, error) {
+		if params[0].(int64) <= 0 {
+			panic("not positive")
+		}
+		return params[0], nil
+	}
+	cc.StatelessOperators = append(cc.StatelessOperators, "must_positive")
+
+	testCases := []struct {
+		expr   string
+		want   Value
+		errMsg string
+	}{
+		{
+			// limited by the default MaxResultLen
+			expr:   `(range 0 9000000000000000000)`,
+			errMsg: "result length exceeded (max: 1048576, got: 9000000000000000000)",
+		},
+		{
+			expr:   `(repeat_str "ab" 999999999999)`,
+			errMsg: "result length exceeded (max: 1048576, got: 1999999999998)",
+		},
+		{
+			// the large results of repeat_str are not folded into constants, but they are evaluated
+			expr: `(repeat_str "ab" 4096)`,
+			want: strings.Repeat("ab", 4096),
+		},
+		{
+			expr: `(repeat_str "ab" 4)`,
+			want: "abababab",
+		},
+		{
+			// the panics of the constant folding are recovered, and the operators are evaluated later
+			expr:   `(must_positive 0)`,
+			errMsg: "not positive",
+		},
+		{
+			expr: `(must_positive 1)`,
+			want: int64(1),
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			e, err := Compile(cc, c.expr)
+			assertNil(t, err)
+			if res, ok := e.nodes[0].value.(string); ok && e.nodes[0].getNodeType() == constant {
+				assertEquals(t, len(res) <= maxFoldedRepeatLen, true)
+			}
+
+			res, err := func() (res Value, err error) {
+				defer func() {
+					if r := recover(); r != nil {
+						err = fmt.Errorf("%v", r)
+					}
+				}()
+				return e.Eval(NewCtxFromVars(cc, nil))
+			}()
+			if len(c.errMsg) != 0 {
+				assertErrStrContains(t, err, c.errMsg)
+				return
+			}
+			assertNil(t, err)
+			assertEquals(t, res, c.want)
+		})
+	}
+}
+
+func TestCompile_MaxOutputDepth(t *testing.T) {
+	testCases := []struct {
+		expr   string
+		vals   map[string]interface{}
+		want   Value
+		errMsg string
+	}{
+		{
+			expr: `(dict "a" (dict "b" (tuple 1 2)))`,
+			want: map[string]interface{}{
+				"a": map[string]interface{}{"b": []interface{}{int64(1), int64(2)}},
+			},
+		},
+		{
+			expr:   `(dict "a" (dict "b" (dict "c" (dict "d" 1))))`,
+			errMsg: "operator: dict, error: output depth exceeded (max: 3, got: 4)",
+		},
+		{
+			expr: `(dict "a" (dict "b" (dict "c" v)))`,
+			vals: map[string]interface{}{
+				"v": 1,
+			},
+			want: map[string]interface{}{
+				"a": map[string]interface{}{"b": map[string]interface{}{"c": int64(1)}},
+			},
+		},
+		{
+			expr: `(dict "a" (dict "b" (dict "c" v)))`,
+			vals: map[string]interface{}{
+				"v": []int{1},
+			},
+			errMsg: "operator: dict, error: output depth exceeded (max: 3, got: 4)",
+		},
+		{
+			expr: `(tuple k (tuple 1 (tuple 2 v)))`,
+			vals: map[string]interface{}{
+				"k": "a",
+				"v": []string{"x"},
+			},
+			errMsg: "operator: tuple, error: output depth exceeded (max: 3, got: 4)",
+		},
+		{
+			expr: `(map v (map v (tuple x 1)))`,
+			vals: map[string]interface{}{
+				"v": []int{1},
+			},
+			want: []interface{}{[]interface{}{[]interface{}{int64(1), int64(1)}}},
+		},
+		{
+			expr: `(map v (map v (map v (tuple x 1))))`,
+			vals: map[string]interface{}{
+				"v": []int{1},
+			},
+			errMsg: "operator: map, error: output depth exceeded (max: 3, got: 4)",
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			for _, opt := range []Option{Optimizations(true), Optimizations(false)} {
+				cc := NewConfig(opt, LimitOutputDepth(3), RegVarAndOp(c.vals))
+				e, err := Compile(cc, c.expr)
+				assertNil(t, err)
+
+				res, err := e.Eval(NewCtxFromVars(cc, c.vals))
+				if len(c.errMsg) != 0 {
+					assertErrStrContains(t, err, c.errMsg)
+					assertEquals(t, errors.Is(err, ErrOutputDepthExceeded), true)
+					continue
+				}
+				assertNil(t, err)
+				assertEquals(t, res, c.want)
+			}
+		})
+	}
+}
+
+func TestCompile_CostThreshold(t *testing.T) {
+	vals := map[string]interface{}{"age": 20, "items": []int{1, 9}}
+	testCases := []struct {
+		expr string
+		opts []Option
+		cost float64
+	}{
+		{
+			// variable 5+7, constant 1, operator (2+1)+5+10
+			expr: `(> age 18)`,
+			cost: 31,
+		},
+		{
+			// fast operator 5+10
+			expr: `(> age 18)`,
+			opts: []Option{Optimizations(true, FastEvaluation)},
+			cost: 28,
+		},
+		{
+			expr: `(> age 18)`,
+			opts: []Option{func(c *Config) { c.CostsMap["age"] = 100 }},
+			cost: 124,
+		},
+		{
+			// the constants are folded
+			expr: `(> 20 (+ 10 8))`,
+			opts: []Option{Optimizations(true)},
+			cost: 1,
+		},
+		{
+			// cond 4, only the more expensive branch is counted
+			expr: `(if (> age 18) age 1)`,
+			cost: 31 + 12 + 4,
+		},
+		{
+			// the lambda is counted once, (1+1)+5+10 with items, and 31 for the predicate
+			expr: `(find_all items (> x 1))`,
+			cost: 17 + 12 + 31,
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			opts := append([]Option{Optimizations(false), RegVarAndOp(vals)}, c.opts...)
+			e, err := Compile(NewConfig(opts...), c.expr)
+			assertNil(t, err)
+			assertEquals(t, e.Cost(), c.cost)
+
+			// the cost is stable across the compilations
+			again, err := Compile(NewConfig(opts...), c.expr)
+			assertNil(t, err)
+			assertEquals(t, again.Cost(), e.Cost())
+
+			_, err = Compile(NewConfig(append(opts, LimitCost(c.cost))...), c.expr)
+			assertNil(t, err)
+			_, err = Compile(NewConfig(append(opts, LimitCost(c.cost-0.5))...), c.expr)
+			assertEquals(t, errors.Is(err, ErrCostExceeded), true)
+		})
+	}
+}
+
+func TestCompile_RequireAllSelectorsUsed(t *testing.T) {
+	vals := map[string]interface{}{
+		"age":     20,
+		"gender":  "Male",
+		"country": "US",
+	}
+
+	testCases := []struct {
+		expr        string
+		require     bool
+		diagnostics []string
+	}{
+		{
+			expr:        `(>= age 18)`,
+			require:     true,
+			diagnostics: []string{"unused selectors: [country gender]"},
+		},
+		{
+			expr:    `(and (>= age 18) (= gender "Male") (= country "US"))`,
+			require: true,
+		},
+		{
+			// the selectors referenced in lambdas are used
+			expr:    `(find_all (coerce_list country) (= x (if (> age 18) gender "US")))`,
+			require: true,
+		},
+		{
+			expr: `(>= age 18)`,
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			cc := NewConfig(RegVarAndOp(vals))
+			if c.require {
+				EnableRequireAllSelectorsUsed(cc)
+			}
+			e, err := Compile(cc, c.expr)
+			assertNil(t, err)
+
+			var diagnostics []string
+			for _, d := range e.Diagnostics() {
+				assertEquals(t, errors.Is(d, ErrUnusedSelectors), true)
+				diagnostics = append(diagnostics, d.Error())
+			}
+			assertEquals(t, diagnostics, c.diagnostics)
+		})
+	}
+
+	// the local variables are not the references of the selectors with the same names
+	cc := NewConfig(EnableRequireAllSelectorsUsed, RegVarAndOp(vals), RegVarAndOp(map[string]interface{}{"x": 1}))
+	for expr, want := range map[string]string{
+		`(map (coerce_list age) (let (gender 1) (+ x gender)))`:                   "[unused selectors: [country gender x]]",
+		`(and (> (len (map (coerce_list gender) x)) 0) (= x country) (> age 18))`: "[]",
+	} {
+		e, err := Compile(cc, expr)
+		assertNil(t, err, expr)
+		assertEquals(t, fmt.Sprint(e.Diagnostics()), want, expr)
+	}
+}
+
+func TestCompile_StackSize(t *testing.T) {
+	vals := map[string]interface{}{"a": 1, "b": 2, "s": "x"}
+	exprs := []string{
+		`(+ a b)`,
+		`(+ 1 (+ a (+ b (+ a (+ b (+ a (+ b (+ a (+ b (+ 1 a))))))))))`,
+		`(+ (+ (+ (+ (+ (+ (+ (+ (+ a 1) b) a) b) a) b) a) b) 1)`,
+		`(and (or (= a 1) (= b 2)) (> (if (> a b) (+ a (+ b (+ a b))) (- a b)) 0) (in s ("x" "y")))`,
+		`(if (= a 1) (if (= b 2) (+ a (* b (- a (/ b 1)))) 0) (+ 1 (+ 2 (+ 3 a))))`,
+		`(find_all (1 2 3) (= x (+ a (+ b (+ a b)))))`,
+		`(between (+ a 1) (- b (+ a (+ b 1))) (* a (* b (* a (* b 2)))))`,
+	}
+
+	for _, expr := range exprs {
+		for _, opt := range []Option{Optimizations(true), Optimizations(false)} {
+			cc := NewConfig(opt, RegVarAndOp(vals))
+			p := newParser(cc, expr)
+			ast, conf, err := p.parse()
+			assertNil(t, err, expr)
+			e, err := compileAst(conf, ast)
+			assertNil(t, err, expr)
+
+			// the stack size computed from the nodes is an upper bound of the stack depth
+			calAndSetStackSize(e)
+			assertEquals(t, int(e.maxStackSize) >= stackBound(ast), true, expr)
+			assertEquals(t, e.StackSize(), int(e.maxStackSize), expr)
+
+			_, err = e.Eval(NewCtxFromVars(cc, vals))
+			assertNil(t, err, expr)
+		}
+	}
+}
+
+func TestCheckStackSize(t *testing.T) {
+	cc := NewConfig(RegVarAndOp(map[string]interface{}{"a": 1, "b": 2}))
+	p := newParser(cc, `(+ 1 (+ a (+ b (+ a 1))))`)
+	ast, conf, err := p.parse()
+	assertNil(t, err)
+	e, err := compileAst(conf, ast)
+	assertNil(t, err)
+	assertNil(t, checkStackSize(e, ast))
+
+	// the stack size less than the stack depth is reported
+	e.maxStackSize = int16(stackBound(ast) - 1)
+	assertErrStrContains(t, checkStackSize(e, ast), "invalid stack size")
+
+	// the stack depth exceeding int16
+	deep := &astNode{node: &node{flag: constant, value: int64(1)}}
+	for i := 0; i < math.MaxInt16; i++ {
+		deep = &astNode{
+			node:     &node{flag: operator, value: "+"},
+			children: []*astNode{{node: &node{flag: constant, value: int64(1)}}, deep},
+		}
+	}
+	assertErrStrContains(t, checkStackSize(e, deep), "stack size cannot exceed a maximum of 32767")
+}
+
+func TestCompile_OptimizationLog(t *testing.T) {
+	vals := map[string]interface{}{"age": 20, "items": []int{1, 9}}
+	expr := `(find_all items (and (> x (* 2 3)) (and (= 1 1) (> age (+ 10 8)))))`
+
+	e, err := Compile(NewConfig(RegVarAndOp(vals)), expr)
+	assertNil(t, err)
+	assertEquals(t, len(e.OptimizationLog()), 0)
+
+	cc := NewConfig(EnableOptimizationLog, RegVarAndOp(vals))
+	e, err = Compile(cc, expr)
+	assertNil(t, err)
+	assertEquals(t, e.OptimizationLog(), []string{
+		"constant folding: (* 2 3) at [26:33] => 6",
+		"constant folding: (= 1 1) at [40:47] => true",
+		"constant folding: (+ 10 8) at [55:63] => 18",
+		"fast evaluation: (> x 6) at [21:34]",
+		"fast evaluation: (> age 18) at [48:64]",
+	})
+
+	res, err := e.Eval(NewCtxFromVars(cc, vals))
+	assertNil(t, err)
+	assertEquals(t, res, []interface{}{[]interface{}{int64(1), int64(9)}})
+
+	cc = NewConfig(EnableOptimizationLog, RegVarAndOp(map[string]interface{}{"a": true, "b": true}))
+	e, err = Compile(cc, `(or (and a (and b a)) (or (!= a b) a))`)
+	assertNil(t, err)
+	assertEquals(t, e.OptimizationLog(), []string{
+		"reduce nesting: (and a (and b a)) at [4:21] => (and a b a)",
+		"fast evaluation: (!= a b) at [26:34]",
+		"reordering: (or (!= a b) a) at [22:37] => (or a (!= a b))",
+	})
+}
+
+func TestValidate(t *testing.T) {
+	testCases := []struct {
+		expr   string
+		opts   []Option
+		errMsg string
+	}{
+		{expr: `(and (> age 18) (in name ("a" "b")))`},
+		{expr: `(> age 18`, errMsg: "parentheses unmatched error"},
+		{expr: `(> agee 18)`, errMsg: "unknown token error occurs at"},
+		{expr: `(> age (+ 1))`},
+		{
+			expr:   `(> age (+ 1))`,
+			opts:   []Option{EnableStrictArity},
+			errMsg: "+ parameters count error (want: at least 2, got: 1) occurs at",
+		},
+		{
+			expr:   `(> age "18" 1)`,
+			opts:   []Option{EnableStrictArity},
+			errMsg: "> parameters count error (want: 2, got: 3) occurs at",
+		},
+		{expr: `(if (+ age 1) 1 2)`},
+		{
+			expr:   `(if (+ age 1) 1 2)`,
+			opts:   []Option{EnableTypeCheck},
+			errMsg: "type check error, operator: if, param: 0, expected: bool, got: int64 occurs at",
+		},
+		{
+			expr:   `(and (> age) (= name "a"))`,
+			opts:   []Option{EnableParseRecovery, EnableStrictArity},
+			errMsg: "> parameters count error (want: 2, got: 1) occurs at",
+		},
+		{expr: ``, errMsg: "empty expression error occurs at line 1, col 1: []"},
+		{expr: "  \n", errMsg: "empty expression error occurs at"},
+		{expr: ";; comment only", errMsg: "empty expression error occurs at"},
+		{expr: ";;;; optimize: false", errMsg: "empty expression error occurs at"},
+		{expr: ``, opts: []Option{EnableInfixNotation}, errMsg: "empty expression error occurs at"},
+		{expr: ``, opts: []Option{EnableParseRecovery}, errMsg: "empty expression error occurs at"},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			cc := NewConfig(append(c.opts, RegVarAndOp(map[string]interface{}{"name": nil}))...)
+			assertNil(t, RegisterVariable(cc, "age", IntType))
+
+			err := Validate(cc, c.expr)
+			_, compileErr := Compile(cc, c.expr)
+			if len(c.errMsg) == 0 {
+				assertNil(t, err)
+				assertNil(t, compileErr)
+				return
+			}
+			assertErrStrContains(t, err, c.errMsg)
+			if compileErr != nil {
+				// the same error as Compile
+				assertEquals(t, err.Error(), compileErr.Error())
+			}
+		})
+	}
+}
+
+func TestCompile_TrailingTokens(t *testing.T) {
+	vals := map[string]interface{}{"age": 20, "name": "日本"}
+	testCases := []struct {
+		mode     TrailingMode
+		expr     string
+		want     Value
+		consumed int
+		errMsg   string
+	}{
+		{
+			mode:     TrailingError,
+			expr:     `(> age 18) ;; comment`,
+			want:     true,
+			consumed: 10,
+		},
+		{
+			mode:   TrailingError,
+			expr:   `(> age 18) (< age 30)`,
+			errMsg: "parentheses unmatched error",
+		},
+		{
+			// the trailing content is not lexed
+			mode:     TrailingIgnore,
+			expr:     `(> age 18) #!@ "unclosed`,
+			want:     true,
+			consumed: 10,
+		},
+		{
+			mode:     TrailingIgnore,
+			expr:     "  (= name \"日本\")\n(< age 30)",
+			want:     true,
+			consumed: 19,
+		},
+		{
+			mode:     TrailingIgnore,
+			expr:     `(and (> age 18) (< age 30))`,
+			want:     true,
+			consumed: 27,
+		},
+		{
+			mode:   TrailingIgnore,
+			expr:   `(> age 18`,
+			errMsg: "parentheses unmatched error",
+		},
+		{
+			mode:     TrailingSequence,
+			expr:     `(> age 30) (+ age 1) ;; the last one is returned`,
+			want:     int64(21),
+			consumed: 20,
+		},
+		{
+			mode:     TrailingSequence,
+			expr:     `(> age 30)`,
+			want:     false,
+			consumed: 10,
+		},
+		{
+			mode:   TrailingSequence,
+			expr:   `(> age 30) (+ age)) (+ age 1)`,
+			errMsg: "parentheses unmatched error",
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			cc := NewConfig(HandleTrailingTokens(c.mode), RegVarAndOp(vals))
+			e, err := Compile(cc, c.expr)
+			if len(c.errMsg) != 0 {
+				assertErrStrContains(t, err, c.errMsg)
+				return
+			}
+			assertNil(t, err)
+			assertEquals(t, e.ConsumedLen(), c.consumed)
+
+			res, err := e.Eval(NewCtxFromVars(cc, vals))
+			assertNil(t, err)
+			assertEquals(t, res, c.want)
+		})
+	}
+}
+
+func TestCompiler(t *testing.T) {
+	vals := map[string]interface{}{"age": 20, "name": "Bob", "scores": []int{55, 70}}
+	cc := NewConfig(RegVarAndOp(vals))
+	ctx := NewCtxFromVars(cc, vals)
+
+	c := NewCompiler(cc)
+	for _, s := range []struct {
+		expr   string
+		want   Value
+		errMsg string
+	}{
+		{expr: `(and (> age 18) (= name "Bob"))`, want: true},
+		{expr: `(find_all scores (< x 60))`, want: []interface{}{[]interface{}{int64(0), int64(55)}}},
+		{expr: `(+ age "a`, errMsg: "unclosed quotes"},
+		// the buffers are reused after the error
+		{expr: `(+ 1 2)`, want: int64(3)},
+		{expr: `(+ age (- 1 2) ;; the longer source grows the buffers
+                  (* 3 4))`, want: int64(31)},
+		{expr: `(< age 30)`, want: true},
+		// the position is located in the current source
+		{expr: `(+ age))`, errMsg: "parentheses unmatched error occurs at line 1, col 7: (+ age[)])"},
+		{expr: `(in "δ" ("αβγ" "δ"))`, want: true},
+	} {
+		e, err := c.Compile(s.expr)
+		_, wantErr := Compile(cc, s.expr)
+		if s.errMsg != "" {
+			assertErrStrContains(t, err, s.errMsg)
+			assertEquals(t, err.Error(), wantErr.Error())
+			continue
+		}
+		assertNil(t, err)
+		assertNil(t, wantErr)
+		assertEquals(t, e.source, s.expr)
+
+		res, err := e.Eval(ctx)
+		assertNil(t, err)
+		assertEquals(t, res, s.want)
+	}
+}
+
+func BenchmarkCompiler(b *testing.B) {
+	vals := map[string]interface{}{"age": 20, "name": "Bob", "score": 80}
+	cc := NewConfig(RegVarAndOp(vals))
+
+	sources := make([]string, 500)
+	for i := range sources {
+		sources[i] = fmt.Sprintf(`(and (> age %d) (or (= name "user_%d") (< score %d)))`, i%60, i, i)
+	}
+
+	b.Run("Compile", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, s := range sources {
+				if _, err := Compile(cc, s); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("Compiler", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			c := NewCompiler(cc)
+			for _, s := range sources {
+				if _, err := c.Compile(s); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
@@ -2,18 +2,50 @@ package eval
 
 import (
 	"context"
-	"errors"
+	"fmt"
+	"sync"
 )
 
 type (
 	VariableKey int16
 	Value       interface{}
-	Operator    func(ctx *Ctx, params []Value) (res Value, err error)
+
+	// Operator is the function of an operator, the params are the values of its children in order.
+	// The params may be reused by the later calls of the operators, even of the other evaluations
+	// and goroutines, as the buffers of the params are pooled, so the operators should not retain
+	// the params after returning, copy them if they are needed later, e.g. in the results.
+	Operator func(ctx *Ctx, params []Value) (res Value, err error)
 )
 
+// Ctx is the context of an evaluation. It's not safe for concurrent use, since the variable
+// fetchers may cache the values, e.g. the lazy variables, so each goroutine should use its own.
 type Ctx struct {
 	VariableFetcher
+
+	// Ctx cancels the evaluation, e.g. with a request-scoped deadline. It's checked before
+	// each operator call and each iteration of the loop keywords, the evaluation returns an
+	// error wrapping the error of Ctx, e.g. context.DeadlineExceeded. A nil Ctx is not checked.
 	Ctx context.Context
+
+	// SnapshotVars makes each variable fetched at most once in an evaluation,
+	// the later references of the variable reuse the snapshot of the first fetched value.
+	// The snapshots are discarded after the evaluation.
+	SnapshotVars bool
+
+	// PartialResults makes the evaluation return the partial result of the list keywords,
+	// e.g. find_all and map_if, when Ctx is cancelled during their iterations.
+	// The partial result is the list of the elements produced so far, it's returned
+	// alongside an error wrapping the error of Ctx, e.g. context.Canceled.
+	// Only the partial result of the root keyword is returned, the other ones are discarded.
+	PartialResults bool
+
+	// Trace receives each step of the evaluation, i.e. the evaluated nodes and the short circuit
+	// jumps, e.g. to log how the result is reached. The steps of the sub-expressions of keywords,
+	// such as the predicate of find_all, are not reported. A nil Trace adds no overhead.
+	Trace TraceFunc
+
+	// yield receives the elements of the result in EvalStream
+	yield func(Value) error
 }
 
 const (
@@ -35,6 +67,14 @@ const (
 	parentOpMask = uint8(0b01100000)
 	andOp        = uint8(0b00100000)
 	orOp         = uint8(0b01000000)
+
+	// dotted selector flag, the variable is resolved by getPath
+	pathVar = uint8(0b10000000)
+
+	// keyword flag of the operator nodes, it shares the bit with pathVar of the variable nodes.
+	// The keyword nodes are named by the builtin names of the keywords, which may be registered
+	// as operators after the keywords are disabled or renamed, so the names can't tell them apart.
+	keywordOp = uint8(0b10000000)
 )
 
 type node struct {
@@ -51,11 +91,58 @@ func (n *node) getNodeType() uint8 {
 	return n.flag & nodeTypeMask
 }
 
+// Expr is a compiled expression. It's safe for concurrent use after the compilation, an Expr
+// can be evaluated from many goroutines simultaneously with distinct Ctx values. The nodes are
+// not changed by the evaluations, each evaluation takes its own operand stack from the pools,
+// and the states of the builtin operators, e.g. the compiled patterns of regex, are synchronized.
+// The custom operators and the observers of tap should be safe for concurrent use too, and they
+// should not retain the params, see Operator.
 type Expr struct {
 	maxStackSize int16
 	nodes        []*node
 	parentIdx    []int16
 
+	// lambdas of the keyword nodes, e.g. the predicate of find_all
+	lambdas map[*node][]*lambda
+
+	// errors recovered in the parse recovery mode
+	parseErrs []error
+
+	// non-fatal problems found at compile time, e.g. the unused selectors
+	diagnostics []error
+
+	// the root operator yields its elements in EvalStream
+	streamRoot bool
+
+	// the variables referenced by the expression, used by ValidateInputs
+	inputs map[string]VariableInfo
+
+	// the rewrites of the optimizations, recorded when OptimizationLog is enabled
+	optimizationLog []string
+
+	// the arithmetic of the operator nodes by index, it's set only when the expression
+	// is entirely int64 arithmetic, which is evaluated on an []int64 stack by evalInt
+	intArith []arithmetic
+
+	// whether the expression calls the stateless operators only, see MemoizedExpr
+	pure bool
+
+	// the length in bytes of the source consumed by the parsing, see ConsumedLen
+	consumed int
+
+	// the source expression and the source spans of the operator nodes, used by EvalWithTrace
+	source string
+	spans  map[*node]Span
+
+	// the copy of the config the expression is compiled with, see Config
+	conf *Config
+
+	// the static cost of the expression, see Cost
+	cost float64
+
+	// prints the events if the expression is compiled with Debug and EventChan is not set
+	debug *debugPrinter
+
 	EventChan chan Event
 }
 
@@ -68,7 +155,59 @@ func Eval(expr string, vals map[string]interface{}, opts ...Option) (Value, erro
 	if err != nil {
 		return nil, err
 	}
-	return tree.Eval(NewCtxFromVars(conf, vals))
+	return tree.Eval(NewCtxFromVars(tree.Config(), vals))
+}
+
+// Config returns the config the expression is compiled with, which includes the selectors
+// and constants declared in the compile config comments, e.g. `;;;; selector: age`.
+// The contexts of such expressions should be created with it, e.g. NewCtxFromVars(e.Config(), vals).
+func (e *Expr) Config() *Config {
+	return e.conf
+}
+
+// Cost returns the static cost of the expression calculated at compile time after the
+// optimizations, it's the sum of the costs of the nodes, which are the base costs of the node
+// types plus the costs in the CostsMap of the variables and the operators, or their defaults.
+// Only the more expensive branch of an if is counted, and the lambdas of the keywords, e.g. the
+// predicate of filter, are counted once, since the lengths of the lists are unknown at compile time.
+func (e *Expr) Cost() float64 {
+	return e.cost
+}
+
+// StackSize returns the max size of the operand stack of the evaluations, the stacks are
+// taken from the pools of their size buckets and returned after the evaluations
+func (e *Expr) StackSize() int {
+	return int(e.maxStackSize)
+}
+
+// ParseErrors returns the errors recovered in the parse recovery mode
+func (e *Expr) ParseErrors() []error {
+	return e.parseErrs
+}
+
+// Diagnostics returns the non-fatal problems found at compile time,
+// e.g. the unused selectors when RequireAllSelectorsUsed is enabled
+func (e *Expr) Diagnostics() []error {
+	return e.diagnostics
+}
+
+// OptimizationLog returns the rewrites of the optimizations in the order they are applied,
+// e.g. "constant folding: (+ 1 2) at [3:10] => 3". It's empty unless EnableOptimizationLog is set.
+func (e *Expr) OptimizationLog() []string {
+	return e.optimizationLog
+}
+
+// ConsumedLen returns the length in bytes of the source up to the end of the parsed expression,
+// the trailing comments and spaces are not counted. With TrailingIgnore, source[ConsumedLen():]
+// is the ignored content after the first complete expression.
+func (e *Expr) ConsumedLen() int {
+	return e.consumed
+}
+
+// AsFunc returns a closure that evaluates the expression, it's safe for concurrent use,
+// as each evaluation takes its own operand stack from the pools, see Eval and StackSize.
+func (e *Expr) AsFunc() func(ctx *Ctx) (Value, error) {
+	return e.Eval
 }
 
 func (e *Expr) EvalBool(ctx *Ctx) (bool, error) {
@@ -78,11 +217,76 @@ func (e *Expr) EvalBool(ctx *Ctx) (bool, error) {
 	}
 	b, ok := res.(bool)
 	if !ok {
-		return false, errors.New("invalid result type error")
+		return false, resultTypeErr("bool", res)
 	}
 	return b, nil
 }
 
+// EvalInt is like EvalBool, it returns an error if the result is not an int64
+func (e *Expr) EvalInt(ctx *Ctx) (int64, error) {
+	res, err := e.Eval(ctx)
+	if err != nil {
+		return 0, err
+	}
+	i, ok := res.(int64)
+	if !ok {
+		return 0, resultTypeErr("int64", res)
+	}
+	return i, nil
+}
+
+// EvalFloat is like EvalBool, it returns an error if the result is not a float64,
+// the int64 results are not converted
+func (e *Expr) EvalFloat(ctx *Ctx) (float64, error) {
+	res, err := e.Eval(ctx)
+	if err != nil {
+		return 0, err
+	}
+	f, ok := res.(float64)
+	if !ok {
+		return 0, resultTypeErr("float64", res)
+	}
+	return f, nil
+}
+
+// EvalString is like EvalBool, it returns an error if the result is not a string
+func (e *Expr) EvalString(ctx *Ctx) (string, error) {
+	res, err := e.Eval(ctx)
+	if err != nil {
+		return "", err
+	}
+	s, ok := res.(string)
+	if !ok {
+		return "", resultTypeErr("string", res)
+	}
+	return s, nil
+}
+
+func resultTypeErr(want string, res Value) error {
+	return fmt.Errorf("invalid result type error (want: %s, got: %T)", want, res)
+}
+
+// EvalBoolWithInputs is like EvalBool, and it also returns the values of the variables
+// fetched during the evaluation, e.g. for audit logging.
+// The variables skipped by short circuits are not fetched, so they are absent in the inputs.
+func (e *Expr) EvalBoolWithInputs(ctx *Ctx) (bool, map[string]Value, error) {
+	var c Ctx
+	if ctx != nil {
+		c = *ctx
+	}
+	recorder := &inputsRecorder{
+		VariableFetcher: c.VariableFetcher,
+		inputs:          make(map[string]Value),
+	}
+	c.VariableFetcher = recorder
+
+	b, err := e.EvalBool(&c)
+	if err != nil {
+		return false, nil, err
+	}
+	return b, recorder.inputs, nil
+}
+
 func (e *Expr) TryEvalBool(ctx *Ctx) (bool, error) {
 	res, err := e.TryEval(ctx)
 	if err != nil {
@@ -95,33 +299,124 @@ func (e *Expr) TryEvalBool(ctx *Ctx) (bool, error) {
 
 	b, ok := res.(bool)
 	if !ok {
-		return false, errors.New("invalid result type error")
+		return false, resultTypeErr("bool", res)
 	}
 	return b, nil
 }
 
 func (e *Expr) Eval(ctx *Ctx) (res Value, err error) {
+	return e.eval(ctx, nil, nil)
+}
+
+// EvalBatch evaluates the expression with each of the ctxs, the results and the errors
+// are in the same order as the ctxs, and errs[i] is nil if the i-th evaluation succeeds.
+// The operand stack and the params buffer of the binary operators are reused across the
+// evaluations, which is cheaper than calling Eval for each ctx.
+// It's safe for concurrent use, as each call has its own buffers.
+func (e *Expr) EvalBatch(ctxs []*Ctx) ([]Value, []error) {
+	var (
+		results = make([]Value, len(ctxs))
+		errs    = make([]error, len(ctxs))
+		buf     = getEvalBuffers(int(e.maxStackSize))
+	)
+	defer putEvalBuffers(buf)
+	for i, ctx := range ctxs {
+		results[i], errs[i] = e.eval(ctx, buf.os, &buf.param2)
+	}
+	return results, errs
+}
+
+// evalBuffers are the operand stack and the params buffer of the binary operators of the
+// evaluations, they are pooled by the size buckets of the stacks, see getEvalBuffers
+type evalBuffers struct {
+	os     []Value
+	param2 [2]Value
+}
+
+const (
+	minPooledStack = 8
+	maxPooledStack = 1024
+)
+
+// evalBuffersPools are the pools of the evalBuffers, the size of the stacks of
+// the i-th pool is minPooledStack<<i, the larger stacks are not pooled
+var evalBuffersPools [8]sync.Pool
+
+// stackBucket returns the index of the pool of the stacks of the size,
+// it's the smallest i that minPooledStack<<i >= size
+func stackBucket(size int) int {
+	i := 0
+	for minPooledStack<<i < size {
+		i++
+	}
+	return i
+}
+
+// getEvalBuffers returns the buffers of an evaluation with a stack of the size at least,
+// they should be returned by putEvalBuffers after the evaluation
+func getEvalBuffers(size int) *evalBuffers {
+	if size > maxPooledStack {
+		return &evalBuffers{os: make([]Value, size)}
+	}
+	i := stackBucket(size)
+	if buf, ok := evalBuffersPools[i].Get().(*evalBuffers); ok {
+		return buf
+	}
+	return &evalBuffers{os: make([]Value, minPooledStack<<i)}
+}
+
+// putEvalBuffers clears the buffers and returns them to the pool, so the values of the
+// evaluation are not retained, the buffers should not be used after that
+func putEvalBuffers(buf *evalBuffers) {
+	if len(buf.os) > maxPooledStack {
+		return
+	}
+	for i := range buf.os {
+		buf.os[i] = nil
+	}
+	buf.param2 = [2]Value{}
+	evalBuffersPools[stackBucket(len(buf.os))].Put(buf)
+}
+
+// eval evaluates the expression on the operand stack os with the params buffer param2 of the
+// binary operators, they are taken from the pools if nil. Each evaluation overwrites the buffers before
+// reading them, so they can be reused. The operators should not retain the params, since the
+// buffer is shared by all the binary operators of an evaluation.
+func (e *Expr) eval(ctx *Ctx, os []Value, param2 *[2]Value) (res Value, err error) {
+	if ctx != nil && ctx.SnapshotVars {
+		ctx = snapshotCtx(ctx)
+	}
+
+	done := doneChan(ctx)
+	if isDone(done) {
+		return nil, cancelled(ctx)
+	}
+
+	var trace TraceFunc
+	if ctx != nil {
+		trace = ctx.Trace
+	}
+
+	if e.intArith != nil && trace == nil {
+		if res, ok, err := e.evalInt(ctx); ok {
+			return res, err
+		}
+	}
+
+	if os == nil {
+		buf := getEvalBuffers(int(e.maxStackSize))
+		defer putEvalBuffers(buf)
+		os, param2 = buf.os, &buf.param2
+	}
+
 	var (
 		nodes = e.nodes
 		size  = int16(len(nodes))
-		m     = e.maxStackSize
-
-		os    []Value
 		osTop = int16(-1)
 	)
 
-	switch {
-	case m <= 8:
-		os = make([]Value, 8)
-	case m <= 16:
-		os = make([]Value, 16)
-	default:
-		os = make([]Value, size)
-	}
-
 	var (
 		params []Value
-		param2 [2]Value
 		curt   *node
 	)
 
@@ -133,34 +428,62 @@ func (e *Expr) Eval(ctx *Ctx) (res Value, err error) {
 			child := nodes[i]
 			res = child.value
 			if child.flag&nodeTypeMask == variable {
-				res, err = ctx.Get(child.varKey, res.(string))
+				res, err = getVar(ctx, child)
+				if trace != nil {
+					traceNode(trace, i, child, res, err, os, osTop)
+				}
 				if err != nil {
 					return
 				}
+			} else if trace != nil {
+				traceNode(trace, i, child, res, nil, os, osTop)
 			}
 			param2[0] = res
-
-			i++
-			child = nodes[i]
-			res = child.value
-			if child.flag&nodeTypeMask == variable {
-				res, err = ctx.Get(child.varKey, res.(string))
-				if err != nil {
-					return
+			params = param2[:]
+
+			if curt.childCnt == 2 {
+				i++
+				child = nodes[i]
+				res = child.value
+				if child.flag&nodeTypeMask == variable {
+					res, err = getVar(ctx, child)
+					if trace != nil {
+						traceNode(trace, i, child, res, err, os, osTop)
+					}
+					if err != nil {
+						return
+					}
+				} else if trace != nil {
+					traceNode(trace, i, child, res, nil, os, osTop)
 				}
+				param2[1] = res
+			} else {
+				// the unary operators, e.g. `(not a)`
+				params = param2[:1]
+			}
+			if isDone(done) {
+				return nil, cancelled(ctx)
+			}
+			res, err = curt.operator(ctx, params)
+			if trace != nil {
+				traceNode(trace, i-int16(curt.childCnt), curt, res, err, os, osTop)
 			}
-			param2[1] = res
-			res, err = curt.operator(ctx, param2[:])
 			if err != nil {
 				return
 			}
 		case variable:
-			res, err = ctx.Get(curt.varKey, curt.value.(string))
+			res, err = getVar(ctx, curt)
+			if trace != nil {
+				traceNode(trace, i, curt, res, err, os, osTop)
+			}
 			if err != nil {
 				return
 			}
 		case constant:
 			res = curt.value
+			if trace != nil {
+				traceNode(trace, i, curt, res, nil, os, osTop)
+			}
 		case operator:
 			cCnt := int16(curt.childCnt)
 			osTop = osTop - cCnt
@@ -172,8 +495,18 @@ func (e *Expr) Eval(ctx *Ctx) (res Value, err error) {
 				copy(params, os[osTop+1:])
 			}
 
+			if isDone(done) {
+				return nil, cancelled(ctx)
+			}
 			res, err = curt.operator(ctx, params)
+			if trace != nil {
+				traceNode(trace, i, curt, res, err, os, osTop)
+			}
 			if err != nil {
+				// the partial result is only returned from the root node
+				if e.parentIdx[i] != -1 {
+					res = nil
+				}
 				return
 			}
 		case cond:
@@ -183,6 +516,9 @@ func (e *Expr) Eval(ctx *Ctx) (res Value, err error) {
 				return
 			}
 			if res == true {
+				if trace != nil {
+					traceJump(trace, i, curt)
+				}
 				osTop = curt.osTop
 				i = curt.scIdx
 			}
@@ -194,6 +530,13 @@ func (e *Expr) Eval(ctx *Ctx) (res Value, err error) {
 		if b, ok := res.(bool); ok {
 			for (!b && curt.flag&scIfFalse == scIfFalse) ||
 				(b && curt.flag&scIfTrue == scIfTrue) {
+				if trace != nil {
+					if nodes[i] != curt {
+						// the children of the fast operator are evaluated inline
+						i -= int16(curt.childCnt)
+					}
+					traceJump(trace, i, curt)
+				}
 				i = curt.scIdx
 				if i == -1 {
 					return
@@ -202,32 +545,121 @@ func (e *Expr) Eval(ctx *Ctx) (res Value, err error) {
 				curt = nodes[i]
 				osTop = curt.osTop - 1
 			}
+		} else if curt.flag&scMask != 0 {
+			// the params of the short circuit operators should be bools
+			return nil, ParamTypeError(scParentName(e, curt), typeBool, res)
 		}
 
+		if int(osTop)+1 >= len(os) {
+			// the stack size is computed at compile time, grow it defensively
+			os = growStack(os)
+		}
 		os[osTop+1], osTop = res, osTop+1
 	}
 	return os[0], nil
 }
 
+// scParentName returns the name of the short circuit operator of the node,
+// the if nodes between them are skipped since their branches inherit the short circuits
+func scParentName(e *Expr, n *node) string {
+	p := int16(-1)
+	for i := range e.nodes {
+		if e.nodes[i] == n {
+			p = e.parentIdx[i]
+			break
+		}
+	}
+	for p != -1 && e.nodes[p].getNodeType() == cond {
+		p = e.parentIdx[p]
+	}
+	if p == -1 {
+		return ""
+	}
+	return fmt.Sprint(e.nodes[p].value)
+}
+
+// evalInt evaluates the int64 arithmetic expression on an []int64 stack, the intermediate
+// results are not boxed into Values. It returns false if a variable is not an int64 at runtime,
+// then the expression should be evaluated by the boxed path.
+func (e *Expr) evalInt(ctx *Ctx) (Value, bool, error) {
+	var (
+		nodes = e.nodes
+		buf   [16]int64
+		os    = buf[:0]
+	)
+	if int(e.maxStackSize) > len(buf) {
+		os = make([]int64, 0, e.maxStackSize)
+	}
+
+	for i := 0; i < len(nodes); i++ {
+		curt := nodes[i]
+		switch curt.flag & nodeTypeMask {
+		case constant, variable:
+			v, ok, err := loadInt(ctx, curt)
+			if !ok || err != nil {
+				return nil, ok, err
+			}
+			os = append(os, v)
+		case fastOperator:
+			x, ok, err := loadInt(ctx, nodes[i+1])
+			if !ok || err != nil {
+				return nil, ok, err
+			}
+			y, ok, err := loadInt(ctx, nodes[i+2])
+			if !ok || err != nil {
+				return nil, ok, err
+			}
+			res, err := e.intArith[i].apply(x, y)
+			if err != nil {
+				return nil, true, err
+			}
+			os = append(os, res)
+			i += 2
+		case operator:
+			params := os[len(os)-int(curt.childCnt):]
+			res := params[0]
+			for _, v := range params[1:] {
+				var err error
+				if res, err = e.intArith[i].apply(res, v); err != nil {
+					return nil, true, err
+				}
+			}
+			os = append(os[:len(os)-len(params)], res)
+		}
+	}
+	return os[0], true, nil
+}
+
+// loadInt loads the int64 value of the constant or variable node
+func loadInt(ctx *Ctx, n *node) (int64, bool, error) {
+	v := n.value
+	if n.flag&nodeTypeMask == variable {
+		var err error
+		if v, err = getVar(ctx, n); err != nil {
+			return 0, true, err
+		}
+	}
+	i, ok := v.(int64)
+	return i, ok, nil
+}
+
 func (e *Expr) TryEval(ctx *Ctx) (res Value, err error) {
+	if ctx != nil && ctx.SnapshotVars {
+		ctx = snapshotCtx(ctx)
+	}
+	done := doneChan(ctx)
+
+	buf := getEvalBuffers(int(e.maxStackSize))
+	defer putEvalBuffers(buf)
+
 	var (
 		nodes = e.nodes
 		size  = int16(len(nodes))
-		m     = e.maxStackSize
 
-		os    []Value
+		os    = buf.os
 		osTop = int16(-1)
 	)
 
-	switch {
-	case m <= 8:
-		os = make([]Value, 8)
-	case m <= 16:
-		os = make([]Value, 16)
-	default:
-		os = make([]Value, size)
-	}
-
 	var (
 		param  []Value
 		param2 [2]Value
@@ -238,19 +670,21 @@ func (e *Expr) TryEval(ctx *Ctx) (res Value, err error) {
 		curt = nodes[i]
 		switch curt.flag & nodeTypeMask {
 		case fastOperator:
-			param2[0], err = getNodeValueProxy(ctx, nodes[i+1])
-			if err != nil {
-				return
+			param = param2[:curt.childCnt]
+			for j := range param {
+				i++
+				param[j], err = getNodeValueProxy(ctx, nodes[i])
+				if err != nil {
+					return
+				}
 			}
-			param2[1], err = getNodeValueProxy(ctx, nodes[i+2])
-			if err != nil {
-				return
+			if isDone(done) {
+				return nil, cancelled(ctx)
 			}
-			res, err = executeOperatorProxy(ctx, curt, param2[:])
+			res, err = executeOperatorProxy(ctx, curt, param)
 			if err != nil {
 				return
 			}
-			i += 2
 		case variable:
 			res, err = fetchVariableValueProxy(ctx, curt)
 			if err != nil {
@@ -269,8 +703,15 @@ func (e *Expr) TryEval(ctx *Ctx) (res Value, err error) {
 				copy(param, os[osTop+1:])
 			}
 
+			if isDone(done) {
+				return nil, cancelled(ctx)
+			}
 			res, err = executeOperatorProxy(ctx, curt, param)
 			if err != nil {
+				// the partial result is only returned from the root node
+				if e.parentIdx[i] != -1 {
+					res = nil
+				}
 				return
 			}
 		case cond:
@@ -305,11 +746,43 @@ func (e *Expr) TryEval(ctx *Ctx) (res Value, err error) {
 			}
 		}
 
+		if int(osTop)+1 >= len(os) {
+			// the stack size is computed at compile time, grow it defensively
+			os = growStack(os)
+		}
 		os[osTop+1], osTop = res, osTop+1
 	}
 	return os[0], nil
 }
 
+// doneChan returns the done channel of ctx.Ctx, it's nil if ctx.Ctx can never be cancelled,
+// e.g. context.Background(), then the cancellation checks of the operators are skipped cheaply
+func doneChan(ctx *Ctx) <-chan struct{} {
+	if ctx == nil || ctx.Ctx == nil {
+		return nil
+	}
+	return ctx.Ctx.Done()
+}
+
+// isDone reports whether the done channel is closed without blocking
+func isDone(done <-chan struct{}) bool {
+	if done == nil {
+		return false
+	}
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+func growStack(os []Value) []Value {
+	res := make([]Value, len(os)*2+1)
+	copy(res, os)
+	return res
+}
+
 func matchesShortCircuit(res Value, n *node) bool {
 	switch n.flag & parentOpMask {
 	case andOp:
@@ -347,12 +820,16 @@ func fetchVariableValueProxy(ctx *Ctx, n *node) (Value, error) {
 		varKey = n.varKey
 		strKey = n.value.(string)
 	)
+	if n.flag&pathVar != 0 {
+		// the root of the dotted selector is fetched
+		strKey, _ = pathRoot(strKey)
+	}
 
 	if !ctx.Cached(varKey, strKey) {
 		return DNE, nil
 	}
 
-	return ctx.Get(varKey, strKey)
+	return getVar(ctx, n)
 }
 
 type EventType string
@@ -374,9 +851,19 @@ func reportEvent(e *Expr, os []Value, osTop int16, data Value) {
 		stack[i] = os[i]
 	}
 
-	e.EventChan <- Event{
+	e.emit(Event{
 		EventType: LoopEvent,
 		Stack:     stack,
 		Data:      data,
+	})
+}
+
+// emit sends the event to EventChan, or prints it to the debug output
+// if the expression is compiled with Debug and EventChan is not set
+func (e *Expr) emit(ev Event) {
+	if e.EventChan == nil && e.debug != nil {
+		e.debug.print(ev)
+		return
 	}
+	e.EventChan <- ev
 }
@@ -1,8 +1,10 @@
 package eval
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"math/rand"
 	"reflect"
@@ -442,6 +444,68 @@ func TestExpr_Eval(t *testing.T) {
 				"s_78":  int64(78),
 			},
 		},
+		{
+			want: int64(-3),
+			s:    `(+ -1 -2)`,
+		},
+		{
+			want: int64(-5),
+			s:    `(- 0 5)`,
+		},
+		{
+			want: int64(8),
+			s:    `(- -42 -50)`,
+		},
+		{
+			want: int64(-2),
+			s:    `(int -2.5)`,
+		},
+		{
+			want: 5.0,
+			s:    `(apply_pct 2.5 100)`,
+		},
+		{
+			want: -0.5,
+			s:    `(ratio -1.5 3.0)`,
+		},
+		{
+			want: 50.0,
+			s:    `(pct_of 1.5e-3 3e-3)`,
+		},
+		{
+			want:          37.5,
+			optimizeLevel: disable,
+			s:             `(apply_pct P 50)`,
+			valMap: map[string]interface{}{
+				"P": 25.0,
+			},
+		},
+		{
+			want:          6.0,
+			optimizeLevel: onlyFast,
+			s:             `(* price 1.5)`,
+			valMap: map[string]interface{}{
+				"price": 4,
+			},
+		},
+		{
+			want: 2.0,
+			s:    `(% (+ 1 (/ 9 2.0)) 3.5)`,
+		},
+		{
+			want: true,
+			s:    `(in status ("active" 1 true))`,
+			valMap: map[string]interface{}{
+				"status": "active",
+			},
+		},
+		{
+			want: false,
+			s:    `(in status ("active" 1 true))`,
+			valMap: map[string]interface{}{
+				"status": "pending",
+			},
+		},
 	}
 
 	for _, c := range cs {
@@ -515,6 +579,10 @@ func TestEval_Infix(t *testing.T) {
 			expr: `1 + 1`,
 			want: int64(2),
 		},
+		{
+			expr: `1 - -2 + -1`,
+			want: int64(2),
+		},
 		{
 			expr: `a + b`,
 			want: int64(3),
@@ -1464,6 +1532,118 @@ func TestStatelessOperators(t *testing.T) {
 	assertEquals(t, len(expr.nodes), 3)
 }
 
+func TestExpr_EvalTyped(t *testing.T) {
+	vals := map[string]interface{}{"age": 20, "name": "Bob"}
+	cc := NewConfig(RegVarAndOp(vals))
+	ctx := NewCtxFromVars(cc, vals)
+	compile := func(expr string) *Expr {
+		e, err := Compile(cc, expr)
+		assertNil(t, err)
+		return e
+	}
+
+	i, err := compile(`(+ age 1)`).EvalInt(ctx)
+	assertNil(t, err)
+	assertEquals(t, i, int64(21))
+
+	f, err := compile(`(ratio age 8)`).EvalFloat(ctx)
+	assertNil(t, err)
+	assertEquals(t, f, 2.5)
+
+	s, err := compile(`(interp "hi {name}")`).EvalString(ctx)
+	assertNil(t, err)
+	assertEquals(t, s, "hi Bob")
+
+	b, err := compile(`(> age 18)`).EvalBool(ctx)
+	assertNil(t, err)
+	assertEquals(t, b, true)
+
+	// the zero values are returned with the errors on type mismatch
+	i, err = compile(`(ratio age 8)`).EvalInt(ctx)
+	assertErrStrContains(t, err, "invalid result type error (want: int64, got: float64)")
+	assertEquals(t, i, int64(0))
+
+	f, err = compile(`(+ age 1)`).EvalFloat(ctx)
+	assertErrStrContains(t, err, "invalid result type error (want: float64, got: int64)")
+	assertEquals(t, f, 0.0)
+
+	s, err = compile(`(> age 18)`).EvalString(ctx)
+	assertErrStrContains(t, err, "invalid result type error (want: string, got: bool)")
+	assertEquals(t, s, "")
+
+	b, err = compile(`(interp "{name}")`).EvalBool(ctx)
+	assertErrStrContains(t, err, "invalid result type error (want: bool, got: string)")
+	assertEquals(t, b, false)
+
+	// the errors of the evaluations are returned as they are
+	_, err = compile(`(/ age 0)`).EvalInt(ctx)
+	assertErrStrContains(t, err, "divide by zero")
+}
+
+func TestExpr_EvalBoolWithInputs(t *testing.T) {
+	vals := map[string]interface{}{
+		"is_student": true,
+		"balance":    200,
+		"age":        20,
+		"locale":     "en-US",
+	}
+
+	testCases := []struct {
+		expr   string
+		want   bool
+		inputs map[string]Value
+	}{
+		{
+			// only the variables on the taken branch are fetched
+			expr: `(if is_student (> balance 100) (> age 18))`,
+			want: true,
+			inputs: map[string]Value{
+				"is_student": true,
+				"balance":    int64(200),
+			},
+		},
+		{
+			// short circuit
+			expr: `(or (= locale "en-US") (> age 18) (> balance 100))`,
+			want: true,
+			inputs: map[string]Value{
+				"locale": "en-US",
+			},
+		},
+		{
+			expr: `(and (> age 18) (< balance 100))`,
+			want: false,
+			inputs: map[string]Value{
+				"age":     int64(20),
+				"balance": int64(200),
+			},
+		},
+		{
+			// the local variables are not inputs
+			expr: `(= (count_of (find_all (1 2 3) (> x age)) 1) 0)`,
+			want: true,
+			inputs: map[string]Value{
+				"age": int64(20),
+			},
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			for _, opt := range []Option{Optimizations(true), Optimizations(false)} {
+				cc := NewConfig(opt, RegVarAndOp(vals))
+				e, err := Compile(cc, c.expr)
+				assertNil(t, err)
+
+				res, inputs, err := e.EvalBoolWithInputs(NewCtxFromVars(cc, vals))
+				assertNil(t, err)
+				assertEquals(t, res, c.want)
+				assertEquals(t, inputs, c.inputs)
+			}
+		})
+	}
+}
+
 func assertEquals(t *testing.T, got, want any, msg ...any) {
 	if !reflect.DeepEqual(got, want) {
 		t.Fatalf("assertEquals failed, got: %+v, want: %+v, msg: %+v", got, want, msg)
@@ -1505,3 +1685,500 @@ func safeExec(fn func(*Ctx) (Value, error), ctx *Ctx) (res Value, err error) {
 	}()
 	return fn(ctx)
 }
+
+func TestExpr_Eval_StackGrowth(t *testing.T) {
+	const depth = 200
+	vals := map[string]interface{}{"n": 1}
+	expr := strings.Repeat("(+ n ", depth) + "n" + strings.Repeat(")", depth)
+
+	cc := NewConfig(RegVarAndOp(vals))
+	e, err := Compile(cc, expr)
+	assertNil(t, err)
+
+	res, err := e.Eval(NewCtxFromVars(cc, vals))
+	assertNil(t, err)
+	assertEquals(t, res, int64(depth+1))
+
+	// a wrong stack size makes the stack grow instead of panicking
+	e.maxStackSize = 1
+	res, err = e.Eval(NewCtxFromVars(cc, vals))
+	assertNil(t, err)
+	assertEquals(t, res, int64(depth+1))
+
+	res, err = e.TryEval(NewCtxFromVars(cc, vals))
+	assertNil(t, err)
+	assertEquals(t, res, int64(depth+1))
+}
+
+func TestEvalBuffers(t *testing.T) {
+	for size, bucket := range map[int]int{0: 0, 1: 0, 8: 0, 9: 1, 16: 1, 17: 2, 1000: 7, 1024: 7} {
+		assertEquals(t, stackBucket(size), bucket, size)
+		buf := getEvalBuffers(size)
+		assertEquals(t, len(buf.os), minPooledStack<<bucket, size)
+
+		// the values are not retained by the pooled buffers
+		buf.os[len(buf.os)-1], buf.param2[1] = "x", "y"
+		putEvalBuffers(buf)
+		assertEquals(t, buf.os[len(buf.os)-1], nil, size)
+		assertEquals(t, buf.param2, [2]Value{}, size)
+	}
+
+	// the larger stacks are not pooled
+	buf := getEvalBuffers(maxPooledStack + 1)
+	assertEquals(t, len(buf.os), maxPooledStack+1)
+	putEvalBuffers(buf)
+}
+
+func TestEvalBuffers_ParamsEscape(t *testing.T) {
+	// the params escape the evaluation by the goroutines of the operators with timeouts,
+	// and by the events handled asynchronously, they should not share the pooled buffers
+	// with the later evaluations, which is detected by the race detector
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		sizes []int
+	)
+	slow := func(_ *Ctx, params []Value) (Value, error) {
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		sizes = append(sizes, len(fmt.Sprint(params)))
+		mu.Unlock()
+		wg.Done()
+		return true, nil
+	}
+
+	vals := map[string]interface{}{"age": 20}
+	cc := NewConfig(RegVarAndOp(vals))
+	assertNil(t, RegisterOperator(cc, "slow", slow, WithTimeout(time.Millisecond)))
+	e, err := Compile(cc, `(slow age 1)`)
+	assertNil(t, err)
+	next, err := Compile(cc, `(+ age 1)`)
+	assertNil(t, err)
+
+	const n = 4
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		ctx := NewCtxFromVars(cc, vals)
+		ctx.Ctx = context.Background()
+		_, err = e.Eval(ctx)
+		assertErrStrContains(t, err, "timeout")
+		// the next evaluations reuse the buffers
+		_, _ = next.Eval(NewCtxFromVars(cc, vals))
+	}
+	wg.Wait()
+	assertEquals(t, len(sizes), n)
+
+	cc = NewConfig(EnableDebug, WriteDebugTo(io.Discard), RegVarAndOp(vals))
+	e, err = Compile(cc, `(+ age 1)`)
+	assertNil(t, err)
+	e.EventChan = make(chan Event, 64)
+	done := HandleDebugEventWithDone(e)
+	for i := 0; i < n; i++ {
+		res, err := e.Eval(NewCtxFromVars(cc, vals))
+		assertNil(t, err)
+		assertEquals(t, res, int64(21))
+	}
+	close(e.EventChan)
+	<-done
+}
+
+func TestExpr_AsFunc(t *testing.T) {
+	cc := NewConfig(RegVarAndOp(map[string]interface{}{"age": 0, "scores": nil}))
+	e, err := Compile(cc, `(if (>= age 18) (+ age (* 2 age)) (find_all scores (> x age)))`)
+	assertNil(t, err)
+	fn := e.AsFunc()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(age int) {
+			defer wg.Done()
+			vals := map[string]interface{}{"age": age, "scores": []int{age - 1, age + 1}}
+			res, err := fn(NewCtxFromVars(cc, vals))
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			var want Value = int64(3 * age)
+			if age < 18 {
+				want = []interface{}{[]interface{}{int64(1), int64(age + 1)}}
+			}
+			if !reflect.DeepEqual(res, want) {
+				errs <- fmt.Errorf("age: %d, got: %v, want: %v", age, res, want)
+			}
+		}(i % 40)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestExpr_Eval_Concurrent evaluates each expression from many goroutines with distinct
+// contexts, run it with -race to check the operators do not share mutable states
+func TestExpr_Eval_Concurrent(t *testing.T) {
+	exprs := []string{
+		`(and (>= age 18) (or (= name "Bob") (in name ("a" "b" "c" "d" "e" "f" "g" "h" "i" "j" "k" "l"))))`,
+		`(if (> age 30) (+ age (* 2 age)) (- age 1.5))`,
+		`(cond ((< age 13) "child") ((< age 20) "teen") (else (concat name "!")))`,
+		`(regex name (if (> age 20) "^B" "b$"))`,
+		`(find_all scores (> x age))`,
+		`(map scores (+ x age))`,
+		`(reduce scores 0 (+ acc x))`,
+		`(sort_by scores (- 0 x))`,
+		`(let (a (+ age 1) b (* a 2)) (filter scores (> x b)))`,
+		`(dict "name" name "total" (sum scores) "avg" (avg scores))`,
+		`(append scores age)`,
+		`(len (concat_lists scores scores))`,
+		`(in age (range 0 (+ age 1)))`,
+	}
+	newVals := func(i int) map[string]interface{} {
+		return map[string]interface{}{
+			"age":    i,
+			"name":   fmt.Sprintf("Bob%d", i),
+			"scores": []int{i, 2 * i, 30},
+		}
+	}
+
+	for _, expr := range exprs {
+		t.Run(expr, func(t *testing.T) {
+			cc := NewConfig(RegVarAndOp(newVals(0)))
+			e, err := Compile(cc, expr)
+			assertNil(t, err)
+
+			const n = 40
+			wants := make([]Value, n)
+			for i := range wants {
+				wants[i], err = e.Eval(NewCtxFromVars(cc, newVals(i)))
+				assertNil(t, err)
+			}
+
+			var wg sync.WaitGroup
+			errs := make(chan error, 4*n)
+			for i := 0; i < 4*n; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					ctx := NewCtxFromVars(cc, newVals(i%n))
+					ctx.SnapshotVars = i%2 == 0
+					res, err := e.Eval(ctx)
+					if err != nil {
+						errs <- err
+						return
+					}
+					if !reflect.DeepEqual(res, wants[i%n]) {
+						errs <- fmt.Errorf("i: %d, got: %v, want: %v", i, res, wants[i%n])
+					}
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestExpr_Eval_IntArithmetic(t *testing.T) {
+	vals := map[string]interface{}{"a": 7, "b": 3, "c": 5}
+	testCases := []struct {
+		expr     string
+		intArith bool
+		want     Value
+		errMsg   string
+	}{
+		{expr: `(+ a (* b 2) (- a b))`, intArith: true, want: int64(17)},
+		{expr: `(+ a 1)`, intArith: true, want: int64(8)},
+		{expr: `(div (mod a b) (sub b 2))`, intArith: true, want: int64(1)},
+		{expr: `(* (+ 1 2) a)`, intArith: true, want: int64(21)},
+		{expr: `(/ a (- b b))`, intArith: true, errMsg: "operator: div, error: divide by zero"},
+		{expr: `(% a (- b 3))`, intArith: true, errMsg: "operator: mod, error: divide by zero"},
+		// c is not registered as IntType
+		{expr: `(+ a c)`, want: int64(12)},
+		{expr: `(if (> a b) (+ a 1) b)`, want: int64(8)},
+		{expr: `(+ a (let (x 2) x))`, want: int64(9)},
+		{expr: `(+ a (- b "1"))`, errMsg: paramTypeErrMsg},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			for _, opt := range []Option{Optimizations(true), Optimizations(false)} {
+				cc := NewConfig(opt, RegVarAndOp(map[string]interface{}{"c": 0}))
+				assertNil(t, RegisterVariable(cc, "a", IntType))
+				assertNil(t, RegisterVariable(cc, "b", IntType))
+
+				e, err := Compile(cc, c.expr)
+				assertNil(t, err)
+				assertEquals(t, e.intArith != nil, c.intArith)
+
+				res, err := e.Eval(NewCtxFromVars(cc, vals))
+				if len(c.errMsg) != 0 {
+					assertErrStrContains(t, err, c.errMsg)
+					continue
+				}
+				assertNil(t, err)
+				assertEquals(t, res, c.want)
+			}
+		})
+	}
+
+	// the values which are not int64 at runtime are evaluated by the boxed path
+	cc := NewConfig()
+	assertNil(t, RegisterVariable(cc, "a", IntType))
+	e, err := Compile(cc, `(+ a 1)`)
+	assertNil(t, err)
+	_, err = e.Eval(&Ctx{VariableFetcher: MapVarFetcher{"a": "7"}})
+	assertErrStrContains(t, err, paramTypeErrMsg)
+}
+
+func TestExpr_Eval_Cancellation(t *testing.T) {
+	vals := map[string]interface{}{"age": 20}
+	cc := NewConfig(RegVarAndOp(vals))
+	_ = RegisterVariable(cc, "n", IntType)
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// the cancelled evaluations return promptly, including the int64 arithmetic path
+	for _, expr := range []string{`(> age 18)`, `(+ n 1)`, `(iterate 0 (+ acc 1) true 1000000000)`} {
+		e, err := Compile(cc, expr)
+		assertNil(t, err)
+		ctx := NewCtxFromVars(cc, map[string]interface{}{"age": 20, "n": 1})
+		ctx.Ctx = cancelled
+		_, err = e.Eval(ctx)
+		assertErrStrContains(t, err, "evaluation cancelled")
+		assertEquals(t, errors.Is(err, context.Canceled), true)
+
+		_, err = e.TryEval(ctx)
+		assertEquals(t, errors.Is(err, context.Canceled), true)
+
+		if strings.HasPrefix(expr, "(iterate") {
+			continue
+		}
+		// no checks without Ctx.Ctx or with a context which can never be cancelled
+		for _, c := range []context.Context{nil, context.Background()} {
+			ctx.Ctx = c
+			_, err = e.Eval(ctx)
+			assertNil(t, err)
+		}
+	}
+
+	// the operators after the cancellation are not called
+	var calls int
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assertNil(t, RegisterOperator(cc, "cancel_now", func(_ *Ctx, _ []Value) (Value, error) {
+		cancel()
+		return int64(1), nil
+	}))
+	assertNil(t, RegisterOperator(cc, "count", func(_ *Ctx, params []Value) (Value, error) {
+		calls++
+		return params[0], nil
+	}))
+	e, err := Compile(cc, `(count (+ (cancel_now) age))`)
+	assertNil(t, err)
+	evalCtx := NewCtxFromVars(cc, vals)
+	evalCtx.Ctx = ctx
+	_, err = e.Eval(evalCtx)
+	assertEquals(t, errors.Is(err, context.Canceled), true)
+	assertEquals(t, calls, 0)
+
+	// the long-running loops stop at the deadline
+	deadline, cancelDeadline := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancelDeadline()
+	e, err = Compile(cc, `(iterate 0 (+ acc 1) true 1000000000000)`)
+	assertNil(t, err)
+	evalCtx = NewCtxFromVars(cc, vals)
+	evalCtx.Ctx = deadline
+	start := time.Now()
+	_, err = e.Eval(evalCtx)
+	assertEquals(t, errors.Is(err, context.DeadlineExceeded), true)
+	assertEquals(t, time.Since(start) < 500*time.Millisecond, true)
+
+	// the streaming range checks the cancellation periodically
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	e, err = Compile(cc, `(range 0 n)`)
+	assertNil(t, err)
+	evalCtx = NewCtxFromVars(cc, map[string]interface{}{"n": 1000000000000})
+	evalCtx.Ctx = ctx
+	var yielded int
+	err = e.EvalStream(evalCtx, func(Value) error {
+		if yielded++; yielded == 10 {
+			cancel()
+		}
+		return nil
+	})
+	assertEquals(t, errors.Is(err, context.Canceled), true)
+	assertEquals(t, yielded, cancelCheckInterval)
+}
+
+func TestExpr_EvalBatch(t *testing.T) {
+	cc := NewConfig(RegVarAndOp(map[string]interface{}{
+		"age":    nil,
+		"scores": nil,
+	}))
+	// the stack is deeper than the cheap fixed sizes
+	e, err := Compile(cc, `(and (> age 18) (or (= age 20) (in age (1 2 3)) (> (+ age (count_of scores 1) 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16) 30)))`)
+	assertNil(t, err)
+
+	var ctxs []*Ctx
+	var want []Value
+	for _, age := range []interface{}{10, 20, 21, "x", 40} {
+		vals := map[string]interface{}{"age": age, "scores": []int{1, 1}}
+		ctx := NewCtxFromVars(cc, vals)
+		ctxs = append(ctxs, ctx)
+		res, err := e.Eval(ctx)
+		if err != nil {
+			res = err.Error()
+		}
+		want = append(want, res)
+	}
+
+	results, errs := e.EvalBatch(ctxs)
+	assertEquals(t, len(results), len(ctxs))
+	assertEquals(t, len(errs), len(ctxs))
+	for i := range ctxs {
+		if errs[i] != nil {
+			assertEquals(t, errs[i].Error(), want[i])
+			continue
+		}
+		assertEquals(t, results[i], want[i])
+	}
+	assertEquals(t, results[0], false)
+	assertEquals(t, results[2], true)
+	assertErrStrContains(t, errs[3], "unexpected param type")
+
+	results, errs = e.EvalBatch(nil)
+	assertEquals(t, len(results), 0)
+	assertEquals(t, len(errs), 0)
+}
+
+func BenchmarkExpr_EvalBatch(b *testing.B) {
+	const expr = `(and (> age 18) (or (= country "US") (in country ("CA" "MX"))) (< (+ age bonus 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15) 150))`
+	cc := NewConfig(RegVarAndOp(map[string]interface{}{
+		"age":     nil,
+		"bonus":   nil,
+		"country": nil,
+	}))
+	e, err := Compile(cc, expr)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	ctxs := make([]*Ctx, 1000)
+	for i := range ctxs {
+		ctxs[i] = NewCtxFromVars(cc, map[string]interface{}{
+			"age":     i % 50,
+			"bonus":   i % 7,
+			"country": []string{"US", "CA", "UK"}[i%3],
+		})
+	}
+
+	b.Run("eval", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, ctx := range ctxs {
+				_, _ = e.Eval(ctx)
+			}
+		}
+	})
+	b.Run("batch", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = e.EvalBatch(ctxs)
+		}
+	})
+}
+
+func BenchmarkExpr_Eval_IntArithmetic(b *testing.B) {
+	const expr = `(+ (* a b) (- a (/ b 2)) (% (* a 3) 7) (* (+ a b) (- a b)))`
+	vals := map[string]interface{}{"a": 1000, "b": 300}
+
+	for _, bc := range []struct {
+		name  string
+		typed bool
+	}{
+		{name: "boxed"},
+		{name: "int64", typed: true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			cc := NewConfig(RegVarAndOp(vals))
+			if bc.typed {
+				cc = NewConfig()
+				_ = RegisterVariable(cc, "a", IntType)
+				_ = RegisterVariable(cc, "b", IntType)
+			}
+			e, err := Compile(cc, expr)
+			if err != nil {
+				b.Fatal(err)
+			}
+			ctx := NewCtxFromVars(cc, vals)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _ = e.Eval(ctx)
+			}
+		})
+	}
+}
+
+func BenchmarkExpr_Eval_Unary(b *testing.B) {
+	const expr = `(and (not a) (not (empty s)) (not (blank s)) (not (not b)))`
+	vals := map[string]interface{}{"a": false, "b": true, "s": "x"}
+
+	for _, bc := range []struct {
+		name string
+		fast bool
+	}{
+		{name: "operator"},
+		{name: "fast", fast: true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			cc := NewConfig(Optimizations(bc.fast, FastEvaluation), RegVarAndOp(vals))
+			e, err := Compile(cc, expr)
+			if err != nil {
+				b.Fatal(err)
+			}
+			ctx := NewCtxFromVars(cc, vals)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _ = e.Eval(ctx)
+			}
+		})
+	}
+}
+
+func BenchmarkExpr_Eval_StackPool(b *testing.B) {
+	const expr = `(and (= gender "F") (or (> age 18) (in country ("US" "CA"))) (not (blank name)))`
+	vals := map[string]interface{}{"gender": "F", "age": 20, "country": "US", "name": "Ann"}
+
+	cc := NewConfig(RegVarAndOp(vals))
+	e, err := Compile(cc, expr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx := NewCtxFromVars(cc, vals)
+
+	b.Run("alloc", func(b *testing.B) {
+		// the buffers allocated by each evaluation, as Eval did before the pools
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = e.eval(ctx, make([]Value, 8), new([2]Value))
+		}
+	})
+	b.Run("pool", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = e.Eval(ctx)
+		}
+	})
+}
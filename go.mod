@@ -1,3 +1,10 @@
 module github.com/onheap/eval
 
 go 1.18
+
+require (
+	github.com/nyaruka/phonenumbers v1.2.2
+	golang.org/x/text v0.22.0
+)
+
+require google.golang.org/protobuf v1.31.0 // indirect
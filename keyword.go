@@ -0,0 +1,1236 @@
+package eval
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// localVarKey is the VariableKey of local variables, such as the element variable
+// of the loop keywords. Local variables are always resolved by their names.
+const localVarKey VariableKey = UndefinedVarKey + 1
+
+const (
+	// elemVar is the local variable bound to the current element in the loop keywords
+	elemVar = "x"
+	// accVar is the local variable bound to the accumulator in the iterate and reduce keywords
+	accVar = "acc"
+)
+
+// lambda is a sub-expression compiled separately from the main expression,
+// it's evaluated with its params bound as local variables,
+// e.g. the predicate of `(find_all coll predicate)`
+type lambda struct {
+	params []string
+	body   *Expr
+}
+
+// bind returns a Ctx that resolves the params of the lambda on top of ctx,
+// the values of the params are assigned through the returned scope before each call.
+func (l *lambda) bind(ctx *Ctx) (*Ctx, *scope) {
+	var c Ctx
+	if ctx != nil {
+		c = *ctx
+	}
+	// the steps of the lambdas are not traced
+	c.Trace = nil
+	s := &scope{
+		VariableFetcher: c.VariableFetcher,
+		names:           l.params,
+		vals:            make([]Value, len(l.params)),
+	}
+	c.VariableFetcher = s
+	return &c, s
+}
+
+// scope binds local variables and delegates the others to the parent fetcher,
+// the locals of the inner scope shadow the outer ones and the selectors.
+type scope struct {
+	VariableFetcher
+	names []string
+	vals  []Value
+}
+
+func (s *scope) Get(varKey VariableKey, strKey string) (Value, error) {
+	if varKey == localVarKey {
+		// the later names shadow the earlier ones, e.g. the rebound names of let
+		for i := len(s.names) - 1; i >= 0; i-- {
+			if s.names[i] == strKey {
+				return s.vals[i], nil
+			}
+		}
+	}
+	if s.VariableFetcher == nil {
+		return nil, fmt.Errorf("variableKey not exist %s", strKey)
+	}
+	return s.VariableFetcher.Get(varKey, strKey)
+}
+
+func (s *scope) Set(varKey VariableKey, strKey string, val Value) error {
+	if varKey == localVarKey {
+		for i, name := range s.names {
+			if name == strKey {
+				s.vals[i] = val
+				return nil
+			}
+		}
+	}
+	if s.VariableFetcher == nil {
+		return fmt.Errorf("variableKey not exist %s", strKey)
+	}
+	return s.VariableFetcher.Set(varKey, strKey, val)
+}
+
+func (s *scope) Cached(varKey VariableKey, strKey string) bool {
+	if varKey == localVarKey {
+		for _, name := range s.names {
+			if name == strKey {
+				return true
+			}
+		}
+	}
+	if s.VariableFetcher == nil {
+		return false
+	}
+	return s.VariableFetcher.Cached(varKey, strKey)
+}
+
+// RenameKeyword renames the builtin keyword in the config, e.g. renaming `map` to
+// `transform`, then the original name is no longer a keyword, and it's free to be used
+// as a variable or an operator. The new name should not be another keyword, an operator,
+// a variable or a constant, as they would be shadowed by the keyword. The errors of the
+// compilations report the keywords by the new names.
+func RenameKeyword(cc *Config, from, to string) error {
+	kw, exist := keywordOf(cc, from)
+	if !exist {
+		return fmt.Errorf("keyword not exist %s", from)
+	}
+	if _, exist = keywordOf(cc, to); exist {
+		return fmt.Errorf("keyword already exist %s", to)
+	}
+	if _, exist = builtinOperators[to]; exist {
+		return fmt.Errorf("operator already exist %s", to)
+	}
+	if _, exist = cc.OperatorMap[to]; exist {
+		return fmt.Errorf("operator already exist %s", to)
+	}
+	if _, exist = cc.VariableKeyMap[to]; exist {
+		return fmt.Errorf("variable already exist %s", to)
+	}
+	if _, exist = cc.ConstantMap[to]; exist {
+		return fmt.Errorf("constant already exist %s", to)
+	}
+
+	kws := configKeywords(cc)
+	delete(kws, from)
+	kws[to] = string(kw)
+	return nil
+}
+
+// DisableKeyword removes the keyword from the config,
+// then the name is free to be used as a variable or an operator.
+func DisableKeyword(cc *Config, name string) error {
+	if _, exist := keywordOf(cc, name); !exist {
+		return fmt.Errorf("keyword not exist %s", name)
+	}
+	delete(configKeywords(cc), name)
+	return nil
+}
+
+// configKeywords returns the keywords of the config,
+// it's initialized with the builtin keywords if it's nil.
+func configKeywords(cc *Config) map[string]string {
+	if cc.Keywords == nil {
+		cc.Keywords = make(map[string]string, len(keywords))
+		for _, kw := range keywords {
+			cc.Keywords[string(kw)] = string(kw)
+		}
+	}
+	return cc.Keywords
+}
+
+// keywordOf returns the builtin keyword of the name in the config,
+// the builtin keywords are used if the keywords of the config are not customized.
+func keywordOf(cc *Config, name string) (keyword, bool) {
+	if cc.Keywords != nil {
+		kw, exist := cc.Keywords[name]
+		return keyword(kw), exist
+	}
+	return builtinKeyword(name)
+}
+
+// builtinKeyword returns the builtin keyword of the name, the keyword nodes are named by the builtin names
+func builtinKeyword(name string) (keyword, bool) {
+	for _, kw := range keywords {
+		if name == string(kw) {
+			return kw, true
+		}
+	}
+	return "", false
+}
+
+// keywordLocals returns the local variables which are visible in the i-th child of the keyword
+func keywordLocals(kw keyword, i int) []string {
+	switch {
+	case (kw == keywordFindAll || kw == keywordAny || kw == keywordAll) && i == 1:
+		return []string{elemVar}
+	case (kw == keywordMap || kw == keywordFilter) && i == 1:
+		return []string{elemVar}
+	case kw == keywordMapIf && (i == 1 || i == 2):
+		return []string{elemVar}
+	case (kw == keywordSortBy || kw == keywordSortByDesc) && i == 1:
+		return []string{elemVar}
+	case kw == keywordReduce && i == 2:
+		return []string{accVar, elemVar}
+	case kw == keywordIterate && (i == 1 || i == 2):
+		return []string{accVar}
+	}
+	return nil
+}
+
+// compileLambda compiles the ast of a keyword child into a lambda.
+// The events of lambdas are not reported, as they are not a part of the main expression.
+func (p *parser) compileLambda(body *astNode, params ...string) (*lambda, error) {
+	conf := CopyConfig(p.conf)
+	conf.CompileOptions[ReportEvent] = false
+	conf.CompileOptions[Debug] = false
+
+	e, err := compileAst(conf, body)
+	if err != nil {
+		return nil, err
+	}
+	return &lambda{params: params, body: e}, nil
+}
+
+// parseLet parses the rest of `(let (name1 val1 name2 val2 ...) body)` after the car.
+// Each value is evaluated with the previous names bound, and the body is evaluated
+// with all the names bound. The names shadow the selectors, and are only visible
+// inside the let expression.
+func (p *parser) parseLet(car token) (*astNode, error) {
+	err := p.eat(lParen)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(n int) { p.locals = p.locals[:n] }(len(p.locals))
+
+	var (
+		names []string
+		vals  []*astNode
+	)
+	for {
+		t, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if t.typ == rParen {
+			break
+		}
+		if t.typ != ident {
+			return nil, p.tokenTypeError(ident, t)
+		}
+
+		peek, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		if peek.typ == rParen {
+			return nil, p.errWithToken(ErrKindInvalidExpr, fmt.Errorf(
+				"%s bindings should be pairs of name and value, got an odd number of elements", car.val), car)
+		}
+
+		val, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, t.val)
+		vals = append(vals, val)
+		p.locals = append(p.locals, t.val)
+	}
+
+	if len(names) == 0 {
+		return nil, p.errWithToken(ErrKindInvalidExpr, fmt.Errorf("%s requires at least one binding", car.val), car)
+	}
+
+	if peek, err := p.peek(); err != nil || peek.typ == rParen {
+		return nil, p.errWithToken(ErrKindInvalidExpr, fmt.Errorf("%s requires a body", car.val), car)
+	}
+	body, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	if err = p.eat(rParen); err != nil {
+		return nil, err
+	}
+	return p.buildLetNode(car, names, vals, body)
+}
+
+// condElse is the test of the default clause of cond
+const condElse = "else"
+
+// parseCond parses the rest of `(cond (test1 result1) (test2 result2) ... (else result))` after the car.
+// The tests are evaluated in order, and the result of the first true one is returned. The clauses
+// are built into nested if nodes, so the short circuit of if jumps over the rest ones. An unmatched
+// cond returns nil if there is no else clause, unless CondRequiresElse is enabled.
+func (p *parser) parseCond(car token) (*astNode, error) {
+	var (
+		starts  []int
+		clauses [][]*astNode
+		orElse  *astNode
+	)
+	for {
+		t, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if t.typ == rParen {
+			break
+		}
+		if t.typ != lParen {
+			return nil, p.tokenTypeError(lParen, t)
+		}
+		if orElse != nil {
+			return nil, p.errWithToken(ErrKindInvalidExpr, fmt.Errorf("%s else clause should be the last one", car.val), t)
+		}
+
+		var clause []*astNode
+		if peek, err := p.peek(); err == nil && peek.typ == ident && peek.val == condElse {
+			p.walk()
+		} else if clause, err = p.parseCondParam(car, clause); err != nil {
+			return nil, err
+		}
+		if clause, err = p.parseCondParam(car, clause); err != nil {
+			return nil, err
+		}
+		if err = p.eat(rParen); err != nil {
+			return nil, err
+		}
+
+		if len(clause) == 1 {
+			orElse = clause[0]
+			continue
+		}
+		starts = append(starts, t.pos)
+		clauses = append(clauses, clause)
+	}
+
+	if len(clauses) == 0 {
+		return nil, p.errWithToken(ErrKindInvalidExpr, fmt.Errorf("%s requires at least one clause", car.val), car)
+	}
+	if orElse == nil && p.conf.CompileOptions[CondRequiresElse] {
+		return nil, p.errWithToken(ErrKindInvalidExpr, fmt.Errorf("%s requires an else clause", car.val), car)
+	}
+
+	// the clauses are nested from the last one, the missing else is nil, see buildIfNode
+	end := p.tokens[p.idx-1].pos + 1
+	ast := orElse
+	for i := len(clauses) - 1; i >= 0; i-- {
+		children := clauses[i]
+		if ast != nil {
+			children = append(children, ast)
+		}
+		next, err := p.buildIfNode(car, children)
+		if err != nil {
+			return nil, err
+		}
+		if p.conf.CompileOptions[TypeCheck] {
+			if next.typ, err = p.typeCheckKeyword(keywordIf, car, children); err != nil {
+				return nil, err
+			}
+		}
+		next.span = Span{Start: starts[i], End: end}
+		ast = next
+	}
+	return ast, nil
+}
+
+// parseCondParam parses a param of the cond clause
+func (p *parser) parseCondParam(car token, clause []*astNode) ([]*astNode, error) {
+	if peek, err := p.peek(); err != nil || peek.typ == rParen {
+		return nil, p.errWithToken(ErrKindInvalidExpr, fmt.Errorf("%s clauses should be pairs of test and result", car.val), car)
+	}
+	param, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	return append(clause, param), nil
+}
+
+// buildLetNode builds the let node, the first value is a child of the node,
+// the other values and the body are lambdas of the names bound before them.
+func (p *parser) buildLetNode(car token, names []string, vals []*astNode, body *astNode) (*astNode, error) {
+	lambdas := make([]*lambda, 0, len(vals))
+	for i, val := range append(vals[1:], body) {
+		l, err := p.compileLambda(val, names[:i+1]...)
+		if err != nil {
+			return nil, err
+		}
+		lambdas = append(lambdas, l)
+	}
+
+	return &astNode{
+		node: &node{
+			flag:  operator | keywordOp,
+			value: string(keywordLet),
+			operator: func(ctx *Ctx, params []Value) (Value, error) {
+				return evalLet(ctx, params[0], lambdas)
+			},
+		},
+		children: vals[:1],
+		lambdas:  lambdas,
+	}, nil
+}
+
+// evalLet evaluates the lambdas in order, each one with the results of the previous ones bound,
+// the result of the last one, which is the body, is returned
+func evalLet(ctx *Ctx, first Value, lambdas []*lambda) (Value, error) {
+	bound := make([]Value, 1, len(lambdas)+1)
+	bound[0] = first
+	for _, l := range lambdas {
+		lctx, s := l.bind(ctx)
+		copy(s.vals, bound)
+		v, err := l.body.Eval(lctx)
+		if err != nil {
+			return nil, err
+		}
+		bound = append(bound, v)
+	}
+	return bound[len(bound)-1], nil
+}
+
+// buildQuantifierNode builds `(any coll predicate)` and `(all coll predicate)`, the current
+// element is bound to `x` in the predicate. The elements are evaluated in order, and the
+// evaluation stops at the first element which determines the result, it's true for `any`
+// and false for `all`. An empty list returns false for `any` and true for `all`.
+func (p *parser) buildQuantifierNode(car token, children []*astNode) (*astNode, error) {
+	if len(children) != 2 {
+		return nil, p.paramsCountErr(2, len(children), car)
+	}
+
+	pred, err := p.compileLambda(children[1], elemVar)
+	if err != nil {
+		return nil, err
+	}
+
+	// the result of any is true once an element matches,
+	// and the result of all is false once an element doesn't match
+	kw, _ := keywordOf(p.conf, car.val)
+	op, stopAt := car.val, kw == keywordAny
+	return &astNode{
+		node: &node{
+			flag:  operator,
+			value: car.val,
+			operator: func(ctx *Ctx, params []Value) (Value, error) {
+				return quantify(ctx, op, params[0], pred, stopAt)
+			},
+		},
+		children: children[:1],
+		lambdas:  []*lambda{pred},
+	}, nil
+}
+
+func quantify(ctx *Ctx, op string, coll Value, pred *lambda, stopAt bool) (Value, error) {
+	elems, ok := listElems(coll)
+	if !ok {
+		return nil, ParamTypeError(op, typeList, coll)
+	}
+
+	lctx, s := pred.bind(ctx)
+	for i, elem := range elems {
+		elem = unifyType(elem)
+		if err := cancelled(ctx); err != nil {
+			return nil, err
+		}
+		s.vals[0] = elem
+		matched, err := evalPredicate(op, pred.body, lctx, i)
+		if err != nil {
+			return nil, err
+		}
+		if matched == stopAt {
+			return stopAt, nil
+		}
+	}
+	return !stopAt, nil
+}
+
+// buildFindAllNode builds `(find_all coll predicate)`, it returns the list of
+// `(index element)` pairs of the elements that match the predicate,
+// the current element is bound to `x` in the predicate.
+func (p *parser) buildFindAllNode(car token, children []*astNode) (*astNode, error) {
+	if len(children) != 2 {
+		return nil, p.paramsCountErr(2, len(children), car)
+	}
+
+	pred, err := p.compileLambda(children[1], elemVar)
+	if err != nil {
+		return nil, err
+	}
+
+	return &astNode{
+		node: &node{
+			flag:  operator,
+			value: car.val,
+			operator: func(ctx *Ctx, params []Value) (Value, error) {
+				return findAll(ctx, params[0], pred)
+			},
+		},
+		children: children[:1],
+		lambdas:  []*lambda{pred},
+	}, nil
+}
+
+func findAll(ctx *Ctx, coll Value, pred *lambda) (Value, error) {
+	res := make([]interface{}, 0)
+	err := eachFound(ctx, coll, pred, func(pair Value) error {
+		res = append(res, pair)
+		return nil
+	})
+	if err != nil {
+		return interrupted(ctx, res, err)
+	}
+	return res, nil
+}
+
+// streamFindAll yields the `(index element)` pairs of find_all one by one
+func streamFindAll(ctx *Ctx, params []Value, lambdas []*lambda, yield func(Value) error) error {
+	return eachFound(ctx, params[0], lambdas[0], yield)
+}
+
+// eachFound calls fn with the `(index element)` pair of each element that matches the predicate
+func eachFound(ctx *Ctx, coll Value, pred *lambda, fn func(pair Value) error) error {
+	return eachMatched(ctx, string(keywordFindAll), coll, pred, func(i int, elem Value) error {
+		return fn([]interface{}{int64(i), elem})
+	})
+}
+
+// eachMatched calls fn with the index and the element of each element that matches the predicate
+func eachMatched(ctx *Ctx, op string, coll Value, pred *lambda, fn func(i int, elem Value) error) error {
+	elems, ok := listElems(coll)
+	if !ok {
+		return ParamTypeError(op, typeList, coll)
+	}
+
+	lctx, s := pred.bind(ctx)
+	for i, elem := range elems {
+		elem = unifyType(elem)
+		if err := cancelled(ctx); err != nil {
+			return err
+		}
+		s.vals[0] = elem
+		matched, err := evalPredicate(op, pred.body, lctx, i)
+		if err != nil {
+			return err
+		}
+		if matched {
+			if err = fn(i, elem); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// buildFilterNode builds `(filter coll predicate)`, it returns a new list of the elements
+// that match the predicate in order, the current element is bound to `x` in the predicate.
+func (p *parser) buildFilterNode(car token, children []*astNode) (*astNode, error) {
+	if len(children) != 2 {
+		return nil, p.paramsCountErr(2, len(children), car)
+	}
+
+	pred, err := p.compileLambda(children[1], elemVar)
+	if err != nil {
+		return nil, err
+	}
+
+	return &astNode{
+		node: &node{
+			flag:  operator,
+			value: car.val,
+			operator: func(ctx *Ctx, params []Value) (Value, error) {
+				return filter(ctx, params[0], pred)
+			},
+		},
+		children: children[:1],
+		lambdas:  []*lambda{pred},
+	}, nil
+}
+
+// filter keeps the type of the list, e.g. an []int64 is filtered into an []int64
+func filter(ctx *Ctx, coll Value, pred *lambda) (Value, error) {
+	res := make([]interface{}, 0)
+	err := eachMatched(ctx, string(keywordFilter), coll, pred, func(_ int, elem Value) error {
+		res = append(res, elem)
+		return nil
+	})
+	if err != nil {
+		return interrupted(ctx, filterResult(coll, res), err)
+	}
+	return filterResult(coll, res), nil
+}
+
+// streamFilter yields the matched elements of filter one by one
+func streamFilter(ctx *Ctx, params []Value, lambdas []*lambda, yield func(Value) error) error {
+	return eachMatched(ctx, string(keywordFilter), params[0], lambdas[0], func(_ int, elem Value) error {
+		return yield(elem)
+	})
+}
+
+// filterResult converts the matched elements to the list type of the coll
+func filterResult(coll Value, res []interface{}) Value {
+	switch coll.(type) {
+	case []int64:
+		ints := make([]int64, len(res))
+		for i, v := range res {
+			ints[i] = v.(int64)
+		}
+		return ints
+	case []string:
+		strs := make([]string, len(res))
+		for i, v := range res {
+			strs[i] = v.(string)
+		}
+		return strs
+	}
+	return res
+}
+
+func evalPredicate(op string, body *Expr, ctx *Ctx, idx int) (bool, error) {
+	v, err := body.Eval(ctx)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, OpExecError(op,
+			fmt.Errorf("predicate returns a non bool result: [%v] at index %d", v, idx))
+	}
+	return b, nil
+}
+
+// Observer observes the values passed through the `tap` keyword, such as logging or metrics
+type Observer func(ctx *Ctx, val Value)
+
+// buildTapNode builds `(tap val observerName)`, it calls the observer registered
+// in Config.Observers with the val, and returns the val unchanged.
+func (p *parser) buildTapNode(car token, children []*astNode) (*astNode, error) {
+	if len(children) != 2 {
+		return nil, p.paramsCountErr(2, len(children), car)
+	}
+
+	n := children[1].node
+	name, ok := n.value.(string)
+	if n.getNodeType() != constant || !ok {
+		return nil, p.errWithToken(ErrKindInvalidParam, fmt.Errorf("%s observer name should be a string literal", car.val), car)
+	}
+	observer, exist := p.conf.Observers[name]
+	if !exist || observer == nil {
+		return nil, p.errWithToken(ErrKindUnknownToken, fmt.Errorf("unknown observer [%s]", name), car)
+	}
+
+	return &astNode{
+		node: &node{
+			flag:  operator,
+			value: car.val,
+			operator: func(ctx *Ctx, params []Value) (Value, error) {
+				observer(ctx, params[0])
+				return params[0], nil
+			},
+		},
+		children: children[:1],
+	}, nil
+}
+
+// buildInterpNode builds `(interp template)`, it returns the template with the `{name}` placeholders
+// replaced by the values of the variables, e.g. `(interp "Hello {name}")`. The `{{` and `}}` are
+// the escaped braces. The template should be a string literal, and the placeholders are resolved
+// at compile time, so the variables are fetched like the other ones referenced by the expression.
+func (p *parser) buildInterpNode(car token, children []*astNode) (*astNode, error) {
+	if len(children) != 1 {
+		return nil, p.paramsCountErr(1, len(children), car)
+	}
+
+	n := children[0].node
+	tmpl, ok := n.value.(string)
+	if n.getNodeType() != constant || !ok {
+		return nil, p.errWithToken(ErrKindInvalidParam, fmt.Errorf("%s template should be a string literal", car.val), car)
+	}
+	parts, names, err := parseTemplate(tmpl)
+	if err != nil {
+		return nil, p.errWithToken(ErrKindInvalidParam, fmt.Errorf("%s template error: %w", car.val, err), car)
+	}
+
+	// the values of the placeholders are the params after the template
+	for _, name := range names {
+		v, ok := p.placeholderVar(name)
+		if !ok {
+			return nil, p.errWithToken(ErrKindUnknownToken, fmt.Errorf("unknown placeholder {%s} in %s template", name, car.val), car)
+		}
+		children = append(children, v)
+	}
+
+	return &astNode{
+		node: &node{
+			flag:  operator,
+			value: car.val,
+			operator: func(_ *Ctx, params []Value) (Value, error) {
+				var sb strings.Builder
+				sb.WriteString(parts[0])
+				for i, v := range params[1:] {
+					sb.WriteString(formatValue(v))
+					sb.WriteString(parts[i+1])
+				}
+				return sb.String(), nil
+			},
+		},
+		children: children,
+	}, nil
+}
+
+// placeholderVar resolves the placeholder name to a local variable or a selector,
+// the unknown names are resolved to undefined variables if AllowUndefinedVariable is enabled
+func (p *parser) placeholderVar(name string) (*astNode, bool) {
+	for i := len(p.locals) - 1; i >= 0; i-- {
+		if p.locals[i] == name {
+			return &astNode{node: &node{flag: variable, value: name, varKey: localVarKey}}, true
+		}
+	}
+	key, ok := p.conf.VariableKeyMap[name]
+	if !ok {
+		if !p.allowUndefinedVariable() {
+			return nil, false
+		}
+		key = UndefinedVarKey
+	}
+	p.useSelector(name)
+	return &astNode{node: &node{flag: variable, value: name, varKey: key}}, true
+}
+
+// parseTemplate splits the template into the literal parts and the placeholder names in between,
+// so there is always one more part than the names
+func parseTemplate(tmpl string) (parts []string, names []string, err error) {
+	var sb strings.Builder
+	for i := 0; i < len(tmpl); i++ {
+		c := tmpl[i]
+		switch {
+		case (c == '{' || c == '}') && i+1 < len(tmpl) && tmpl[i+1] == c:
+			// escaped brace
+			sb.WriteByte(c)
+			i++
+		case c == '{':
+			end := strings.IndexByte(tmpl[i+1:], '}')
+			if end == -1 {
+				return nil, nil, fmt.Errorf("unclosed placeholder at %d", i)
+			}
+			name := tmpl[i+1 : i+1+end]
+			if name == "" || strings.ContainsAny(name, "{ \t\n") {
+				return nil, nil, fmt.Errorf("invalid placeholder {%s} at %d", name, i)
+			}
+			parts, names = append(parts, sb.String()), append(names, name)
+			sb.Reset()
+			i += end + 1
+		case c == '}':
+			return nil, nil, fmt.Errorf("unmatched } at %d", i)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return append(parts, sb.String()), names, nil
+}
+
+// formatValue formats the value of the placeholder, nil is formatted as an empty string
+func formatValue(v Value) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(x)
+	}
+	return fmt.Sprint(v)
+}
+
+// buildIterateNode builds `(iterate init step cond maxSteps)`, the accumulator starts
+// with init, and is replaced by the result of step while cond holds, at most maxSteps times.
+// The accumulator is bound to `acc` in both step and cond, the final accumulator is returned.
+func (p *parser) buildIterateNode(car token, children []*astNode) (*astNode, error) {
+	if len(children) != 4 {
+		return nil, p.paramsCountErr(4, len(children), car)
+	}
+
+	step, err := p.compileLambda(children[1], accVar)
+	if err != nil {
+		return nil, err
+	}
+	cond, err := p.compileLambda(children[2], accVar)
+	if err != nil {
+		return nil, err
+	}
+
+	return &astNode{
+		node: &node{
+			flag:  operator,
+			value: car.val,
+			operator: func(ctx *Ctx, params []Value) (Value, error) {
+				return iterate(ctx, params[0], params[1], step, cond)
+			},
+		},
+		children: []*astNode{children[0], children[3]},
+		lambdas:  []*lambda{step, cond},
+	}, nil
+}
+
+func iterate(ctx *Ctx, init, maxSteps Value, step, cond *lambda) (Value, error) {
+	const op = "iterate"
+	n, ok := maxSteps.(int64)
+	if !ok {
+		return nil, ParamTypeError(op, typeInt, maxSteps)
+	}
+	if n < 0 {
+		return nil, OpExecError(op, fmt.Errorf("maxSteps should not be negative: [%d]", n))
+	}
+
+	stepCtx, stepScope := step.bind(ctx)
+	condCtx, condScope := cond.bind(ctx)
+
+	acc := init
+	for i := 0; int64(i) < n; i++ {
+		if err := cancelled(ctx); err != nil {
+			return nil, err
+		}
+		condScope.vals[0] = acc
+		ok, err := evalPredicate(op, cond.body, condCtx, i)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+
+		stepScope.vals[0] = acc
+		acc, err = step.body.Eval(stepCtx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return acc, nil
+}
+
+// buildMapIfNode builds `(map_if coll predicate transform)`, it returns a new list
+// in which the elements that match the predicate are replaced by the results of the transform,
+// the current element is bound to `x` in both the predicate and the transform.
+func (p *parser) buildMapIfNode(car token, children []*astNode) (*astNode, error) {
+	if len(children) != 3 {
+		return nil, p.paramsCountErr(3, len(children), car)
+	}
+
+	pred, err := p.compileLambda(children[1], elemVar)
+	if err != nil {
+		return nil, err
+	}
+	transform, err := p.compileLambda(children[2], elemVar)
+	if err != nil {
+		return nil, err
+	}
+
+	return &astNode{
+		node: &node{
+			flag:  operator,
+			value: car.val,
+			operator: func(ctx *Ctx, params []Value) (Value, error) {
+				return mapIf(ctx, params[0], pred, transform)
+			},
+		},
+		children: children[:1],
+		lambdas:  []*lambda{pred, transform},
+	}, nil
+}
+
+// mapIf keeps the type of the list, the results of the transform should be of the
+// element type of the list, e.g. int64 for an []int64, while a []interface{} accepts any results.
+func mapIf(ctx *Ctx, coll Value, pred, transform *lambda) (Value, error) {
+	const op = "map_if"
+	elems, ok := listElems(coll)
+	if !ok {
+		return nil, ParamTypeError(op, typeList, coll)
+	}
+
+	predCtx, predScope := pred.bind(ctx)
+	transformCtx, transformScope := transform.bind(ctx)
+
+	res := make([]interface{}, len(elems))
+	for i, elem := range elems {
+		elem = unifyType(elem)
+		if err := cancelled(ctx); err != nil {
+			return interruptedMapIf(ctx, coll, res[:i], err)
+		}
+		predScope.vals[0] = elem
+		matched, err := evalPredicate(op, pred.body, predCtx, i)
+		if err != nil {
+			return interruptedMapIf(ctx, coll, res[:i], err)
+		}
+		if !matched {
+			res[i] = elem
+			continue
+		}
+
+		transformScope.vals[0] = elem
+		v, err := transform.body.Eval(transformCtx)
+		if err != nil {
+			return interruptedMapIf(ctx, coll, res[:i], err)
+		}
+		res[i] = v
+	}
+	return mapIfResult(coll, res)
+}
+
+func interruptedMapIf(ctx *Ctx, coll Value, res []interface{}, err error) (Value, error) {
+	if v, e := mapIfResult(coll, res); e == nil {
+		return interrupted(ctx, v, err)
+	}
+	return nil, err
+}
+
+// mapIfResult converts the results to the list type of the coll
+func mapIfResult(coll Value, res []interface{}) (Value, error) {
+	const op = "map_if"
+	var ok bool
+	switch coll.(type) {
+	case []int64:
+		ints := make([]int64, len(res))
+		for i, v := range res {
+			if ints[i], ok = v.(int64); !ok {
+				return nil, OpExecError(op,
+					fmt.Errorf("transform returns a non int64 result: [%v] at index %d", v, i))
+			}
+		}
+		return ints, nil
+	case []string:
+		strs := make([]string, len(res))
+		for i, v := range res {
+			if strs[i], ok = v.(string); !ok {
+				return nil, OpExecError(op,
+					fmt.Errorf("transform returns a non string result: [%v] at index %d", v, i))
+			}
+		}
+		return strs, nil
+	}
+	return res, nil
+}
+
+// buildMapNode builds `(map coll transform)`, it returns a new list of the results
+// of the transform, the current element is bound to `x` in the transform.
+func (p *parser) buildMapNode(car token, children []*astNode) (*astNode, error) {
+	if len(children) != 2 {
+		return nil, p.paramsCountErr(2, len(children), car)
+	}
+
+	transform, err := p.compileLambda(children[1], elemVar)
+	if err != nil {
+		return nil, err
+	}
+
+	// the results of the transforms may be nested lists, e.g. the results of nested maps
+	agg := aggregate{maxDepth: p.conf.MaxOutputDepth}
+	return &astNode{
+		node: &node{
+			flag:  operator,
+			value: car.val,
+			operator: func(ctx *Ctx, params []Value) (Value, error) {
+				res, err := mapList(ctx, params[0], transform)
+				if err != nil {
+					return res, err
+				}
+				if err = agg.checkDepth(car.val, res); err != nil {
+					return nil, err
+				}
+				return res, nil
+			},
+		},
+		children: children[:1],
+		lambdas:  []*lambda{transform},
+	}, nil
+}
+
+func mapList(ctx *Ctx, coll Value, transform *lambda) (Value, error) {
+	res := make([]interface{}, 0)
+	err := eachMapped(ctx, coll, transform, func(v Value) error {
+		res = append(res, v)
+		return nil
+	})
+	if err != nil {
+		return interrupted(ctx, mapResult(coll, res), err)
+	}
+	return mapResult(coll, res), nil
+}
+
+// streamMap yields the results of the transform one by one
+func streamMap(ctx *Ctx, params []Value, lambdas []*lambda, yield func(Value) error) error {
+	return eachMapped(ctx, params[0], lambdas[0], yield)
+}
+
+// eachMapped calls fn with the result of the transform of each element
+func eachMapped(ctx *Ctx, coll Value, transform *lambda, fn func(Value) error) error {
+	const op = "map"
+	elems, ok := listElems(coll)
+	if !ok {
+		return ParamTypeError(op, typeList, coll)
+	}
+
+	lctx, s := transform.bind(ctx)
+	for _, elem := range elems {
+		elem = unifyType(elem)
+		if err := cancelled(ctx); err != nil {
+			return err
+		}
+		s.vals[0] = elem
+		v, err := transform.body.Eval(lctx)
+		if err != nil {
+			return err
+		}
+		if err = fn(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mapResult converts the results to an []int64 or a []string if they're all of the type,
+// otherwise they're kept in an []interface{}. The empty results keep the list type of the coll.
+func mapResult(coll Value, res []interface{}) Value {
+	if len(res) == 0 {
+		switch coll.(type) {
+		case []int64:
+			return []int64{}
+		case []string:
+			return []string{}
+		}
+		return res
+	}
+
+	switch res[0].(type) {
+	case int64:
+		ints := make([]int64, len(res))
+		for i, v := range res {
+			n, ok := v.(int64)
+			if !ok {
+				return res
+			}
+			ints[i] = n
+		}
+		return ints
+	case string:
+		strs := make([]string, len(res))
+		for i, v := range res {
+			str, ok := v.(string)
+			if !ok {
+				return res
+			}
+			strs[i] = str
+		}
+		return strs
+	}
+	return res
+}
+
+// buildReduceNode builds `(reduce coll init body)`, the accumulator starts with init, and is
+// replaced by the result of the body for each element in order, the final accumulator is returned.
+// The accumulator is bound to `acc` and the current element is bound to `x` in the body.
+func (p *parser) buildReduceNode(car token, children []*astNode) (*astNode, error) {
+	if len(children) != 3 {
+		return nil, p.paramsCountErr(3, len(children), car)
+	}
+
+	body, err := p.compileLambda(children[2], accVar, elemVar)
+	if err != nil {
+		return nil, err
+	}
+
+	return &astNode{
+		node: &node{
+			flag:  operator,
+			value: car.val,
+			operator: func(ctx *Ctx, params []Value) (Value, error) {
+				return reduce(ctx, params[0], params[1], body)
+			},
+		},
+		children: children[:2],
+		lambdas:  []*lambda{body},
+	}, nil
+}
+
+// reduce requires the body to return the values of the same type as the accumulator,
+// e.g. an int64 accumulator can't be replaced by a float64
+func reduce(ctx *Ctx, coll, acc Value, body *lambda) (Value, error) {
+	const op = "reduce"
+	elems, ok := listElems(coll)
+	if !ok {
+		return nil, ParamTypeError(op, typeList, coll)
+	}
+
+	lctx, s := body.bind(ctx)
+	for i, elem := range elems {
+		elem = unifyType(elem)
+		if err := cancelled(ctx); err != nil {
+			return interrupted(ctx, acc, err)
+		}
+		s.vals[0], s.vals[1] = acc, elem
+		v, err := body.body.Eval(lctx)
+		if err != nil {
+			return interrupted(ctx, acc, err)
+		}
+		if acc != nil && reflect.TypeOf(v) != reflect.TypeOf(acc) {
+			return nil, OpExecError(op,
+				fmt.Errorf("body returns a %T result, but the accumulator is %T: [%v] at index %d", v, acc, v, i))
+		}
+		acc = v
+	}
+	return acc, nil
+}
+
+// buildSortByNode builds `(sort_by coll key)` and `(sort_by_desc coll key)`, they return a new list
+// sorted by the keys of the elements, the current element is bound to `x` in the key.
+// The sort is stable, the elements with equal keys keep their order.
+// The keys should be all numbers or all strings, otherwise it's an error.
+func (p *parser) buildSortByNode(car token, children []*astNode) (*astNode, error) {
+	if len(children) != 2 {
+		return nil, p.paramsCountErr(2, len(children), car)
+	}
+
+	key, err := p.compileLambda(children[1], elemVar)
+	if err != nil {
+		return nil, err
+	}
+
+	kw, _ := keywordOf(p.conf, car.val)
+	op, desc := car.val, kw == keywordSortByDesc
+	return &astNode{
+		node: &node{
+			flag:  operator,
+			value: car.val,
+			operator: func(ctx *Ctx, params []Value) (Value, error) {
+				return sortBy(ctx, op, params[0], key, desc)
+			},
+		},
+		children: children[:1],
+		lambdas:  []*lambda{key},
+	}, nil
+}
+
+func sortBy(ctx *Ctx, op string, coll Value, key *lambda, desc bool) (Value, error) {
+	elems, ok := listElems(coll)
+	if !ok {
+		return nil, ParamTypeError(op, typeList, coll)
+	}
+
+	lctx, s := key.bind(ctx)
+	keys := make([]Value, len(elems))
+	for i, elem := range elems {
+		elem = unifyType(elem)
+		if err := cancelled(ctx); err != nil {
+			return nil, err
+		}
+		s.vals[0] = elem
+		k, err := key.body.Eval(lctx)
+		if err != nil {
+			return nil, err
+		}
+		switch k.(type) {
+		case int64, float64, string:
+		default:
+			return nil, OpExecError(op,
+				fmt.Errorf("key should be a number or a string, got: [%v] at index %d", k, i))
+		}
+		if _, isStr := k.(string); i > 0 && isStr != isStrKey(keys[0]) {
+			return nil, OpExecError(op,
+				fmt.Errorf("incomparable keys: [%v] at index 0 and [%v] at index %d", keys[0], k, i))
+		}
+		keys[i] = k
+	}
+
+	idx := make([]int, len(elems))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		if desc {
+			return keyLess(keys[idx[j]], keys[idx[i]])
+		}
+		return keyLess(keys[idx[i]], keys[idx[j]])
+	})
+
+	switch l := coll.(type) {
+	case []int64:
+		res := make([]int64, len(l))
+		for i, j := range idx {
+			res[i] = l[j]
+		}
+		return res, nil
+	case []string:
+		res := make([]string, len(l))
+		for i, j := range idx {
+			res[i] = l[j]
+		}
+		return res, nil
+	}
+	res := make([]interface{}, len(elems))
+	for i, j := range idx {
+		res[i] = elems[j]
+	}
+	return res, nil
+}
+
+func isStrKey(k Value) bool {
+	_, ok := k.(string)
+	return ok
+}
+
+// keyLess compares two keys of sort_by, which are both numbers or both strings
+func keyLess(a, b Value) bool {
+	if s, ok := a.(string); ok {
+		return s < b.(string)
+	}
+	return keyFloat(a) < keyFloat(b)
+}
+
+func keyFloat(k Value) float64 {
+	if i, ok := k.(int64); ok {
+		return float64(i)
+	}
+	return k.(float64)
+}
+
+// cancelCheckInterval is the number of the iterations between the cancellation checks
+// of the cheap loops, e.g. the streaming range, which is not worth checking every iteration
+const cancelCheckInterval = 1024
+
+// cancelled returns an error wrapping the error of Ctx.Ctx if it's done,
+// the loop keywords check it before each iteration.
+func cancelled(ctx *Ctx) error {
+	if ctx == nil || ctx.Ctx == nil {
+		return nil
+	}
+	if err := ctx.Ctx.Err(); err != nil {
+		return fmt.Errorf("evaluation cancelled: %w", err)
+	}
+	return nil
+}
+
+// interrupted returns the partial result with the err if the err is caused by
+// the cancellation of Ctx.Ctx and Ctx.PartialResults is enabled, otherwise it returns nil with the err
+func interrupted(ctx *Ctx, partial Value, err error) (Value, error) {
+	if ctx == nil || !ctx.PartialResults || ctx.Ctx == nil {
+		return nil, err
+	}
+	if cause := ctx.Ctx.Err(); cause == nil || !errors.Is(err, cause) {
+		return nil, err
+	}
+	return partial, err
+}
@@ -0,0 +1,943 @@
+package eval
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestKeywords(t *testing.T) {
+	testCases := []struct {
+		expr   string
+		vals   map[string]interface{}
+		cc     *Config
+		want   Value
+		errMsg string
+	}{
+		// map
+		{
+			expr: `(map scores (+ x 10))`,
+			vals: map[string]interface{}{
+				"scores": []int{55, 70, 40},
+			},
+			want: []int64{65, 80, 50},
+		},
+		{
+			// the result type follows the results of the transform
+			expr: `(map scores (if (< x 60) "fail" "pass"))`,
+			vals: map[string]interface{}{
+				"scores": []int{55, 70},
+			},
+			want: []string{"fail", "pass"},
+		},
+		{
+			expr: `(map ("a" "bb") (= x "a"))`,
+			want: []interface{}{true, false},
+		},
+		{
+			expr: `(map items x.name)`,
+			vals: map[string]interface{}{
+				"items": []interface{}{
+					map[string]interface{}{"name": "a"},
+					map[string]interface{}{"name": "b"},
+				},
+			},
+			want: []string{"a", "b"},
+		},
+		{
+			// mixed results
+			expr: `(map (1 2) (if (= x 1) x "two"))`,
+			want: []interface{}{int64(1), "two"},
+		},
+		{
+			expr: `(map scores (* x 2))`,
+			vals: map[string]interface{}{
+				"scores": []int{},
+			},
+			want: []int64{},
+		},
+		{
+			expr: `(map (map (1 2) (* x 10)) (+ x 1))`,
+			want: []int64{11, 21},
+		},
+		{
+			expr: `(map score (* x 2))`,
+			vals: map[string]interface{}{
+				"score": 1,
+			},
+			errMsg: "unexpected param type, operator: map, expected: list, got: 1",
+		},
+		{
+			expr:   `(map (1 0) (/ 1 x))`,
+			errMsg: "divide by zero",
+		},
+		{
+			expr:   `(map (1 2))`,
+			errMsg: "map parameters count error",
+		},
+
+		// map_if
+		{
+			// some elements are transformed
+			expr: `(map_if scores (< x 60) (+ x 10))`,
+			vals: map[string]interface{}{
+				"scores": []int{55, 70, 40},
+			},
+			want: []int64{65, 70, 50},
+		},
+		{
+			// all elements are transformed
+			expr: `(map_if names true (if (= x "bob") "Bob" "Alice"))`,
+			vals: map[string]interface{}{
+				"names": []string{"bob", "alice"},
+			},
+			want: []string{"Bob", "Alice"},
+		},
+		{
+			// no elements are transformed
+			expr: `(map_if scores (> x 100) 100)`,
+			vals: map[string]interface{}{
+				"scores": []int{55, 70},
+			},
+			want: []int64{55, 70},
+		},
+		{
+			expr: `(map_if items (= x "a") true)`,
+			vals: map[string]interface{}{
+				"items": []interface{}{1, "a"},
+			},
+			want: []interface{}{int64(1), true},
+		},
+		{
+			expr: `(map_if () true x)`,
+			cc:   NewConfig(EnableEmptyList),
+			want: []string{},
+		},
+		{
+			expr: `(map_if scores (> x 60) "pass")`,
+			vals: map[string]interface{}{
+				"scores": []int{55, 70},
+			},
+			errMsg: "transform returns a non int64 result: [pass] at index 1",
+		},
+		{
+			expr: `(map_if scores x x)`,
+			vals: map[string]interface{}{
+				"scores": []int{55},
+			},
+			errMsg: "predicate returns a non bool result: [55] at index 0",
+		},
+		{
+			expr:   `(map_if ("a") true)`,
+			errMsg: "map_if parameters count error",
+		},
+
+		// sort_by, sort_by_desc
+		{
+			// the dicts decoded from JSON, the numbers are float64
+			expr: `(sort_by items x.price)`,
+			vals: map[string]interface{}{
+				"items": []interface{}{
+					map[string]interface{}{"name": "b", "price": 30.0},
+					map[string]interface{}{"name": "a", "price": 9.5},
+					map[string]interface{}{"name": "c", "price": 30.0},
+				},
+			},
+			want: []interface{}{
+				map[string]interface{}{"name": "a", "price": 9.5},
+				map[string]interface{}{"name": "b", "price": 30.0},
+				map[string]interface{}{"name": "c", "price": 30.0},
+			},
+		},
+		{
+			// the sort is stable in descending order too
+			expr: `(sort_by_desc items x.price)`,
+			vals: map[string]interface{}{
+				"items": []interface{}{
+					map[string]interface{}{"name": "b", "price": 30.0},
+					map[string]interface{}{"name": "a", "price": int64(9)},
+					map[string]interface{}{"name": "c", "price": 30.0},
+				},
+			},
+			want: []interface{}{
+				map[string]interface{}{"name": "b", "price": 30.0},
+				map[string]interface{}{"name": "c", "price": 30.0},
+				map[string]interface{}{"name": "a", "price": int64(9)},
+			},
+		},
+		{
+			expr: `(sort_by scores (- 0 x))`,
+			vals: map[string]interface{}{
+				"scores": []int{55, 70, 40},
+			},
+			want: []int64{70, 55, 40},
+		},
+		{
+			expr:   `(sort_by ("bb" "a" "ccc") (if (= x "ccc") true x))`,
+			errMsg: "key should be a number or a string, got: [true] at index 2",
+		},
+		{
+			expr: `(sort_by ("bb" "a" "ccc") x)`,
+			want: []string{"a", "bb", "ccc"},
+		},
+		{
+			expr:   `(sort_by items x)`,
+			vals:   map[string]interface{}{"items": []interface{}{1, "a"}},
+			errMsg: "incomparable keys: [1] at index 0 and [a] at index 1",
+		},
+		{
+			expr:   `(sort_by (1 2) (= x 1))`,
+			errMsg: "key should be a number or a string, got: [true] at index 0",
+		},
+		{
+			expr: `(sort_by () x)`,
+			cc:   NewConfig(EnableEmptyList),
+			want: []string{},
+		},
+		{
+			expr:   `(sort_by (1 2))`,
+			errMsg: "sort_by parameters count error",
+		},
+
+		// any, all
+		{
+			expr: `(any items (> x 10))`,
+			vals: map[string]interface{}{
+				"items": []int{3, 12, 5},
+			},
+			want: true,
+		},
+		{
+			expr: `(any items (> x 10))`,
+			vals: map[string]interface{}{
+				"items": []int{3, 5},
+			},
+			want: false,
+		},
+		{
+			expr: `(all items (> x 2))`,
+			vals: map[string]interface{}{
+				"items": []int{3, 12, 5},
+			},
+			want: true,
+		},
+		{
+			expr: `(all ("a" "bb") (= x "a"))`,
+			want: false,
+		},
+		{
+			expr: `(any () (> x 10))`,
+			cc:   NewConfig(EnableEmptyList),
+			want: false,
+		},
+		{
+			expr: `(all () (> x 10))`,
+			cc:   NewConfig(EnableEmptyList),
+			want: true,
+		},
+		{
+			// short circuits at the first matched element, the division by zero is not evaluated
+			expr: `(any (5 0) (> (/ 10 x) 1))`,
+			want: true,
+		},
+		{
+			expr: `(all (20 0) (> (/ 10 x) 1))`,
+			want: false,
+		},
+		{
+			expr:   `(all (5 0) (> (/ 10 x) 1))`,
+			errMsg: "divide by zero",
+		},
+		{
+			expr:   `(any (1 2) x)`,
+			errMsg: "predicate returns a non bool result: [1] at index 0",
+		},
+		{
+			expr:   `(all 1 (> x 10))`,
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			expr:   `(any (1 2))`,
+			errMsg: "any parameters count error",
+		},
+
+		// filter
+		{
+			expr: `(filter scores (>= x 60))`,
+			vals: map[string]interface{}{
+				"scores": []int{55, 70, 40, 90},
+			},
+			want: []int64{70, 90},
+		},
+		{
+			expr: `(filter users (>= x.age 18))`,
+			vals: map[string]interface{}{
+				"users": []interface{}{
+					map[string]interface{}{"name": "a", "age": int64(20)},
+					map[string]interface{}{"name": "b", "age": int64(12)},
+					map[string]interface{}{"name": "c", "age": int64(18)},
+				},
+			},
+			want: []interface{}{
+				map[string]interface{}{"name": "a", "age": int64(20)},
+				map[string]interface{}{"name": "c", "age": int64(18)},
+			},
+		},
+		{
+			expr: `(filter ("a" "bb" "a") (= x "a"))`,
+			want: []string{"a", "a"},
+		},
+		{
+			// empty result
+			expr: `(filter scores (> x 100))`,
+			vals: map[string]interface{}{
+				"scores": []int{55, 70},
+			},
+			want: []int64{},
+		},
+		{
+			// empty input
+			expr: `(filter items (> x 1))`,
+			vals: map[string]interface{}{
+				"items": []interface{}{},
+			},
+			want: []interface{}{},
+		},
+		{
+			expr:   `(filter (1 2 3) (if (< x 2) true x))`,
+			errMsg: "operator: filter, error: predicate returns a non bool result: [2] at index 1",
+		},
+		{
+			expr:   `(filter "a" (> x 1))`,
+			errMsg: "unexpected param type, operator: filter, expected: list, got: a",
+		},
+		{
+			expr:   `(filter (1 2))`,
+			errMsg: "filter parameters count error",
+		},
+
+		// reduce
+		{
+			expr: `(reduce nums 0 (+ acc x))`,
+			vals: map[string]interface{}{
+				"nums": []int{1, 2, 3, 4},
+			},
+			want: int64(10),
+		},
+		{
+			// float accumulator
+			expr: `(reduce rates base (apply_pct acc x))`,
+			vals: map[string]interface{}{
+				"base":  100.0,
+				"rates": []int{10, -50},
+			},
+			want: 55.0,
+		},
+		{
+			// the init is returned for an empty list
+			expr: `(reduce nums 1 (* acc x))`,
+			vals: map[string]interface{}{
+				"nums": []int{},
+			},
+			want: int64(1),
+		},
+		{
+			expr: `(reduce (1 2 3) true (and acc (> x 0)))`,
+			want: true,
+		},
+		{
+			expr: `(reduce (1 5 3) 0 (if (> x acc) x acc))`,
+			want: int64(5),
+		},
+		{
+			expr:   `(reduce (1 2) 0 (apply_pct acc x))`,
+			errMsg: "operator: reduce, error: body returns a float64 result, but the accumulator is int64: [0] at index 0",
+		},
+		{
+			expr:   `(reduce 1 0 (+ acc x))`,
+			errMsg: "unexpected param type, operator: reduce, expected: list, got: 1",
+		},
+		{
+			expr:   `(reduce (1 2) 0)`,
+			errMsg: "reduce parameters count error",
+		},
+
+		// interp
+		{
+			expr: `(interp "Hello {name}, you have {count} items")`,
+			vals: map[string]interface{}{
+				"name":  "Bob",
+				"count": 3,
+			},
+			want: "Hello Bob, you have 3 items",
+		},
+		{
+			expr: `(interp "{a}{b}: {a} {c} {d}")`,
+			vals: map[string]interface{}{
+				"a": true,
+				"b": 2.5,
+				"c": []int{1, 2},
+				"d": nil,
+			},
+			want: "true2.5: true [1 2] ",
+		},
+		{
+			expr: `(interp "{{name}} is {name}, {{}}")`,
+			vals: map[string]interface{}{
+				"name": "Bob",
+			},
+			want: "{name} is Bob, {}",
+		},
+		{
+			expr: `(interp "no placeholders")`,
+			want: "no placeholders",
+		},
+		{
+			// local variables
+			expr: `(map (1 2) (interp "#{x}"))`,
+			want: []string{"#1", "#2"},
+		},
+		{
+			expr:   `(interp "Hello {nickname}")`,
+			errMsg: "unknown placeholder {nickname} in interp template",
+		},
+		{
+			expr:   `(interp "Hello {name")`,
+			errMsg: "interp template error: unclosed placeholder at 6",
+		},
+		{
+			expr:   `(interp "Hello name}")`,
+			errMsg: "interp template error: unmatched } at 10",
+		},
+		{
+			expr:   `(interp "Hello {}")`,
+			errMsg: "interp template error: invalid placeholder {} at 6",
+		},
+		{
+			expr: `(interp name)`,
+			vals: map[string]interface{}{
+				"name": "Bob",
+			},
+			errMsg: "interp template should be a string literal",
+		},
+		{
+			expr:   `(interp "a" "b")`,
+			errMsg: "interp parameters count error",
+		},
+
+		// let
+		{
+			expr: `(let (x (+ 1 2)) (* x x))`,
+			want: int64(9),
+		},
+		{
+			// the later values see the previous bindings
+			expr: `(let (a 2 b (* a 3)) (+ a b))`,
+			want: int64(8),
+		},
+		{
+			// the bindings shadow the selectors, but don't leak outside the body
+			expr: `(+ (let (age 1) age) age)`,
+			vals: map[string]interface{}{"age": 20},
+			want: int64(21),
+		},
+		{
+			// nested let, and the rebound names shadow the earlier ones
+			expr: `(let (a 2 b (* a 3)) (let (a 10 a (+ a 1)) (+ a b)))`,
+			want: int64(17),
+		},
+		{
+			expr: `(let (limit (* age 2)) (find_all scores (> x limit)))`,
+			vals: map[string]interface{}{
+				"age":    30,
+				"scores": []int{55, 70},
+			},
+			want: []interface{}{[]interface{}{int64(1), int64(70)}},
+		},
+		{
+			expr:   `(let (a 1 b) a)`,
+			errMsg: "let bindings should be pairs of name and value, got an odd number of elements",
+		},
+		{
+			expr:   `(let () 1)`,
+			errMsg: "let requires at least one binding",
+		},
+		{
+			expr:   `(let (a 1))`,
+			errMsg: "let requires a body",
+		},
+		{
+			expr:   `(let (1 2) 3)`,
+			errMsg: "token type unexpected error (want: ident, got: integer)",
+		},
+		{
+			expr:   `(let (a 1) a a)`,
+			errMsg: "token type unexpected error (want: rParen, got: ident)",
+		},
+		{
+			expr:   `(let (a (/ 1 0)) a)`,
+			errMsg: "divide by zero",
+		},
+
+		// cond
+		{
+			expr: `(cond ((< age 13) "child") ((< age 20) "teen") (else "adult"))`,
+			vals: map[string]interface{}{"age": 15},
+			want: "teen",
+		},
+		{
+			expr: `(cond ((< age 13) "child") ((< age 20) "teen") (else "adult"))`,
+			vals: map[string]interface{}{"age": 30},
+			want: "adult",
+		},
+		{
+			// the first matched clause wins
+			expr: `(cond ((> age 10) 1) ((> age 20) 2))`,
+			vals: map[string]interface{}{"age": 30},
+			want: int64(1),
+		},
+		{
+			// the unmatched cond without else returns nil
+			expr: `(cond ((< age 13) "child") ((< age 20) "teen"))`,
+			vals: map[string]interface{}{"age": 30},
+			want: nil,
+		},
+		{
+			// the tests after the matched one are not evaluated
+			expr: `(cond (true 1) ((/ 1 0) 2))`,
+			want: int64(1),
+		},
+		{
+			expr: `(+ (cond (false 1) (else (cond ((= 1 1) 2)))) 1)`,
+			want: int64(3),
+		},
+		{
+			expr:   `(cond ((< 1 13) "child"))`,
+			cc:     NewConfig(EnableCondRequiresElse),
+			errMsg: "cond requires an else clause",
+		},
+		{
+			expr:   `(cond (else 1))`,
+			errMsg: "cond requires at least one clause",
+		},
+		{
+			expr:   `(cond (else 1) (true 2))`,
+			errMsg: "cond else clause should be the last one",
+		},
+		{
+			expr:   `(cond (true))`,
+			errMsg: "cond clauses should be pairs of test and result",
+		},
+		{
+			expr:   `(cond true 1)`,
+			errMsg: "token type unexpected error (want: lParen, got: bool)",
+		},
+		{
+			expr:   `(cond (1 2))`,
+			errMsg: "condition node returns a non bool result: [1]",
+		},
+
+		// find_all
+		{
+			expr: `(find_all items (= x "a"))`,
+			vals: map[string]interface{}{
+				"items": []interface{}{1, "a", true, "a", "b"},
+			},
+			want: []interface{}{
+				[]interface{}{int64(1), "a"},
+				[]interface{}{int64(3), "a"},
+			},
+		},
+		{
+			expr: `(find_all items (> x 2))`,
+			vals: map[string]interface{}{
+				"items": []int{1, 3, 2, 5},
+			},
+			want: []interface{}{
+				[]interface{}{int64(1), int64(3)},
+				[]interface{}{int64(3), int64(5)},
+			},
+		},
+		{
+			expr: `(find_all ("a" "b") (= x "c"))`,
+			want: []interface{}{},
+		},
+		{
+			// the element variable shadows the variable with the same name
+			expr: `(find_all (1 2 3) (= x 3))`,
+			vals: map[string]interface{}{
+				"x": 2,
+			},
+			want: []interface{}{
+				[]interface{}{int64(2), int64(3)},
+			},
+		},
+		{
+			// the element variable is only visible in the predicate
+			expr:   `(find_all x (= x 3))`,
+			errMsg: "unknown token error",
+		},
+		{
+			expr:   `(find_all (1 2 3))`,
+			errMsg: "find_all parameters count error",
+		},
+		{
+			expr:   `(find_all (1 2 3) (+ x 1))`,
+			errMsg: "predicate returns a non bool result: [2] at index 0",
+		},
+		{
+			expr: `(find_all items (= x 1))`,
+			vals: map[string]interface{}{
+				"items": 1,
+			},
+			errMsg: paramTypeErrMsg,
+		},
+
+		// iterate
+		{
+			// converges before maxSteps: the smallest power of 2 not less than n
+			expr: `(iterate 1 (* acc 2) (< acc n) 100)`,
+			vals: map[string]interface{}{
+				"n": 100,
+			},
+			want: int64(128),
+		},
+		{
+			// stops at maxSteps
+			expr: `(iterate 0 (+ acc 1) (< acc 1000) 10)`,
+			want: int64(10),
+		},
+		{
+			expr: `(iterate 5 (+ acc 1) false 10)`,
+			want: int64(5),
+		},
+		{
+			expr: `(iterate 5 (+ acc 1) true 0)`,
+			want: int64(5),
+		},
+		{
+			// the accumulator is only visible in step and cond
+			expr:   `(iterate acc (+ acc 1) true 1)`,
+			errMsg: "unknown token error",
+		},
+		{
+			expr:   `(iterate 0 (+ acc 1) true -1)`,
+			errMsg: "maxSteps should not be negative",
+		},
+		{
+			expr:   `(iterate 0 (+ acc 1) true "1")`,
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			expr:   `(iterate 0 (+ acc 1) acc 1)`,
+			errMsg: "predicate returns a non bool result: [0] at index 0",
+		},
+		{
+			expr:   `(iterate 0 (+ acc 1) true)`,
+			errMsg: "iterate parameters count error",
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			cc := NewConfig(ExtendConf(c.cc), RegVarAndOp(c.vals))
+			for _, opt := range []Option{Optimizations(true), Optimizations(false)} {
+				opt(cc)
+				e, err := Compile(cc, c.expr)
+				if err == nil {
+					var res Value
+					res, err = e.Eval(NewCtxFromVars(cc, c.vals))
+					if err == nil {
+						assertEquals(t, res, c.want)
+					}
+				}
+
+				if len(c.errMsg) != 0 {
+					assertErrStrContains(t, err, c.errMsg)
+					continue
+				}
+				assertNil(t, err)
+			}
+		})
+	}
+}
+
+func TestDump_Lambda(t *testing.T) {
+	cc := NewConfig(Optimizations(false), RegVarAndOp(map[string]interface{}{
+		"items": nil,
+	}))
+	e, err := Compile(cc, `(find_all items (> x 2))`)
+	assertNil(t, err)
+	assertEquals(t, Dump(e), "(find_all items\n  (> x 2))")
+
+	e, err = Compile(cc, `(let (a (+ items 1) b 2) (+ a b))`)
+	assertNil(t, err)
+	assertEquals(t, Dump(e), "(let (a\n    (+ items 1)\n  b 2)\n  (+ a b))")
+}
+
+func TestDump_Cond(t *testing.T) {
+	cc := NewConfig(Optimizations(false), RegVarAndOp(map[string]interface{}{"age": 1}))
+	// the clauses are dumped as nested ifs
+	e, err := Compile(cc, `(cond ((< age 13) "child") ((< age 20) "teen"))`)
+	assertNil(t, err)
+	assertEquals(t, Dump(e), `(if
+  (< age 13) "child"
+  (if
+    (< age 20) "teen"))`)
+	again, err := Compile(cc, Dump(e))
+	assertNil(t, err)
+	assertEquals(t, Dump(again), Dump(e))
+}
+
+func TestTap(t *testing.T) {
+	var observed []Value
+	cc := NewConfig(RegVarAndOp(map[string]interface{}{
+		"age": 20,
+	}))
+	cc.Observers["audit"] = func(_ *Ctx, val Value) {
+		observed = append(observed, val)
+	}
+
+	testCases := []struct {
+		expr     string
+		want     Value
+		observed []Value
+		errMsg   string
+	}{
+		{
+			expr:     `(tap age "audit")`,
+			want:     int64(20),
+			observed: []Value{int64(20)},
+		},
+		{
+			expr:     `(> (tap (+ age 1) "audit") 18)`,
+			want:     true,
+			observed: []Value{int64(21)},
+		},
+		{
+			expr:     `(tap (tap "a" "audit") "audit")`,
+			want:     "a",
+			observed: []Value{"a", "a"},
+		},
+		{
+			expr:   `(tap age "unknown")`,
+			errMsg: "unknown observer [unknown]",
+		},
+		{
+			expr:   `(tap age age)`,
+			errMsg: "tap observer name should be a string literal",
+		},
+		{
+			expr:   `(tap age)`,
+			errMsg: "tap parameters count error",
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			for _, opt := range []Option{Optimizations(true), Optimizations(false)} {
+				opt(cc)
+				observed = nil
+				e, err := Compile(cc, c.expr)
+				if len(c.errMsg) != 0 {
+					assertErrStrContains(t, err, c.errMsg)
+					continue
+				}
+				assertNil(t, err)
+
+				res, err := e.Eval(NewCtxFromVars(cc, map[string]interface{}{"age": 20}))
+				assertNil(t, err)
+				assertEquals(t, res, c.want)
+				assertEquals(t, observed, c.observed)
+			}
+		})
+	}
+}
+
+func TestInterp_Variables(t *testing.T) {
+	vals := map[string]interface{}{"name": "Bob", "count": 3}
+
+	// the unknown placeholders are fetched as undefined variables
+	cc := NewConfig(EnableUndefinedVariable)
+	e, err := Compile(cc, `(interp "Hello {name}, {count}")`)
+	assertNil(t, err)
+	res, err := e.Eval(NewCtxFromVars(cc, vals))
+	assertNil(t, err)
+	assertEquals(t, res, "Hello Bob, 3")
+
+	// the placeholders are the inputs of the expression
+	cc = NewConfig(EnableRequireAllSelectorsUsed, RegVarAndOp(vals))
+	e, err = Compile(cc, `(interp "Hello {name}")`)
+	assertNil(t, err)
+	assertEquals(t, len(e.Diagnostics()), 1)
+	assertErrStrContains(t, e.Diagnostics()[0], "unused selectors: [count]")
+	assertErrStrContains(t, e.ValidateInputs(map[string]interface{}{}), "name")
+}
+
+func TestRenameKeyword(t *testing.T) {
+	vals := map[string]interface{}{
+		"find_all": []int{1, 5, 10},
+		"limit":    4,
+	}
+	cc := NewConfig(RegVarAndOp(vals))
+	assertNil(t, RenameKeyword(cc, "find_all", "search"))
+	assertNil(t, DisableKeyword(cc, "iterate"))
+	assertNil(t, RegisterOperator(cc, "iterate", func(_ *Ctx, params []Value) (Value, error) {
+		return params[0], nil
+	}))
+
+	testCases := []struct {
+		expr   string
+		want   Value
+		errMsg string
+	}{
+		{
+			// the original name is free for a selector
+			expr: `(search find_all (> x limit))`,
+			want: []interface{}{
+				[]interface{}{int64(1), int64(5)},
+				[]interface{}{int64(2), int64(10)},
+			},
+		},
+		{
+			// the disabled keyword is free for an operator
+			expr: `(iterate limit)`,
+			want: int64(4),
+		},
+		{
+			expr: `(if (> limit 1) "a" "b")`,
+			want: "a",
+		},
+		{
+			expr:   `(find_all find_all (> x limit))`,
+			errMsg: "unknown token error",
+		},
+		{
+			// the errors report the renamed keyword
+			expr:   `(search find_all)`,
+			errMsg: "search parameters count error (want: 2, got: 1) occurs at line 1, col 2: ([s]earch find_all)",
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			e, err := Compile(cc, c.expr)
+			if len(c.errMsg) != 0 {
+				assertErrStrContains(t, err, c.errMsg)
+				return
+			}
+			assertNil(t, err)
+
+			res, err := e.Eval(NewCtxFromVars(cc, vals))
+			assertNil(t, err)
+			assertEquals(t, res, c.want)
+		})
+	}
+
+	// the builtin keywords are not changed
+	_, err := Compile(NewConfig(RegVarAndOp(vals)), `(search find_all (> x limit))`)
+	assertErrStrContains(t, err, "unknown token error")
+
+	assertErrStrContains(t, RenameKeyword(cc, "find_all", "lookup"), "keyword not exist find_all")
+	assertErrStrContains(t, RenameKeyword(cc, "if", "search"), "keyword already exist search")
+	assertErrStrContains(t, RenameKeyword(cc, "if", "and"), "operator already exist and")
+	assertErrStrContains(t, RenameKeyword(cc, "if", "iterate"), "operator already exist iterate")
+	assertErrStrContains(t, RenameKeyword(cc, "if", "limit"), "variable already exist limit")
+	cc.ConstantMap["adult"] = int64(18)
+	assertErrStrContains(t, RenameKeyword(cc, "if", "adult"), "constant already exist adult")
+	assertErrStrContains(t, DisableKeyword(cc, "iterate"), "keyword not exist iterate")
+
+	// the keywords parsed before they are built report the renamed names too
+	cc = NewConfig(RegVarAndOp(vals))
+	assertNil(t, RenameKeyword(cc, "cond", "when"))
+	assertNil(t, RenameKeyword(cc, "let", "with"))
+	_, err = Compile(cc, `(when)`)
+	assertErrStrContains(t, err, "when requires at least one clause")
+	e, err := Compile(cc, `(with (y 2) (when ((> limit y) y) (else 0)))`)
+	assertNil(t, err)
+	res, err := e.Eval(NewCtxFromVars(cc, vals))
+	assertNil(t, err)
+	assertEquals(t, res, int64(2))
+}
+
+func TestKeywords_PartialResults(t *testing.T) {
+	items := make([]int64, 100)
+	for i := range items {
+		items[i] = int64(i)
+	}
+	vals := map[string]interface{}{"items": items}
+
+	testCases := []struct {
+		expr    string
+		partial bool
+		want    Value
+	}{
+		{
+			// the transform of the third element is cancelled, as the operators check the cancellation
+			expr:    `(map_if items (tick) (* x 2))`,
+			partial: true,
+			want:    []int64{0, 2},
+		},
+		{
+			expr:    `(find_all items (tick))`,
+			partial: true,
+			want: []interface{}{
+				[]interface{}{int64(0), int64(0)},
+				[]interface{}{int64(1), int64(1)},
+				[]interface{}{int64(2), int64(2)},
+			},
+		},
+		{
+			expr:    `(map items (if (tick) (* x 3) 0))`,
+			partial: true,
+			want:    []int64{0, 3},
+		},
+		{
+			expr:    `(filter items (tick))`,
+			partial: true,
+			want:    []int64{0, 1, 2},
+		},
+		{
+			expr:    `(reduce items 0 (if (tick) (+ acc x) acc))`,
+			partial: true,
+			want:    int64(1),
+		},
+		{
+			// the partial result is discarded if PartialResults is not enabled
+			expr: `(map_if items (tick) (* x 2))`,
+		},
+		{
+			// the partial result of the non-root keyword is discarded
+			expr:    `(append (map_if items (tick) (* x 2)) 1)`,
+			partial: true,
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			for _, opt := range []Option{Optimizations(true), Optimizations(false)} {
+				ctx, cancel := context.WithCancel(context.Background())
+				calls := 0
+				cc := NewConfig(opt, RegVarAndOp(vals))
+				// tick cancels the evaluation at the third element
+				assertNil(t, RegisterOperator(cc, "tick", func(_ *Ctx, _ []Value) (Value, error) {
+					if calls++; calls == 3 {
+						cancel()
+					}
+					return true, nil
+				}))
+
+				e, err := Compile(cc, c.expr)
+				assertNil(t, err)
+
+				evalCtx := NewCtxFromVars(cc, vals)
+				evalCtx.Ctx = ctx
+				evalCtx.PartialResults = c.partial
+				res, err := e.Eval(evalCtx)
+				assertEquals(t, errors.Is(err, context.Canceled), true)
+				assertEquals(t, res, c.want)
+				cancel()
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package eval
+
+import (
+	"errors"
+	"fmt"
+)
+
+// maxMacroExpansions limits the count of the macro expansions in an expression,
+// to prevent the recursive macros from expanding infinitely
+const maxMacroExpansions = 1024
+
+// Macro is an expression template, it's expanded inline at compile time before the
+// optimizations, so using a macro costs nothing at runtime.
+// e.g. the macro `is_adult` with the params `(age)` and the body `(>= age 18)`
+// expands `(is_adult user_age)` to `(>= user_age 18)`.
+type Macro struct {
+	Params []string
+	Body   string
+}
+
+// RegisterMacro registers a macro into the config, the params of the macro are
+// replaced with the arguments in the body when the macro is expanded.
+// Macros are only supported in the prefix notation.
+func RegisterMacro(cc *Config, name string, params []string, body string) error {
+	if _, exist := builtinOperators[name]; exist {
+		return fmt.Errorf("operator already exist %s", name)
+	}
+	if _, exist := cc.OperatorMap[name]; exist {
+		return fmt.Errorf("operator already exist %s", name)
+	}
+	if _, exist := keywordOf(cc, name); exist {
+		return fmt.Errorf("keyword already exist %s", name)
+	}
+	if _, exist := cc.Macros[name]; exist {
+		return fmt.Errorf("macro already exist %s", name)
+	}
+
+	// check the syntax of the body
+	p := newParser(cc, body)
+	if err := p.lex(); err != nil {
+		return fmt.Errorf("macro [%s] body error: %w", name, err)
+	}
+	for _, t := range p.tokens {
+		if t.typ == ident && t.val == name {
+			return fmt.Errorf("macro [%s] can not be used in its own body", name)
+		}
+	}
+
+	if cc.Macros == nil {
+		cc.Macros = make(map[string]Macro)
+	}
+	cc.Macros[name] = Macro{Params: params, Body: body}
+	return nil
+}
+
+// expandMacros replaces the macro calls in the tokens with the bodies of the macros,
+// the tokens of the bodies take the position of the macro calls.
+func (p *parser) expandMacros() error {
+	if len(p.conf.Macros) == 0 || p.isInfixNotation() {
+		return nil
+	}
+
+	bodies := make(map[string][]token)
+	expansions := 0
+	for i := 0; i+1 < len(p.tokens); i++ {
+		if p.tokens[i].typ != lParen || p.tokens[i+1].typ != ident {
+			continue
+		}
+		car := p.tokens[i+1]
+		m, exist := p.conf.Macros[car.val]
+		if !exist {
+			continue
+		}
+
+		if expansions++; expansions > maxMacroExpansions {
+			return p.errWithToken(ErrKindInvalidExpr, errors.New("macro expansions exceed the limit"), car)
+		}
+
+		body, ok := bodies[car.val]
+		if !ok {
+			sub := newParser(p.conf, m.Body)
+			if err := sub.lex(); err != nil {
+				return p.errWithToken(ErrKindInvalidExpr, fmt.Errorf("macro [%s] body error: %w", car.val, err), car)
+			}
+			for _, t := range sub.tokens {
+				if t.typ != comment {
+					body = append(body, t)
+				}
+			}
+			bodies[car.val] = body
+		}
+
+		args, end, err := p.macroArgs(i + 2)
+		if err != nil {
+			return err
+		}
+		if len(args) != len(m.Params) {
+			return p.paramsCountErr(len(m.Params), len(args), car)
+		}
+
+		var expanded []token
+		for _, t := range body {
+			if t.typ == ident {
+				if idx := indexOf(m.Params, t.val); idx != -1 {
+					expanded = append(expanded, args[idx]...)
+					continue
+				}
+			}
+			t.pos = car.pos
+			expanded = append(expanded, t)
+		}
+
+		// replace the macro call, the expanded tokens are scanned again for the nested macros
+		rest := append(expanded, p.tokens[end+1:]...)
+		p.tokens = append(p.tokens[:i], rest...)
+		i--
+	}
+	return nil
+}
+
+// macroArgs splits the arguments of the macro call started from the i-th token,
+// it returns the arguments and the index of the right parenthesis of the call.
+func (p *parser) macroArgs(i int) ([][]token, int, error) {
+	var args [][]token
+	for i < len(p.tokens) {
+		t := p.tokens[i]
+		switch t.typ {
+		case rParen:
+			return args, i, nil
+		case lParen:
+			start, depth := i, 0
+			for ; i < len(p.tokens); i++ {
+				if p.tokens[i].typ == lParen {
+					depth++
+				} else if p.tokens[i].typ == rParen {
+					depth--
+				}
+				if depth == 0 {
+					break
+				}
+			}
+			if i == len(p.tokens) {
+				return nil, 0, p.parenUnmatchedErr(t.pos)
+			}
+			args = append(args, p.tokens[start:i+1])
+		default:
+			args = append(args, p.tokens[i:i+1])
+		}
+		i++
+	}
+	return nil, 0, p.errNoNextToken()
+}
+
+func indexOf(s []string, v string) int {
+	for i, e := range s {
+		if e == v {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,155 @@
+package eval
+
+import (
+	"testing"
+)
+
+func TestMacro(t *testing.T) {
+	cc := NewConfig()
+	assertNil(t, RegisterMacro(cc, "is_adult", []string{"age"}, `(>= age 18)`))
+	assertNil(t, RegisterMacro(cc, "between_excl", []string{"v", "lo", "hi"}, `(and (> v lo) (< v hi))`))
+	assertNil(t, RegisterMacro(cc, "can_drive", []string{"age"},
+		`(and (is_adult age) ;; nested macro
+		      (not (between_excl age 80 200)))`))
+	assertNil(t, RegisterMacro(cc, "no_params", nil, `(+ 1 2)`))
+
+	testCases := []struct {
+		expr   string
+		vals   map[string]interface{}
+		want   Value
+		dump   string
+		errMsg string
+	}{
+		{
+			expr: `(is_adult age)`,
+			vals: map[string]interface{}{"age": 20},
+			want: true,
+			dump: `(>= age 18)`,
+		},
+		{
+			expr: `(between_excl (+ age 1) 10 30)`,
+			vals: map[string]interface{}{"age": 20},
+			want: true,
+			dump: `(and
+  (>
+    (+ age 1) 10)
+  (<
+    (+ age 1) 30))`,
+		},
+		{
+			expr: `(can_drive age)`,
+			vals: map[string]interface{}{"age": 85},
+			want: false,
+			dump: `(and
+  (>= age 18)
+  (not
+    (and
+      (> age 80)
+      (< age 200))))`,
+		},
+		{
+			// the arguments can be macros as well
+			expr: `(is_adult (no_params))`,
+			want: false,
+			dump: `(>=
+  (+ 1 2) 18)`,
+		},
+		{
+			// the macro params are local to the macro body
+			expr: `(= (is_adult 30) (= age 18))`,
+			vals: map[string]interface{}{"age": 18},
+			want: true,
+			dump: `(=
+  (>= 30 18)
+  (= age 18))`,
+		},
+		{
+			expr: `(find_all items (is_adult x))`,
+			vals: map[string]interface{}{"items": []int{10, 20}},
+			want: []interface{}{[]interface{}{int64(1), int64(20)}},
+			dump: "(find_all items\n  (>= x 18))",
+		},
+		{
+			expr:   `(is_adult age 1)`,
+			vals:   map[string]interface{}{"age": 20},
+			errMsg: "is_adult parameters count error (want: 1, got: 2)",
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			conf := NewConfig(ExtendConf(cc), Optimizations(false), RegVarAndOp(c.vals))
+			e, err := Compile(conf, c.expr)
+			if len(c.errMsg) != 0 {
+				assertErrStrContains(t, err, c.errMsg)
+				return
+			}
+			assertNil(t, err)
+			assertEquals(t, Dump(e), c.dump)
+
+			res, err := e.Eval(NewCtxFromVars(conf, c.vals))
+			assertNil(t, err)
+			assertEquals(t, res, c.want)
+		})
+	}
+}
+
+func TestMacro_Optimized(t *testing.T) {
+	cc := NewConfig(RegVarAndOp(map[string]interface{}{"age": nil}))
+	assertNil(t, RegisterMacro(cc, "is_adult", []string{"age"}, `(>= age LIMIT)`))
+	cc.ConstantMap["LIMIT"] = int64(18)
+
+	// the macro is expanded before the optimizations, so it's constant folded
+	e, err := Compile(cc, `(and (is_adult 20) (is_adult age))`)
+	assertNil(t, err)
+	assertEquals(t, Dump(e), "(and true\n  (>= age 18))")
+
+	inlined, err := Compile(cc, `(and (>= 20 18) (>= age 18))`)
+	assertNil(t, err)
+	assertEquals(t, DumpTable(e, false), DumpTable(inlined, false))
+}
+
+func TestRegisterMacro(t *testing.T) {
+	cc := NewConfig()
+	assertNil(t, RegisterMacro(cc, "is_adult", []string{"age"}, `(>= age 18)`))
+	assertErrStrContains(t, RegisterMacro(cc, "is_adult", []string{"age"}, `(>= age 18)`), "macro already exist")
+	assertErrStrContains(t, RegisterMacro(cc, "and", nil, `(>= 1 1)`), "operator already exist")
+	assertErrStrContains(t, RegisterMacro(cc, "if", nil, `(>= 1 1)`), "keyword already exist")
+	assertErrStrContains(t, RegisterMacro(cc, "rec", nil, `(rec)`), "can not be used in its own body")
+	assertErrStrContains(t, RegisterMacro(cc, "bad", nil, `(= "a`), "macro [bad] body error")
+
+	// mutually recursive macros
+	assertNil(t, RegisterMacro(cc, "ping", nil, `(pong)`))
+	assertNil(t, RegisterMacro(cc, "pong", nil, `(ping)`))
+	_, err := Compile(cc, `(ping)`)
+	assertErrStrContains(t, err, "macro expansions exceed the limit")
+}
+
+func BenchmarkMacro(b *testing.B) {
+	vals := map[string]interface{}{"age": 30, "gender": "Male"}
+	cc := NewConfig(RegVarAndOp(vals))
+	_ = RegisterMacro(cc, "is_adult", []string{"age"}, `(>= age 18)`)
+	_ = RegisterMacro(cc, "is_male", []string{"gender"}, `(= gender "Male")`)
+
+	for _, bc := range []struct {
+		name string
+		expr string
+	}{
+		{name: "macro", expr: `(and (is_adult age) (is_male gender))`},
+		{name: "inlined", expr: `(and (>= age 18) (= gender "Male"))`},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			e, err := Compile(cc, bc.expr)
+			if err != nil {
+				b.Fatal(err)
+			}
+			ctx := NewCtxFromVars(cc, vals)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _ = e.Eval(ctx)
+			}
+		})
+	}
+}
@@ -0,0 +1,547 @@
+package eval
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"sort"
+	"unicode"
+)
+
+// exprFormatVersion is the version of the format of the marshaled expressions,
+// it should be bumped whenever the format or the meaning of the nodes changes
+const exprFormatVersion byte = 3
+
+// ErrIncompatibleExpr is returned when unmarshaling the data of another version of
+// the format, or the data corrupted, which does not match its checksum
+var ErrIncompatibleExpr = errors.New("incompatible expression data")
+
+// the tags of the constant values
+const (
+	tagNil byte = iota
+	tagBool
+	tagInt
+	tagFloat
+	tagStr
+	tagStrs
+	tagInts
+	tagList
+	tagDict
+	tagKeyword
+)
+
+// MarshalBinary encodes the compiled expression, so it can be cached and loaded by UnmarshalExpr
+// without compiling the source again. The operators are stored by their names, and they are
+// rebound against the Config on load. The data starts with the version of the format, and ends
+// with the CRC-32 checksum of the rest.
+//
+// The expressions with the event nodes, i.e. compiled with ReportEvent or Debug, and the ones
+// with the parse errors recovered are not supported. The keywords are rebound by parsing their
+// source again, so they are not supported in the infix notation, where the sources of the
+// sub-expressions are not recorded.
+func (e *Expr) MarshalBinary() ([]byte, error) {
+	w := &exprWriter{buf: []byte{exprFormatVersion}}
+	w.varint(int64(e.maxStackSize))
+	w.uvarint(uint64(e.consumed))
+	w.uvarint(math.Float64bits(e.cost))
+	w.str(e.source)
+
+	w.uvarint(uint64(len(e.nodes)))
+	for i, n := range e.nodes {
+		switch n.getNodeType() {
+		case event:
+			return nil, errors.New("the expressions with event nodes can not be marshaled")
+		case operator, fastOperator:
+			if n.value == placeholderOp {
+				return nil, errors.New("the expressions with parse errors can not be marshaled")
+			}
+			if _, ok := e.spans[n]; !ok && isKeywordNode(n) {
+				return nil, fmt.Errorf("keyword [%v] without the source can not be marshaled", n.value)
+			}
+		}
+
+		w.buf = append(w.buf, n.flag, byte(n.childCnt))
+		w.varint(int64(n.scIdx))
+		w.varint(int64(n.osTop))
+		w.varint(int64(n.varKey))
+		if err := w.value(n.value); err != nil {
+			return nil, err
+		}
+		w.varint(int64(e.parentIdx[i]))
+
+		span, ok := e.spans[n]
+		w.bool(ok)
+		if ok {
+			w.uvarint(uint64(span.Start))
+			w.uvarint(uint64(span.End))
+		}
+	}
+
+	w.uvarint(uint64(len(e.optimizationLog)))
+	for _, s := range e.optimizationLog {
+		w.str(s)
+	}
+
+	var sum [crc32.Size]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(w.buf))
+	return append(w.buf, sum[:]...), nil
+}
+
+// UnmarshalBinary decodes the expression encoded by MarshalBinary, the operators are rebound
+// against a default Config, in which only the builtin operators are available, and the variables
+// are resolved by their names. Use UnmarshalExpr to rebind the custom operators and variables.
+func (e *Expr) UnmarshalBinary(data []byte) error {
+	res, err := UnmarshalExpr(NewConfig(EnableUndefinedVariable), data)
+	if err != nil {
+		return err
+	}
+	*e = *res
+	return nil
+}
+
+// UnmarshalExpr decodes the expression encoded by MarshalBinary, and rebinds its operators and
+// variables against the config, which should have the operators and the variables referenced
+// by the expression. The limits of the config, e.g. MaxResultLen, are applied to the operators.
+func UnmarshalExpr(cc *Config, data []byte) (*Expr, error) {
+	if len(data) < 1+crc32.Size {
+		return nil, fmt.Errorf("%w: too short", ErrIncompatibleExpr)
+	}
+	if data[0] != exprFormatVersion {
+		return nil, fmt.Errorf("%w: version %d, want %d", ErrIncompatibleExpr, data[0], exprFormatVersion)
+	}
+	body, sum := data[:len(data)-crc32.Size], data[len(data)-crc32.Size:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(sum) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrIncompatibleExpr)
+	}
+
+	r := &exprReader{buf: body[1:]}
+	e := &Expr{
+		maxStackSize: int16(r.varint()),
+		consumed:     int(r.uvarint()),
+		cost:         math.Float64frombits(r.uvarint()),
+		source:       r.str(),
+	}
+
+	size := int(r.uvarint())
+	if r.err == nil && size > len(r.buf) {
+		// each node takes several bytes at least
+		r.err = errors.New("invalid count of nodes")
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIncompatibleExpr, r.err)
+	}
+
+	e.nodes = make([]*node, size)
+	e.parentIdx = make([]int16, size)
+	for i := range e.nodes {
+		n := &node{flag: r.byte(), childCnt: int8(r.byte())}
+		n.scIdx = int16(r.varint())
+		n.osTop = int16(r.varint())
+		n.varKey = VariableKey(r.varint())
+		n.value = r.value()
+		e.parentIdx[i] = int16(r.varint())
+		if r.bool() {
+			if e.spans == nil {
+				e.spans = make(map[*node]Span)
+			}
+			e.spans[n] = Span{Start: int(r.uvarint()), End: int(r.uvarint())}
+		}
+		if p := e.parentIdx[i]; r.err == nil && (p < -1 || int(p) >= size) {
+			r.err = fmt.Errorf("invalid parent index %d", p)
+		}
+		if r.err == nil && (n.scIdx < -1 || int(n.scIdx) >= size) {
+			r.err = fmt.Errorf("invalid short circuit index %d", n.scIdx)
+		}
+		e.nodes[i] = n
+	}
+	if r.err == nil {
+		// the count of the children of each node is the count of the nodes with its index as the parent
+		cnt := make([]int, size)
+		for _, p := range e.parentIdx {
+			if p != -1 {
+				cnt[p]++
+			}
+		}
+		for i, n := range e.nodes {
+			if int(n.childCnt) != cnt[i] {
+				r.err = fmt.Errorf("invalid count of children %d of node %d", n.childCnt, i)
+				break
+			}
+		}
+	}
+	if cnt := int(r.uvarint()); r.err == nil && cnt <= len(r.buf) {
+		for i := 0; i < cnt; i++ {
+			e.optimizationLog = append(e.optimizationLog, r.str())
+		}
+	}
+	if r.err == nil && len(r.buf) != 0 {
+		r.err = errors.New("unexpected trailing data")
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIncompatibleExpr, r.err)
+	}
+
+	if err := rebind(cc, e); err != nil {
+		return nil, err
+	}
+	e.intArith = intArithmetic(e.conf, e)
+	e.inputs = referencedInputs(e.conf, e)
+	e.pure = isPure(e.conf, e)
+	setStreamRoot(e)
+	return e, nil
+}
+
+// rebind binds the operators of the nodes by their names, and the variables by the keys in the config.
+// The builtin operators are built from their constant params again, and the keywords are parsed
+// from their sources again, since their operators are the closures of the compiled lambdas.
+func rebind(cc *Config, e *Expr) error {
+	p := newParser(cc, e.source)
+	if p.lex() == nil {
+		// the selectors and constants declared in the compile config comments
+		if err := p.parseConfig(); err != nil {
+			return err
+		}
+	}
+	cc, e.conf = p.conf, p.conf
+	p.setLineStarts()
+	runes := p.sourceRunes()
+
+	for i, n := range e.nodes {
+		switch n.getNodeType() {
+		case variable:
+			name, ok := n.value.(string)
+			if !ok {
+				return fmt.Errorf("invalid variable %v", n.value)
+			}
+			if n.varKey == localVarKey {
+				continue
+			}
+			if n.flag&pathVar != 0 {
+				name, _ = pathRoot(name)
+			}
+			if key, exist := cc.VariableKeyMap[name]; exist {
+				n.varKey = key
+			} else if p.allowUndefinedVariable() {
+				n.varKey = UndefinedVarKey
+			} else {
+				return fmt.Errorf("variable not exist %s", name)
+			}
+		case cond:
+			switch n.value {
+			case keywordIf:
+				n.operator = ifCond
+			case endIf:
+				n.operator = endIfJump
+			default:
+				return fmt.Errorf("invalid cond node %v", n.value)
+			}
+		case operator, fastOperator:
+			name, ok := n.value.(string)
+			if !ok {
+				return fmt.Errorf("invalid operator %v", n.value)
+			}
+			span, hasSpan := e.spans[n]
+			if hasSpan && (span.Start < 0 || span.Start >= span.End || span.End > len(runes)) {
+				return fmt.Errorf("invalid span of operator [%s]", name)
+			}
+
+			var err error
+			switch {
+			case name == sequenceOp:
+				n.operator = lastParam
+			case isKeywordNode(n):
+				if !hasSpan {
+					return fmt.Errorf("keyword [%s] can not be rebound without the source", name)
+				}
+				err = rebindKeyword(cc, e, n, string(runes[span.Start:span.End]))
+			default:
+				car := token{typ: ident, val: name}
+				if hasSpan {
+					// the operator follows the left parenthesis
+					car.pos = span.Start + 1
+					for car.pos < span.End && unicode.IsSpace(runes[car.pos]) {
+						car.pos++
+					}
+				}
+				n.operator, err = p.rebindOperator(car, childNodes(e, int16(i)))
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rebindOperator builds the operator of the name in the same way as buildOperatorNode,
+// and precomputes its constant params in the same way as the constant folding
+func (p *parser) rebindOperator(car token, children []*astNode) (Operator, error) {
+	op, exist := p.getOperator(car.val)
+	if !exist {
+		return nil, fmt.Errorf("operator not exist %s", car.val)
+	}
+	builtin := isBuiltinOperator(p.conf, car.val)
+	if build, ok := builtinOperatorBuilders[car.val]; ok && builtin {
+		var err error
+		if op, err = build(p.conf, children); err != nil {
+			return nil, fmt.Errorf("operator [%s] error: %w", car.val, err)
+		}
+	}
+
+	// the optimizations are enabled unless they are disabled explicitly, the same as optimize
+	folding, exist := p.conf.CompileOptions[ConstantFolding]
+	if precompute, ok := builtinPrecomputers[car.val]; ok && builtin && (folding || !exist) {
+		if res := precompute(children); res != nil {
+			op = res
+		}
+	}
+
+	n := &node{flag: operator, operator: op}
+	p.wrapOperator(n, car)
+	return n.operator, nil
+}
+
+// rebindKeyword parses the source of the keyword node again, and takes its operator and lambdas
+func rebindKeyword(cc *Config, e *Expr, n *node, source string) error {
+	ast, _, err := newParser(cc, source).parse()
+	if err != nil {
+		return fmt.Errorf("keyword [%v] error: %w", n.value, err)
+	}
+	if !isKeywordNode(ast.node) || ast.node.value != n.value || len(ast.children) != int(n.childCnt) {
+		return fmt.Errorf("keyword [%v] can not be rebound from the source %s", n.value, source)
+	}
+
+	n.operator = ast.node.operator
+	if len(ast.lambdas) != 0 {
+		if e.lambdas == nil {
+			e.lambdas = make(map[*node][]*lambda)
+		}
+		e.lambdas[n] = ast.lambdas
+	}
+	return nil
+}
+
+// isKeywordNode checks if the operator node is built by a keyword
+func isKeywordNode(n *node) bool {
+	return n.flag&keywordOp != 0
+}
+
+// childNodes returns the children of the idx-th node in order,
+// which are only inspected for their constant values by the builders
+func childNodes(e *Expr, idx int16) []*astNode {
+	var res []*astNode
+	for i, p := range e.parentIdx {
+		if p == idx {
+			res = append(res, &astNode{node: e.nodes[i]})
+		}
+	}
+	return res
+}
+
+type exprWriter struct {
+	buf []byte
+}
+
+func (w *exprWriter) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf = append(w.buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func (w *exprWriter) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf = append(w.buf, b[:binary.PutVarint(b[:], v)]...)
+}
+
+func (w *exprWriter) bool(b bool) {
+	if b {
+		w.buf = append(w.buf, 1)
+	} else {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+func (w *exprWriter) str(s string) {
+	w.uvarint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *exprWriter) value(v Value) error {
+	switch v := v.(type) {
+	case nil:
+		w.buf = append(w.buf, tagNil)
+	case bool:
+		w.buf = append(w.buf, tagBool)
+		w.bool(v)
+	case int64:
+		w.buf = append(w.buf, tagInt)
+		w.varint(v)
+	case float64:
+		w.buf = append(w.buf, tagFloat)
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], math.Float64bits(v))
+		w.buf = append(w.buf, b[:]...)
+	case string:
+		w.buf = append(w.buf, tagStr)
+		w.str(v)
+	case keyword:
+		w.buf = append(w.buf, tagKeyword)
+		w.str(string(v))
+	case []string:
+		w.buf = append(w.buf, tagStrs)
+		w.uvarint(uint64(len(v)))
+		for _, s := range v {
+			w.str(s)
+		}
+	case []int64:
+		w.buf = append(w.buf, tagInts)
+		w.uvarint(uint64(len(v)))
+		for _, i := range v {
+			w.varint(i)
+		}
+	case []interface{}:
+		w.buf = append(w.buf, tagList)
+		w.uvarint(uint64(len(v)))
+		for _, elem := range v {
+			if err := w.value(elem); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		w.buf = append(w.buf, tagDict)
+		w.uvarint(uint64(len(v)))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		// the same dicts are always encoded into the same bytes
+		sort.Strings(keys)
+		for _, k := range keys {
+			w.str(k)
+			if err := w.value(v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("the constants of type %T can not be marshaled", v)
+	}
+	return nil
+}
+
+// exprReader reads the data written by exprWriter, the first error is kept,
+// and the reads after it return the zero values
+type exprReader struct {
+	buf []byte
+	err error
+}
+
+func (r *exprReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+	r.buf = nil
+}
+
+func (r *exprReader) byte() byte {
+	if len(r.buf) == 0 {
+		r.fail(errors.New("unexpected end of data"))
+		return 0
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b
+}
+
+func (r *exprReader) bool() bool {
+	return r.byte() != 0
+}
+
+func (r *exprReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.fail(errors.New("invalid uvarint"))
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *exprReader) varint() int64 {
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.fail(errors.New("invalid varint"))
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+// count reads the length of a string or a collection, each element takes one byte at least
+func (r *exprReader) count() int {
+	n := r.uvarint()
+	if n > uint64(len(r.buf)) {
+		r.fail(errors.New("invalid length"))
+		return 0
+	}
+	return int(n)
+}
+
+func (r *exprReader) str() string {
+	n := r.count()
+	s := string(r.buf[:n])
+	r.buf = r.buf[n:]
+	return s
+}
+
+func (r *exprReader) value() Value {
+	switch tag := r.byte(); tag {
+	case tagNil:
+		return nil
+	case tagBool:
+		return r.bool()
+	case tagInt:
+		return r.varint()
+	case tagFloat:
+		if len(r.buf) < 8 {
+			r.fail(errors.New("unexpected end of data"))
+			return nil
+		}
+		v := math.Float64frombits(binary.BigEndian.Uint64(r.buf))
+		r.buf = r.buf[8:]
+		return v
+	case tagStr:
+		return r.str()
+	case tagKeyword:
+		return keyword(r.str())
+	case tagStrs:
+		res := make([]string, r.count())
+		for i := range res {
+			res[i] = r.str()
+		}
+		return res
+	case tagInts:
+		res := make([]int64, r.count())
+		for i := range res {
+			res[i] = r.varint()
+		}
+		return res
+	case tagList:
+		res := make([]interface{}, r.count())
+		for i := range res {
+			res[i] = r.value()
+		}
+		return res
+	case tagDict:
+		n := r.count()
+		res := make(map[string]interface{}, n)
+		for i := 0; i < n; i++ {
+			k := r.str()
+			res[k] = r.value()
+		}
+		return res
+	default:
+		r.fail(fmt.Errorf("invalid value tag %d", tag))
+		return nil
+	}
+}
@@ -0,0 +1,211 @@
+package eval
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestExpr_MarshalBinary(t *testing.T) {
+	vals := map[string]interface{}{
+		"age":    int64(20),
+		"price":  2.5,
+		"name":   "Bob",
+		"scores": []int64{50, 70, 90},
+		"status": "active",
+	}
+	newConfig := func() *Config {
+		cc := NewConfig(RegVarAndOp(vals), HandleTrailingTokens(TrailingSequence))
+		assertNil(t, RegisterOperator(cc, "twice", func(_ *Ctx, params []Value) (Value, error) {
+			return params[0].(int64) * 2, nil
+		}))
+		return cc
+	}
+
+	testCases := []string{
+		`(+ age (* 2 3) (- age 1))`,
+		`(* price 1.5)`,
+		`(and (> age 18) (or (= name "Bob") (in status ("a" "b"))))`,
+		`(if (> age 18) (concat name "!") "minor")`,
+		`(if (> age 18) (concat name "!"))`,
+		`(cond ((< age 13) "child") ((< age 20) "teen") (else name))`,
+		`(in age (1 2 3 4 5 6 7 8 9 10 11 12 13 20))`,
+		`(regex name "^B")`,
+		`(any scores (> x 60))`,
+		`(map scores (+ x age))`,
+		`(let (a (+ age 1) b (* a 2)) (filter scores (> x b)))`,
+		`(reduce scores 0 (+ acc x))`,
+		`(twice (+ age 1))`,
+		`(dict "a" 1 "b" (1.5 "c" true))`,
+		`(= name "日本")
+		 (+ age 1)`,
+	}
+
+	for _, expr := range testCases {
+		t.Run(expr, func(t *testing.T) {
+			cc := newConfig()
+			e, err := Compile(cc, expr)
+			assertNil(t, err)
+			data, err := e.MarshalBinary()
+			assertNil(t, err)
+
+			// rebound against another config with the same operators and variables,
+			// the keys of the variables may be different
+			cc2 := newConfig()
+			got, err := UnmarshalExpr(cc2, data)
+			assertNil(t, err)
+			assertEquals(t, Dump(got), Dump(e))
+			assertEquals(t, got.maxStackSize, e.maxStackSize)
+			assertEquals(t, got.Cost(), e.Cost())
+			assertEquals(t, got.pure, e.pure)
+			assertEquals(t, got.intArith != nil, e.intArith != nil)
+			assertEquals(t, got.inputs, e.inputs)
+
+			want, err := e.Eval(NewCtxFromVars(cc, vals))
+			assertNil(t, err)
+			res, err := got.Eval(NewCtxFromVars(cc2, vals))
+			assertNil(t, err)
+			assertEquals(t, res, want)
+
+			// the same expression is encoded into the same bytes once rebound against the same config
+			again, err := got.MarshalBinary()
+			assertNil(t, err)
+			back, err := UnmarshalExpr(cc, again)
+			assertNil(t, err)
+			again, err = back.MarshalBinary()
+			assertNil(t, err)
+			assertEquals(t, again, data)
+		})
+	}
+}
+
+func TestExpr_UnmarshalBinary(t *testing.T) {
+	cc := NewConfig(RegVarAndOp(map[string]interface{}{"age": nil}))
+	assertNil(t, RegisterOperator(cc, "twice", func(_ *Ctx, params []Value) (Value, error) {
+		return params[0].(int64) * 2, nil
+	}))
+
+	e, err := Compile(cc, `(if (> age 18) (+ age 1) 0)`)
+	assertNil(t, err)
+	data, err := e.MarshalBinary()
+	assertNil(t, err)
+
+	// the variables are resolved by their names with the default config
+	var got Expr
+	assertNil(t, got.UnmarshalBinary(data))
+	res, err := got.Eval(NewCtxFromVars(NewConfig(EnableUndefinedVariable), map[string]interface{}{"age": 20}))
+	assertNil(t, err)
+	assertEquals(t, res, int64(21))
+
+	// the custom operators are not available in the default config
+	e, err = Compile(cc, `(twice (+ age 1))`)
+	assertNil(t, err)
+	data, err = e.MarshalBinary()
+	assertNil(t, err)
+	assertErrStrContains(t, got.UnmarshalBinary(data), "operator not exist twice")
+
+	// the variables should be in the config
+	_, err = UnmarshalExpr(NewConfig(RegVarAndOp(map[string]interface{}{"twice": nil})), data)
+	assertErrStrContains(t, err, "variable not exist age")
+
+	// the selectors declared in the compile config comments are declared again
+	e, err = Compile(NewConfig(), ";;;; selector: age\n(+ age 1)")
+	assertNil(t, err)
+	data, err = e.MarshalBinary()
+	assertNil(t, err)
+	decoded, err := UnmarshalExpr(NewConfig(), data)
+	assertNil(t, err)
+	res, err = decoded.Eval(NewCtxFromVars(decoded.Config(), map[string]interface{}{"age": 20}))
+	assertNil(t, err)
+	assertEquals(t, res, int64(21))
+
+	// the operators registered with the names of the disabled keywords are not rebound as keywords
+	vals := map[string]interface{}{"v": []int64{1, 2}}
+	cc = NewConfig(RegVarAndOp(vals))
+	assertNil(t, DisableKeyword(cc, "map"))
+	assertNil(t, RegisterOperator(cc, "map", func(_ *Ctx, _ []Value) (Value, error) {
+		return []int64{7, 8}, nil
+	}))
+	e, err = Compile(cc, `(map v 1)`)
+	assertNil(t, err)
+	data, err = e.MarshalBinary()
+	assertNil(t, err)
+	decoded, err = UnmarshalExpr(cc, data)
+	assertNil(t, err)
+	res, err = decoded.Eval(NewCtxFromVars(cc, vals))
+	assertNil(t, err)
+	assertEquals(t, res, []int64{7, 8})
+
+	// the keywords are not rebound as the operators either
+	e, err = Compile(NewConfig(RegVarAndOp(vals)), `(map v (+ x 1))`)
+	assertNil(t, err)
+	data, err = e.MarshalBinary()
+	assertNil(t, err)
+	_, err = UnmarshalExpr(cc, data)
+	assertErrStrContains(t, err, "keyword [map] error")
+}
+
+func TestUnmarshalExpr_Incompatible(t *testing.T) {
+	cc := NewConfig(RegVarAndOp(map[string]interface{}{"age": nil}))
+	e, err := Compile(cc, `(> age 18)`)
+	assertNil(t, err)
+	data, err := e.MarshalBinary()
+	assertNil(t, err)
+
+	var corrupt = func(fn func(b []byte) []byte) []byte {
+		b := append([]byte(nil), data...)
+		return fn(b)
+	}
+	// malformed returns the data of the malformed nodes with a valid checksum
+	var malformed = func(fn func(e *Expr)) []byte {
+		e, err := Compile(cc, `(and (> age 18) (< age 60))`)
+		assertNil(t, err)
+		fn(e)
+		b, err := e.MarshalBinary()
+		assertNil(t, err)
+		return b
+	}
+
+	testCases := []struct {
+		name   string
+		data   []byte
+		errMsg string
+	}{
+		{name: "empty", data: nil, errMsg: "too short"},
+		{name: "version", data: corrupt(func(b []byte) []byte { b[0]++; return b }), errMsg: "version 4, want 3"},
+		{name: "checksum", data: corrupt(func(b []byte) []byte { b[len(b)/2]++; return b }), errMsg: "checksum mismatch"},
+		{name: "truncated", data: corrupt(func(b []byte) []byte { return b[:len(b)-1] }), errMsg: "checksum mismatch"},
+		{name: "children", data: malformed(func(e *Expr) { e.nodes[0].childCnt = 3 }), errMsg: "invalid count of children 3 of node 0"},
+		{name: "negative children", data: malformed(func(e *Expr) { e.nodes[1].childCnt = -1 }), errMsg: "invalid count of children -1 of node 1"},
+		{name: "short circuit", data: malformed(func(e *Expr) { e.nodes[2].scIdx = int16(len(e.nodes)) }), errMsg: "invalid short circuit index"},
+		{name: "negative short circuit", data: malformed(func(e *Expr) { e.nodes[2].scIdx = -2 }), errMsg: "invalid short circuit index -2"},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := UnmarshalExpr(cc, c.data)
+			assertEquals(t, errors.Is(err, ErrIncompatibleExpr), true)
+			assertErrStrContains(t, err, c.errMsg)
+		})
+	}
+}
+
+func TestExpr_MarshalBinary_Unsupported(t *testing.T) {
+	testCases := []struct {
+		expr   string
+		opts   []Option
+		errMsg string
+	}{
+		{expr: `(> age 18)`, opts: []Option{EnableReportEvent}, errMsg: "event nodes"},
+		{expr: `(> (time_now) 18)`, opts: []Option{EnableParseRecovery}, errMsg: "parse errors"},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			cc := NewConfig(append(c.opts, RegVarAndOp(map[string]interface{}{"age": nil}))...)
+			e, err := Compile(cc, c.expr)
+			assertNil(t, err)
+			_, err = e.MarshalBinary()
+			assertErrStrContains(t, err, c.errMsg)
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package eval
+
+import (
+	"container/list"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MemoizedExpr evaluates the expression and caches the results keyed by the values
+// of the selectors it reads, so the repeated evaluations with the same inputs are
+// not recomputed. It's safe for concurrent use.
+//
+// The expressions calling the operators not registered as stateless, e.g. tap or
+// the custom operators absent in Config.StatelessOperators, are never memoized,
+// their evaluations are always delegated to the expression.
+type MemoizedExpr struct {
+	expr      *Expr
+	selectors []memoSelector
+	size      int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // the front is the most recently used entry
+}
+
+type memoSelector struct {
+	key  VariableKey
+	name string
+	path bool // the dotted selector, see getPath
+}
+
+type memoEntry struct {
+	key string
+	res Value
+}
+
+// NewMemoizedExpr returns a MemoizedExpr caching at most size results of the expression,
+// the least recently used result is evicted when the cache is full.
+// A non-positive size disables the cache.
+func NewMemoizedExpr(e *Expr, size int) *MemoizedExpr {
+	return &MemoizedExpr{
+		expr:      e,
+		selectors: memoSelectors(e),
+		size:      size,
+		entries:   make(map[string]*list.Element),
+		lru:       list.New(),
+	}
+}
+
+// Eval returns the cached result if the selectors have the same values as a previous
+// evaluation, otherwise it evaluates the expression and caches the result.
+// All the selectors are fetched to compute the cache key, even the ones would be skipped
+// by short circuits. The failed evaluations are not cached, and neither are the evaluations
+// with the selector values of the unsupported types, see writeMemoKey.
+func (m *MemoizedExpr) Eval(ctx *Ctx) (Value, error) {
+	if !m.expr.pure || m.size <= 0 || (ctx == nil && len(m.selectors) != 0) {
+		return m.expr.Eval(ctx)
+	}
+	if ctx != nil && ctx.SnapshotVars {
+		// the selectors fetched for the key are reused in the evaluation
+		ctx = snapshotCtx(ctx)
+	}
+
+	key, ok := m.key(ctx)
+	if !ok {
+		return m.expr.Eval(ctx)
+	}
+
+	m.mu.Lock()
+	if elem, exist := m.entries[key]; exist {
+		m.lru.MoveToFront(elem)
+		res := elem.Value.(*memoEntry).res
+		m.mu.Unlock()
+		return res, nil
+	}
+	m.mu.Unlock()
+
+	res, err := m.expr.Eval(ctx)
+	if err != nil {
+		return res, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if elem, exist := m.entries[key]; exist {
+		// cached by a concurrent evaluation
+		m.lru.MoveToFront(elem)
+		return res, nil
+	}
+	m.entries[key] = m.lru.PushFront(&memoEntry{key: key, res: res})
+	if m.lru.Len() > m.size {
+		oldest := m.lru.Back()
+		m.lru.Remove(oldest)
+		delete(m.entries, oldest.Value.(*memoEntry).key)
+	}
+	return res, nil
+}
+
+// Len returns the number of the cached results
+func (m *MemoizedExpr) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lru.Len()
+}
+
+// key returns the cache key of the selector values, it returns false if a selector
+// can not be fetched or its value is not supported
+func (m *MemoizedExpr) key(ctx *Ctx) (string, bool) {
+	var sb strings.Builder
+	for _, s := range m.selectors {
+		var (
+			val Value
+			err error
+		)
+		if s.path {
+			val, err = getPath(ctx, s.key, s.name)
+		} else {
+			val, err = ctx.Get(s.key, s.name)
+		}
+		if err != nil {
+			// let the evaluation report the error
+			return "", false
+		}
+		if !writeMemoKey(&sb, UnifyType(val)) {
+			return "", false
+		}
+	}
+	return sb.String(), true
+}
+
+// writeMemoKey writes the value with its type tag, so that the values of different
+// types are not equal, e.g. 1 and "1". The strings and lists are prefixed with their
+// lengths, so the concatenated keys are unambiguous. It returns false if the type is
+// not supported, e.g. maps and structs.
+func writeMemoKey(sb *strings.Builder, val Value) bool {
+	switch v := val.(type) {
+	case nil:
+		sb.WriteByte('n')
+	case dne:
+		sb.WriteByte('d')
+	case bool:
+		if v {
+			sb.WriteByte('T')
+		} else {
+			sb.WriteByte('F')
+		}
+	case int64:
+		sb.WriteByte('i')
+		sb.WriteString(strconv.FormatInt(v, 10))
+		sb.WriteByte(';')
+	case float64:
+		// the bits distinguish 0 and -0, and all the NaNs are the same
+		if v != v {
+			v = math.NaN()
+		}
+		sb.WriteByte('f')
+		sb.WriteString(strconv.FormatUint(math.Float64bits(v), 16))
+		sb.WriteByte(';')
+	case string:
+		sb.WriteByte('s')
+		sb.WriteString(strconv.Itoa(len(v)))
+		sb.WriteByte(':')
+		sb.WriteString(v)
+	case []int64:
+		sb.WriteByte('I')
+		sb.WriteString(strconv.Itoa(len(v)))
+		sb.WriteByte(':')
+		for _, n := range v {
+			sb.WriteString(strconv.FormatInt(n, 10))
+			sb.WriteByte(';')
+		}
+	case []string:
+		sb.WriteByte('S')
+		sb.WriteString(strconv.Itoa(len(v)))
+		sb.WriteByte(':')
+		for _, s := range v {
+			writeMemoKey(sb, s)
+		}
+	case []interface{}:
+		sb.WriteByte('L')
+		sb.WriteString(strconv.Itoa(len(v)))
+		sb.WriteByte(':')
+		for _, elem := range v {
+			if !writeMemoKey(sb, unifyType(elem)) {
+				return false
+			}
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// memoSelectors returns the selectors read by the expression and its lambdas, sorted by names
+func memoSelectors(e *Expr) []memoSelector {
+	seen := make(map[string]bool)
+	var res []memoSelector
+	var walk func(e *Expr)
+	walk = func(e *Expr) {
+		for _, n := range e.nodes {
+			if n.getNodeType() == variable && n.varKey != localVarKey {
+				name := n.value.(string)
+				if !seen[name] {
+					seen[name] = true
+					res = append(res, memoSelector{key: n.varKey, name: name, path: n.flag&pathVar != 0})
+				}
+			}
+			for _, l := range e.lambdas[n] {
+				walk(l.body)
+			}
+		}
+	}
+	walk(e)
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].name < res[j].name
+	})
+	return res
+}
+
+// isPure returns true if the expression and its lambdas call the stateless operators only,
+// the keywords are pure except tap, which notifies the observers
+func isPure(cc *Config, e *Expr) bool {
+	for _, n := range e.nodes {
+		switch n.getNodeType() {
+		case event:
+			return false
+		case operator, fastOperator:
+			name, _ := n.value.(string)
+			if isKeywordNode(n) {
+				if name == string(keywordTap) {
+					return false
+				}
+			} else if name != sequenceOp {
+				if stateless, _ := isStatelessOp(cc, n); !stateless {
+					return false
+				}
+			}
+		}
+		for _, l := range e.lambdas[n] {
+			if !isPure(cc, l.body) {
+				return false
+			}
+		}
+	}
+	return true
+}
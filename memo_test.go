@@ -0,0 +1,190 @@
+package eval
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestMemoizedExpr_Eval(t *testing.T) {
+	var calls int
+	cc := NewConfig(RegVarAndOp(map[string]interface{}{
+		"age":    nil,
+		"scores": nil,
+	}))
+	cc.OperatorMap["expensive"] = func(_ *Ctx, params []Value) (Value, error) {
+		calls++
+		if params[0] == int64(0) {
+			return nil, errors.New("zero age")
+		}
+		return params[0], nil
+	}
+	cc.StatelessOperators = append(cc.StatelessOperators, "expensive")
+
+	e, err := Compile(cc, `(+ (expensive age) (count_of scores 1))`)
+	assertNil(t, err)
+	m := NewMemoizedExpr(e, 2)
+
+	eval := func(vals map[string]interface{}, want Value, wantCalls int) {
+		t.Helper()
+		res, err := m.Eval(NewCtxFromVars(cc, vals))
+		assertNil(t, err)
+		assertEquals(t, res, want)
+		assertEquals(t, calls, wantCalls)
+	}
+
+	eval(map[string]interface{}{"age": 20, "scores": []int{1, 2}}, int64(21), 1)
+	// the second evaluation with identical inputs is not recomputed
+	eval(map[string]interface{}{"age": 20, "scores": []int{1, 2}}, int64(21), 1)
+	eval(map[string]interface{}{"age": int64(20), "scores": []int64{1, 2}}, int64(21), 1)
+	// any changed selector is a miss
+	eval(map[string]interface{}{"age": 20, "scores": []int{1, 1}}, int64(22), 2)
+	eval(map[string]interface{}{"age": 30, "scores": []int{1, 2}}, int64(31), 3)
+	assertEquals(t, m.Len(), 2)
+
+	// the least recently used result is evicted
+	eval(map[string]interface{}{"age": 20, "scores": []int{1, 2}}, int64(21), 4)
+	eval(map[string]interface{}{"age": 30, "scores": []int{1, 2}}, int64(31), 4)
+
+	// the failed evaluations are not cached
+	for i := 0; i < 2; i++ {
+		_, err = m.Eval(NewCtxFromVars(cc, map[string]interface{}{"age": 0, "scores": []int{}}))
+		assertErrStrContains(t, err, "zero age")
+	}
+	assertEquals(t, calls, 6)
+}
+
+func TestMemoizedExpr_NotMemoized(t *testing.T) {
+	var calls int
+	testCases := []struct {
+		name string
+		expr string
+		vals map[string]interface{}
+		size int
+
+		// the keyword disabled and registered as the counted operator
+		disabled string
+	}{
+		{
+			name: "not stateless",
+			expr: `(counted age)`,
+			vals: map[string]interface{}{"age": 20},
+			size: 10,
+		},
+		{
+			name: "not stateless in lambda",
+			expr: `(map ages (counted x))`,
+			vals: map[string]interface{}{"ages": []int{20}},
+			size: 10,
+		},
+		{
+			name: "tap",
+			expr: `(tap (stateless_counted age) "audit")`,
+			vals: map[string]interface{}{"age": 20},
+			size: 10,
+		},
+		{
+			name:     "operator named as a disabled keyword",
+			expr:     `(filter age)`,
+			vals:     map[string]interface{}{"age": 20},
+			size:     10,
+			disabled: "filter",
+		},
+		{
+			name: "unsupported value type",
+			expr: `(stateless_counted age)`,
+			vals: map[string]interface{}{"age": map[string]interface{}{"a": 1}},
+			size: 10,
+		},
+		{
+			name: "disabled cache",
+			expr: `(stateless_counted age)`,
+			vals: map[string]interface{}{"age": 20},
+			size: 0,
+		},
+	}
+
+	counted := func(_ *Ctx, params []Value) (Value, error) {
+		calls++
+		return params[0], nil
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			cc := NewConfig(RegVarAndOp(c.vals))
+			cc.OperatorMap["counted"] = counted
+			cc.OperatorMap["stateless_counted"] = counted
+			cc.StatelessOperators = append(cc.StatelessOperators, "stateless_counted")
+			cc.Observers["audit"] = func(*Ctx, Value) {}
+			if c.disabled != "" {
+				assertNil(t, DisableKeyword(cc, c.disabled))
+				assertNil(t, RegisterOperator(cc, c.disabled, counted))
+			}
+
+			e, err := Compile(cc, c.expr)
+			assertNil(t, err)
+			m := NewMemoizedExpr(e, c.size)
+
+			calls = 0
+			for i := 0; i < 2; i++ {
+				_, err = m.Eval(NewCtxFromVars(cc, c.vals))
+				assertNil(t, err)
+			}
+			assertEquals(t, calls, 2)
+			assertEquals(t, m.Len(), 0)
+		})
+	}
+}
+
+func TestMemoizedExpr_Lambda(t *testing.T) {
+	var calls int
+	cc := NewConfig(RegVarAndOp(map[string]interface{}{
+		"scores":    nil,
+		"threshold": nil,
+	}))
+	cc.OperatorMap["expensive"] = func(_ *Ctx, params []Value) (Value, error) {
+		calls++
+		return params[0], nil
+	}
+	cc.StatelessOperators = append(cc.StatelessOperators, "expensive")
+
+	e, err := Compile(cc, `(filter scores (> (expensive x) threshold))`)
+	assertNil(t, err)
+	m := NewMemoizedExpr(e, 10)
+
+	for _, threshold := range []int{1, 1, 2} {
+		res, err := m.Eval(NewCtxFromVars(cc, map[string]interface{}{
+			"scores":    []int{1, 2, 3},
+			"threshold": threshold,
+		}))
+		assertNil(t, err)
+		assertEquals(t, res, []int64{1, 2, 3}[threshold:])
+	}
+	// the selectors of the lambda are a part of the key
+	assertEquals(t, calls, 6)
+}
+
+func TestWriteMemoKey(t *testing.T) {
+	vals := []Value{
+		nil, DNE, true, false,
+		int64(1), float64(1), "1", "", "i1;",
+		0.0, math.Copysign(0, -1),
+		[]int64{}, []string{}, []interface{}{},
+		[]int64{1, 2}, []int64{12}, []string{"1", "2"}, []string{"12"}, []string{"1;2"},
+		[]interface{}{int64(1), "2"}, []interface{}{[]interface{}{int64(1)}, "2"},
+	}
+
+	keys := make(map[string]Value)
+	for _, v := range vals {
+		var sb strings.Builder
+		assertEquals(t, writeMemoKey(&sb, v), true)
+		if prev, exist := keys[sb.String()]; exist {
+			t.Fatalf("the keys of %#v and %#v are the same: %s", prev, v, sb.String())
+		}
+		keys[sb.String()] = v
+	}
+
+	var sb strings.Builder
+	assertEquals(t, writeMemoKey(&sb, map[string]Value{}), false)
+	assertEquals(t, writeMemoKey(&sb, []interface{}{struct{}{}}), false)
+}
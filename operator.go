@@ -1,27 +1,248 @@
 package eval
 
 import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
+	"net/netip"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
+
+	"github.com/nyaruka/phonenumbers"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/number"
 )
 
-func RegisterOperator(cc *Config, name string, op Operator) error {
-	if _, exist := builtinOperators[name]; exist {
+// RegisterOperator registers an operator into the config. The reserved builtin operators,
+// e.g. `add`, `=` and `between`, can not be registered. The other builtin operators, e.g.
+// `max`, `len` and `keys`, are overridden by the registered operators of the same names.
+// The keywords, e.g. `if` and `cond`, can not be registered unless they are disabled
+// or renamed, see DisableKeyword and RenameKeyword.
+func RegisterOperator(cc *Config, name string, op Operator, opts ...OperatorOption) error {
+	if _, reserved := reservedOperators[name]; reserved {
 		return fmt.Errorf("operator already exist %s", name)
 	}
 
+	if _, exist := keywordOf(cc, name); exist {
+		return fmt.Errorf("keyword already exist %s", name)
+	}
+
 	if _, exist := cc.OperatorMap[name]; exist {
 		return fmt.Errorf("operator already exist %s", name)
 	}
 
 	cc.OperatorMap[name] = op
+
+	if len(opts) != 0 {
+		var info OperatorInfo
+		for _, opt := range opts {
+			opt(&info)
+		}
+		if cc.OperatorInfos == nil {
+			cc.OperatorInfos = make(map[string]OperatorInfo)
+		}
+		cc.OperatorInfos[name] = info
+	}
 	return nil
 }
 
+// OperatorInfo is the metadata of a registered operator, it's used by the compiler
+type OperatorInfo struct {
+	// ShortCircuit declares the short circuit behavior of the operator,
+	// so the compiler can skip the remaining params as it does for `and` and `or`.
+	ShortCircuit ShortCircuit
+
+	// Returns declares the type of the results of the operator, it's checked
+	// after each call of the operator when StrictReturns is enabled.
+	Returns ValueType
+
+	// Timeout limits the duration of each call of the operator, 0 means no limit.
+	// The operator is called with a Ctx.Ctx derived from the Ctx.Ctx of the evaluation,
+	// which is cancelled at the timeout, and the evaluation fails with a timeout error
+	// without waiting for the operator to return.
+	// There is no timeout if the Ctx.Ctx of the evaluation is nil.
+	Timeout time.Duration
+
+	// Params declares the types of the params of the operator, they are checked at
+	// compile time when TypeCheck is enabled. The params are not checked if it's nil.
+	Params []ValueType
+
+	// Variadic declares that the operator accepts at least len(Params) params, and the
+	// type of the params after the declared ones is the type of the last declared one.
+	Variadic bool
+
+	// Arity declares the counts of the params of the operator accepted, it's checked at
+	// compile time. The count is not checked if it's nil.
+	Arity *Arity
+}
+
+// Arity is the min and max counts of the params of an operator,
+// the negative Max means no upper limit, e.g. `Arity{Min: 2, Max: -1}`
+type Arity struct {
+	Min int
+	Max int
+}
+
+func (a Arity) accepts(n int) bool {
+	return n >= a.Min && (a.Max < 0 || n <= a.Max)
+}
+
+type OperatorOption func(info *OperatorInfo)
+
+// WithTimeout declares the timeout of each call of the operator
+func WithTimeout(d time.Duration) OperatorOption {
+	return func(info *OperatorInfo) {
+		info.Timeout = d
+	}
+}
+
+// WithReturns declares the type of the results of the operator
+func WithReturns(t ValueType) OperatorOption {
+	return func(info *OperatorInfo) {
+		info.Returns = t
+	}
+}
+
+// WithArity declares the min and max counts of the params of the operator,
+// the negative max means no upper limit
+func WithArity(min, max int) OperatorOption {
+	return func(info *OperatorInfo) {
+		info.Arity = &Arity{Min: min, Max: max}
+	}
+}
+
+// WithParams declares the types of the params of the operator
+func WithParams(types ...ValueType) OperatorOption {
+	return func(info *OperatorInfo) {
+		info.Params = types
+		info.Variadic = false
+	}
+}
+
+// WithVariadicParams declares the types of the params of the variadic operator,
+// the last type is repeated for the rest params, e.g. `WithVariadicParams(StringType)`
+func WithVariadicParams(types ...ValueType) OperatorOption {
+	return func(info *OperatorInfo) {
+		info.Params = types
+		info.Variadic = true
+	}
+}
+
+// WithShortCircuit declares the short circuit behavior of the operator
+func WithShortCircuit(sc ShortCircuit) OperatorOption {
+	return func(info *OperatorInfo) {
+		info.ShortCircuit = sc
+	}
+}
+
+// ValueType is the type of the values in expressions
+type ValueType uint8
+
+const (
+	AnyType ValueType = iota
+	BoolType
+	IntType
+	FloatType
+	StringType
+	ListType
+	DictType
+	NumberType // either IntType or FloatType
+)
+
+var valueTypeNames = [...]string{
+	AnyType:    "any",
+	BoolType:   typeBool,
+	IntType:    typeInt,
+	FloatType:  "float64",
+	StringType: typeStr,
+	ListType:   typeList,
+	DictType:   typeDict,
+	NumberType: "number",
+}
+
+func (t ValueType) String() string {
+	if int(t) < len(valueTypeNames) {
+		return valueTypeNames[t]
+	}
+	return fmt.Sprintf("ValueType(%d)", t)
+}
+
+// matches checks if the value is of the type, nil matches any type
+func (t ValueType) matches(v Value) bool {
+	switch v.(type) {
+	case nil:
+		return true
+	case bool:
+		return t == AnyType || t == BoolType
+	case int64:
+		return t == AnyType || t == IntType || t == NumberType
+	case float64:
+		return t == AnyType || t == FloatType || t == NumberType
+	case string:
+		return t == AnyType || t == StringType
+	case []interface{}, []int64, []string:
+		return t == AnyType || t == ListType
+	case map[string]interface{}:
+		return t == AnyType || t == DictType
+	}
+	return t == AnyType
+}
+
+// ShortCircuit declares that an operator returns a bool value directly once any
+// of its params equals to the value, e.g. `and` returns false once a param is false.
+// The short circuit operators are executed in the same way as `and` and `or`,
+// the remaining params are skipped once a param short-circuits the operator,
+// and the last param is returned directly if none of the previous params does.
+type ShortCircuit uint8
+
+const (
+	NoShortCircuit ShortCircuit = iota
+	ShortCircuitOnFalse
+	ShortCircuitOnTrue
+)
+
+// isBuiltinOperator reports whether the name refers to a builtin operator in the config,
+// the operators in OperatorMap take the place of the builtin ones which are not reserved.
+func isBuiltinOperator(cc *Config, name string) bool {
+	if _, exist := builtinOperators[name]; !exist {
+		return false
+	}
+	if _, custom := cc.OperatorMap[name]; custom {
+		_, reserved := reservedOperators[name]
+		return reserved
+	}
+	return true
+}
+
 var (
+	// reservedOperators are the builtin operators which can not be overridden by the
+	// operators in the config, the builtin operators added later are not reserved, so
+	// the existing operators of the same names in the configs keep working.
+	reservedOperators = map[string]struct{}{
+		"add": {}, "sub": {}, "mul": {}, "div": {}, "mod": {}, "+": {}, "-": {}, "*": {}, "/": {}, "%": {},
+		"and": {}, "or": {}, "xor": {}, "not": {}, "&": {}, "|": {}, "!": {},
+		"eq": {}, "ne": {}, "gt": {}, "lt": {}, "ge": {}, "le": {},
+		"=": {}, "!=": {}, ">": {}, "<": {}, ">=": {}, "<=": {}, "between": {},
+		"in": {}, "overlap": {},
+		"date": {}, "datetime": {}, "to_date": {}, "to_datetime": {},
+		"t_time": {}, "t_date": {}, "td_time": {}, "td_date": {},
+		"version": {}, "t_version": {}, "to_version": {},
+		"==": {}, "&&": {}, "||": {},
+	}
+
 	builtinOperators = map[string]Operator{
 		// arithmetic
 		"add": arithmetic{mode: add}.execute,
@@ -35,6 +256,8 @@ var (
 		"/":   arithmetic{mode: div}.execute,
 		"%":   arithmetic{mode: mod}.execute,
 
+		"divisible": arithDivisible,
+
 		// logic
 		"and": logic{mode: and}.execute,
 		"or":  logic{mode: or}.execute,
@@ -60,8 +283,45 @@ var (
 		"between": comparisonBetween,
 
 		// list
-		"in":      listIn,
-		"overlap": listOverlap,
+		"in":           listIn,
+		"overlap":      listOverlap,
+		"count_of":     listCountOf,
+		"frequencies":  listFrequencies,
+		"range":        listRange{}.execute,
+		"coerce_list":  listCoerce,
+		"append":       listInsert{}.execute,
+		"prepend":      listInsert{prepend: true}.execute,
+		"concat_lists": listConcat,
+
+		"all_equal":     listAllEqual,
+		"any_duplicate": listAnyDuplicate,
+
+		// aggregates
+		"sum": listAggregate{op: "sum"}.execute,
+		"avg": listAggregate{op: "avg"}.execute,
+		"min": listAggregate{op: "min"}.execute,
+		"max": listAggregate{op: "max"}.execute,
+
+		// statistics
+		"median":     statMedian,
+		"variance":   statVariance,
+		"stddev":     statStddev,
+		"percentile": statPercentile,
+
+		// percentage
+		"pct_of":    pctOf,
+		"apply_pct": applyPct,
+		"ratio":     ratio,
+
+		// aggregate
+		"dict":  aggregate{}.dict,
+		"tuple": aggregate{}.tuple,
+
+		// dict
+		"has_key":   dictHasKey,
+		"has_value": dictHasValue,
+		"keys":      dictKeys,
+		"values":    dictValues,
 
 		// time
 		"date":        timeConvert{mode: date, layout: defaultDateLayout}.execute,
@@ -79,6 +339,48 @@ var (
 		"t_version":  versionConvert{mode: toVersion, validLen: 3}.execute,
 		"to_version": versionConvert{mode: version, validLen: 3}.execute,
 
+		// conversion
+		"int":          convertInt,
+		"parse_int":    convertParseInt,
+		"coerce_bool":  convertBool,
+		"bool":         convertBool,
+		"parse_int_or": convertParseIntOr,
+		"default":      convertDefault,
+
+		// string
+		"concat": strConcat,
+		"empty":  strEmpty,
+		"blank":  strBlank,
+		"len":    strLen,
+
+		"normalize_space": strNormalizeSpace,
+		"edit_distance":   strEditDistance,
+		"repeat_str":      strRepeat{}.execute,
+		"regex":           strRegex,
+
+		// format
+		"format_number": formatNumber,
+
+		// hash
+		"hash":   hashValue,
+		"sample": hashSample,
+
+		// json
+		"json_get": jsonGet,
+
+		// network
+		"in_cidr": netInCIDR,
+
+		// url
+		"url_scheme": urlExtract{op: "url_scheme"}.execute,
+		"url_host":   urlExtract{op: "url_host"}.execute,
+		"url_path":   urlExtract{op: "url_path"}.execute,
+		"url_query":  urlExtract{op: "url_query"}.execute,
+
+		// validation
+		"is_email": isEmail,
+		"is_phone": isPhone,
+
 		// infix notation patch
 		"==": comparisonEquals,
 		"&&": logic{mode: and}.execute,
@@ -89,16 +391,72 @@ var (
 	// stateless functions will be used in optimizeConstantFolding,
 	// so please make sure when adding new operators into builtinStatelessOperations
 	builtinStatelessOperations = []string{
-		"add", "sub", "mul", "div", "mod", "+", "-", "*", "/", "%",
+		"add", "sub", "mul", "div", "mod", "+", "-", "*", "/", "%", "divisible",
 		"and", "or", "xor", "not", "&", "|", "!",
 		"eq", "ne", "gt", "lt", "ge", "le", "=", "!=", ">", "<", ">=", "<=", "between",
-		"in", "overlap",
+		"in", "overlap", "count_of", "frequencies", "all_equal", "any_duplicate", "range", "coerce_list",
+		"append", "prepend", "concat_lists",
+		"dict", "tuple",
+		"has_key", "has_value", "keys", "values",
+		"sum", "avg", "min", "max",
+		"median", "variance", "stddev", "percentile",
+		"pct_of", "apply_pct", "ratio",
 		"date", "datetime", "to_date", "to_datetime", "t_time", "t_date", "td_time", "td_date",
 		"version", "t_version", "to_version",
+		"int", "parse_int", "parse_int_or", "coerce_bool", "bool", "default",
+		"concat", "empty", "blank", "len", "normalize_space", "edit_distance", "repeat_str", "regex",
+		"format_number",
+		"hash", "sample",
+		"json_get",
+		"in_cidr",
+		"url_scheme", "url_host", "url_path", "url_query",
+		"is_email", "is_phone",
 		"==", "&&", "||",
 	}
+
+	// builtinOperatorBuilders build the builtin operators which depend on the config or
+	// the constant params, the built operators take the place of the ones in builtinOperators
+	builtinOperatorBuilders = map[string]operatorBuilder{
+		"range": func(conf *Config, _ []*astNode) (Operator, error) {
+			return listRange{maxLen: conf.MaxResultLen}.execute, nil
+		},
+		"dict": func(conf *Config, _ []*astNode) (Operator, error) {
+			return aggregate{maxDepth: conf.MaxOutputDepth}.dict, nil
+		},
+		"tuple": func(conf *Config, _ []*astNode) (Operator, error) {
+			return aggregate{maxDepth: conf.MaxOutputDepth}.tuple, nil
+		},
+		"in_cidr":       buildInCIDR,
+		"format_number": buildFormatNumber,
+		"json_get":      buildJSONGet,
+		"percentile":    buildPercentile,
+		"url_scheme":    buildURLExtract("url_scheme"),
+		"url_host":      buildURLExtract("url_host"),
+		"url_path":      buildURLExtract("url_path"),
+		"url_query":     buildURLExtract("url_query"),
+		"is_phone":      buildIsPhone,
+		"repeat_str":    buildRepeatStr,
+		"concat":        buildConcat,
+		"regex":         buildRegex,
+	}
+
+	// builtinPrecomputers precompute the expensive parts of the builtin operators from their
+	// constant params in the constant folding, e.g. the sets of the constant lists of `in`.
+	// The returned operators take the place of the ones of the nodes, and nil is returned
+	// if there is nothing to precompute.
+	builtinPrecomputers = map[string]func(params []*astNode) Operator{
+		"in": precomputeIn,
+	}
+
+	ErrResultLenExceeded   = errors.New("result length exceeded")
+	ErrOutputDepthExceeded = errors.New("output depth exceeded")
+
+	ErrUnexpectedReturnType = errors.New("unexpected return type")
 )
 
+// operatorBuilder builds an operator at compile time, e.g. to precompile its constant params
+type operatorBuilder func(conf *Config, params []*astNode) (Operator, error)
+
 type mode int
 
 const (
@@ -186,8 +544,16 @@ const (
 	typeStr     = "string"
 	typeIntList = "[]int64"
 	typeStrList = "[]string"
+	typeList    = "list"
+	typeDict    = "dict"
 )
 
+// intArithmeticModes are the builtin arithmetic operators which can be evaluated on int64s directly
+var intArithmeticModes = map[string]mode{
+	"add": add, "sub": sub, "mul": mul, "div": div, "mod": mod,
+	"+": add, "-": sub, "*": mul, "/": div, "%": mod,
+}
+
 type arithmetic struct {
 	mode mode
 }
@@ -201,43 +567,115 @@ func (a arithmetic) execute(_ *Ctx, params []Value) (Value, error) {
 	for i, p := range params {
 		v, ok := p.(int64)
 		if !ok {
-			return nil, errTypeInt(a.mode, p)
+			if _, isFloat := p.(float64); isFloat {
+				return a.executeFloat(params)
+			}
+			return nil, ParamTypeError(modeNames[a.mode], "number", p)
 		}
 
 		if i == 0 {
 			res = v
-		} else {
-			switch a.mode {
-			case add:
-				res += v
-			case sub:
-				res -= v
-			case mul:
-				res *= v
-			case div:
-				if v == 0 {
-					return nil, OpExecError("div", errors.New("divide by zero"))
-				}
+			continue
+		}
+		var err error
+		if res, err = a.apply(res, v); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// executeFloat applies the arithmetic to the params promoted to float64, it's used if any
+// of the params is a float64, e.g. `(* 2 1.5)` is 3.0. The remainder of mod has the sign
+// of the dividend as the int64 mod does.
+func (a arithmetic) executeFloat(params []Value) (Value, error) {
+	op := modeNames[a.mode]
+	var res float64
+	for i, p := range params {
+		var v float64
+		switch n := p.(type) {
+		case int64:
+			v = float64(n)
+		case float64:
+			v = n
+		default:
+			return nil, ParamTypeError(op, "number", p)
+		}
+
+		if i == 0 {
+			res = v
+			continue
+		}
+		switch a.mode {
+		case add:
+			res += v
+		case sub:
+			res -= v
+		case mul:
+			res *= v
+		case div, mod:
+			if v == 0 {
+				return nil, OpExecError(op, errors.New("divide by zero"))
+			}
+			if a.mode == div {
 				res /= v
-			case mod:
-				if v == 0 {
-					return nil, OpExecError("mod", errors.New("divide by zero"))
-				}
-				res %= v
-			default:
-				return 0, errInvalidMode(a.mode, "arithmetic")
+			} else {
+				res = math.Mod(res, v)
 			}
+		default:
+			return nil, errInvalidMode(a.mode, "arithmetic")
 		}
 	}
 	return res, nil
 }
 
+// apply applies the arithmetic to x and y, it's shared by the int64 evaluation path
+func (a arithmetic) apply(x, y int64) (int64, error) {
+	switch a.mode {
+	case add:
+		return x + y, nil
+	case sub:
+		return x - y, nil
+	case mul:
+		return x * y, nil
+	case div:
+		if y == 0 {
+			return 0, OpExecError("div", errors.New("divide by zero"))
+		}
+		return x / y, nil
+	case mod:
+		if y == 0 {
+			return 0, OpExecError("mod", errors.New("divide by zero"))
+		}
+		return x % y, nil
+	default:
+		return 0, errInvalidMode(a.mode, "arithmetic")
+	}
+}
+
+// arithDivisible checks if the integer x is divisible by n, e.g. `(divisible x 5)`
+func arithDivisible(_ *Ctx, params []Value) (Value, error) {
+	const op = "divisible"
+	x, n, err := DestructParamsInt2(op, params)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, OpExecError(op, errors.New("divide by zero"))
+	}
+	return x%n == 0, nil
+}
+
 type logic struct {
 	mode mode
 }
 
 func (c logic) execute(_ *Ctx, params []Value) (Value, error) {
-	if len(params) < 2 {
+	switch {
+	case len(params) == 0 && (c.mode == and || c.mode == or):
+		// the identities, `(and)` is true and `(or)` is false
+		return c.mode == and, nil
+	case len(params) < 2 && c.mode == xor:
 		return nil, errCnt2(c.mode, params)
 	}
 
@@ -281,38 +719,57 @@ type comparison struct {
 	mode mode
 }
 
+// execute compares two int64s, two strings in lexicographic order, or two numbers
+// which are promoted to float64 if any of them is a float64, e.g. `(> 2 1.5)`
 func (c comparison) execute(_ *Ctx, params []Value) (Value, error) {
 	if len(params) != 2 {
 		return nil, errCnt2(c.mode, params)
 	}
 
-	i, ok := params[0].(int64)
-	if !ok {
-		return nil, errTypeInt(c.mode, params[0])
+	switch i := params[0].(type) {
+	case int64:
+		if j, ok := params[1].(int64); ok {
+			return c.compare(i < j, i == j)
+		}
+	case string:
+		j, ok := params[1].(string)
+		if !ok {
+			return nil, errTypeStr(c.mode, params[1])
+		}
+		return c.compare(i < j, i == j)
 	}
 
-	j, ok := params[1].(int64)
-	if !ok {
-		return nil, errTypeInt(c.mode, params[1])
+	x, y, err := numParams2(modeNames[c.mode], params)
+	if err != nil {
+		return nil, err
 	}
+	if x != x || y != y {
+		// NaN is not ordered
+		return false, nil
+	}
+	return c.compare(x < y, x == y)
+}
 
+func (c comparison) compare(lt, eq bool) (Value, error) {
 	switch c.mode {
 	case greater:
-		return i > j, nil
+		return !lt && !eq, nil
 	case less:
-		return i < j, nil
+		return lt, nil
 	case greaterEquals:
-		return i >= j, nil
+		return !lt, nil
 	case lessEquals:
-		return i <= j, nil
+		return lt || eq, nil
 	default:
 		return false, errInvalidMode(c.mode, "comparison")
 	}
 }
 
+// comparisonEquals checks if the params are all equal, the int64s and the float64s are
+// promoted to float64 as the ordering comparisons do, e.g. `(= 1 1.0)` is true
 func comparisonEquals(_ *Ctx, params []Value) (Value, error) {
 	if len(params) == 2 {
-		return params[0] == params[1], nil
+		return valueEquals(params[0], params[1]), nil
 	}
 
 	if len(params) < 2 {
@@ -321,7 +778,7 @@ func comparisonEquals(_ *Ctx, params []Value) (Value, error) {
 
 	v := params[0]
 	for _, p := range params {
-		if v != p {
+		if !valueEquals(v, p) {
 			return false, nil
 		}
 	}
@@ -333,28 +790,119 @@ func comparisonNotEquals(_ *Ctx, params []Value) (Value, error) {
 		return nil, errCnt2(notEquals, params)
 	}
 
-	return params[0] != params[1], nil
+	return !valueEquals(params[0], params[1]), nil
+}
+
+// valueEquals compares the values by ==, except the mixed int64 and float64, which are
+// compared as float64s, and the lists and dicts, which are compared element by element,
+// e.g. `(= (1 2) (1.0 2))` is true. The other uncomparable values are compared deeply.
+func valueEquals(a, b Value) bool {
+	switch x := a.(type) {
+	case int64:
+		if y, ok := b.(float64); ok {
+			return float64(x) == y
+		}
+	case float64:
+		if y, ok := b.(int64); ok {
+			return x == float64(y)
+		}
+	case string, bool:
+	case []int64, []string, []interface{}:
+		return listEquals(a, b)
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, v := range x {
+			if w, exist := y[k]; !exist || !valueEquals(v, w) {
+				return false
+			}
+		}
+		return true
+	default:
+		if t := reflect.TypeOf(a); t != nil && !t.Comparable() {
+			return reflect.DeepEqual(a, b)
+		}
+	}
+	return a == b
+}
+
+// listEquals compares the lists element by element by valueEquals
+func listEquals(a, b Value) bool {
+	switch x := a.(type) {
+	case []int64:
+		if y, ok := b.([]int64); ok {
+			if len(x) != len(y) {
+				return false
+			}
+			for i := range x {
+				if x[i] != y[i] {
+					return false
+				}
+			}
+			return true
+		}
+	case []string:
+		if y, ok := b.([]string); ok {
+			if len(x) != len(y) {
+				return false
+			}
+			for i := range x {
+				if x[i] != y[i] {
+					return false
+				}
+			}
+			return true
+		}
+	}
+
+	xs, _ := listElems(a)
+	ys, ok := listElems(b)
+	if !ok || len(xs) != len(ys) {
+		return false
+	}
+	for i := range xs {
+		if !valueEquals(xs[i], ys[i]) {
+			return false
+		}
+	}
+	return true
 }
 
+// comparisonBetween checks if `lo <= v <= hi` for `(between v lo hi)`,
+// the three params should be all int64s or all float64s
 func comparisonBetween(_ *Ctx, params []Value) (Value, error) {
 	const op = "between"
 	if len(params) != 3 {
 		return nil, ParamsCountError(op, 3, len(params))
 	}
 
-	v, ok := params[0].(int64)
-	if !ok {
-		return nil, errTypeInt(between, params[0])
-	}
-	a, ok := params[1].(int64)
-	if !ok {
-		return nil, errTypeInt(between, params[1])
-	}
-	b, ok := params[2].(int64)
-	if !ok {
-		return nil, errTypeInt(between, params[2])
+	switch v := params[0].(type) {
+	case int64:
+		a, ok := params[1].(int64)
+		if !ok {
+			return nil, errTypeInt(between, params[1])
+		}
+		b, ok := params[2].(int64)
+		if !ok {
+			return nil, errTypeInt(between, params[2])
+		}
+		return a <= v && v <= b, nil
+	case float64:
+		a, ok := params[1].(float64)
+		if !ok {
+			return nil, ParamTypeError(op, "float64", params[1])
+		}
+		b, ok := params[2].(float64)
+		if !ok {
+			return nil, ParamTypeError(op, "float64", params[2])
+		}
+		// NaN is not ordered, so it's never between
+		return a <= v && v <= b, nil
+	default:
+		return nil, ParamTypeError(op, "number", params[0])
 	}
-	return a <= v && v <= b, nil
 }
 
 func listIn(_ *Ctx, params []Value) (Value, error) {
@@ -362,6 +910,9 @@ func listIn(_ *Ctx, params []Value) (Value, error) {
 	if len(params) != 2 {
 		return nil, errCnt2(in, params)
 	}
+	if coll, ok := params[1].([]interface{}); ok {
+		return listContains(op, coll, params[0])
+	}
 	switch v := params[0].(type) {
 	case string:
 		switch coll := params[1].(type) {
@@ -396,8 +947,97 @@ func listIn(_ *Ctx, params []Value) (Value, error) {
 			return exist, nil
 		}
 		return nil, ParamTypeError(op, typeIntList, params[1])
+	case float64:
+		// the integers are promoted to floats as the equality comparisons do
+		switch coll := params[1].(type) {
+		case []int64:
+			for _, i := range coll {
+				if float64(i) == v {
+					return true, nil
+				}
+			}
+			return false, nil
+		case []string: // the empty list is parsed to a string list
+			if len(coll) == 0 {
+				return false, nil
+			}
+		case map[int64]struct{}:
+			i := int64(v)
+			if float64(i) != v {
+				return false, nil
+			}
+			_, exist := coll[i]
+			return exist, nil
+		}
+		return nil, ParamTypeError(op, typeIntList, params[1])
+	}
+	return nil, ParamTypeError(op, "string or number", params[0])
+}
+
+// inSetMinLen is the min length of the constant lists converted into sets by precomputeIn,
+// the linear search is faster for the shorter lists
+const inSetMinLen = 12
+
+// precomputeIn converts the constant list into a set, e.g. `(in status ("a" "b" ... "z"))`
+func precomputeIn(params []*astNode) Operator {
+	if len(params) != 2 || params[1].node.getNodeType() != constant {
+		return nil
+	}
+
+	switch coll := params[1].node.value.(type) {
+	case []string:
+		if len(coll) < inSetMinLen {
+			return nil
+		}
+		set := make(map[string]struct{}, len(coll))
+		for _, s := range coll {
+			set[s] = struct{}{}
+		}
+		return func(ctx *Ctx, params []Value) (Value, error) {
+			if len(params) == 2 {
+				if v, ok := params[0].(string); ok {
+					_, exist := set[v]
+					return exist, nil
+				}
+			}
+			return listIn(ctx, params)
+		}
+	case []int64:
+		if len(coll) < inSetMinLen {
+			return nil
+		}
+		set := make(map[int64]struct{}, len(coll))
+		for _, i := range coll {
+			set[i] = struct{}{}
+		}
+		return func(ctx *Ctx, params []Value) (Value, error) {
+			if len(params) == 2 {
+				if v, ok := params[0].(int64); ok {
+					_, exist := set[v]
+					return exist, nil
+				}
+			}
+			return listIn(ctx, params)
+		}
+	}
+	return nil
+}
+
+// listContains checks if the mixed-type list contains the value, e.g. `(in status ("active" 1))`,
+// the elements of other types than the value are not equal to it.
+func listContains(op string, coll []interface{}, v Value) (Value, error) {
+	switch v.(type) {
+	case string, int64, float64, bool:
+	default:
+		// the lists and dicts are not comparable
+		return nil, OpExecError(op, fmt.Errorf("unsupported value type %T", v))
 	}
-	return nil, OpExecError(op, errors.New("unsupported list type"))
+	for _, e := range coll {
+		if valueEquals(unifyType(e), v) {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 func listOverlap(_ *Ctx, params []Value) (Value, error) {
@@ -474,57 +1114,571 @@ func listOverlap(_ *Ctx, params []Value) (Value, error) {
 	return nil, ParamTypeError(op, typeStrList, params[0])
 }
 
-const (
-	defaultDatetimeLayout = "2006-01-02 15:04:05"
-	defaultDateLayout     = "2006-01-02"
-)
-
-type timeConvert struct {
-	mode   mode
-	layout string
+// listElems returns the elements of a list value,
+// the supported list types are []int64, []string and []interface{}.
+// The elements of []interface{} are not unified, the keywords unify each one when binding it.
+func listElems(v Value) ([]interface{}, bool) {
+	switch l := v.(type) {
+	case []interface{}:
+		return l, true
+	case []int64:
+		res := make([]interface{}, len(l))
+		for i, e := range l {
+			res[i] = e
+		}
+		return res, true
+	case []string:
+		res := make([]interface{}, len(l))
+		for i, e := range l {
+			res[i] = e
+		}
+		return res, true
+	}
+	return nil, false
 }
 
-func (c timeConvert) execute(_ *Ctx, params []Value) (Value, error) {
-	var layout string
-	switch c.mode {
-	case datetime, date:
-		switch len(params) {
-		case 1:
-			layout = c.layout
-		case 2:
-			temp, ok := params[1].(string)
-			if !ok {
-				return nil, errTypeStr(c.mode, params[1])
+// limitResultLen wraps the operator to return an error if it produces a list longer than max,
+// the error is annotated with the position of the operator in the expression.
+func limitResultLen(op Operator, opName string, max int, pos string) Operator {
+	return func(ctx *Ctx, params []Value) (Value, error) {
+		res, err := op(ctx, params)
+		if err == nil {
+			if l := resultLen(res); l > max {
+				err = resultLenErr(opName, max, uint64(l))
 			}
-			layout = temp
-		default:
-			return nil, ParamsCountError(modeNames[c.mode], 1, len(params))
-		}
-	case toTime, toDate:
-		if len(params) != 2 {
-			return nil, errCnt2(c.mode, params)
-		}
-		temp, ok := params[1].(string)
-		if !ok {
-			return nil, errTypeStr(c.mode, params[1])
 		}
-		layout = temp
-	case toDefaultTime, toDefaultDate:
-		if len(params) != 1 {
-			return nil, ParamsCountError(modeNames[c.mode], 1, len(params))
+		if err != nil && errors.Is(err, ErrResultLenExceeded) {
+			return nil, fmt.Errorf("%w occurs at %s", err, pos)
 		}
-		layout = c.layout
+		return res, err
 	}
+}
 
-	v, ok := params[0].(string)
-	if !ok {
-		return nil, errTypeStr(c.mode, params[0])
-	}
-	t, err := time.Parse(layout, v)
-	if err != nil {
-		return nil, OpExecError(modeNames[c.mode], err)
+// checkReturns wraps the operator to return an error if its result is not of the type,
+// the pos is the position of the operator in the expression.
+func checkReturns(op Operator, opName string, t ValueType, pos string) Operator {
+	return func(ctx *Ctx, params []Value) (Value, error) {
+		res, err := op(ctx, params)
+		if err == nil && !t.matches(res) {
+			return nil, fmt.Errorf("%w occurs at %s",
+				OpExecError(opName, fmt.Errorf("%w (want: %s, got: %T)", ErrUnexpectedReturnType, t, res)), pos)
+		}
+		return res, err
 	}
-	return t.Unix(), nil
+}
+
+// limitDuration wraps the operator to fail once a call of it lasts longer than the timeout,
+// the operator is called in a separate goroutine, and its result is dropped after the timeout.
+func limitDuration(op Operator, opName string, timeout time.Duration) Operator {
+	type result struct {
+		res Value
+		err error
+	}
+	return func(ctx *Ctx, params []Value) (Value, error) {
+		if ctx == nil || ctx.Ctx == nil {
+			return op(ctx, params)
+		}
+
+		tctx, cancel := context.WithTimeout(ctx.Ctx, timeout)
+		defer cancel()
+		c := *ctx
+		c.Ctx = tctx
+
+		// the params may be pooled buffers of the evaluation, which are reused once it
+		// returns on the timeout, so the goroutine works on a copy of them
+		params = append([]Value(nil), params...)
+		done := make(chan result, 1)
+		go func() {
+			res, err := op(&c, params)
+			done <- result{res: res, err: err}
+		}()
+
+		select {
+		case r := <-done:
+			return r.res, r.err
+		case <-tctx.Done():
+			if errors.Is(tctx.Err(), context.DeadlineExceeded) && ctx.Ctx.Err() == nil {
+				return nil, OpExecError(opName, fmt.Errorf("timeout after %v: %w", timeout, tctx.Err()))
+			}
+			return nil, OpExecError(opName, tctx.Err())
+		}
+	}
+}
+
+func resultLen(v Value) int {
+	switch l := v.(type) {
+	case []interface{}:
+		return len(l)
+	case []int64:
+		return len(l)
+	case []string:
+		return len(l)
+	}
+	return 0
+}
+
+// defaultMaxResultLen is the max length of the results of the operators producing large
+// outputs from small params, such as range and repeat_str, when MaxResultLen is not set
+const defaultMaxResultLen = 1 << 20
+
+// maxResultLen returns the max length of the results by the configured one, 0 means the default
+func maxResultLen(max int) int {
+	if max > 0 {
+		return max
+	}
+	return defaultMaxResultLen
+}
+
+func resultLenErr(opName string, max int, got uint64) error {
+	return OpExecError(opName, fmt.Errorf("%w (max: %d, got: %d)", ErrResultLenExceeded, max, got))
+}
+
+// listRange returns the integers from start (inclusive) to end (exclusive) by step,
+// the step is optional and defaults to 1. e.g. `(range 1 7 2)` returns `(1 3 5)`
+// The length of the result is limited by the maxLen, 0 means defaultMaxResultLen.
+type listRange struct {
+	maxLen int
+}
+
+func (r listRange) execute(_ *Ctx, params []Value) (Value, error) {
+	start, step, n, err := r.bounds(params)
+	if err != nil {
+		return nil, err
+	}
+	if max := maxResultLen(r.maxLen); n > uint64(max) {
+		return nil, resultLenErr("range", max, n)
+	}
+
+	res := make([]int64, n)
+	for i := range res {
+		res[i] = start + int64(i)*step
+	}
+	return res, nil
+}
+
+// stream yields the integers one by one without materializing the list,
+// so the maxLen is not applied.
+func (r listRange) stream(ctx *Ctx, params []Value, _ []*lambda, yield func(Value) error) error {
+	start, step, n, err := listRange{}.bounds(params)
+	if err != nil {
+		return err
+	}
+
+	for i := uint64(0); i < n; i++ {
+		if i%cancelCheckInterval == 0 {
+			if err = cancelled(ctx); err != nil {
+				return err
+			}
+		}
+		if err = yield(start + int64(i)*step); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bounds returns the start, the step and the count of the integers in the range
+func (r listRange) bounds(params []Value) (start, step int64, n uint64, err error) {
+	const op = "range"
+	if len(params) != 2 && len(params) != 3 {
+		return 0, 0, 0, paramsRangeCountError(op, 2, 3, len(params))
+	}
+
+	var nums [3]int64
+	nums[2] = 1
+	for i, p := range params {
+		v, ok := p.(int64)
+		if !ok {
+			return 0, 0, 0, ParamTypeError(op, typeInt, p)
+		}
+		nums[i] = v
+	}
+
+	start, end, step := nums[0], nums[1], nums[2]
+	switch {
+	case step == 0:
+		return 0, 0, 0, OpExecError(op, errors.New("step should not be 0"))
+	case step > 0 && start < end:
+		n = (uint64(end-start)-1)/uint64(step) + 1
+	case step < 0 && start > end:
+		n = (uint64(start-end)-1)/uint64(-step) + 1
+	}
+
+	return start, step, n, nil
+}
+
+// listCoerce returns the list unchanged, and wraps a scalar value into a single-element list,
+// the strings and integers are wrapped into []string and []int64, the others into []interface{}.
+// It returns an empty list for nil or DNE, which is a []string as the empty list literal `()`.
+func listCoerce(_ *Ctx, params []Value) (Value, error) {
+	const op = "coerce_list"
+	if len(params) != 1 {
+		return nil, ParamsCountError(op, 1, len(params))
+	}
+
+	switch v := params[0].(type) {
+	case []string, []int64, []interface{}:
+		return v, nil
+	case nil, dne:
+		return []string{}, nil
+	case string:
+		return []string{v}, nil
+	case int64:
+		return []int64{v}, nil
+	default:
+		return []interface{}{v}, nil
+	}
+}
+
+// listInsert returns a new list with the value appended or prepended, the input list is not changed.
+// The value should match the element type of the list, e.g. an int64 for an []int64,
+// and an empty list takes the type of the value.
+type listInsert struct {
+	prepend bool
+}
+
+func (l listInsert) execute(_ *Ctx, params []Value) (Value, error) {
+	op := "append"
+	if l.prepend {
+		op = "prepend"
+	}
+	if len(params) != 2 {
+		return nil, ParamsCountError(op, 2, len(params))
+	}
+
+	x := params[1]
+	switch list := params[0].(type) {
+	case []int64:
+		v, ok := x.(int64)
+		if !ok && len(list) != 0 {
+			return nil, ParamTypeError(op, typeInt, x)
+		}
+		if ok {
+			return insertInt64(list, v, l.prepend), nil
+		}
+	case []string:
+		v, ok := x.(string)
+		if !ok && len(list) != 0 {
+			return nil, ParamTypeError(op, typeStr, x)
+		}
+		if ok {
+			return insertString(list, v, l.prepend), nil
+		}
+	case []interface{}:
+		return insertInterface(list, x, l.prepend), nil
+	default:
+		return nil, ParamTypeError(op, typeList, params[0])
+	}
+
+	// the list is empty
+	switch v := x.(type) {
+	case int64:
+		return []int64{v}, nil
+	case string:
+		return []string{v}, nil
+	}
+	return []interface{}{x}, nil
+}
+
+func insertInt64(list []int64, v int64, prepend bool) []int64 {
+	res := make([]int64, 0, len(list)+1)
+	if prepend {
+		return append(append(res, v), list...)
+	}
+	return append(append(res, list...), v)
+}
+
+func insertString(list []string, v string, prepend bool) []string {
+	res := make([]string, 0, len(list)+1)
+	if prepend {
+		return append(append(res, v), list...)
+	}
+	return append(append(res, list...), v)
+}
+
+func insertInterface(list []interface{}, v interface{}, prepend bool) []interface{} {
+	res := make([]interface{}, 0, len(list)+1)
+	if prepend {
+		return append(append(res, v), list...)
+	}
+	return append(append(res, list...), v)
+}
+
+// listConcat returns a new list of the elements of the two lists, the input lists are not changed.
+// The lists of different element types are concatenated into a []interface{}.
+func listConcat(_ *Ctx, params []Value) (Value, error) {
+	const op = "concat_lists"
+	if len(params) != 2 {
+		return nil, ParamsCountError(op, 2, len(params))
+	}
+	a, ok := listElems(params[0])
+	if !ok {
+		return nil, ParamTypeError(op, typeList, params[0])
+	}
+	b, ok := listElems(params[1])
+	if !ok {
+		return nil, ParamTypeError(op, typeList, params[1])
+	}
+
+	switch {
+	case len(a) == 0 && len(b) == 0:
+		if reflect.TypeOf(params[0]) == reflect.TypeOf(params[1]) {
+			return listCopy(params[0]), nil
+		}
+		return []interface{}{}, nil
+	case len(a) == 0:
+		return listCopy(params[1]), nil
+	case len(b) == 0:
+		return listCopy(params[0]), nil
+	}
+
+	switch x := params[0].(type) {
+	case []int64:
+		if y, ok := params[1].([]int64); ok {
+			return append(append(make([]int64, 0, len(x)+len(y)), x...), y...), nil
+		}
+	case []string:
+		if y, ok := params[1].([]string); ok {
+			return append(append(make([]string, 0, len(x)+len(y)), x...), y...), nil
+		}
+	}
+	return append(append(make([]interface{}, 0, len(a)+len(b)), a...), b...), nil
+}
+
+func listCopy(v Value) Value {
+	switch l := v.(type) {
+	case []int64:
+		return append([]int64{}, l...)
+	case []string:
+		return append([]string{}, l...)
+	case []interface{}:
+		return append([]interface{}{}, l...)
+	}
+	return v
+}
+
+// listCountOf counts the elements of the list that equal to the value,
+// the value should be a comparable type: string, int64 or bool.
+func listCountOf(_ *Ctx, params []Value) (Value, error) {
+	const op = "count_of"
+	if len(params) != 2 {
+		return nil, ParamsCountError(op, 2, len(params))
+	}
+	elems, ok := listElems(params[0])
+	if !ok {
+		return nil, ParamTypeError(op, typeList, params[0])
+	}
+
+	v := params[1]
+	switch v.(type) {
+	case string, int64, bool:
+	default:
+		return nil, ParamTypeError(op, "comparable", v)
+	}
+
+	var cnt int64
+	for _, e := range elems {
+		if e == v {
+			cnt++
+		}
+	}
+	return cnt, nil
+}
+
+// listFrequencies returns a dict that maps each distinct element of the list to its count.
+// The elements should be of the same comparable type: string, int64 or bool,
+// and they are formatted as the string keys of the dict.
+func listFrequencies(_ *Ctx, params []Value) (Value, error) {
+	const op = "frequencies"
+	if len(params) != 1 {
+		return nil, ParamsCountError(op, 1, len(params))
+	}
+
+	res := make(map[string]interface{})
+	switch l := params[0].(type) {
+	case []string:
+		for _, e := range l {
+			res[e] = countOf(res, e) + 1
+		}
+	case []int64:
+		for _, e := range l {
+			k := strconv.FormatInt(e, 10)
+			res[k] = countOf(res, k) + 1
+		}
+	case []interface{}:
+		var typ string
+		for _, e := range l {
+			var k, t string
+			switch v := e.(type) {
+			case string:
+				k, t = v, typeStr
+			case int64:
+				k, t = strconv.FormatInt(v, 10), typeInt
+			case bool:
+				k, t = strconv.FormatBool(v), typeBool
+			default:
+				return nil, ParamTypeError(op, "comparable", e)
+			}
+			if typ == "" {
+				typ = t
+			} else if typ != t {
+				return nil, ParamTypeError(op, typ, e)
+			}
+			res[k] = countOf(res, k) + 1
+		}
+	default:
+		return nil, ParamTypeError(op, typeList, params[0])
+	}
+	return res, nil
+}
+
+// listAllEqual checks if all the elements of the list are equal, it's true if the list has
+// at most one element. The check stops at the first element different from the first one.
+func listAllEqual(_ *Ctx, params []Value) (Value, error) {
+	const op = "all_equal"
+	if len(params) != 1 {
+		return nil, ParamsCountError(op, 1, len(params))
+	}
+
+	var first interface{}
+	equal := true
+	err := eachComparable(op, params[0], func(e interface{}) bool {
+		if first == nil {
+			first = e
+		} else if e != first {
+			equal = false
+		}
+		return equal
+	})
+	if err != nil {
+		return nil, err
+	}
+	return equal, nil
+}
+
+// listAnyDuplicate checks if any element of the list repeats,
+// the check stops at the first repeated element.
+func listAnyDuplicate(_ *Ctx, params []Value) (Value, error) {
+	const op = "any_duplicate"
+	if len(params) != 1 {
+		return nil, ParamsCountError(op, 1, len(params))
+	}
+
+	seen := make(map[interface{}]struct{})
+	dup := false
+	err := eachComparable(op, params[0], func(e interface{}) bool {
+		if _, dup = seen[e]; !dup {
+			seen[e] = struct{}{}
+		}
+		return !dup
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dup, nil
+}
+
+// eachComparable calls fn with each element of the list until fn returns false,
+// the elements should be all int64s, all strings or all bools
+func eachComparable(op string, list Value, fn func(e interface{}) bool) error {
+	switch l := list.(type) {
+	case []int64:
+		for _, e := range l {
+			if !fn(e) {
+				return nil
+			}
+		}
+	case []string:
+		for _, e := range l {
+			if !fn(e) {
+				return nil
+			}
+		}
+	case []interface{}:
+		var typ string
+		for _, e := range l {
+			var t string
+			switch e.(type) {
+			case string:
+				t = typeStr
+			case int64:
+				t = typeInt
+			case bool:
+				t = typeBool
+			default:
+				return ParamTypeError(op, "comparable", e)
+			}
+			if typ == "" {
+				typ = t
+			} else if typ != t {
+				return ParamTypeError(op, typ, e)
+			}
+			if !fn(e) {
+				return nil
+			}
+		}
+	default:
+		return ParamTypeError(op, typeList, list)
+	}
+	return nil
+}
+
+func countOf(dict map[string]interface{}, k string) int64 {
+	cnt, _ := dict[k].(int64)
+	return cnt
+}
+
+const (
+	defaultDatetimeLayout = "2006-01-02 15:04:05"
+	defaultDateLayout     = "2006-01-02"
+)
+
+type timeConvert struct {
+	mode   mode
+	layout string
+}
+
+func (c timeConvert) execute(_ *Ctx, params []Value) (Value, error) {
+	var layout string
+	switch c.mode {
+	case datetime, date:
+		switch len(params) {
+		case 1:
+			layout = c.layout
+		case 2:
+			temp, ok := params[1].(string)
+			if !ok {
+				return nil, errTypeStr(c.mode, params[1])
+			}
+			layout = temp
+		default:
+			return nil, ParamsCountError(modeNames[c.mode], 1, len(params))
+		}
+	case toTime, toDate:
+		if len(params) != 2 {
+			return nil, errCnt2(c.mode, params)
+		}
+		temp, ok := params[1].(string)
+		if !ok {
+			return nil, errTypeStr(c.mode, params[1])
+		}
+		layout = temp
+	case toDefaultTime, toDefaultDate:
+		if len(params) != 1 {
+			return nil, ParamsCountError(modeNames[c.mode], 1, len(params))
+		}
+		layout = c.layout
+	}
+
+	v, ok := params[0].(string)
+	if !ok {
+		return nil, errTypeStr(c.mode, params[0])
+	}
+	t, err := time.Parse(layout, v)
+	if err != nil {
+		return nil, OpExecError(modeNames[c.mode], err)
+	}
+	return t.Unix(), nil
 }
 
 type versionConvert struct {
@@ -532,47 +1686,1454 @@ type versionConvert struct {
 	validLen int
 }
 
-func (c versionConvert) execute(_ *Ctx, params []Value) (Value, error) {
-	var validLen int
-	switch len(params) {
-	case 1:
-		validLen = c.validLen
-	case 2:
-		temp, ok := params[1].(int64)
-		if !ok {
-			return nil, errTypeInt(c.mode, params[1])
+func (c versionConvert) execute(_ *Ctx, params []Value) (Value, error) {
+	var validLen int
+	switch len(params) {
+	case 1:
+		validLen = c.validLen
+	case 2:
+		temp, ok := params[1].(int64)
+		if !ok {
+			return nil, errTypeInt(c.mode, params[1])
+		}
+		if temp > 4 || temp < 1 {
+			return nil, OpExecError(modeNames[c.mode], fmt.Errorf("version valid length out of range: %d", temp))
+		}
+		validLen = int(temp)
+	default:
+		return nil, errCnt2(c.mode, params)
+	}
+	s, ok := params[0].(string)
+	if !ok {
+		return nil, errTypeStr(c.mode, params[0])
+	}
+
+	arr := strings.Split(s, ".")
+	var res int64
+	for i := 0; i < validLen; i++ {
+		if i < len(arr) {
+			v, err := strconv.ParseInt(arr[i], 10, 64)
+			if err != nil {
+				return nil, OpExecError(modeNames[c.mode], fmt.Errorf("version layout error, %s", s))
+			}
+			if v >= 10000 {
+				return nil, OpExecError(modeNames[c.mode], fmt.Errorf("version layout error, %s", s))
+			}
+			res = res*10000 + v
+		} else {
+			res = res * 10000
+		}
+	}
+	return res, nil
+}
+
+// listAggregate aggregates the numeric list by sum, avg, min or max. The results of the int64s
+// are int64s, and the integers are promoted to floats if any number is a float, except avg
+// which is always a float. The sum of an empty list is 0, the others are errors.
+type listAggregate struct {
+	op string
+}
+
+func (a listAggregate) execute(_ *Ctx, params []Value) (Value, error) {
+	if len(params) != 1 {
+		return nil, ParamsCountError(a.op, 1, len(params))
+	}
+
+	var ints []int64
+	switch l := params[0].(type) {
+	case []int64:
+		ints = l
+	case []interface{}:
+		ints = make([]int64, 0, len(l))
+		for _, e := range l {
+			n, ok := e.(int64)
+			if !ok {
+				// the integers are promoted to floats
+				nums, err := statNums(a.op, l)
+				if err != nil {
+					return nil, err
+				}
+				return a.floats(nums), nil
+			}
+			ints = append(ints, n)
+		}
+	case []string:
+		if len(l) != 0 {
+			return nil, ParamTypeError(a.op, "numeric list", params[0])
+		}
+	default:
+		return nil, ParamTypeError(a.op, "numeric list", params[0])
+	}
+
+	if len(ints) == 0 {
+		if a.op == "sum" {
+			return int64(0), nil
+		}
+		return nil, OpExecError(a.op, errors.New("the list is empty"))
+	}
+	return a.ints(ints), nil
+}
+
+func (a listAggregate) ints(nums []int64) Value {
+	res := nums[0]
+	switch a.op {
+	case "avg":
+		var sum float64
+		for _, n := range nums {
+			sum += float64(n)
+		}
+		return sum / float64(len(nums))
+	case "sum":
+		for _, n := range nums[1:] {
+			res += n
+		}
+	case "min":
+		for _, n := range nums[1:] {
+			if n < res {
+				res = n
+			}
+		}
+	case "max":
+		for _, n := range nums[1:] {
+			if n > res {
+				res = n
+			}
+		}
+	}
+	return res
+}
+
+func (a listAggregate) floats(nums []float64) Value {
+	res := nums[0]
+	switch a.op {
+	case "sum", "avg":
+		for _, n := range nums[1:] {
+			res += n
+		}
+		if a.op == "avg" {
+			res /= float64(len(nums))
+		}
+	case "min":
+		for _, n := range nums[1:] {
+			res = math.Min(res, n)
+		}
+	case "max":
+		for _, n := range nums[1:] {
+			res = math.Max(res, n)
+		}
+	}
+	return res
+}
+
+// statNums converts the numeric list into float64 numbers, the list should not be empty
+func statNums(op string, v Value) ([]float64, error) {
+	var nums []float64
+	switch l := v.(type) {
+	case []int64:
+		nums = make([]float64, len(l))
+		for i, n := range l {
+			nums[i] = float64(n)
+		}
+	case []interface{}:
+		nums = make([]float64, len(l))
+		for i, e := range l {
+			switch n := e.(type) {
+			case int64:
+				nums[i] = float64(n)
+			case float64:
+				nums[i] = n
+			default:
+				return nil, ParamTypeError(op, "number", e)
+			}
+		}
+	case []string:
+		if len(l) != 0 {
+			return nil, ParamTypeError(op, "numeric list", v)
+		}
+	default:
+		return nil, ParamTypeError(op, "numeric list", v)
+	}
+	if len(nums) == 0 {
+		return nil, OpExecError(op, errors.New("the list is empty"))
+	}
+	return nums, nil
+}
+
+// statMedian returns the median of the numeric list, it's the mean of
+// the two middle numbers if the length of the list is even.
+func statMedian(_ *Ctx, params []Value) (Value, error) {
+	const op = "median"
+	if len(params) != 1 {
+		return nil, ParamsCountError(op, 1, len(params))
+	}
+	nums, err := statNums(op, params[0])
+	if err != nil {
+		return nil, err
+	}
+	return percentile(nums, 50), nil
+}
+
+// statVariance returns the population variance of the numeric list
+func statVariance(_ *Ctx, params []Value) (Value, error) {
+	const op = "variance"
+	if len(params) != 1 {
+		return nil, ParamsCountError(op, 1, len(params))
+	}
+	nums, err := statNums(op, params[0])
+	if err != nil {
+		return nil, err
+	}
+	return variance(nums), nil
+}
+
+// statStddev returns the population standard deviation of the numeric list
+func statStddev(_ *Ctx, params []Value) (Value, error) {
+	const op = "stddev"
+	if len(params) != 1 {
+		return nil, ParamsCountError(op, 1, len(params))
+	}
+	nums, err := statNums(op, params[0])
+	if err != nil {
+		return nil, err
+	}
+	return math.Sqrt(variance(nums)), nil
+}
+
+// numParams2 converts the two number params into float64
+func numParams2(op string, params []Value) (a, b float64, err error) {
+	if len(params) != 2 {
+		return 0, 0, ParamsCountError(op, 2, len(params))
+	}
+	var res [2]float64
+	for i, p := range params {
+		switch n := p.(type) {
+		case int64:
+			res[i] = float64(n)
+		case float64:
+			res[i] = n
+		default:
+			return 0, 0, ParamTypeError(op, "number", p)
+		}
+	}
+	return res[0], res[1], nil
+}
+
+// divide returns a/b, it returns an error if b is zero
+func divide(op string, a, b float64) (float64, error) {
+	if b == 0 {
+		return 0, OpExecError(op, errors.New("divide by zero"))
+	}
+	return a / b, nil
+}
+
+// pctOf returns the percentage of x in total as a float, e.g. `(pct_of 25 200)` is 12.5
+func pctOf(_ *Ctx, params []Value) (Value, error) {
+	const op = "pct_of"
+	x, total, err := numParams2(op, params)
+	if err != nil {
+		return nil, err
+	}
+	r, err := divide(op, x, total)
+	if err != nil {
+		return nil, err
+	}
+	return r * 100, nil
+}
+
+// applyPct returns the base changed by p percent as a float, e.g. `(apply_pct 200 -10)` is 180
+func applyPct(_ *Ctx, params []Value) (Value, error) {
+	base, p, err := numParams2("apply_pct", params)
+	if err != nil {
+		return nil, err
+	}
+	// base + base*p/100 is more precise than base*(1+p/100), e.g. for (apply_pct 200 15)
+	return base + base*p/100, nil
+}
+
+// ratio returns a/b as a float, e.g. `(ratio 1 4)` is 0.25
+func ratio(_ *Ctx, params []Value) (Value, error) {
+	const op = "ratio"
+	a, b, err := numParams2(op, params)
+	if err != nil {
+		return nil, err
+	}
+	r, err := divide(op, a, b)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// statPercentile returns the p-th percentile of the numeric list, p is in [0, 100].
+// It's linearly interpolated between the closest ranks, the rank of p is p/100 * (n-1),
+// which is the same as the default method of numpy and Excel PERCENTILE.INC.
+func statPercentile(_ *Ctx, params []Value) (Value, error) {
+	const op = "percentile"
+	if len(params) != 2 {
+		return nil, ParamsCountError(op, 2, len(params))
+	}
+	p, err := percentileParam(params[1])
+	if err != nil {
+		return nil, OpExecError(op, err)
+	}
+	nums, err := statNums(op, params[0])
+	if err != nil {
+		return nil, err
+	}
+	return percentile(nums, p), nil
+}
+
+// buildPercentile validates p at compile time, it should be a constant in [0, 100],
+// or a sub-expression folded into such a constant, e.g. `(+ 40 10)`
+func buildPercentile(conf *Config, params []*astNode) (Operator, error) {
+	if len(params) != 2 {
+		return statPercentile, nil
+	}
+	p, ok := constantValue(conf, params[1])
+	if !ok {
+		return nil, errors.New("percentile p should be a constant")
+	}
+	if _, err := percentileParam(p); err != nil {
+		return nil, err
+	}
+	return statPercentile, nil
+}
+
+func percentileParam(v Value) (float64, error) {
+	var p float64
+	switch n := v.(type) {
+	case int64:
+		p = float64(n)
+	case float64:
+		p = n
+	default:
+		return 0, fmt.Errorf("percentile p should be a number, got: %v", v)
+	}
+	if p < 0 || p > 100 || math.IsNaN(p) {
+		return 0, fmt.Errorf("percentile p should be in [0, 100], got: %v", v)
+	}
+	return p, nil
+}
+
+func percentile(nums []float64, p float64) float64 {
+	sorted := make([]float64, len(nums))
+	copy(sorted, nums)
+	sort.Float64s(sorted)
+
+	rank := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	if lo == len(sorted)-1 {
+		return sorted[lo]
+	}
+	return sorted[lo] + (rank-float64(lo))*(sorted[lo+1]-sorted[lo])
+}
+
+func variance(nums []float64) float64 {
+	var mean float64
+	for _, n := range nums {
+		mean += n
+	}
+	mean /= float64(len(nums))
+
+	var sum float64
+	for _, n := range nums {
+		sum += (n - mean) * (n - mean)
+	}
+	return sum / float64(len(nums))
+}
+
+// aggregate constructs the nested structures, the depth of the constructed
+// structures is limited by maxDepth, 0 means no limit.
+type aggregate struct {
+	maxDepth int
+}
+
+// dict constructs a dict from the key value pairs, e.g. `(dict "name" name "age" age)`,
+// the keys should be strings and unique.
+func (a aggregate) dict(_ *Ctx, params []Value) (Value, error) {
+	const op = "dict"
+	if len(params)%2 != 0 {
+		return nil, OpExecError(op, fmt.Errorf("the count of params should be even, got: %d", len(params)))
+	}
+
+	res := make(map[string]interface{}, len(params)/2)
+	for i := 0; i < len(params); i += 2 {
+		k, ok := params[i].(string)
+		if !ok {
+			return nil, ParamTypeError(op, typeStr, params[i])
+		}
+		if _, exist := res[k]; exist {
+			return nil, OpExecError(op, fmt.Errorf("duplicate key [%s]", k))
+		}
+		res[k] = params[i+1]
+	}
+	if err := a.checkDepth(op, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// tuple constructs a tuple from two or more values, e.g. `(tuple name age)`
+func (a aggregate) tuple(_ *Ctx, params []Value) (Value, error) {
+	const op = "tuple"
+	if len(params) < 2 {
+		return nil, ParamsCountError(op, 2, len(params))
+	}
+
+	res := make([]interface{}, len(params))
+	for i, v := range params {
+		res[i] = v
+	}
+	if err := a.checkDepth(op, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (a aggregate) checkDepth(op string, v Value) error {
+	if a.maxDepth <= 0 {
+		return nil
+	}
+	if depth := outputDepth(v); depth > a.maxDepth {
+		return OpExecError(op, fmt.Errorf("%w (max: %d, got: %d)", ErrOutputDepthExceeded, a.maxDepth, depth))
+	}
+	return nil
+}
+
+// outputDepth returns the nesting depth of the value, the depth of scalars is 0,
+// and the depth of a list or a dict is 1 plus the max depth of its elements.
+func outputDepth(v Value) int {
+	max := 0
+	switch l := v.(type) {
+	case []int64, []string:
+		return 1
+	case []interface{}:
+		for _, e := range l {
+			if d := outputDepth(e); d > max {
+				max = d
+			}
+		}
+	case map[string]interface{}:
+		for _, e := range l {
+			if d := outputDepth(e); d > max {
+				max = d
+			}
+		}
+	default:
+		return 0
+	}
+	return max + 1
+}
+
+// dictParam returns the dict param, nil is treated as an empty dict
+func dictParam(op string, v Value) (map[string]interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, ParamTypeError(op, typeDict, v)
+	}
+	return d, nil
+}
+
+// sortedKeys returns the keys of the dict in ascending order
+func sortedKeys(d map[string]interface{}) []string {
+	keys := make([]string, 0, len(d))
+	for k := range d {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// dictHasKey checks if the dict has the key, the key should be a string
+func dictHasKey(_ *Ctx, params []Value) (Value, error) {
+	const op = "has_key"
+	if len(params) != 2 {
+		return nil, ParamsCountError(op, 2, len(params))
+	}
+	d, err := dictParam(op, params[0])
+	if err != nil {
+		return nil, err
+	}
+	k, ok := params[1].(string)
+	if !ok {
+		return nil, ParamTypeError(op, typeStr, params[1])
+	}
+	_, exist := d[k]
+	return exist, nil
+}
+
+// dictHasValue checks if any value of the dict deeply equals the value
+func dictHasValue(_ *Ctx, params []Value) (Value, error) {
+	const op = "has_value"
+	if len(params) != 2 {
+		return nil, ParamsCountError(op, 2, len(params))
+	}
+	d, err := dictParam(op, params[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range d {
+		if reflect.DeepEqual(unifyType(v), params[1]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// dictKeys returns the keys of the dict in ascending order
+func dictKeys(_ *Ctx, params []Value) (Value, error) {
+	const op = "keys"
+	if len(params) != 1 {
+		return nil, ParamsCountError(op, 1, len(params))
+	}
+	d, err := dictParam(op, params[0])
+	if err != nil {
+		return nil, err
+	}
+	return sortedKeys(d), nil
+}
+
+// dictValues returns the values of the dict in the ascending order of their keys
+func dictValues(_ *Ctx, params []Value) (Value, error) {
+	const op = "values"
+	if len(params) != 1 {
+		return nil, ParamsCountError(op, 1, len(params))
+	}
+	d, err := dictParam(op, params[0])
+	if err != nil {
+		return nil, err
+	}
+	res := make([]interface{}, 0, len(d))
+	for _, k := range sortedKeys(d) {
+		res = append(res, unifyType(d[k]))
+	}
+	return res, nil
+}
+
+// convertInt converts a numeric value to int64, float numbers are truncated toward zero.
+// Strings are not accepted, use parse_int to parse them instead. The float numbers out
+// of the range of int64, NaN and the infinities are errors.
+func convertInt(_ *Ctx, params []Value) (Value, error) {
+	const op = "int"
+	if len(params) != 1 {
+		return nil, ParamsCountError(op, 1, len(params))
+	}
+	var f float64
+	switch v := params[0].(type) {
+	case int64:
+		return v, nil
+	case float64:
+		f = v
+	case float32:
+		f = float64(v)
+	default:
+		return nil, ParamTypeError(op, "number", params[0])
+	}
+	// -2^63 is exact in float64, and NaN fails both comparisons
+	if !(f >= math.MinInt64 && f < -math.MinInt64) {
+		return nil, OpExecError(op, fmt.Errorf("integer overflow %v", f))
+	}
+	return int64(f), nil
+}
+
+// convertBool converts a value into a bool: the strings "true" and "1" are true,
+// the strings "false" and "0" are false, the numbers are true if they are nonzero,
+// and the bools are returned unchanged. The strings are matched exactly, e.g. "TRUE" and " 1" are errors.
+func convertBool(_ *Ctx, params []Value) (Value, error) {
+	const op = "coerce_bool"
+	if len(params) != 1 {
+		return nil, ParamsCountError(op, 1, len(params))
+	}
+	switch v := params[0].(type) {
+	case bool:
+		return v, nil
+	case int64:
+		return v != 0, nil
+	case float64:
+		return v != 0, nil
+	case string:
+		switch v {
+		case "true", "1":
+			return true, nil
+		case "false", "0":
+			return false, nil
+		}
+		return nil, OpExecError(op, fmt.Errorf("unrecognized bool string: [%s]", v))
+	}
+	return nil, ParamTypeError(op, "bool, number or string", params[0])
+}
+
+// convertParseInt parses a base 10 integer string, leading and trailing spaces are ignored.
+func convertParseInt(_ *Ctx, params []Value) (Value, error) {
+	const op = "parse_int"
+	if len(params) != 1 {
+		return nil, ParamsCountError(op, 1, len(params))
+	}
+	s, ok := params[0].(string)
+	if !ok {
+		return nil, ParamTypeError(op, typeStr, params[0])
+	}
+	v, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return nil, OpExecError(op, err)
+	}
+	return v, nil
+}
+
+// convertParseIntOr is like convertParseInt, but returns the default value if the string is not an integer.
+func convertParseIntOr(_ *Ctx, params []Value) (Value, error) {
+	const op = "parse_int_or"
+	if len(params) != 2 {
+		return nil, ParamsCountError(op, 2, len(params))
+	}
+	s, ok := params[0].(string)
+	if !ok {
+		return nil, ParamTypeError(op, typeStr, params[0])
+	}
+	def, ok := params[1].(int64)
+	if !ok {
+		return nil, ParamTypeError(op, typeInt, params[1])
+	}
+	v, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return def, nil
+	}
+	return v, nil
+}
+
+// convertDefault returns the fallback (the second param) if the value is nil, which is
+// the value of undefined variables, otherwise it returns the value.
+// The errors of evaluating the value are not swallowed, they're returned as they are.
+// In TryEval, the result is DNE if the value is not fetched yet, as other operators.
+func convertDefault(_ *Ctx, params []Value) (Value, error) {
+	const op = "default"
+	if len(params) != 2 {
+		return nil, ParamsCountError(op, 2, len(params))
+	}
+	if params[0] == nil {
+		return params[1], nil
+	}
+	return params[0], nil
+}
+
+// strConcat joins the strings, e.g. `(concat first " " last)`, it returns "" without params
+func strConcat(_ *Ctx, params []Value) (Value, error) {
+	const op = "concat"
+	n := 0
+	for i, p := range params {
+		s, ok := p.(string)
+		if !ok {
+			return nil, concatParamErr(op, i, p)
+		}
+		n += len(s)
+	}
+
+	var sb strings.Builder
+	sb.Grow(n)
+	for _, p := range params {
+		sb.WriteString(p.(string))
+	}
+	return sb.String(), nil
+}
+
+// buildConcat rejects the constant params which are not strings at compile time
+func buildConcat(_ *Config, params []*astNode) (Operator, error) {
+	for i, p := range params {
+		if p.node.getNodeType() != constant {
+			continue
+		}
+		if _, ok := p.node.value.(string); !ok {
+			return nil, concatParamErr("concat", i, p.node.value)
+		}
+	}
+	return strConcat, nil
+}
+
+func concatParamErr(op string, i int, p Value) error {
+	return fmt.Errorf("unexpected param type, operator: %s, param: %d, expected: %s, got: %+v", op, i, typeStr, p)
+}
+
+// strEmpty checks if the string, the list or the dict has no elements,
+// nil and undefined values are considered empty.
+func strEmpty(_ *Ctx, params []Value) (Value, error) {
+	const op = "empty"
+	if len(params) != 1 {
+		return nil, ParamsCountError(op, 1, len(params))
+	}
+	switch v := params[0].(type) {
+	case nil, dne:
+		return true, nil
+	case string:
+		return len(v) == 0, nil
+	case []string:
+		return len(v) == 0, nil
+	case []int64:
+		return len(v) == 0, nil
+	case []interface{}:
+		return len(v) == 0, nil
+	case map[string]interface{}:
+		return len(v) == 0, nil
+	}
+	return nil, ParamTypeError(op, "string or list", params[0])
+}
+
+// strLen returns the length of the string in runes, or the count of the elements of the list or the dict
+func strLen(_ *Ctx, params []Value) (Value, error) {
+	const op = "len"
+	if len(params) != 1 {
+		return nil, ParamsCountError(op, 1, len(params))
+	}
+	switch v := params[0].(type) {
+	case string:
+		return int64(utf8.RuneCountInString(v)), nil
+	case []string:
+		return int64(len(v)), nil
+	case []int64:
+		return int64(len(v)), nil
+	case []interface{}:
+		return int64(len(v)), nil
+	case map[string]interface{}:
+		return int64(len(v)), nil
+	}
+	return nil, ParamTypeError(op, "string, list or dict", params[0])
+}
+
+// strBlank checks if the string is empty or contains only white spaces,
+// nil and undefined values are considered blank.
+func strBlank(_ *Ctx, params []Value) (Value, error) {
+	const op = "blank"
+	if len(params) != 1 {
+		return nil, ParamsCountError(op, 1, len(params))
+	}
+	switch v := params[0].(type) {
+	case nil, dne:
+		return true, nil
+	case string:
+		return len(strings.TrimSpace(v)) == 0, nil
+	}
+	return nil, ParamTypeError(op, typeStr, params[0])
+}
+
+// strNormalizeSpace trims the leading and trailing white spaces, and collapses the internal
+// runs of white spaces, including tabs, newlines and the Unicode white spaces, into single spaces.
+func strNormalizeSpace(_ *Ctx, params []Value) (Value, error) {
+	const op = "normalize_space"
+	if len(params) != 1 {
+		return nil, ParamsCountError(op, 1, len(params))
+	}
+	s, ok := params[0].(string)
+	if !ok {
+		return nil, ParamTypeError(op, typeStr, params[0])
+	}
+	return strings.Join(strings.Fields(s), " "), nil
+}
+
+// strEditDistance returns the Levenshtein distance between two strings, which is the minimum
+// count of single rune insertions, deletions and substitutions (each costs 1) to change one into the other.
+// The strings are compared by runes, so a multibyte character counts as one.
+func strEditDistance(_ *Ctx, params []Value) (Value, error) {
+	a, b, err := DestructParamsStr2("edit_distance", params)
+	if err != nil {
+		return nil, err
+	}
+	s, t := []rune(a), []rune(b)
+	if len(s) < len(t) {
+		s, t = t, s
+	}
+
+	// dist[j] is the distance between the prefix of s and t[:j]
+	dist := make([]int64, len(t)+1)
+	for j := range dist {
+		dist[j] = int64(j)
+	}
+	for i := 1; i <= len(s); i++ {
+		prev := dist[0] // the distance between s[:i-1] and t[:j-1]
+		dist[0] = int64(i)
+		for j := 1; j <= len(t); j++ {
+			cost := prev
+			if s[i-1] != t[j-1] {
+				cost++
+			}
+			if dist[j]+1 < cost {
+				cost = dist[j] + 1
+			}
+			if dist[j-1]+1 < cost {
+				cost = dist[j-1] + 1
+			}
+			prev, dist[j] = dist[j], cost
+		}
+	}
+	return dist[len(t)], nil
+}
+
+// strRepeat returns the string s concatenated n times, e.g. `(repeat_str "-" 3)` returns `"---"`.
+// The length of the result in bytes is limited by the maxLen, 0 means defaultMaxResultLen.
+type strRepeat struct {
+	maxLen int
+}
+
+func (r strRepeat) execute(_ *Ctx, params []Value) (Value, error) {
+	const op = "repeat_str"
+	if len(params) != 2 {
+		return nil, ParamsCountError(op, 2, len(params))
+	}
+	s, ok := params[0].(string)
+	if !ok {
+		return nil, ParamTypeError(op, typeStr, params[0])
+	}
+	n, err := repeatCount(params[1])
+	if err != nil {
+		return nil, OpExecError(op, err)
+	}
+
+	// check the length before building the string
+	max := maxResultLen(r.maxLen)
+	if n != 0 && uint64(len(s)) > uint64(max)/n {
+		got := uint64(math.MaxUint64)
+		if uint64(len(s)) <= math.MaxUint64/n {
+			got = uint64(len(s)) * n
 		}
-		if temp > 4 || temp < 1 {
-			return nil, OpExecError(modeNames[c.mode], fmt.Errorf("version valid length out of range: %d", temp))
+		return nil, resultLenErr(op, max, got)
+	}
+	return strings.Repeat(s, int(n)), nil
+}
+
+func repeatCount(v Value) (uint64, error) {
+	n, ok := v.(int64)
+	if !ok {
+		return 0, fmt.Errorf("n should be an integer, got: %v", v)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("n should be non-negative, got: %d", n)
+	}
+	return uint64(n), nil
+}
+
+// buildRepeatStr validates the count if it's a constant
+func buildRepeatStr(conf *Config, params []*astNode) (Operator, error) {
+	if len(params) == 2 && params[1].node.getNodeType() == constant {
+		if _, err := repeatCount(params[1].node.value); err != nil {
+			return nil, err
 		}
-		validLen = int(temp)
-	default:
-		return nil, errCnt2(c.mode, params)
+	}
+	return strRepeat{maxLen: conf.MaxResultLen}.execute, nil
+}
+
+// regexCacheSize is the max number of the compiled patterns cached by a regex operator
+const regexCacheSize = 64
+
+// strRegex checks if the string matches the regular expression, e.g. `(regex email "^[^@]+@[^@]+$")`,
+// the pattern is compiled in each call, see buildRegex for the compiled patterns reused.
+func strRegex(_ *Ctx, params []Value) (Value, error) {
+	return regexMatch(params, regexp.Compile)
+}
+
+func regexMatch(params []Value, compile func(string) (*regexp.Regexp, error)) (Value, error) {
+	const op = "regex"
+	if len(params) != 2 {
+		return nil, ParamsCountError(op, 2, len(params))
 	}
 	s, ok := params[0].(string)
 	if !ok {
-		return nil, errTypeStr(c.mode, params[0])
+		return nil, ParamTypeError(op, typeStr, params[0])
+	}
+	pattern, ok := params[1].(string)
+	if !ok {
+		return nil, ParamTypeError(op, typeStr, params[1])
+	}
+	re, err := compile(pattern)
+	if err != nil {
+		return nil, OpExecError(op, regexPatternErr(pattern, err))
 	}
+	return re.MatchString(s), nil
+}
 
-	arr := strings.Split(s, ".")
-	var res int64
-	for i := 0; i < validLen; i++ {
-		if i < len(arr) {
-			v, err := strconv.ParseInt(arr[i], 10, 64)
+// buildRegex compiles the constant pattern at compile time, and the other patterns are
+// cached by the operator after compiled, so they are not recompiled in each evaluation.
+func buildRegex(_ *Config, params []*astNode) (Operator, error) {
+	if len(params) == 2 && params[1].node.getNodeType() == constant {
+		if pattern, ok := params[1].node.value.(string); ok {
+			re, err := regexp.Compile(pattern)
 			if err != nil {
-				return nil, OpExecError(modeNames[c.mode], fmt.Errorf("version layout error, %s", s))
+				return nil, regexPatternErr(pattern, err)
 			}
-			if v >= 10000 {
-				return nil, OpExecError(modeNames[c.mode], fmt.Errorf("version layout error, %s", s))
+			compiled := func(string) (*regexp.Regexp, error) { return re, nil }
+			return func(_ *Ctx, params []Value) (Value, error) {
+				return regexMatch(params, compiled)
+			}, nil
+		}
+	}
+
+	cache := &regexCache{patterns: make(map[string]*regexp.Regexp)}
+	return func(_ *Ctx, params []Value) (Value, error) {
+		return regexMatch(params, cache.compile)
+	}, nil
+}
+
+func regexPatternErr(pattern string, err error) error {
+	return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+}
+
+// regexCache caches the compiled patterns, it's safe for concurrent use.
+// The cache is reset once it's full, so it's bounded even if the patterns are not,
+// e.g. the patterns read from the selectors.
+type regexCache struct {
+	mu       sync.RWMutex
+	patterns map[string]*regexp.Regexp
+}
+
+func (c *regexCache) compile(pattern string) (*regexp.Regexp, error) {
+	c.mu.RLock()
+	re, exist := c.patterns[pattern]
+	c.mu.RUnlock()
+	if exist {
+		return re, nil
+	}
+
+	// the invalid patterns are not cached
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.patterns) >= regexCacheSize {
+		c.patterns = make(map[string]*regexp.Regexp)
+	}
+	c.patterns[pattern] = re
+	return re, nil
+}
+
+// formatNumber formats the number with the thousands separators of the locale,
+// e.g. `(format_number 1234567.5 "de")` returns "1.234.567,5".
+// The optional third param is the count of decimal places, otherwise the
+// float numbers are formatted with the fewest decimal places that represent them exactly.
+func formatNumber(_ *Ctx, params []Value) (Value, error) {
+	const op = "format_number"
+	if len(params) != 2 && len(params) != 3 {
+		return nil, paramsRangeCountError(op, 2, 3, len(params))
+	}
+	locale, ok := params[1].(string)
+	if !ok {
+		return nil, ParamTypeError(op, typeStr, params[1])
+	}
+	p, err := newNumberPrinter(locale)
+	if err != nil {
+		return nil, OpExecError(op, err)
+	}
+	return printNumber(p, params)
+}
+
+// buildFormatNumber parses the locale at compile time, the locale should be a constant
+func buildFormatNumber(_ *Config, params []*astNode) (Operator, error) {
+	if len(params) != 2 && len(params) != 3 {
+		return formatNumber, nil
+	}
+	if params[1].node.getNodeType() != constant {
+		return nil, errors.New("format_number locale should be a constant")
+	}
+	locale, ok := params[1].node.value.(string)
+	if !ok {
+		return nil, ParamTypeError("format_number", typeStr, params[1].node.value)
+	}
+	p, err := newNumberPrinter(locale)
+	if err != nil {
+		return nil, err
+	}
+	return func(_ *Ctx, params []Value) (Value, error) {
+		if len(params) != 2 && len(params) != 3 {
+			return nil, paramsRangeCountError("format_number", 2, 3, len(params))
+		}
+		return printNumber(p, params)
+	}, nil
+}
+
+// newNumberPrinter returns the printer of the BCP 47 locale, e.g. "en-US" or "de_CH",
+// the printers are safe for concurrent use
+func newNumberPrinter(locale string) (*message.Printer, error) {
+	tag, err := language.Parse(locale)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported locale [%s], err %w", locale, err)
+	}
+	return message.NewPrinter(tag), nil
+}
+
+func printNumber(p *message.Printer, params []Value) (Value, error) {
+	const op = "format_number"
+	digits := -1
+	if len(params) == 3 {
+		d, ok := params[2].(int64)
+		if !ok || d < 0 {
+			return nil, ParamTypeError(op, "non-negative int64", params[2])
+		}
+		digits = int(d)
+	}
+
+	switch v := params[0].(type) {
+	case int64:
+		if digits < 0 {
+			digits = 0
+		}
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, OpExecError(op, fmt.Errorf("can not format %v", v))
+		}
+		if digits < 0 {
+			// the fewest decimal places that represent the float exactly
+			s := strconv.FormatFloat(v, 'f', -1, 64)
+			if i := strings.IndexByte(s, '.'); i >= 0 {
+				digits = len(s) - i - 1
+			} else {
+				digits = 0
 			}
-			res = res*10000 + v
-		} else {
-			res = res * 10000
+		}
+	default:
+		return nil, ParamTypeError(op, "number", params[0])
+	}
+	return p.Sprint(number.Decimal(params[0],
+		number.MinFractionDigits(digits), number.MaxFractionDigits(digits))), nil
+}
+
+// hashValue returns the 64-bit FNV-1a hash of the value as a non-negative int64,
+// it's stable across processes so that it can be used for consistent bucketing,
+// e.g. `(% (hash user_id) 100)`.
+// The hashable types are string, int64, bool and lists of them:
+//   - string is hashed by its UTF-8 bytes
+//   - int64 is hashed by its 8 bytes in big endian
+//   - bool is hashed by a byte 1 or 0
+//   - list is hashed by the length prefixed bytes of its elements in order
+func hashValue(_ *Ctx, params []Value) (Value, error) {
+	const op = "hash"
+	if len(params) != 1 {
+		return nil, ParamsCountError(op, 1, len(params))
+	}
+
+	h := fnv.New64a()
+	if elems, ok := listElems(params[0]); ok {
+		var buf [8]byte
+		for _, e := range elems {
+			b, ok := hashBytes(e)
+			if !ok {
+				return nil, ParamTypeError(op, "hashable", e)
+			}
+			binary.BigEndian.PutUint64(buf[:], uint64(len(b)))
+			_, _ = h.Write(buf[:])
+			_, _ = h.Write(b)
+		}
+	} else {
+		b, ok := hashBytes(params[0])
+		if !ok {
+			return nil, ParamTypeError(op, "hashable", params[0])
+		}
+		_, _ = h.Write(b)
+	}
+	return int64(h.Sum64() &^ (1 << 63)), nil
+}
+
+func hashBytes(v Value) ([]byte, bool) {
+	switch v := v.(type) {
+	case string:
+		return []byte(v), true
+	case int64:
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], uint64(v))
+		return buf[:], true
+	case bool:
+		if v {
+			return []byte{1}, true
+		}
+		return []byte{0}, true
+	}
+	return nil, false
+}
+
+// hashSample returns an element of the list chosen deterministically by the seed,
+// the same seed always chooses the same element, e.g. `(sample ("A" "B") user_id)`.
+// The seed is hashed by FNV-1a as the hash operator, the hash is mixed by the
+// SplitMix64 finalizer, and the index is the mixed hash modulo the length of the list.
+func hashSample(_ *Ctx, params []Value) (Value, error) {
+	const op = "sample"
+	if len(params) != 2 {
+		return nil, ParamsCountError(op, 2, len(params))
+	}
+	elems, ok := listElems(params[0])
+	if !ok {
+		return nil, ParamTypeError(op, typeList, params[0])
+	}
+	b, ok := hashBytes(params[1])
+	if !ok {
+		return nil, ParamTypeError(op, "hashable", params[1])
+	}
+	if len(elems) == 0 {
+		return nil, OpExecError(op, errors.New("the list is empty"))
+	}
+
+	h := fnv.New64a()
+	_, _ = h.Write(b)
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return elems[x%uint64(len(elems))], nil
+}
+
+// jsonPathSeg is a segment of the JSON path, it's either an object key or an array index
+type jsonPathSeg struct {
+	key   string
+	idx   int
+	isIdx bool
+}
+
+// parseJSONPath parses the JSONPath-like expression, e.g. `$.a.b[0]["c.d"]`,
+// the root `$` and the dot before the first key are optional.
+func parseJSONPath(path string) ([]jsonPathSeg, error) {
+	s := strings.TrimPrefix(path, "$")
+	var segs []jsonPathSeg
+	for len(s) != 0 {
+		switch s[0] {
+		case '.':
+			s = s[1:]
+			fallthrough
+		default:
+			i := strings.IndexAny(s, ".[")
+			if i == -1 {
+				i = len(s)
+			}
+			if i == 0 {
+				return nil, fmt.Errorf("invalid JSON path [%s]", path)
+			}
+			segs = append(segs, jsonPathSeg{key: s[:i]})
+			s = s[i:]
+		case '[':
+			end := strings.IndexByte(s, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("invalid JSON path [%s]", path)
+			}
+			sub := s[1:end]
+			if key, err := strconv.Unquote(sub); err == nil {
+				segs = append(segs, jsonPathSeg{key: key})
+			} else if idx, err := strconv.Atoi(sub); err == nil && idx >= 0 {
+				segs = append(segs, jsonPathSeg{idx: idx, isIdx: true})
+			} else {
+				return nil, fmt.Errorf("invalid JSON path [%s]", path)
+			}
+			s = s[end+1:]
+		}
+	}
+	return segs, nil
+}
+
+// jsonGet extracts the value of the path from the JSON string, e.g.
+// `(json_get "{\"a\": [1, 2]}" "$.a[1]")` returns 2.
+// The numbers are decoded as float64, the arrays as []interface{} and the objects as map[string]interface{}.
+// It returns DNE if the path does not exist, which differs from the JSON null decoded as nil,
+// and returns an error if the JSON is invalid.
+func jsonGet(_ *Ctx, params []Value) (Value, error) {
+	const op = "json_get"
+	if len(params) != 2 {
+		return nil, ParamsCountError(op, 2, len(params))
+	}
+	path, ok := params[1].(string)
+	if !ok {
+		return nil, ParamTypeError(op, typeStr, params[1])
+	}
+	segs, err := parseJSONPath(path)
+	if err != nil {
+		return nil, OpExecError(op, err)
+	}
+	return extractJSON(params[0], segs)
+}
+
+// buildJSONGet parses the path at compile time if it's a constant
+func buildJSONGet(_ *Config, params []*astNode) (Operator, error) {
+	if len(params) != 2 || params[1].node.getNodeType() != constant {
+		return jsonGet, nil
+	}
+	path, ok := params[1].node.value.(string)
+	if !ok {
+		return jsonGet, nil
+	}
+	segs, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return func(_ *Ctx, params []Value) (Value, error) {
+		if len(params) != 2 {
+			return nil, ParamsCountError("json_get", 2, len(params))
+		}
+		return extractJSON(params[0], segs)
+	}, nil
+}
+
+func extractJSON(v Value, segs []jsonPathSeg) (Value, error) {
+	const op = "json_get"
+	s, ok := v.(string)
+	if !ok {
+		return nil, ParamTypeError(op, typeStr, v)
+	}
+
+	var res interface{}
+	if err := json.Unmarshal([]byte(s), &res); err != nil {
+		return nil, OpExecError(op, err)
+	}
+
+	for _, seg := range segs {
+		switch cur := res.(type) {
+		case map[string]interface{}:
+			if seg.isIdx {
+				return DNE, nil
+			}
+			if res, ok = cur[seg.key]; !ok {
+				return DNE, nil
+			}
+		case []interface{}:
+			if !seg.isIdx || seg.idx >= len(cur) {
+				return DNE, nil
+			}
+			res = cur[seg.idx]
+		default:
+			return DNE, nil
 		}
 	}
 	return res, nil
 }
 
+// netInCIDR checks if the IP address is in the CIDR network, both IPv4 and IPv6 are supported.
+// The IP address can be a string, a netip.Addr or a net.IP.
+func netInCIDR(_ *Ctx, params []Value) (Value, error) {
+	const op = "in_cidr"
+	if len(params) != 2 {
+		return nil, ParamsCountError(op, 2, len(params))
+	}
+	s, ok := params[1].(string)
+	if !ok {
+		return nil, ParamTypeError(op, typeStr, params[1])
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return nil, OpExecError(op, err)
+	}
+	return inCIDR(prefix, params[0])
+}
+
+// buildInCIDR precompiles the CIDR network if it's a constant
+func buildInCIDR(_ *Config, params []*astNode) (Operator, error) {
+	if len(params) != 2 || params[1].node.getNodeType() != constant {
+		return netInCIDR, nil
+	}
+	s, ok := params[1].node.value.(string)
+	if !ok {
+		return netInCIDR, nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR error: %w", err)
+	}
+	return func(_ *Ctx, params []Value) (Value, error) {
+		if len(params) != 2 {
+			return nil, ParamsCountError("in_cidr", 2, len(params))
+		}
+		return inCIDR(prefix, params[0])
+	}, nil
+}
+
+func inCIDR(prefix netip.Prefix, ip Value) (Value, error) {
+	const op = "in_cidr"
+	var addr netip.Addr
+	switch v := ip.(type) {
+	case string:
+		var err error
+		if addr, err = netip.ParseAddr(v); err != nil {
+			return nil, OpExecError(op, err)
+		}
+	case netip.Addr:
+		addr = v
+	case net.IP:
+		var ok bool
+		if addr, ok = netip.AddrFromSlice(v); !ok {
+			return nil, OpExecError(op, fmt.Errorf("invalid IP address: %v", v))
+		}
+	default:
+		return nil, ParamTypeError(op, "ip", ip)
+	}
+	// IPv4-mapped IPv6 addresses are matched as IPv4 addresses
+	return prefix.Contains(addr.Unmap()), nil
+}
+
+// urlExtract parses the URL and extracts a component of it, e.g.
+// `(url_host "https://example.com:8080/a?b=1")` returns "example.com".
+// The URL is parsed in each call, unless it's a constant which is parsed at compile time.
+type urlExtract struct {
+	op     string
+	parsed *url.URL
+}
+
+func (x urlExtract) execute(_ *Ctx, params []Value) (Value, error) {
+	want := 1
+	if x.op == "url_query" {
+		want = 2
+	}
+	if len(params) != want {
+		return nil, ParamsCountError(x.op, want, len(params))
+	}
+
+	u := x.parsed
+	if u == nil {
+		s, ok := params[0].(string)
+		if !ok {
+			return nil, ParamTypeError(x.op, typeStr, params[0])
+		}
+		var err error
+		if u, err = url.Parse(s); err != nil {
+			return nil, OpExecError(x.op, err)
+		}
+	}
+
+	switch x.op {
+	case "url_scheme":
+		return u.Scheme, nil
+	case "url_host":
+		// the port is not included
+		return u.Hostname(), nil
+	case "url_path":
+		return u.Path, nil
+	default:
+		key, ok := params[1].(string)
+		if !ok {
+			return nil, ParamTypeError(x.op, typeStr, params[1])
+		}
+		// returns the first value of the key, or "" if the key is absent
+		return u.Query().Get(key), nil
+	}
+}
+
+// buildURLExtract precompiles the URL if it's a constant
+func buildURLExtract(op string) operatorBuilder {
+	return func(_ *Config, params []*astNode) (Operator, error) {
+		x := urlExtract{op: op}
+		if len(params) == 0 || params[0].node.getNodeType() != constant {
+			return x.execute, nil
+		}
+		s, ok := params[0].node.value.(string)
+		if !ok {
+			return x.execute, nil
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL error: %w", err)
+		}
+		x.parsed = u
+		return x.execute, nil
+	}
+}
+
+// emailPattern is the "valid e-mail address" of the WHATWG HTML spec (the rule of <input type="email">),
+// except that the domain must have at least two labels, e.g. "a@localhost" is invalid
+var emailPattern = regexp.MustCompile(
+	"^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+" +
+		"@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?" +
+		"(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)+$")
+
+// isEmail checks if the string is a valid email address, which matches the emailPattern,
+// and the local part is at most 64 bytes, and the whole address is at most 254 bytes.
+// Quoted local parts, IP address literals and internationalized domains are not supported.
+func isEmail(_ *Ctx, params []Value) (Value, error) {
+	const op = "is_email"
+	if len(params) != 1 {
+		return nil, ParamsCountError(op, 1, len(params))
+	}
+	s, ok := params[0].(string)
+	if !ok {
+		return nil, ParamTypeError(op, typeStr, params[0])
+	}
+	if len(s) > 254 || strings.IndexByte(s, '@') > 64 {
+		return false, nil
+	}
+	return emailPattern.MatchString(s), nil
+}
+
+// phoneChars are the characters allowed in the phone numbers of is_phone, the digits with
+// the separators, and a leading '+' of the international format
+var phoneChars = regexp.MustCompile(`^\+?[0-9 ().-]+$`)
+
+// isPhone checks if the string is a valid phone number of the region by libphonenumber,
+// see github.com/nyaruka/phonenumbers. The number is valid if it only contains digits,
+// spaces, '-', '.' and parentheses, optionally following a '+', and it's either in the
+// national format of the region or in the international format with the calling code of
+// the region, and it matches a number range of the region in the metadata of libphonenumber,
+// e.g. the fixed-line, mobile, toll-free or VoIP numbers. The letters and the extensions are
+// rejected, and it doesn't check whether the number is assigned.
+func isPhone(_ *Ctx, params []Value) (Value, error) {
+	const op = "is_phone"
+	if len(params) != 2 {
+		return nil, ParamsCountError(op, 2, len(params))
+	}
+	s, ok := params[0].(string)
+	if !ok {
+		return nil, ParamTypeError(op, typeStr, params[0])
+	}
+	region, err := phoneRegionOf(params[1])
+	if err != nil {
+		return nil, OpExecError(op, err)
+	}
+	return matchPhone(region, s), nil
+}
+
+// phoneRegionOf returns the ISO 3166-1 alpha-2 code of the region supported by libphonenumber
+func phoneRegionOf(v Value) (string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("phone region should be a string, got: %v", v)
+	}
+	region := strings.ToUpper(s)
+	if !phonenumbers.GetSupportedRegions()[region] {
+		return "", fmt.Errorf("unsupported phone region: %s", s)
+	}
+	return region, nil
+}
+
+func matchPhone(region, s string) bool {
+	if !phoneChars.MatchString(s) {
+		return false
+	}
+	num, err := phonenumbers.Parse(s, region)
+	if err != nil {
+		return false
+	}
+	return phonenumbers.IsValidNumberForRegion(num, region)
+}
+
+// buildIsPhone validates the region at compile time, the region should be a constant
+func buildIsPhone(_ *Config, params []*astNode) (Operator, error) {
+	if len(params) != 2 {
+		return isPhone, nil
+	}
+	if params[1].node.getNodeType() != constant {
+		return nil, errors.New("is_phone region should be a constant")
+	}
+	region, err := phoneRegionOf(params[1].node.value)
+	if err != nil {
+		return nil, err
+	}
+	return func(_ *Ctx, params []Value) (Value, error) {
+		const op = "is_phone"
+		if len(params) != 2 {
+			return nil, ParamsCountError(op, 2, len(params))
+		}
+		s, ok := params[0].(string)
+		if !ok {
+			return nil, ParamTypeError(op, typeStr, params[0])
+		}
+		return matchPhone(region, s), nil
+	}, nil
+}
+
 func DestructParamsStr2(opName string, params []Value) (a, b string, e error) {
 	if len(params) != 2 {
 		e = ParamsCountError(opName, 2, len(params))
@@ -623,6 +3184,11 @@ func ParamsCountError(opName string, want, got int) error {
 	return fmt.Errorf("unexpected params count, operator: %s, expected: %d, got: %d", opName, want, got)
 }
 
+// paramsRangeCountError is the ParamsCountError of the operators which take min to max params
+func paramsRangeCountError(opName string, min, max, got int) error {
+	return fmt.Errorf("unexpected params count, operator: %s, expected: %d to %d, got: %d", opName, min, max, got)
+}
+
 func ParamTypeError(opName string, want string, got Value) error {
 	return fmt.Errorf("unexpected param type, operator: %s, expected: %s, got: %+v", opName, want, got)
 }
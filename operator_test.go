@@ -1,6 +1,15 @@
 package eval
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -53,6 +62,379 @@ func TestRegisterOperator(t *testing.T) {
 	}
 	err = RegisterOperator(cc, "add", testOp)
 	assertErrStrContains(t, err, "operator already exist")
+
+	// register a keyword, the keywords are not shadowed by the operators
+	for _, name := range []string{"if", "cond", "find_all", "tap", "iterate", "map_if", "sort_by", "sort_by_desc", "interp"} {
+		err = RegisterOperator(cc, name, testOp)
+		assertErrStrContains(t, err, "keyword already exist "+name)
+	}
+
+	// the disabled keywords are free to be registered
+	assertNil(t, DisableKeyword(cc, "cond"))
+	assertNil(t, RegisterOperator(cc, "cond", maxOp))
+	res, err = Eval(`(cond 1 2)`, nil, ExtendConf(cc))
+	assertNil(t, err)
+	assertEquals(t, res, int64(2))
+}
+
+func TestRegisterOperator_OverrideBuiltin(t *testing.T) {
+	// the string of the params, it's distinct from the results of the builtin operators
+	joinOp := func(_ *Ctx, params []Value) (Value, error) {
+		return fmt.Sprint(params), nil
+	}
+
+	cc := NewConfig(EnableTypeCheck, RegVarAndOp(map[string]interface{}{
+		"keys": joinOp,
+	}))
+	assertNil(t, RegisterOperator(cc, "max", joinOp))
+	assertNil(t, RegisterOperator(cc, "len", joinOp, WithArity(2, 2)))
+
+	testCases := []struct {
+		expr string
+		want Value
+	}{
+		{expr: `(max 1 5 3)`, want: "[1 5 3]"},
+		{expr: `(len "a" "b")`, want: "[a b]"},
+		{expr: `(keys 1 2)`, want: "[1 2]"},
+		{expr: `(min (1 5 3))`, want: int64(1)},
+	}
+	for _, tc := range testCases {
+		for _, opt := range []Option{Optimizations(true), Optimizations(false)} {
+			e, err := Compile(NewConfig(ExtendConf(cc), opt), tc.expr)
+			assertNil(t, err, tc.expr)
+
+			res, err := e.Eval(NewCtxFromVars(cc, nil))
+			assertNil(t, err, tc.expr)
+			assertEquals(t, res, tc.want, tc.expr)
+
+			data, err := e.MarshalBinary()
+			assertNil(t, err, tc.expr)
+			back, err := UnmarshalExpr(cc, data)
+			assertNil(t, err, tc.expr)
+			res, err = back.Eval(NewCtxFromVars(cc, nil))
+			assertNil(t, err, tc.expr)
+			assertEquals(t, res, tc.want, tc.expr)
+		}
+	}
+
+	// the reserved builtin operators are not overridden
+	cc = NewConfig(RegVarAndOp(map[string]interface{}{"add": joinOp}))
+	res, err := Eval(`(add 1 2)`, nil, ExtendConf(cc))
+	assertNil(t, err)
+	assertEquals(t, res, int64(3))
+}
+
+func TestRegisterOperator_ShortCircuit(t *testing.T) {
+	var called []string
+	boolOp := func(name string, fn func(a, b bool) bool) Operator {
+		return func(_ *Ctx, params []Value) (Value, error) {
+			called = append(called, name)
+			res := params[0].(bool)
+			for _, p := range params[1:] {
+				res = fn(res, p.(bool))
+			}
+			return res, nil
+		}
+	}
+	// the `t` operator records the calls and returns its param
+	tracer := func(_ *Ctx, params []Value) (Value, error) {
+		called = append(called, fmt.Sprint(params[0]))
+		return params[0], nil
+	}
+
+	cc := NewConfig()
+	assertNil(t, RegisterOperator(cc, "t", tracer))
+	assertNil(t, RegisterOperator(cc, "and2", boolOp("and2", func(a, b bool) bool { return a && b }),
+		WithShortCircuit(ShortCircuitOnFalse)))
+	assertNil(t, RegisterOperator(cc, "or2", boolOp("or2", func(a, b bool) bool { return a || b }),
+		WithShortCircuit(ShortCircuitOnTrue)))
+	assertNil(t, RegisterOperator(cc, "xor2", boolOp("xor2", func(a, b bool) bool { return a != b }),
+		WithShortCircuit(NoShortCircuit)))
+
+	testCases := []struct {
+		expr   string
+		want   Value
+		called []string
+	}{
+		{
+			expr:   `(and2 (t true) (t false) (t true))`,
+			want:   false,
+			called: []string{"true", "false"},
+		},
+		{
+			// the result of the last param is returned directly as `and` does
+			expr:   `(and2 (t true) (t true))`,
+			want:   true,
+			called: []string{"true", "true"},
+		},
+		{
+			expr:   `(or2 (t false) (t true) (t false))`,
+			want:   true,
+			called: []string{"false", "true"},
+		},
+		{
+			expr:   `(or2 (and2 (t true) (t false)) (t true))`,
+			want:   true,
+			called: []string{"true", "false", "true"},
+		},
+		{
+			// no short circuit
+			expr:   `(xor2 (t true) (t false) (t true))`,
+			want:   false,
+			called: []string{"true", "false", "true", "xor2"},
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			for _, opt := range []Option{Optimizations(true), Optimizations(false)} {
+				opt(cc)
+				e, err := Compile(cc, c.expr)
+				assertNil(t, err)
+
+				called = nil
+				res, err := e.Eval(NewCtxFromVars(cc, nil))
+				assertNil(t, err)
+				assertEquals(t, res, c.want)
+				assertEquals(t, called, c.called)
+			}
+		})
+	}
+}
+
+func TestLogic_ShortCircuit(t *testing.T) {
+	var called []string
+	cc := NewConfig(RegVarAndOp(map[string]interface{}{"n": 1}))
+	// the `t` operator records the calls and returns its param
+	assertNil(t, RegisterOperator(cc, "t", func(_ *Ctx, params []Value) (Value, error) {
+		called = append(called, fmt.Sprint(params[0]))
+		return params[0], nil
+	}))
+
+	testCases := []struct {
+		expr   string
+		want   Value
+		called []string
+		errMsg string
+	}{
+		{expr: `(and)`, want: true},
+		{expr: `(or)`, want: false},
+		{expr: `(and (t false))`, want: false, called: []string{"false"}},
+		{expr: `(or (t true))`, want: true, called: []string{"true"}},
+		{expr: `(and (t true) (t false) (t true))`, want: false, called: []string{"true", "false"}},
+		{expr: `(or (t false) (t true) (t false))`, want: true, called: []string{"false", "true"}},
+		{expr: `(and (or) (t true))`, want: false},
+		{expr: `(or (and) (t false))`, want: true},
+		{expr: `(and (t true) (if (t true) (t false) (t true)) (t true))`, want: false, called: []string{"true", "true", "false"}},
+		// the params should be bools, even if they are not the last ones
+		{expr: `(and (t n) (t true))`, called: []string{"1"}, errMsg: "unexpected param type, operator: and, expected: bool, got: 1"},
+		{expr: `(or (t false) (t "a"))`, called: []string{"false", "a"}, errMsg: "operator: or, expected: bool, got: a"},
+		{expr: `(and (t true) (if (t true) (t n) (t true)))`, called: []string{"true", "true", "1"}, errMsg: "operator: and, expected: bool, got: 1"},
+		{expr: `(or (t n))`, called: []string{"1"}, errMsg: "operator: or, expected: bool, got: 1"},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			// the calls are not reordered
+			for _, opt := range []Option{Optimizations(false), Optimizations(true, ConstantFolding, ReduceNesting, FastEvaluation)} {
+				opt(cc)
+				e, err := Compile(cc, c.expr)
+				assertNil(t, err)
+
+				called = nil
+				res, err := e.Eval(NewCtxFromVars(cc, map[string]interface{}{"n": 1}))
+				assertEquals(t, called, c.called)
+				if len(c.errMsg) != 0 {
+					assertErrStrContains(t, err, c.errMsg)
+					continue
+				}
+				assertNil(t, err)
+				assertEquals(t, res, c.want)
+			}
+		})
+	}
+}
+
+func TestRegisterOperator_StrictReturns(t *testing.T) {
+	// the `age_of` operator declares int results, but misbehaves for unknown names
+	ageOf := func(_ *Ctx, params []Value) (Value, error) {
+		if params[0] == "Alice" {
+			return int64(30), nil
+		}
+		return "unknown", nil
+	}
+	vals := map[string]interface{}{"name": "Alice"}
+
+	cc := NewConfig(RegVarAndOp(vals))
+	assertNil(t, RegisterOperator(cc, "age_of", ageOf, WithReturns(IntType)))
+
+	testCases := []struct {
+		name   string
+		strict bool
+		want   Value
+		errMsg string
+	}{
+		{name: "Alice", strict: true, want: true},
+		{
+			name:   "Bob",
+			strict: true,
+			errMsg: "operator: age_of, error: unexpected return type (want: int64, got: string) occurs at line 1, col 5: (> ([a]ge_of name) 18)",
+		},
+		{
+			// the results are not checked without StrictReturns
+			name:   "Bob",
+			errMsg: paramTypeErrMsg,
+		},
+	}
+
+	for _, c := range testCases {
+		conf := CopyConfig(cc)
+		conf.CompileOptions[StrictReturns] = c.strict
+		e, err := Compile(conf, `(> (age_of name) 18)`)
+		assertNil(t, err)
+
+		res, err := e.Eval(NewCtxFromVars(conf, map[string]interface{}{"name": c.name}))
+		if len(c.errMsg) != 0 {
+			assertErrStrContains(t, err, c.errMsg, c)
+			assertEquals(t, errors.Is(err, ErrUnexpectedReturnType), c.strict, c)
+			continue
+		}
+		assertNil(t, err)
+		assertEquals(t, res, c.want)
+	}
+}
+
+func TestRegisterOperator_Arity(t *testing.T) {
+	first := func(_ *Ctx, params []Value) (Value, error) {
+		return params[0], nil
+	}
+	cc := NewConfig(RegVarAndOp(map[string]interface{}{"age": nil}))
+	assertNil(t, RegisterOperator(cc, "one", first, WithArity(1, 1)))
+	assertNil(t, RegisterOperator(cc, "one_or_two", first, WithArity(1, 2)))
+	assertNil(t, RegisterOperator(cc, "many", first, WithArity(1, -1)))
+	assertNil(t, RegisterOperator(cc, "unchecked", first))
+
+	testCases := []struct {
+		expr   string
+		errMsg string
+	}{
+		{expr: `(one age)`},
+		{expr: `(one_or_two age 2)`},
+		{expr: `(many age 1 2 3 4 5)`},
+		{expr: `(unchecked age 1 2)`},
+		{expr: `(one age 2)`, errMsg: "one parameters count error (want: 1, got: 2) occurs at line 1, col 2: ([o]ne age 2)"},
+		{expr: `(one_or_two age 2 3)`, errMsg: "one_or_two parameters count error (want: 1 to 2, got: 3)"},
+		{expr: `(many)`, errMsg: "many parameters count error (want: at least 1, got: 0)"},
+		{expr: `(+ (one age) (many age))`},
+		// the builtin operators are checked with StrictArity only
+		{expr: `(+ (one age))`},
+		{expr: `(!= age 3 4)`},
+	}
+
+	for _, c := range testCases {
+		_, err := Compile(cc, c.expr)
+		if len(c.errMsg) != 0 {
+			assertErrStrContains(t, err, c.errMsg, c.expr)
+			continue
+		}
+		assertNil(t, err, c.expr)
+	}
+
+	strict := NewConfig(ExtendConf(cc), EnableStrictArity)
+	testCases = []struct {
+		expr   string
+		errMsg string
+	}{
+		{expr: `(+ (one age) (many age))`},
+		{expr: `(+ (one age))`, errMsg: "+ parameters count error (want: at least 2, got: 1)"},
+		{expr: `(!= age 3 4)`, errMsg: "!= parameters count error (want: 2, got: 3)"},
+		{expr: `(eq age 3 4)`},
+		{expr: `(one age 2)`, errMsg: "one parameters count error (want: 1, got: 2)"},
+		// the builtin operators without signatures are checked at runtime
+		{expr: `(int age 1)`},
+	}
+	for _, c := range testCases {
+		_, err := Compile(strict, c.expr)
+		if len(c.errMsg) != 0 {
+			assertErrStrContains(t, err, c.errMsg, c.expr)
+			continue
+		}
+		assertNil(t, err, c.expr)
+	}
+}
+
+func TestRegisterOperator_Timeout(t *testing.T) {
+	// the `fetch` operator sleeps for the duration, or returns once its ctx is done
+	fetch := func(ctx *Ctx, params []Value) (Value, error) {
+		var done <-chan struct{}
+		if ctx.Ctx != nil {
+			done = ctx.Ctx.Done()
+		}
+		select {
+		case <-time.After(time.Duration(params[0].(int64)) * time.Millisecond):
+			return "ok", nil
+		case <-done:
+			return nil, ctx.Ctx.Err()
+		}
+	}
+	// the `block` operator ignores its ctx
+	block := func(_ *Ctx, params []Value) (Value, error) {
+		time.Sleep(time.Duration(params[0].(int64)) * time.Millisecond)
+		return "ok", nil
+	}
+
+	cc := NewConfig()
+	assertNil(t, RegisterOperator(cc, "fetch", fetch, WithTimeout(20*time.Millisecond)))
+	assertNil(t, RegisterOperator(cc, "block", block, WithTimeout(20*time.Millisecond)))
+
+	testCases := []struct {
+		expr    string
+		noCtx   bool
+		want    Value
+		timeout bool
+	}{
+		{expr: `(fetch 1)`, want: "ok"},
+		{expr: `(fetch 1000)`, timeout: true},
+		{expr: `(block 1000)`, timeout: true},
+		{expr: `(= (fetch 1) (fetch 1000))`, timeout: true},
+		{
+			// no timeout without Ctx.Ctx
+			expr:  `(fetch 40)`,
+			noCtx: true,
+			want:  "ok",
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			e, err := Compile(cc, c.expr)
+			assertNil(t, err)
+
+			ctx := NewCtxFromVars(cc, nil)
+			if !c.noCtx {
+				ctx.Ctx = context.Background()
+			}
+
+			start := time.Now()
+			res, err := e.Eval(ctx)
+			if c.timeout {
+				assertErrStrContains(t, err, "timeout after 20ms")
+				assertEquals(t, errors.Is(err, context.DeadlineExceeded), true)
+				assertEquals(t, time.Since(start) < 500*time.Millisecond, true)
+				return
+			}
+			assertNil(t, err)
+			assertEquals(t, res, c.want)
+		})
+	}
+
+	// the cancellation of the parent context is not reported as a timeout
+	e, err := Compile(cc, `(fetch 1000)`)
+	assertNil(t, err)
+	parent, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = e.Eval(&Ctx{Ctx: parent})
+	assertEquals(t, errors.Is(err, context.Canceled), true)
 }
 
 func TestBuiltinOperators(t *testing.T) {
@@ -116,7 +498,19 @@ func TestBuiltinOperators(t *testing.T) {
 		{
 			op:     "add",
 			params: []Value{int64(1), 1.0},
-			errMsg: paramTypeErrMsg, // type of int param should be int64
+			res:    float64(2),
+		},
+
+		{
+			op:     "add",
+			params: []Value{int64(1), 2.5, int64(-4)},
+			res:    -0.5,
+		},
+
+		{
+			op:     "add",
+			params: []Value{int64(1), 2.5, "1"},
+			errMsg: paramTypeErrMsg,
 		},
 
 		// sub
@@ -153,7 +547,13 @@ func TestBuiltinOperators(t *testing.T) {
 		{
 			op:     "sub",
 			params: []Value{int64(1), 1.0},
-			errMsg: paramTypeErrMsg, // type of int param should be int64
+			res:    float64(0),
+		},
+
+		{
+			op:     "sub",
+			params: []Value{1.5, int64(2)},
+			res:    -0.5,
 		},
 
 		// mul
@@ -190,7 +590,19 @@ func TestBuiltinOperators(t *testing.T) {
 		{
 			op:     "mul",
 			params: []Value{int64(1), 1.0},
-			errMsg: paramTypeErrMsg, // type of int param should be int64
+			res:    float64(1),
+		},
+
+		{
+			op:     "mul",
+			params: []Value{int64(2), 1.5, int64(-3)},
+			res:    -9.0,
+		},
+
+		{
+			op:     "mul",
+			params: []Value{int64(1 << 62), int64(4), 0.5},
+			res:    float64(1 << 63), // promoted before the int64 overflow
 		},
 
 		// div
@@ -239,7 +651,19 @@ func TestBuiltinOperators(t *testing.T) {
 		{
 			op:     "div",
 			params: []Value{int64(1), 1.0},
-			errMsg: paramTypeErrMsg, // type of int param should be int64
+			res:    float64(1),
+		},
+
+		{
+			op:     "div",
+			params: []Value{int64(3), 2.0},
+			res:    1.5,
+		},
+
+		{
+			op:     "div",
+			params: []Value{1.5, int64(0)},
+			errMsg: "operator: div, error: divide by zero",
 		},
 
 		// mod
@@ -288,7 +712,19 @@ func TestBuiltinOperators(t *testing.T) {
 		{
 			op:     "mod",
 			params: []Value{int64(1), 1.0},
-			errMsg: paramTypeErrMsg, // type of int param should be int64
+			res:    float64(0),
+		},
+
+		{
+			op:     "mod",
+			params: []Value{-7.5, int64(2)},
+			res:    -1.5,
+		},
+
+		{
+			op:     "mod",
+			params: []Value{int64(7), 0.0},
+			errMsg: "operator: mod, error: divide by zero",
 		},
 
 		// logic
@@ -316,7 +752,12 @@ func TestBuiltinOperators(t *testing.T) {
 		{
 			op:     "and",
 			params: []Value{true},
-			errMsg: paramsCntErrMsg,
+			res:    true,
+		},
+		{
+			op:     "and",
+			params: []Value{},
+			res:    true,
 		},
 		{
 			op:     "and",
@@ -348,7 +789,12 @@ func TestBuiltinOperators(t *testing.T) {
 		{
 			op:     "or",
 			params: []Value{true},
-			errMsg: paramsCntErrMsg,
+			res:    true,
+		},
+		{
+			op:     "or",
+			params: []Value{},
+			res:    false,
 		},
 		{
 			op:     "or",
@@ -575,7 +1021,43 @@ func TestBuiltinOperators(t *testing.T) {
 		{
 			op:     "gt",
 			params: []Value{int64(1), 1.0},
-			errMsg: paramTypeErrMsg, // type of int param should be int64
+			res:    false,
+		},
+
+		{
+			op:     "gt",
+			params: []Value{"b", "a"},
+			res:    true,
+		},
+
+		{
+			op:     "gt",
+			params: []Value{"1", int64(1)},
+			errMsg: paramTypeErrMsg,
+		},
+
+		{
+			op:     "gt",
+			params: []Value{int64(2), 1.5},
+			res:    true,
+		},
+
+		{
+			op:     "gt",
+			params: []Value{math.NaN(), int64(1)},
+			res:    false,
+		},
+
+		{
+			op:     "gt",
+			params: []Value{int64(1), "1"},
+			errMsg: paramTypeErrMsg,
+		},
+
+		{
+			op:     "gt",
+			params: []Value{true, false},
+			errMsg: paramTypeErrMsg,
 		},
 
 		// ge
@@ -624,7 +1106,19 @@ func TestBuiltinOperators(t *testing.T) {
 		{
 			op:     "ge",
 			params: []Value{int64(1), 1.0},
-			errMsg: paramTypeErrMsg, // type of int param should be int64
+			res:    true,
+		},
+
+		{
+			op:     "ge",
+			params: []Value{"a", "a"},
+			res:    true,
+		},
+
+		{
+			op:     "ge",
+			params: []Value{"1", int64(1)},
+			errMsg: paramTypeErrMsg,
 		},
 
 		// lt
@@ -673,7 +1167,19 @@ func TestBuiltinOperators(t *testing.T) {
 		{
 			op:     "lt",
 			params: []Value{int64(1), 1.0},
-			errMsg: paramTypeErrMsg, // type of int param should be int64
+			res:    false,
+		},
+
+		{
+			op:     "lt",
+			params: []Value{"a", "ab"},
+			res:    true,
+		},
+
+		{
+			op:     "lt",
+			params: []Value{"1", int64(1)},
+			errMsg: paramTypeErrMsg,
 		},
 
 		// le
@@ -722,7 +1228,19 @@ func TestBuiltinOperators(t *testing.T) {
 		{
 			op:     "le",
 			params: []Value{int64(1), 1.0},
-			errMsg: paramTypeErrMsg, // type of int param should be int64
+			res:    true,
+		},
+
+		{
+			op:     "le",
+			params: []Value{"b", "ab"},
+			res:    false,
+		},
+
+		{
+			op:     "le",
+			params: []Value{"1", int64(1)},
+			errMsg: paramTypeErrMsg,
 		},
 
 		// between
@@ -774,25 +1292,55 @@ func TestBuiltinOperators(t *testing.T) {
 			errMsg: paramTypeErrMsg, // type of int param should be int64
 		},
 
-		// list
-		// in
 		{
-			op:     "in",
-			params: []Value{int64(1), []int64{1, 2, 3}},
+			op:     "between",
+			params: []Value{1.5, 1.0, 2.0},
 			res:    true,
 		},
 
 		{
-			op:     "in",
-			params: []Value{int64(0), []int64{1, 2, 3}},
+			op:     "between",
+			params: []Value{2.5, -1.0, 2.0},
 			res:    false,
 		},
 
 		{
-			op:     "in",
-			params: []Value{"a", []string{"a", "b", "c"}},
-			res:    true,
-		},
+			op:     "between",
+			params: []Value{math.NaN(), math.Inf(-1), math.Inf(1)},
+			res:    false,
+		},
+
+		{
+			op:     "between",
+			params: []Value{int64(1), int64(0), 2.0},
+			errMsg: paramTypeErrMsg,
+		},
+
+		{
+			op:     "between",
+			params: []Value{1.5, int64(1), 2.0},
+			errMsg: paramTypeErrMsg,
+		},
+
+		// list
+		// in
+		{
+			op:     "in",
+			params: []Value{int64(1), []int64{1, 2, 3}},
+			res:    true,
+		},
+
+		{
+			op:     "in",
+			params: []Value{int64(0), []int64{1, 2, 3}},
+			res:    false,
+		},
+
+		{
+			op:     "in",
+			params: []Value{"a", []string{"a", "b", "c"}},
+			res:    true,
+		},
 
 		{
 			op:     "in",
@@ -818,6 +1366,78 @@ func TestBuiltinOperators(t *testing.T) {
 			errMsg: paramTypeErrMsg, // type of int param should be int64
 		},
 
+		{
+			op:     "in",
+			params: []Value{"a", int64(1)},
+			errMsg: paramTypeErrMsg,
+		},
+
+		{
+			op:     "in",
+			params: []Value{"active", []interface{}{int64(1), "active", true}},
+			res:    true,
+		},
+
+		{
+			op:     "in",
+			params: []Value{int64(1), []interface{}{1, "1", 1.5}},
+			res:    true,
+		},
+
+		{
+			op:     "in",
+			params: []Value{true, []interface{}{"true", int64(1), []interface{}{true}}},
+			res:    false,
+		},
+
+		{
+			op:     "in",
+			params: []Value{1.5, []interface{}{int64(1), 1.5}},
+			res:    true,
+		},
+
+		{
+			op:     "in",
+			params: []Value{"a", []interface{}{}},
+			res:    false,
+		},
+
+		{
+			op:     "in",
+			params: []Value{[]int64{1}, []interface{}{[]int64{1}}},
+			errMsg: "unsupported value type []int64",
+		},
+
+		{
+			op:     "in",
+			params: []Value{1.0, []int64{1, 2}},
+			res:    true,
+		},
+
+		{
+			op:     "in",
+			params: []Value{1.5, []int64{1, 2}},
+			res:    false,
+		},
+
+		{
+			op:     "in",
+			params: []Value{1.0, []interface{}{int64(1), "a"}},
+			res:    true,
+		},
+
+		{
+			op:     "in",
+			params: []Value{1.0, []string{"a"}},
+			errMsg: paramTypeErrMsg,
+		},
+
+		{
+			op:     "in",
+			params: []Value{true, []int64{1, 2}},
+			errMsg: "expected: string or number, got: true",
+		},
+
 		// overlap
 		{
 			op:     "overlap",
@@ -1141,21 +1761,2400 @@ func TestBuiltinOperators(t *testing.T) {
 			params: []Value{},
 			errMsg: paramsCntErrMsg,
 		},
-	}
 
-	for _, c := range testCases {
-		t.Run(c.op, func(t *testing.T) {
-			fn := builtinOperators[c.op]
-			assertNotNil(t, fn, c)
+		// int
+		{
+			op:     "int",
+			params: []Value{int64(42)},
+			res:    int64(42),
+		},
+		{
+			op:     "int",
+			params: []Value{-3.9},
+			res:    int64(-3),
+		},
+		{
+			op:     "int",
+			params: []Value{float64(math.MinInt64)},
+			res:    int64(math.MinInt64),
+		},
+		{
+			op:     "int",
+			params: []Value{1e300},
+			errMsg: "integer overflow 1e+300",
+		},
+		{
+			op:     "int",
+			params: []Value{-9.3e18},
+			errMsg: "integer overflow -9.3e+18",
+		},
+		{
+			op:     "int",
+			params: []Value{float64(math.MaxInt64)},
+			errMsg: "integer overflow",
+		},
+		{
+			op:     "int",
+			params: []Value{math.NaN()},
+			errMsg: "integer overflow NaN",
+		},
+		{
+			op:     "int",
+			params: []Value{math.Inf(1)},
+			errMsg: "integer overflow +Inf",
+		},
+		{
+			op:     "int",
+			params: []Value{math.Inf(-1)},
+			errMsg: "integer overflow -Inf",
+		},
+		{
+			op:     "int",
+			params: []Value{"42"},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "int",
+			params: []Value{},
+			errMsg: paramsCntErrMsg,
+		},
 
-			res, err := fn(nil, c.params)
-			if len(c.errMsg) != 0 {
-				assertErrStrContains(t, err, c.errMsg, c)
-				return
-			}
+		// coerce_bool
+		{
+			op:     "coerce_bool",
+			params: []Value{"true"},
+			res:    true,
+		},
+		{
+			op:     "bool",
+			params: []Value{"1"},
+			res:    true,
+		},
+		{
+			op:     "coerce_bool",
+			params: []Value{"false"},
+			res:    false,
+		},
+		{
+			op:     "bool",
+			params: []Value{"0"},
+			res:    false,
+		},
+		{
+			op:     "coerce_bool",
+			params: []Value{int64(-3)},
+			res:    true,
+		},
+		{
+			op:     "bool",
+			params: []Value{int64(0)},
+			res:    false,
+		},
+		{
+			op:     "coerce_bool",
+			params: []Value{0.5},
+			res:    true,
+		},
+		{
+			op:     "bool",
+			params: []Value{0.0},
+			res:    false,
+		},
+		{
+			op:     "coerce_bool",
+			params: []Value{true},
+			res:    true,
+		},
+		{
+			op:     "bool",
+			params: []Value{"TRUE"},
+			errMsg: "unrecognized bool string: [TRUE]",
+		},
+		{
+			op:     "coerce_bool",
+			params: []Value{"yes"},
+			errMsg: "unrecognized bool string: [yes]",
+		},
+		{
+			op:     "bool",
+			params: []Value{" 1"},
+			errMsg: "unrecognized bool string",
+		},
+		{
+			op:     "coerce_bool",
+			params: []Value{nil},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "bool",
+			params: []Value{[]int64{1}},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "coerce_bool",
+			params: []Value{"1", "0"},
+			errMsg: paramsCntErrMsg,
+		},
 
-			assertNil(t, err, c)
-			assertEquals(t, res, c.res, c)
-		})
+		// parse_int
+		{
+			op:     "parse_int",
+			params: []Value{"42"},
+			res:    int64(42),
+		},
+		{
+			op:     "parse_int",
+			params: []Value{"-17"},
+			res:    int64(-17),
+		},
+		{
+			op:     "parse_int",
+			params: []Value{" \t42\n"},
+			res:    int64(42),
+		},
+		{
+			op:     "parse_int",
+			params: []Value{"4 2"},
+			errMsg: "invalid syntax",
+		},
+		{
+			op:     "parse_int",
+			params: []Value{"abc"},
+			errMsg: "operator: parse_int",
+		},
+		{
+			op:     "parse_int",
+			params: []Value{""},
+			errMsg: "invalid syntax",
+		},
+		{
+			op:     "parse_int",
+			params: []Value{int64(42)},
+			errMsg: paramTypeErrMsg,
+		},
+
+		// parse_int_or
+		{
+			op:     "parse_int_or",
+			params: []Value{" 42 ", int64(-1)},
+			res:    int64(42),
+		},
+		{
+			op:     "parse_int_or",
+			params: []Value{"4.2", int64(-1)},
+			res:    int64(-1),
+		},
+		{
+			op:     "parse_int_or",
+			params: []Value{"   ", int64(0)},
+			res:    int64(0),
+		},
+		{
+			op:     "parse_int_or",
+			params: []Value{"abc", "0"},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "parse_int_or",
+			params: []Value{"abc"},
+			errMsg: paramsCntErrMsg,
+		},
+
+		// divisible
+		{
+			op:     "divisible",
+			params: []Value{int64(10), int64(5)},
+			res:    true,
+		},
+		{
+			op:     "divisible",
+			params: []Value{int64(11), int64(5)},
+			res:    false,
+		},
+		{
+			op:     "divisible",
+			params: []Value{int64(0), int64(7)},
+			res:    true,
+		},
+		{
+			op:     "divisible",
+			params: []Value{int64(-15), int64(5)},
+			res:    true,
+		},
+		{
+			op:     "divisible",
+			params: []Value{int64(15), int64(-4)},
+			res:    false,
+		},
+		{
+			op:     "divisible",
+			params: []Value{int64(-9223372036854775808), int64(-1)},
+			res:    true,
+		},
+		{
+			op:     "divisible",
+			params: []Value{int64(10), int64(0)},
+			errMsg: "divide by zero",
+		},
+		{
+			op:     "divisible",
+			params: []Value{int64(10), "5"},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "divisible",
+			params: []Value{int64(10)},
+			errMsg: paramsCntErrMsg,
+		},
+
+		// count_of
+		{
+			op:     "count_of",
+			params: []Value{[]string{"a", "b", "a", "c", "a"}, "a"},
+			res:    int64(3),
+		},
+		{
+			op:     "count_of",
+			params: []Value{[]int64{1, 2, 2, 3}, int64(2)},
+			res:    int64(2),
+		},
+		{
+			op:     "count_of",
+			params: []Value{[]interface{}{int64(1), "1", true, int64(1)}, int64(1)},
+			res:    int64(2),
+		},
+		{
+			op:     "count_of",
+			params: []Value{[]string{"a", "b"}, "c"},
+			res:    int64(0),
+		},
+		{
+			op:     "count_of",
+			params: []Value{[]string{"a"}, []string{"a"}},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "count_of",
+			params: []Value{"a", "a"},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "count_of",
+			params: []Value{[]string{"a"}},
+			errMsg: paramsCntErrMsg,
+		},
+
+		// all_equal, any_duplicate
+		{
+			op:     "all_equal",
+			params: []Value{[]int64{3, 3, 3}},
+			res:    true,
+		},
+		{
+			op:     "all_equal",
+			params: []Value{[]int64{3, 3, 4, 3}},
+			res:    false,
+		},
+		{
+			op:     "all_equal",
+			params: []Value{[]string{"a", "a"}},
+			res:    true,
+		},
+		{
+			op:     "all_equal",
+			params: []Value{[]string{"a", "b", "a"}},
+			res:    false,
+		},
+		{
+			op:     "all_equal",
+			params: []Value{[]interface{}{true, true}},
+			res:    true,
+		},
+		{
+			op:     "all_equal",
+			params: []Value{[]int64{3}},
+			res:    true,
+		},
+		{
+			op:     "all_equal",
+			params: []Value{[]string{}},
+			res:    true,
+		},
+		{
+			op:     "all_equal",
+			params: []Value{[]interface{}{int64(1), int64(2), "a"}},
+			res:    false,
+		},
+		{
+			op:     "all_equal",
+			params: []Value{[]interface{}{int64(1), "1"}},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "all_equal",
+			params: []Value{[]interface{}{[]int64{1}, []int64{1}}},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "all_equal",
+			params: []Value{int64(1)},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "all_equal",
+			params: []Value{[]int64{1}, []int64{1}},
+			errMsg: paramsCntErrMsg,
+		},
+		{
+			op:     "any_duplicate",
+			params: []Value{[]int64{1, 2, 3}},
+			res:    false,
+		},
+		{
+			op:     "any_duplicate",
+			params: []Value{[]int64{1, 2, 3, 2}},
+			res:    true,
+		},
+		{
+			op:     "any_duplicate",
+			params: []Value{[]string{"a", "b", "a"}},
+			res:    true,
+		},
+		{
+			op:     "any_duplicate",
+			params: []Value{[]interface{}{false, true}},
+			res:    false,
+		},
+		{
+			op:     "any_duplicate",
+			params: []Value{[]int64{}},
+			res:    false,
+		},
+		{
+			op:     "any_duplicate",
+			params: []Value{[]interface{}{int64(1), int64(1), "a"}},
+			res:    true,
+		},
+		{
+			op:     "any_duplicate",
+			params: []Value{[]interface{}{"1", int64(1)}},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "any_duplicate",
+			params: []Value{nil},
+			errMsg: paramTypeErrMsg,
+		},
+
+		// frequencies
+		{
+			op:     "frequencies",
+			params: []Value{[]string{"a", "b", "a", "c", "a"}},
+			res:    map[string]interface{}{"a": int64(3), "b": int64(1), "c": int64(1)},
+		},
+		{
+			op:     "frequencies",
+			params: []Value{[]int64{1, 2, 2, 3}},
+			res:    map[string]interface{}{"1": int64(1), "2": int64(2), "3": int64(1)},
+		},
+		{
+			op:     "frequencies",
+			params: []Value{[]interface{}{true, false, true}},
+			res:    map[string]interface{}{"true": int64(2), "false": int64(1)},
+		},
+		{
+			op:     "frequencies",
+			params: []Value{[]string{}},
+			res:    map[string]interface{}{},
+		},
+		{
+			op:     "frequencies",
+			params: []Value{[]interface{}{int64(1), "1"}},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "frequencies",
+			params: []Value{[]interface{}{[]int64{1}}},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "frequencies",
+			params: []Value{int64(1)},
+			errMsg: paramTypeErrMsg,
+		},
+
+		// range
+		{
+			op:     "range",
+			params: []Value{int64(0), int64(3)},
+			res:    []int64{0, 1, 2},
+		},
+		{
+			op:     "range",
+			params: []Value{int64(1), int64(8), int64(3)},
+			res:    []int64{1, 4, 7},
+		},
+		{
+			op:     "range",
+			params: []Value{int64(3), int64(0), int64(-1)},
+			res:    []int64{3, 2, 1},
+		},
+		{
+			op:     "range",
+			params: []Value{int64(3), int64(3)},
+			res:    []int64{},
+		},
+		{
+			op:     "range",
+			params: []Value{int64(3), int64(0)},
+			res:    []int64{},
+		},
+		{
+			op:     "range",
+			params: []Value{int64(0), int64(3), int64(0)},
+			errMsg: "step should not be 0",
+		},
+		{
+			op:     "range",
+			params: []Value{int64(0), "3"},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "range",
+			params: []Value{int64(0)},
+			errMsg: "unexpected params count, operator: range, expected: 2 to 3, got: 1",
+		},
+		{
+			op:     "range",
+			params: []Value{int64(0), int64(3), int64(1), int64(1)},
+			errMsg: "unexpected params count, operator: range, expected: 2 to 3, got: 4",
+		},
+
+		// in_cidr
+		{
+			op:     "in_cidr",
+			params: []Value{"10.1.2.3", "10.0.0.0/8"},
+			res:    true,
+		},
+		{
+			op:     "in_cidr",
+			params: []Value{"11.1.2.3", "10.0.0.0/8"},
+			res:    false,
+		},
+		{
+			op:     "in_cidr",
+			params: []Value{"2001:db8::1", "2001:db8::/32"},
+			res:    true,
+		},
+		{
+			op:     "in_cidr",
+			params: []Value{"2001:db9::1", "2001:db8::/32"},
+			res:    false,
+		},
+		{
+			op:     "in_cidr",
+			params: []Value{"::ffff:192.168.1.1", "192.168.0.0/16"},
+			res:    true,
+		},
+		{
+			op:     "in_cidr",
+			params: []Value{netip.MustParseAddr("192.168.1.1"), "192.168.0.0/16"},
+			res:    true,
+		},
+		{
+			op:     "in_cidr",
+			params: []Value{net.ParseIP("192.168.1.1"), "192.168.0.0/24"},
+			res:    false,
+		},
+		{
+			op:     "in_cidr",
+			params: []Value{"10.1.2.300", "10.0.0.0/8"},
+			errMsg: "ParseAddr",
+		},
+		{
+			op:     "in_cidr",
+			params: []Value{"10.1.2.3", "10.0.0.0/33"},
+			errMsg: "ParsePrefix",
+		},
+		{
+			op:     "in_cidr",
+			params: []Value{int64(1), "10.0.0.0/8"},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "in_cidr",
+			params: []Value{"10.1.2.3"},
+			errMsg: paramsCntErrMsg,
+		},
+
+		// format_number
+		{
+			op:     "format_number",
+			params: []Value{int64(1234567), "en"},
+			res:    "1,234,567",
+		},
+		{
+			op:     "format_number",
+			params: []Value{int64(-1234567), "en-US"},
+			res:    "-1,234,567",
+		},
+		{
+			op:     "format_number",
+			params: []Value{int64(123), "en"},
+			res:    "123",
+		},
+		{
+			op:     "format_number",
+			params: []Value{int64(-123456), "en"},
+			res:    "-123,456",
+		},
+		{
+			op:     "format_number",
+			params: []Value{1234567.891, "de"},
+			res:    "1.234.567,891",
+		},
+		{
+			op:     "format_number",
+			params: []Value{1234567.891, "de_DE", int64(2)},
+			res:    "1.234.567,89",
+		},
+		{
+			op:     "format_number",
+			params: []Value{int64(1234567), "fr", int64(2)},
+			res:    "1\u00a0234\u00a0567,00",
+		},
+		{
+			op:     "format_number",
+			params: []Value{int64(-1234567), "sv"},
+			res:    "\u22121\u00a0234\u00a0567",
+		},
+		{
+			op:     "format_number",
+			params: []Value{int64(math.MaxInt64), "en"},
+			res:    "9,223,372,036,854,775,807",
+		},
+		{
+			op:     "format_number",
+			params: []Value{0.1, "en"},
+			res:    "0.1",
+		},
+		{
+			op:     "format_number",
+			params: []Value{-9876543.5, "ru"},
+			res:    "-9\u00a0876\u00a0543,5",
+		},
+		{
+			op:     "format_number",
+			params: []Value{int64(1234567), "de-CH"},
+			res:    "1\u2019234\u2019567",
+		},
+		{
+			op:     "format_number",
+			params: []Value{int64(123456789), "en-IN"},
+			res:    "12,34,56,789",
+		},
+		{
+			op:     "format_number",
+			params: []Value{int64(1000), "xx"},
+			errMsg: "unsupported locale [xx]",
+		},
+		{
+			op:     "format_number",
+			params: []Value{"1000", "en"},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "format_number",
+			params: []Value{int64(1000), "en", int64(-1)},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "format_number",
+			params: []Value{int64(1000)},
+			errMsg: "unexpected params count, operator: format_number, expected: 2 to 3, got: 1",
+		},
+
+		// json_get
+		{
+			op:     "json_get",
+			params: []Value{`{"a": {"b": "c"}}`, "$.a.b"},
+			res:    "c",
+		},
+		{
+			op:     "json_get",
+			params: []Value{`{"a": [{"b": 1}, {"b": 2.5}]}`, "$.a[1].b"},
+			res:    2.5,
+		},
+		{
+			op:     "json_get",
+			params: []Value{`{"a": {"b.c": [true, false]}}`, `$.a["b.c"][0]`},
+			res:    true,
+		},
+		{
+			op:     "json_get",
+			params: []Value{`[1, [2, 3]]`, "$[1]"},
+			res:    []interface{}{float64(2), float64(3)},
+		},
+		{
+			op:     "json_get",
+			params: []Value{`{"a": {"b": null}}`, "a"},
+			res:    map[string]interface{}{"b": nil},
+		},
+		{
+			op:     "json_get",
+			params: []Value{`{"a": {"b": "c"}}`, "$"},
+			res:    map[string]interface{}{"a": map[string]interface{}{"b": "c"}},
+		},
+		{
+			op:     "json_get",
+			params: []Value{`{"a": {"b": "c"}}`, "$.a.d"},
+			res:    DNE,
+		},
+		{
+			op:     "json_get",
+			params: []Value{`{"a": [1]}`, "$.a[1]"},
+			res:    DNE,
+		},
+		{
+			op:     "json_get",
+			params: []Value{`{"a": "b"}`, "$.a.b"},
+			res:    DNE,
+		},
+		{
+			op:     "json_get",
+			params: []Value{`{"a": {"b": null}}`, "$.a.b"},
+			res:    nil,
+		},
+		{
+			op:     "json_get",
+			params: []Value{`{"a": `, "$.a"},
+			errMsg: "unexpected end of JSON input",
+		},
+		{
+			op:     "json_get",
+			params: []Value{`{"a": 1}`, "$.a[x]"},
+			errMsg: "invalid JSON path [$.a[x]]",
+		},
+		{
+			op:     "json_get",
+			params: []Value{`{"a": 1}`, "$..a"},
+			errMsg: "invalid JSON path",
+		},
+		{
+			op:     "json_get",
+			params: []Value{int64(1), "$.a"},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "json_get",
+			params: []Value{`{"a": 1}`},
+			errMsg: paramsCntErrMsg,
+		},
+
+		// coerce_list
+		{
+			op:     "coerce_list",
+			params: []Value{"a"},
+			res:    []string{"a"},
+		},
+		{
+			op:     "coerce_list",
+			params: []Value{int64(1)},
+			res:    []int64{1},
+		},
+		{
+			op:     "coerce_list",
+			params: []Value{true},
+			res:    []interface{}{true},
+		},
+		{
+			op:     "coerce_list",
+			params: []Value{[]string{"a", "b"}},
+			res:    []string{"a", "b"},
+		},
+		{
+			op:     "coerce_list",
+			params: []Value{[]int64{1, 2}},
+			res:    []int64{1, 2},
+		},
+		{
+			op:     "coerce_list",
+			params: []Value{[]interface{}{int64(1), "a"}},
+			res:    []interface{}{int64(1), "a"},
+		},
+		{
+			op:     "coerce_list",
+			params: []Value{nil},
+			res:    []string{},
+		},
+		{
+			op:     "coerce_list",
+			params: []Value{DNE},
+			res:    []string{},
+		},
+		{
+			op:     "coerce_list",
+			params: []Value{"a", "b"},
+			errMsg: paramsCntErrMsg,
+		},
+
+		// dict, tuple
+		{
+			op:     "dict",
+			params: []Value{"a", int64(1), "b", []string{"x"}},
+			res:    map[string]interface{}{"a": int64(1), "b": []string{"x"}},
+		},
+		{
+			op:     "dict",
+			params: []Value{},
+			res:    map[string]interface{}{},
+		},
+		{
+			op:     "dict",
+			params: []Value{"a", int64(1), "a", int64(2)},
+			errMsg: "duplicate key [a]",
+		},
+		{
+			op:     "dict",
+			params: []Value{"a"},
+			errMsg: "the count of params should be even",
+		},
+		{
+			op:     "dict",
+			params: []Value{int64(1), "a"},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "tuple",
+			params: []Value{"a", int64(1)},
+			res:    []interface{}{"a", int64(1)},
+		},
+		{
+			op:     "tuple",
+			params: []Value{"a"},
+			errMsg: paramsCntErrMsg,
+		},
+
+		// has_key, has_value, keys, values
+		{
+			op:     "has_key",
+			params: []Value{map[string]interface{}{"b": int64(2), "a": "x", "c": []int64{1}}, "a"},
+			res:    true,
+		},
+		{
+			op:     "has_key",
+			params: []Value{map[string]interface{}{"b": int64(2), "a": "x", "c": []int64{1}}, "z"},
+			res:    false,
+		},
+		{
+			op:     "has_key",
+			params: []Value{nil, "a"},
+			res:    false,
+		},
+		{
+			op:     "has_key",
+			params: []Value{map[string]interface{}{"b": int64(2), "a": "x", "c": []int64{1}}, int64(1)},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "has_key",
+			params: []Value{[]string{"a"}, "a"},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "has_key",
+			params: []Value{map[string]interface{}{"b": int64(2), "a": "x", "c": []int64{1}}},
+			errMsg: paramsCntErrMsg,
+		},
+		{
+			op:     "has_value",
+			params: []Value{map[string]interface{}{"b": int64(2), "a": "x", "c": []int64{1}}, int64(2)},
+			res:    true,
+		},
+		{
+			op:     "has_value",
+			params: []Value{map[string]interface{}{"b": int64(2), "a": "x", "c": []int64{1}}, []int64{1}},
+			res:    true,
+		},
+		{
+			op:     "has_value",
+			params: []Value{map[string]interface{}{"b": int64(2), "a": "x", "c": []int64{1}}, "y"},
+			res:    false,
+		},
+		{
+			op:     "has_value",
+			params: []Value{map[string]interface{}{"b": int64(2), "a": "x", "c": []int64{1}}, "b"},
+			res:    false,
+		},
+		{
+			op:     "has_value",
+			params: []Value{map[string]interface{}{}, nil},
+			res:    false,
+		},
+		{
+			op:     "has_value",
+			params: []Value{"a", "a"},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "keys",
+			params: []Value{map[string]interface{}{"b": int64(2), "a": "x", "c": []int64{1}}},
+			res:    []string{"a", "b", "c"},
+		},
+		{
+			op:     "keys",
+			params: []Value{map[string]interface{}{}},
+			res:    []string{},
+		},
+		{
+			op:     "keys",
+			params: []Value{nil},
+			res:    []string{},
+		},
+		{
+			op:     "keys",
+			params: []Value{int64(1)},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "values",
+			params: []Value{map[string]interface{}{"b": int64(2), "a": "x", "c": []int64{1}}},
+			res:    []interface{}{"x", int64(2), []int64{1}},
+		},
+		{
+			op:     "values",
+			params: []Value{nil},
+			res:    []interface{}{},
+		},
+		{
+			op:     "values",
+			params: []Value{map[string]interface{}{"b": int64(2), "a": "x", "c": []int64{1}}, map[string]interface{}{"b": int64(2), "a": "x", "c": []int64{1}}},
+			errMsg: paramsCntErrMsg,
+		},
+
+		// url
+		{
+			op:     "url_scheme",
+			params: []Value{"https://user@example.com:8080/a/b?k=v&k=w&e="},
+			res:    "https",
+		},
+		{
+			op:     "url_host",
+			params: []Value{"https://user@example.com:8080/a/b?k=v&k=w&e="},
+			res:    "example.com",
+		},
+		{
+			op:     "url_path",
+			params: []Value{"https://user@example.com:8080/a/b?k=v&k=w&e="},
+			res:    "/a/b",
+		},
+		{
+			op:     "url_query",
+			params: []Value{"https://user@example.com:8080/a/b?k=v&k=w&e=", "k"},
+			res:    "v",
+		},
+		{
+			op:     "url_query",
+			params: []Value{"https://user@example.com:8080/a/b?k=v&k=w&e=", "e"},
+			res:    "",
+		},
+		{
+			op:     "url_query",
+			params: []Value{"https://user@example.com:8080/a/b?k=v&k=w&e=", "absent"},
+			res:    "",
+		},
+		{
+			op:     "url_host",
+			params: []Value{"/relative/path"},
+			res:    "",
+		},
+		{
+			op:     "url_path",
+			params: []Value{"/relative/path"},
+			res:    "/relative/path",
+		},
+		{
+			op:     "url_host",
+			params: []Value{"http://[::1"},
+			errMsg: "missing ']' in host",
+		},
+		{
+			op:     "url_scheme",
+			params: []Value{"://example.com"},
+			errMsg: "missing protocol scheme",
+		},
+		{
+			op:     "url_path",
+			params: []Value{int64(1)},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "url_query",
+			params: []Value{"https://user@example.com:8080/a/b?k=v&k=w&e=", int64(1)},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "url_query",
+			params: []Value{"https://user@example.com:8080/a/b?k=v&k=w&e="},
+			errMsg: paramsCntErrMsg,
+		},
+		{
+			op:     "url_host",
+			params: []Value{"https://user@example.com:8080/a/b?k=v&k=w&e=", "k"},
+			errMsg: paramsCntErrMsg,
+		},
+
+		// is_email, is_phone
+		{
+			op:     "is_email",
+			params: []Value{"john.smith@example.com"},
+			res:    true,
+		},
+		{
+			op:     "is_email",
+			params: []Value{"o'reilly+tag@mail.example.co.uk"},
+			res:    true,
+		},
+		{
+			op:     "is_email",
+			params: []Value{"a@b-c.io"},
+			res:    true,
+		},
+		{
+			op:     "is_email",
+			params: []Value{"john@localhost"},
+			res:    false,
+		},
+		{
+			op:     "is_email",
+			params: []Value{"john.example.com"},
+			res:    false,
+		},
+		{
+			op:     "is_email",
+			params: []Value{"john@@example.com"},
+			res:    false,
+		},
+		{
+			op:     "is_email",
+			params: []Value{"john smith@example.com"},
+			res:    false,
+		},
+		{
+			op:     "is_email",
+			params: []Value{"john@-example.com"},
+			res:    false,
+		},
+		{
+			op:     "is_email",
+			params: []Value{"john@example..com"},
+			res:    false,
+		},
+		{
+			op:     "is_email",
+			params: []Value{strings.Repeat("a", 65) + "@example.com"},
+			res:    false,
+		},
+		{
+			op:     "is_email",
+			params: []Value{int64(1)},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "is_phone",
+			params: []Value{"(202) 555-0123", "US"},
+			res:    true,
+		},
+		{
+			op:     "is_phone",
+			params: []Value{"+1 202 555 0123", "us"},
+			res:    true,
+		},
+		{
+			op:     "is_phone",
+			params: []Value{"1-202-555-0123", "US"},
+			res:    true,
+		},
+		{
+			op:     "is_phone",
+			params: []Value{"1-416-555-0123", "CA"},
+			res:    true,
+		},
+		{
+			op:     "is_phone",
+			params: []Value{"1-202-555-0123", "CA"},
+			res:    false,
+		},
+		{
+			op:     "is_phone",
+			params: []Value{"202-055-0123", "US"},
+			res:    false,
+		},
+		{
+			op:     "is_phone",
+			params: []Value{"555-0123", "US"},
+			res:    false,
+		},
+		{
+			op:     "is_phone",
+			params: []Value{"+44 20 7946 0018", "US"},
+			res:    false,
+		},
+		{
+			op:     "is_phone",
+			params: []Value{"1-800-FLOWERS", "US"},
+			res:    false,
+		},
+		{
+			op:     "is_phone",
+			params: []Value{"202-555-0123 ext. 5", "US"},
+			res:    false,
+		},
+		{
+			op:     "is_phone",
+			params: []Value{"Tel: 202-555-0123", "US"},
+			res:    false,
+		},
+		{
+			op:     "is_phone",
+			params: []Value{"020 7946 0018", "GB"},
+			res:    true,
+		},
+		{
+			op:     "is_phone",
+			params: []Value{"0161 234 5678", "GB"},
+			res:    true,
+		},
+		{
+			op:     "is_phone",
+			params: []Value{"+44 7400 123456", "GB"},
+			res:    true,
+		},
+		{
+			// the trunk prefix is optional in the national format
+			op:     "is_phone",
+			params: []Value{"20 7946 0018", "GB"},
+			res:    true,
+		},
+		{
+			op:     "is_phone",
+			params: []Value{"0161 234 567", "GB"},
+			res:    false,
+		},
+		{
+			op:     "is_phone",
+			params: []Value{"+44 7700 900123", "GB"},
+			res:    false,
+		},
+		{
+			op:     "is_phone",
+			params: []Value{"01 23 45 67 89", "FR"},
+			res:    true,
+		},
+		{
+			op:     "is_phone",
+			params: []Value{"06 12 34 56 78", "FR"},
+			res:    true,
+		},
+		{
+			op:     "is_phone",
+			params: []Value{"+33 1 23 45 67 8", "FR"},
+			res:    false,
+		},
+		{
+			op:     "is_phone",
+			params: []Value{"138 0013 8000", "CN"},
+			res:    true,
+		},
+		{
+			op:     "is_phone",
+			params: []Value{"010 6552 9988", "CN"},
+			res:    true,
+		},
+		{
+			op:     "is_phone",
+			params: []Value{"+86 10 6552 9988", "CN"},
+			res:    true,
+		},
+		{
+			op:     "is_phone",
+			params: []Value{"+86 12800138000", "CN"},
+			res:    false,
+		},
+		{
+			op:     "is_phone",
+			params: []Value{"202-555-0123x", "US"},
+			res:    false,
+		},
+		{
+			op:     "is_phone",
+			params: []Value{"202-555-0123", "XX"},
+			errMsg: "unsupported phone region: XX",
+		},
+		{
+			op:     "is_phone",
+			params: []Value{int64(2025550123), "US"},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "is_phone",
+			params: []Value{"202-555-0123"},
+			errMsg: paramsCntErrMsg,
+		},
+
+		// append, prepend, concat_lists
+		{
+			op:     "append",
+			params: []Value{[]int64{1, 2}, int64(3)},
+			res:    []int64{1, 2, 3},
+		},
+		{
+			op:     "prepend",
+			params: []Value{[]int64{1, 2}, int64(3)},
+			res:    []int64{3, 1, 2},
+		},
+		{
+			op:     "append",
+			params: []Value{[]string{"a"}, "b"},
+			res:    []string{"a", "b"},
+		},
+		{
+			op:     "prepend",
+			params: []Value{[]string{"a"}, "b"},
+			res:    []string{"b", "a"},
+		},
+		{
+			op:     "append",
+			params: []Value{[]string{}, int64(1)},
+			res:    []int64{1},
+		},
+		{
+			op:     "append",
+			params: []Value{[]string{}, "a"},
+			res:    []string{"a"},
+		},
+		{
+			op:     "prepend",
+			params: []Value{[]int64{}, true},
+			res:    []interface{}{true},
+		},
+		{
+			op:     "append",
+			params: []Value{[]interface{}{int64(1), "a"}, true},
+			res:    []interface{}{int64(1), "a", true},
+		},
+		{
+			op:     "concat_lists",
+			params: []Value{[]int64{1}, []int64{2, 3}},
+			res:    []int64{1, 2, 3},
+		},
+		{
+			op:     "concat_lists",
+			params: []Value{[]string{"a"}, []string{"b"}},
+			res:    []string{"a", "b"},
+		},
+		{
+			op:     "concat_lists",
+			params: []Value{[]string{}, []int64{1}},
+			res:    []int64{1},
+		},
+		{
+			op:     "concat_lists",
+			params: []Value{[]string{}, []string{}},
+			res:    []string{},
+		},
+		{
+			op:     "concat_lists",
+			params: []Value{[]int64{}, []int64{}},
+			res:    []int64{},
+		},
+		{
+			op:     "concat_lists",
+			params: []Value{[]interface{}{}, []interface{}{}},
+			res:    []interface{}{},
+		},
+		{
+			op:     "concat_lists",
+			params: []Value{[]int64{}, []string{}},
+			res:    []interface{}{},
+		},
+		{
+			op:     "concat_lists",
+			params: []Value{[]int64{1}, []string{"a"}},
+			res:    []interface{}{int64(1), "a"},
+		},
+		{
+			op:     "append",
+			params: []Value{[]int64{1}, "a"},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "prepend",
+			params: []Value{[]string{"a"}, int64(1)},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "append",
+			params: []Value{"a", "b"},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "append",
+			params: []Value{[]int64{1}},
+			errMsg: paramsCntErrMsg,
+		},
+		{
+			op:     "concat_lists",
+			params: []Value{[]int64{1}, int64(1)},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "concat_lists",
+			params: []Value{[]int64{1}},
+			errMsg: paramsCntErrMsg,
+		},
+
+		// normalize_space
+		{
+			op:     "normalize_space",
+			params: []Value{"  a   b  "},
+			res:    "a b",
+		},
+		{
+			op:     "normalize_space",
+			params: []Value{"a\t\tb\n\nc \r\n d"},
+			res:    "a b c d",
+		},
+		{
+			op:     "normalize_space",
+			params: []Value{"a\u00a0\u2003b\u3000"},
+			res:    "a b",
+		},
+		{
+			op:     "normalize_space",
+			params: []Value{" \t\n "},
+			res:    "",
+		},
+		{
+			op:     "normalize_space",
+			params: []Value{""},
+			res:    "",
+		},
+		{
+			op:     "normalize_space",
+			params: []Value{"ab"},
+			res:    "ab",
+		},
+		{
+			op:     "normalize_space",
+			params: []Value{int64(1)},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "normalize_space",
+			params: []Value{"a", "b"},
+			errMsg: paramsCntErrMsg,
+		},
+
+		// concat
+		{
+			op:     "concat",
+			params: []Value{"bob", " ", "smith"},
+			res:    "bob smith",
+		},
+		{
+			op:     "concat",
+			params: []Value{"", "日本"},
+			res:    "日本",
+		},
+		{
+			op:     "concat",
+			params: []Value{},
+			res:    "",
+		},
+		{
+			op:     "concat",
+			params: []Value{"age: ", int64(18)},
+			errMsg: "operator: concat, param: 1, expected: string, got: 18",
+		},
+
+		// repeat_str
+		{
+			op:     "repeat_str",
+			params: []Value{"ab", int64(3)},
+			res:    "ababab",
+		},
+		{
+			op:     "repeat_str",
+			params: []Value{"ab", int64(0)},
+			res:    "",
+		},
+		{
+			op:     "repeat_str",
+			params: []Value{"", int64(5)},
+			res:    "",
+		},
+		{
+			op:     "repeat_str",
+			params: []Value{"日本", int64(2)},
+			res:    "日本日本",
+		},
+		{
+			op:     "repeat_str",
+			params: []Value{"ab", int64(-1)},
+			errMsg: "n should be non-negative, got: -1",
+		},
+		{
+			op:     "repeat_str",
+			params: []Value{"ab", "3"},
+			errMsg: "n should be an integer, got: 3",
+		},
+		{
+			op:     "repeat_str",
+			params: []Value{int64(1), int64(3)},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "repeat_str",
+			params: []Value{"ab", int64(1) << 62},
+			errMsg: "result length exceeded",
+		},
+		{
+			op:     "repeat_str",
+			params: []Value{"ab"},
+			errMsg: paramsCntErrMsg,
+		},
+
+		// regex
+		{
+			op:     "regex",
+			params: []Value{"bob@example.com", "^[^@]+@[^@]+$"},
+			res:    true,
+		},
+		{
+			op:     "regex",
+			params: []Value{"bob", "^[^@]+@[^@]+$"},
+			res:    false,
+		},
+		{
+			op:     "regex",
+			params: []Value{"", ""},
+			res:    true,
+		},
+		{
+			op:     "regex",
+			params: []Value{"bob", "(b"},
+			errMsg: "operator: regex, error: invalid pattern \"(b\": error parsing regexp",
+		},
+		{
+			op:     "regex",
+			params: []Value{int64(1), "1"},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "regex",
+			params: []Value{"1", int64(1)},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "regex",
+			params: []Value{"1"},
+			errMsg: paramsCntErrMsg,
+		},
+
+		// edit_distance
+		{
+			op:     "edit_distance",
+			params: []Value{"kitten", "kitten"},
+			res:    int64(0),
+		},
+		{
+			op:     "edit_distance",
+			params: []Value{"", ""},
+			res:    int64(0),
+		},
+		{
+			op:     "edit_distance",
+			params: []Value{"kitten", "sitten"},
+			res:    int64(1),
+		},
+		{
+			op:     "edit_distance",
+			params: []Value{"kitten", "kittens"},
+			res:    int64(1),
+		},
+		{
+			op:     "edit_distance",
+			params: []Value{"kitten", "itten"},
+			res:    int64(1),
+		},
+		{
+			op:     "edit_distance",
+			params: []Value{"kitten", "sitting"},
+			res:    int64(3),
+		},
+		{
+			op:     "edit_distance",
+			params: []Value{"", "abc"},
+			res:    int64(3),
+		},
+		{
+			op:     "edit_distance",
+			params: []Value{"flaw", "lawn"},
+			res:    int64(2),
+		},
+		{
+			op:     "edit_distance",
+			params: []Value{"café", "cafe"},
+			res:    int64(1),
+		},
+		{
+			op:     "edit_distance",
+			params: []Value{"日本語", "日本"},
+			res:    int64(1),
+		},
+		{
+			op:     "edit_distance",
+			params: []Value{"🙂🙃", "🙃🙂"},
+			res:    int64(2),
+		},
+		{
+			op:     "edit_distance",
+			params: []Value{"a", int64(1)},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "edit_distance",
+			params: []Value{"a"},
+			errMsg: paramsCntErrMsg,
+		},
+
+		// sum, avg, min, max
+		{
+			op:     "sum",
+			params: []Value{[]int64{3, 1, 2}},
+			res:    int64(6),
+		},
+		{
+			op:     "sum",
+			params: []Value{[]interface{}{int64(1), 2.5}},
+			res:    3.5,
+		},
+		{
+			op:     "sum",
+			params: []Value{[]int64{}},
+			res:    int64(0),
+		},
+		{
+			op:     "sum",
+			params: []Value{[]string{}},
+			res:    int64(0),
+		},
+		{
+			op:     "sum",
+			params: []Value{[]string{"1"}},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "sum",
+			params: []Value{[]interface{}{int64(1), "2"}},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "avg",
+			params: []Value{[]int64{1, 2}},
+			res:    1.5,
+		},
+		{
+			op:     "avg",
+			params: []Value{[]interface{}{int64(1), 2.5, int64(3)}},
+			res:    6.5 / 3,
+		},
+		{
+			op:     "avg",
+			params: []Value{[]int64{}},
+			errMsg: "the list is empty",
+		},
+		{
+			op:     "min",
+			params: []Value{[]int64{3, -1, 2}},
+			res:    int64(-1),
+		},
+		{
+			op:     "min",
+			params: []Value{[]interface{}{int64(3), 1.5}},
+			res:    1.5,
+		},
+		{
+			op:     "min",
+			params: []Value{[]interface{}{}},
+			errMsg: "the list is empty",
+		},
+		{
+			op:     "max",
+			params: []Value{[]int64{3, -1, 2}},
+			res:    int64(3),
+		},
+		{
+			op:     "max",
+			params: []Value{[]interface{}{int64(3), 1.5}},
+			res:    float64(3),
+		},
+		{
+			op:     "max",
+			params: []Value{[]int64{}},
+			errMsg: "the list is empty",
+		},
+		{
+			op:     "max",
+			params: []Value{int64(1)},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "sum",
+			params: []Value{[]int64{1}, []int64{2}},
+			errMsg: paramsCntErrMsg,
+		},
+
+		// median, variance, stddev, percentile
+		{
+			op:     "median",
+			params: []Value{[]int64{3, 1, 2}},
+			res:    float64(2),
+		},
+		{
+			op:     "median",
+			params: []Value{[]int64{4, 1, 3, 2}},
+			res:    2.5,
+		},
+		{
+			op:     "median",
+			params: []Value{[]interface{}{int64(1), 2.5}},
+			res:    1.75,
+		},
+		{
+			op:     "variance",
+			params: []Value{[]int64{2, 4, 4, 4, 5, 5, 7, 9}},
+			res:    float64(4),
+		},
+		{
+			op:     "stddev",
+			params: []Value{[]int64{2, 4, 4, 4, 5, 5, 7, 9}},
+			res:    float64(2),
+		},
+		{
+			op:     "stddev",
+			params: []Value{[]int64{5}},
+			res:    float64(0),
+		},
+		{
+			op:     "percentile",
+			params: []Value{[]int64{4, 1, 3, 2}, int64(25)},
+			res:    1.75,
+		},
+		{
+			op:     "percentile",
+			params: []Value{[]int64{4, 1, 3, 2}, int64(0)},
+			res:    float64(1),
+		},
+		{
+			op:     "percentile",
+			params: []Value{[]int64{4, 1, 3, 2}, int64(100)},
+			res:    float64(4),
+		},
+		{
+			op:     "percentile",
+			params: []Value{[]int64{1, 2, 3, 4, 5}, 90.0},
+			res:    4.6,
+		},
+		{
+			op:     "median",
+			params: []Value{[]int64{}},
+			errMsg: "the list is empty",
+		},
+		{
+			op:     "stddev",
+			params: []Value{[]string{}},
+			errMsg: "the list is empty",
+		},
+		{
+			op:     "variance",
+			params: []Value{[]string{"a"}},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "median",
+			params: []Value{[]interface{}{"a"}},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "percentile",
+			params: []Value{[]int64{1}, int64(101)},
+			errMsg: "percentile p should be in [0, 100], got: 101",
+		},
+		{
+			op:     "percentile",
+			params: []Value{[]int64{1}},
+			errMsg: paramsCntErrMsg,
+		},
+		{
+			op:     "median",
+			params: []Value{[]int64{1}, int64(1)},
+			errMsg: paramsCntErrMsg,
+		},
+
+		// pct_of, apply_pct, ratio
+		{
+			op:     "pct_of",
+			params: []Value{int64(25), int64(200)},
+			res:    12.5,
+		},
+		{
+			op:     "pct_of",
+			params: []Value{int64(3), int64(3)},
+			res:    100.0,
+		},
+		{
+			op:     "pct_of",
+			params: []Value{1.5, int64(6)},
+			res:    25.0,
+		},
+		{
+			op:     "pct_of",
+			params: []Value{int64(-5), int64(20)},
+			res:    -25.0,
+		},
+		{
+			op:     "pct_of",
+			params: []Value{int64(1), int64(0)},
+			errMsg: "divide by zero",
+		},
+		{
+			op:     "pct_of",
+			params: []Value{int64(1), 0.0},
+			errMsg: "divide by zero",
+		},
+		{
+			op:     "pct_of",
+			params: []Value{"1", int64(2)},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "pct_of",
+			params: []Value{int64(1)},
+			errMsg: paramsCntErrMsg,
+		},
+		{
+			op:     "apply_pct",
+			params: []Value{int64(200), int64(15)},
+			res:    230.0,
+		},
+		{
+			op:     "apply_pct",
+			params: []Value{int64(200), int64(-10)},
+			res:    180.0,
+		},
+		{
+			op:     "apply_pct",
+			params: []Value{19.5, int64(0)},
+			res:    19.5,
+		},
+		{
+			op:     "apply_pct",
+			params: []Value{int64(200), nil},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "ratio",
+			params: []Value{int64(1), int64(4)},
+			res:    0.25,
+		},
+		{
+			op:     "ratio",
+			params: []Value{int64(9), 1.5},
+			res:    6.0,
+		},
+		{
+			op:     "ratio",
+			params: []Value{int64(0), int64(5)},
+			res:    0.0,
+		},
+		{
+			op:     "ratio",
+			params: []Value{int64(1), int64(0)},
+			errMsg: "divide by zero",
+		},
+		{
+			op:     "ratio",
+			params: []Value{int64(1), int64(2), int64(3)},
+			errMsg: paramsCntErrMsg,
+		},
+
+		// default
+		{
+			op:     "default",
+			params: []Value{int64(1), int64(2)},
+			res:    int64(1),
+		},
+		{
+			op:     "default",
+			params: []Value{nil, int64(2)},
+			res:    int64(2),
+		},
+		{
+			op:     "default",
+			params: []Value{"", "a"},
+			res:    "",
+		},
+		{
+			op:     "default",
+			params: []Value{false, true},
+			res:    false,
+		},
+		{
+			op:     "default",
+			params: []Value{nil},
+			errMsg: paramsCntErrMsg,
+		},
+
+		// empty, blank
+		{
+			op:     "empty",
+			params: []Value{""},
+			res:    true,
+		},
+		{
+			op:     "empty",
+			params: []Value{" "},
+			res:    false,
+		},
+		{
+			op:     "empty",
+			params: []Value{"a"},
+			res:    false,
+		},
+		{
+			op:     "empty",
+			params: []Value{nil},
+			res:    true,
+		},
+		{
+			op:     "empty",
+			params: []Value{DNE},
+			res:    true,
+		},
+		{
+			op:     "empty",
+			params: []Value{[]string{}},
+			res:    true,
+		},
+		{
+			op:     "empty",
+			params: []Value{[]int64{1}},
+			res:    false,
+		},
+		{
+			op:     "empty",
+			params: []Value{[]interface{}{}},
+			res:    true,
+		},
+		{
+			op:     "empty",
+			params: []Value{map[string]interface{}{}},
+			res:    true,
+		},
+		{
+			op:     "blank",
+			params: []Value{""},
+			res:    true,
+		},
+		{
+			op:     "blank",
+			params: []Value{" \t\n"},
+			res:    true,
+		},
+		{
+			op:     "blank",
+			params: []Value{" a "},
+			res:    false,
+		},
+		{
+			op:     "blank",
+			params: []Value{nil},
+			res:    true,
+		},
+		{
+			op:     "blank",
+			params: []Value{DNE},
+			res:    true,
+		},
+		{
+			op:     "empty",
+			params: []Value{int64(0)},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "empty",
+			params: []Value{"a", "b"},
+			errMsg: paramsCntErrMsg,
+		},
+		{
+			op:     "blank",
+			params: []Value{[]string{}},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "blank",
+			params: []Value{},
+			errMsg: paramsCntErrMsg,
+		},
+
+		// len
+		{
+			op:     "len",
+			params: []Value{"hello"},
+			res:    int64(5),
+		},
+		{
+			// the runes are counted, not the bytes
+			op:     "len",
+			params: []Value{"日本語"},
+			res:    int64(3),
+		},
+		{
+			op:     "len",
+			params: []Value{"héllo 👋"},
+			res:    int64(7),
+		},
+		{
+			op:     "len",
+			params: []Value{""},
+			res:    int64(0),
+		},
+		{
+			op:     "len",
+			params: []Value{[]string{"a", "b"}},
+			res:    int64(2),
+		},
+		{
+			op:     "len",
+			params: []Value{[]int64{1, 2, 3}},
+			res:    int64(3),
+		},
+		{
+			op:     "len",
+			params: []Value{[]interface{}{1, "a"}},
+			res:    int64(2),
+		},
+		{
+			op:     "len",
+			params: []Value{map[string]interface{}{"a": 1}},
+			res:    int64(1),
+		},
+		{
+			op:     "len",
+			params: []Value{1},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "len",
+			params: []Value{nil},
+			errMsg: paramTypeErrMsg,
+		},
+		{
+			op:     "len",
+			params: []Value{"a", "b"},
+			errMsg: paramsCntErrMsg,
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.op, func(t *testing.T) {
+			fn := builtinOperators[c.op]
+			assertNotNil(t, fn, c)
+
+			res, err := fn(nil, c.params)
+			if len(c.errMsg) != 0 {
+				assertErrStrContains(t, err, c.errMsg, c)
+				return
+			}
+
+			assertNil(t, err, c)
+			assertEquals(t, res, c.res, c)
+		})
+	}
+}
+
+func TestInCIDR(t *testing.T) {
+	testCases := []struct {
+		expr   string
+		ip     interface{}
+		want   Value
+		errMsg string
+	}{
+		{
+			expr: `(in_cidr ip "10.0.0.0/8")`,
+			ip:   "10.255.0.1",
+			want: true,
+		},
+		{
+			expr: `(in_cidr ip "10.0.0.0/8")`,
+			ip:   "172.16.0.1",
+			want: false,
+		},
+		{
+			expr: `(in_cidr ip "fd00::/8")`,
+			ip:   "fd12:3456::1",
+			want: true,
+		},
+		{
+			expr:   `(in_cidr ip "10.0.0.0/8")`,
+			ip:     "not an ip",
+			errMsg: "ParseAddr",
+		},
+		{
+			expr:   `(in_cidr ip "10.0.0.0/80")`,
+			ip:     "10.0.0.1",
+			errMsg: "invalid CIDR error",
+		},
+		{
+			expr:   `(in_cidr ip "10.0.0.0")`,
+			ip:     "10.0.0.1",
+			errMsg: "invalid CIDR error",
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			vals := map[string]interface{}{"ip": c.ip}
+			res, err := Eval(c.expr, vals)
+			if len(c.errMsg) != 0 {
+				assertErrStrContains(t, err, c.errMsg)
+				return
+			}
+			assertNil(t, err)
+			assertEquals(t, res, c.want)
+		})
+	}
+}
+
+func TestFormatNumber_ConstantLocale(t *testing.T) {
+	res, err := Eval(`(format_number n "es")`, map[string]interface{}{"n": 1234567})
+	assertNil(t, err)
+	assertEquals(t, res, "1.234.567")
+
+	_, err = Compile(NewConfig(), `(format_number 1 "xx")`)
+	assertErrStrContains(t, err, "unsupported locale [xx]")
+
+	_, err = Compile(NewConfig(), `(format_number 1 1)`)
+	assertErrStrContains(t, err, "format_number")
+
+	_, err = Eval(`(format_number 1 locale)`, map[string]interface{}{"locale": "en"})
+	assertErrStrContains(t, err, "format_number locale should be a constant")
+}
+
+func TestHash(t *testing.T) {
+	hash := func(v Value) Value {
+		res, err := hashValue(nil, []Value{v})
+		assertNil(t, err)
+		return res
+	}
+
+	// the hash is stable across processes
+	assertEquals(t, hash("abc"), int64(0x671fa2190541574b))
+
+	values := []Value{
+		"abc", "abd", "", int64(0), int64(1), int64(-1), true, false,
+		[]string{"a", "bc"}, []string{"ab", "c"}, []int64{1, 2}, []interface{}{int64(1), "2", true},
+	}
+	seen := make(map[Value]Value, len(values))
+	for _, v := range values {
+		h := hash(v)
+		assertEquals(t, hash(v), h, v)
+		assertEquals(t, h.(int64) >= 0, true, v)
+
+		if other, exist := seen[h]; exist {
+			t.Fatalf("hash collision: %v and %v", v, other)
+		}
+		seen[h] = v
+	}
+
+	_, err := hashValue(nil, []Value{1.5})
+	assertErrStrContains(t, err, paramTypeErrMsg)
+	_, err = hashValue(nil, []Value{[]interface{}{[]int64{1}}})
+	assertErrStrContains(t, err, paramTypeErrMsg)
+	_, err = hashValue(nil, []Value{"a", "b"})
+	assertErrStrContains(t, err, paramsCntErrMsg)
+}
+
+func TestSample(t *testing.T) {
+	const expr = `(sample ("A" "B" "C" "D") user_id)`
+	sample := func(userID interface{}) Value {
+		res, err := Eval(expr, map[string]interface{}{"user_id": userID})
+		assertNil(t, err)
+		return res
+	}
+
+	// the same seed always picks the same element
+	for _, seed := range []interface{}{"u-1", "u-2", 42, true} {
+		assertEquals(t, sample(seed), sample(seed), seed)
+	}
+
+	// the choice is stable across processes
+	res, err := hashSample(nil, []Value{[]int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, "abc"})
+	assertNil(t, err)
+	assertEquals(t, res, int64(9))
+
+	// different seeds can pick different elements
+	picked := make(map[Value]bool)
+	for i := 0; i < 100; i++ {
+		picked[sample(fmt.Sprintf("user-%d", i))] = true
+	}
+	assertEquals(t, len(picked), 4)
+
+	_, err = hashSample(nil, []Value{[]string{}, "abc"})
+	assertErrStrContains(t, err, "the list is empty")
+	_, err = hashSample(nil, []Value{"abc", "abc"})
+	assertErrStrContains(t, err, paramTypeErrMsg)
+	_, err = hashSample(nil, []Value{[]string{"a"}, 1.5})
+	assertErrStrContains(t, err, paramTypeErrMsg)
+	_, err = hashSample(nil, []Value{[]string{"a"}})
+	assertErrStrContains(t, err, paramsCntErrMsg)
+}
+
+func TestURLExtract_ConstantURL(t *testing.T) {
+	vals := map[string]interface{}{"key": "lang"}
+	res, err := Eval(`(url_query "https://example.com/?lang=en" key)`, vals)
+	assertNil(t, err)
+	assertEquals(t, res, "en")
+
+	// the constant URL is parsed at compile time
+	_, err = Compile(NewConfig(RegVarAndOp(vals)), `(url_query "http://[::1" key)`)
+	assertErrStrContains(t, err, "invalid URL error")
+}
+
+func TestIsPhone_ConstantRegion(t *testing.T) {
+	vals := map[string]interface{}{"phone": "+44 20 7946 0018", "region": "GB"}
+	res, err := Eval(`(is_phone phone "GB")`, vals)
+	assertNil(t, err)
+	assertEquals(t, res, true)
+
+	// the region is validated at compile time
+	_, err = Compile(NewConfig(RegVarAndOp(vals)), `(is_phone phone "ZZ")`)
+	assertErrStrContains(t, err, "unsupported phone region: ZZ")
+
+	_, err = Compile(NewConfig(RegVarAndOp(vals)), `(is_phone phone region)`)
+	assertErrStrContains(t, err, "is_phone region should be a constant")
+}
+
+func TestRepeatStr_ConstantCount(t *testing.T) {
+	vals := map[string]interface{}{"n": -1}
+	cc := NewConfig(RegVarAndOp(vals))
+
+	// the negative constant count is rejected at compile time
+	_, err := Compile(cc, `(repeat_str "-" -2)`)
+	assertErrStrContains(t, err, "n should be non-negative, got: -2")
+
+	// and the dynamic one at runtime
+	e, err := Compile(cc, `(repeat_str "-" n)`)
+	assertNil(t, err)
+	_, err = e.Eval(NewCtxFromVars(cc, vals))
+	assertErrStrContains(t, err, "operator: repeat_str, error: n should be non-negative, got: -1")
+}
+
+func TestDictOperators_UnifiedValues(t *testing.T) {
+	vals := map[string]interface{}{
+		"m": map[string]interface{}{"k": 1, "l": []int{1, 2}},
+	}
+	cc := NewConfig(RegVarAndOp(vals))
+
+	for expr, want := range map[string]Value{
+		`(has_value m 1)`:                     true,
+		`(has_value m (1 2))`:                 true,
+		`(values m)`:                          []interface{}{int64(1), []int64{1, 2}},
+		`(has_value m 2)`:                     false,
+		`(= (len (values m)) (len (keys m)))`: true,
+	} {
+		e, err := Compile(cc, expr)
+		assertNil(t, err, expr)
+		res, err := e.Eval(NewCtxFromVars(cc, vals))
+		assertNil(t, err, expr)
+		assertEquals(t, res, want, expr)
+	}
+}
+
+func TestComparison_MixedNumbers(t *testing.T) {
+	ops := []string{"=", "!=", "<", "<=", ">", ">="}
+	testCases := []struct {
+		a, b   Value
+		params string // the literals of a and b
+		want   []bool // in the order of the ops
+	}{
+		{a: int64(1), b: 1.0, params: "1 1.0", want: []bool{true, false, false, true, false, true}},
+		{a: 1.0, b: int64(1), params: "1.0 1", want: []bool{true, false, false, true, false, true}},
+		{a: int64(1), b: 1.5, params: "1 1.5", want: []bool{false, true, true, true, false, false}},
+		{a: 1.5, b: int64(1), params: "1.5 1", want: []bool{false, true, false, false, true, true}},
+		{a: int64(-2), b: -1.5, params: "-2 -1.5", want: []bool{false, true, true, true, false, false}},
+	}
+
+	for _, c := range testCases {
+		vals := map[string]interface{}{"a": c.a, "b": c.b}
+		cc := NewConfig(RegVarAndOp(vals))
+		for i, op := range ops {
+			for _, expr := range []string{
+				fmt.Sprintf("(%s a b)", op),
+				fmt.Sprintf("(%s %s)", op, c.params),
+			} {
+				name := fmt.Sprintf("%s with a: %#v, b: %#v", expr, c.a, c.b)
+				e, err := Compile(cc, expr)
+				assertNil(t, err, name)
+				res, err := e.Eval(NewCtxFromVars(cc, vals))
+				assertNil(t, err, name)
+				assertEquals(t, res, c.want[i], name)
+			}
+		}
+	}
+}
+
+func TestComparison_Collections(t *testing.T) {
+	vals := map[string]interface{}{
+		"ints":  []int{1, 2},
+		"strs":  []string{"a", "b"},
+		"mixed": []interface{}{int64(1), []interface{}{"a", 2.5}},
+		"attrs": map[string]interface{}{"a": int64(1), "b": []int64{2}},
+		"nums":  []float64{1.5},
+	}
+	cc := NewConfig(RegVarAndOp(vals))
+
+	for expr, want := range map[string]Value{
+		`(= (1 2) (1 2))`:                true,
+		`(= (1 2) (1 2 3))`:              false,
+		`(!= (1 2) (2 1))`:               true,
+		`(= ints (1 2))`:                 true,
+		`(= ints (1.0 2))`:               true,
+		`(= strs ("a" "b"))`:             true,
+		`(= strs ints)`:                  false,
+		`(= (1 2) (1 2) ints)`:           true,
+		`(= mixed (1 ("a" 2.5)))`:        true,
+		`(= mixed (1 ("a" 2)))`:          false,
+		`(= attrs attrs)`:                true,
+		`(= attrs (dict "a" 1 "b" (2)))`: true,
+		`(= attrs (dict "a" 1 "b" 2))`:   false,
+		`(= attrs ints)`:                 false,
+		`(= nums nums)`:                  true,
+		`(= ints 1)`:                     false,
+	} {
+		e, err := Compile(cc, expr)
+		assertNil(t, err, expr)
+		res, err := e.Eval(NewCtxFromVars(cc, vals))
+		assertNil(t, err, expr)
+		assertEquals(t, res, want, expr)
+	}
+}
+
+func TestConcat(t *testing.T) {
+	vals := map[string]interface{}{"first": "bob", "last": "smith", "age": 18}
+	cc := NewConfig(RegVarAndOp(vals))
+
+	for expr, want := range map[string]Value{
+		`(concat first " " last)`:   "bob smith",
+		`(concat)`:                  "",
+		`(eq (concat first) "bob")`: true,
+	} {
+		e, err := Compile(cc, expr)
+		assertNil(t, err, expr)
+		res, err := e.Eval(NewCtxFromVars(cc, vals))
+		assertNil(t, err, expr)
+		assertEquals(t, res, want, expr)
+	}
+
+	// the constant param which is not a string is rejected at compile time
+	_, err := Compile(cc, `(concat first 1)`)
+	assertErrStrContains(t, err, "operator: concat, param: 1, expected: string, got: 1 occurs at")
+
+	// and the variable one at runtime
+	e, err := Compile(cc, `(concat first age)`)
+	assertNil(t, err)
+	_, err = e.Eval(NewCtxFromVars(cc, vals))
+	assertErrStrContains(t, err, "operator: concat, param: 1, expected: string, got: 18")
+}
+
+func TestRegex_ConstantPattern(t *testing.T) {
+	vals := map[string]interface{}{"email": "bob@example.com", "pattern": "(b"}
+	cc := NewConfig(RegVarAndOp(vals))
+
+	// the invalid constant pattern is rejected at compile time
+	_, err := Compile(cc, `(regex email "[a-")`)
+	assertErrStrContains(t, err, `invalid pattern "[a-": error parsing regexp`)
+	assertErrStrContains(t, err, "occurs at")
+
+	// and the dynamic one at runtime
+	e, err := Compile(cc, `(regex email pattern)`)
+	assertNil(t, err)
+	_, err = e.Eval(NewCtxFromVars(cc, vals))
+	assertErrStrContains(t, err, `operator: regex, error: invalid pattern "(b"`)
+
+	e, err = Compile(cc, `(regex email "^[^@]+@[^@]+$")`)
+	assertNil(t, err)
+	res, err := e.Eval(NewCtxFromVars(cc, vals))
+	assertNil(t, err)
+	assertEquals(t, res, true)
+}
+
+func TestRegexCache(t *testing.T) {
+	c := &regexCache{patterns: make(map[string]*regexp.Regexp)}
+	re, err := c.compile("a+")
+	assertNil(t, err)
+	cached, err := c.compile("a+")
+	assertNil(t, err)
+	assertEquals(t, cached == re, true)
+
+	_, err = c.compile("(a")
+	assertErrStrContains(t, err, "missing closing )")
+	assertEquals(t, len(c.patterns), 1)
+
+	// the cache is reset once it's full
+	for i := 0; i < regexCacheSize; i++ {
+		_, err = c.compile(strconv.Itoa(i))
+		assertNil(t, err)
+	}
+	assertEquals(t, len(c.patterns), 1)
+	_, exist := c.patterns[strconv.Itoa(regexCacheSize-1)]
+	assertEquals(t, exist, true)
+}
+
+func TestListInsert_NotMutated(t *testing.T) {
+	list := make([]int64, 2, 4)
+	list[0], list[1] = 1, 2
+	vals := map[string]interface{}{"list": list}
+
+	for _, expr := range []string{
+		`(append list 3)`,
+		`(prepend list 3)`,
+		`(concat_lists list (3))`,
+		`(concat_lists () list)`,
+	} {
+		res, err := Eval(expr, vals, RegVarAndOp(vals), EnableEmptyList)
+		assertNil(t, err)
+		res.([]int64)[0] = 100
+		assertEquals(t, list[:cap(list)], []int64{1, 2, 0, 0}, expr)
+	}
+}
+
+func TestPercentile_ConstantP(t *testing.T) {
+	vals := map[string]interface{}{"scores": []int{10, 20, 30, 40}, "p": 50}
+	res, err := Eval(`(percentile scores 50)`, vals)
+	assertNil(t, err)
+	assertEquals(t, res, float64(25))
+
+	cc := NewConfig(RegVarAndOp(vals))
+	_, err = Compile(cc, `(percentile scores 101)`)
+	assertErrStrContains(t, err, "percentile p should be in [0, 100], got: 101 occurs at")
+	_, err = Compile(cc, `(percentile scores -1)`)
+	assertErrStrContains(t, err, "percentile p should be in [0, 100], got: -1 occurs at")
+	_, err = Compile(cc, `(percentile scores p)`)
+	assertErrStrContains(t, err, "percentile p should be a constant occurs at")
+	_, err = Compile(cc, `(percentile scores (+ p 10))`)
+	assertErrStrContains(t, err, "percentile p should be a constant occurs at")
+
+	// the constant folded p is accepted, and checked the same as the constants
+	for _, opt := range []Option{Optimizations(true), Optimizations(false)} {
+		conf := NewConfig(opt, RegVarAndOp(vals))
+		e, err := Compile(conf, `(percentile scores (+ 40 10))`)
+		assertNil(t, err)
+		res, err = e.Eval(NewCtxFromVars(conf, vals))
+		assertNil(t, err)
+		assertEquals(t, res, float64(25))
+
+		_, err = Compile(conf, `(percentile scores (* 50 3))`)
+		assertErrStrContains(t, err, "percentile p should be in [0, 100], got: 150 occurs at")
+	}
+}
+
+func TestJSONGet_ConstantPath(t *testing.T) {
+	vals := map[string]interface{}{
+		"profile": `{"address": {"city": "Paris", "zip": 75001}, "tags": ["a", "b"]}`,
+	}
+	res, err := Eval(`(= (json_get profile "$.address.city") "Paris")`, vals)
+	assertNil(t, err)
+	assertEquals(t, res, true)
+
+	res, err = Eval(`(json_get profile "$.tags[1]")`, vals)
+	assertNil(t, err)
+	assertEquals(t, res, "b")
+
+	// the missing path is DNE, while the JSON null is nil
+	res, err = Eval(`(json_get profile "$.address.street")`, vals)
+	assertNil(t, err)
+	assertEquals(t, res, DNE)
+
+	_, err = Compile(NewConfig(RegVarAndOp(vals)), `(json_get profile "$.tags[")`)
+	assertErrStrContains(t, err, "invalid JSON path [$.tags[]")
+}
+
+func TestDefault(t *testing.T) {
+	testCases := []struct {
+		expr   string
+		vals   map[string]interface{}
+		want   Value
+		errMsg string
+	}{
+		{
+			expr: `(default age 18)`,
+			vals: map[string]interface{}{"age": 30},
+			want: int64(30),
+		},
+		{
+			expr: `(default age 18)`,
+			vals: map[string]interface{}{"age": nil},
+			want: int64(18),
+		},
+		{
+			expr: `(default (parse_int s) 0)`,
+			vals: map[string]interface{}{"s": "42"},
+			want: int64(42),
+		},
+		{
+			// the errors are not swallowed
+			expr:   `(default (parse_int s) 0)`,
+			vals:   map[string]interface{}{"s": "abc"},
+			errMsg: "parse_int",
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			res, err := Eval(c.expr, c.vals)
+			if len(c.errMsg) != 0 {
+				assertErrStrContains(t, err, c.errMsg)
+				return
+			}
+			assertNil(t, err)
+			assertEquals(t, res, c.want)
+		})
+	}
+
+	// the variable is registered, but its value is absent
+	cc := NewConfig(RegVarAndOp(map[string]interface{}{"name": "Alice"}))
+	e, err := Compile(cc, `(default name "unknown")`)
+	assertNil(t, err)
+	res, err := e.Eval(NewCtxFromVars(cc, map[string]interface{}{}))
+	assertNil(t, err)
+	assertEquals(t, res, "unknown")
+}
+
+func TestCoerceList(t *testing.T) {
+	expr := `(in "admin" (coerce_list roles))`
+	for _, c := range []struct {
+		roles interface{}
+		want  Value
+	}{
+		{roles: "admin", want: true},
+		{roles: []string{"user", "admin"}, want: true},
+		{roles: nil, want: false},
+	} {
+		res, err := Eval(expr, map[string]interface{}{"roles": c.roles})
+		assertNil(t, err)
+		assertEquals(t, res, c.want)
 	}
 }
@@ -3,15 +3,19 @@ package eval
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 type tokenType string
 
 const (
 	integer  tokenType = "integer"
+	float    tokenType = "float"
+	boolean  tokenType = "bool"
 	str      tokenType = "str"
 	ident    tokenType = "ident"
 	lParen   tokenType = "lParen"
@@ -20,8 +24,24 @@ const (
 	rBracket tokenType = "rBracket"
 	comment  tokenType = "comment"
 	comma    tokenType = "comma"
+
+	// placeholder is inserted for the missing expressions in the parse recovery mode
+	placeholder tokenType = "placeholder"
 )
 
+// placeholderOp is the value of the placeholder nodes in the parse recovery mode
+const placeholderOp = "error"
+
+// boolLiterals are the bool constants which are available without registration,
+// a constant with the same name should be registered with the same value
+var boolLiterals = map[string]bool{
+	"true":  true,
+	"false": false,
+}
+
+// sequenceOp is the value of the root node of the expressions parsed with TrailingSequence
+const sequenceOp = "sequence"
+
 func (t tokenType) String() string {
 	return string(t)
 }
@@ -35,18 +55,28 @@ type token struct {
 type keyword string
 
 const (
-	keywordIf      keyword = "if"
-	keywordLet     keyword = "let"
-	keywordAny     keyword = "any"
-	keywordAll     keyword = "all"
-	keywordMap     keyword = "map"
-	keywordFilter  keyword = "filter"
-	keywordReduce  keyword = "reduce"
-	keywordCollect keyword = "collect"
+	keywordIf         keyword = "if"
+	keywordLet        keyword = "let"
+	keywordAny        keyword = "any"
+	keywordAll        keyword = "all"
+	keywordMap        keyword = "map"
+	keywordFilter     keyword = "filter"
+	keywordReduce     keyword = "reduce"
+	keywordCollect    keyword = "collect"
+	keywordFindAll    keyword = "find_all"
+	keywordTap        keyword = "tap"
+	keywordIterate    keyword = "iterate"
+	keywordMapIf      keyword = "map_if"
+	keywordSortBy     keyword = "sort_by"
+	keywordSortByDesc keyword = "sort_by_desc"
+	keywordInterp     keyword = "interp"
+	keywordCond       keyword = "cond"
 )
 
 var keywords = [...]keyword{keywordIf, keywordLet, keywordAny,
-	keywordAll, keywordMap, keywordFilter, keywordReduce, keywordCollect}
+	keywordAll, keywordMap, keywordFilter, keywordReduce, keywordCollect,
+	keywordFindAll, keywordTap, keywordIterate, keywordMapIf,
+	keywordSortBy, keywordSortByDesc, keywordInterp, keywordCond}
 
 // ast
 type astNode struct {
@@ -55,6 +85,18 @@ type astNode struct {
 	cost      float64
 	idx       int
 	parentIdx int
+
+	// sub-expressions compiled separately, e.g. the predicate of find_all
+	lambdas []*lambda
+
+	// the source span of the operator nodes in the prefix notation
+	span Span
+
+	// the static type of the result of the operator nodes, it's inferred when TypeCheck is enabled
+	typ ValueType
+
+	// wraps the operators of the node with the limits of the config, see parser.operatorWrapper
+	wrap func(Operator) Operator
 }
 
 type parser struct {
@@ -63,6 +105,25 @@ type parser struct {
 	tokens []token
 	idx    int
 
+	// the runes of the source, it's decoded lazily by sourceRunes
+	runes []rune
+
+	// the offsets of the first runes of the lines of the source, it's computed in lex
+	lineStarts []int
+
+	// the end of the last lexed token other than comments, in runes
+	lexEnd int
+
+	// local variables visible to the current parsing node
+	locals []string
+
+	// errors recovered in the parse recovery mode
+	errs []error
+
+	// the selectors referenced by the expression, including the placeholders of the interp
+	// templates, the local variables with the same names are not included
+	selectors map[string]bool
+
 	leafNodeParser []func() (*astNode, error)
 }
 
@@ -73,8 +134,32 @@ func newParser(cc *Config, source string) *parser {
 	}
 }
 
+// sourceRunes decodes the source into the runes buffer of the parser,
+// the buffer may be reused across sources by the Compiler
+func (p *parser) sourceRunes() []rune {
+	if len(p.runes) == 0 && len(p.source) != 0 {
+		for _, r := range p.source {
+			p.runes = append(p.runes, r)
+		}
+	}
+	return p.runes
+}
+
+// setLineStarts sets the offsets of the first runes of the lines, see lineCol
+func (p *parser) setLineStarts() {
+	p.lineStarts = append(p.lineStarts[:0], 0)
+	for j, r := range p.sourceRunes() {
+		if r == '\n' {
+			p.lineStarts = append(p.lineStarts, j+1)
+		}
+	}
+}
+
 func (p *parser) lex() error {
-	A, i := []rune(p.source), 0
+	A, i := p.sourceRunes(), 0
+	depth := 0
+
+	p.setLineStarts()
 
 	var (
 		lexComment = func() (string, error) {
@@ -91,11 +176,16 @@ func (p *parser) lex() error {
 			start := i
 			i += 1
 			for ; i < len(A); i++ {
-				if A[i] == '"' {
+				switch A[i] {
+				case '\\':
+					i++ // the escaped rune can not close the string
+				case '"':
 					i++
 					return string(A[start:i]), nil
 				}
 			}
+			// point to the opening quote
+			i = start
 			return "", errors.New("unclosed quotes")
 		}
 
@@ -117,6 +207,13 @@ func (p *parser) lex() error {
 						break
 					}
 				}
+				if r == '[' && i != start {
+					// the index suffixes of the selectors, e.g. `items[0]` and `matrix[1][-1]`
+					if n := indexSuffixLen(A[i:]); n != 0 {
+						i += n - 1
+						continue
+					}
+				}
 				if strings.ContainsRune("()[];,", r) {
 					break
 				}
@@ -133,10 +230,23 @@ func (p *parser) lex() error {
 			return string(A[start:i]), nil
 		}
 
+		// a sign is a part of the number literal only if it's attached to the digits,
+		// since the tokens are delimited by spaces, parentheses and commas, e.g.
+		// `-5` and `-3.14` are negative literals, `(- 0 5)` and `a - 5` are subtractions,
+		// a standalone `-` is always lexed as the operator, so there is no ambiguity.
 		isValidInt = func(s string) bool {
 			_, err := strconv.ParseInt(s, 10, 64)
 			return err == nil
 		}
+		// only the decimal floats are valid, e.g. `3.14`, `-2.5` and `1.5e-3`,
+		// the special values such as `Inf` and `NaN` are not
+		isValidFloat = func(s string) bool {
+			if !strings.ContainsAny(s, ".eE") || strings.Trim(s, "0123456789.eE+-") != "" {
+				return false
+			}
+			_, err := strconv.ParseFloat(s, 64)
+			return err == nil
+		}
 		isValidIdent = func(s string) bool {
 			prevDotIdx := -1
 			runes := []rune(s)
@@ -170,32 +280,70 @@ func (p *parser) lex() error {
 			}
 			return true
 		}
+		// the selectors with index suffixes, e.g. `items[0]`, `matrix[1][-1]` and `users[0].name`,
+		// the segments after an index are map keys or indexes
+		isValidIndexed = func(s string) bool {
+			b := strings.IndexByte(s, '[')
+			if b <= 0 || !isValidIdent(s[:b]) {
+				return false
+			}
+			runes := []rune(s[b:])
+			for j := 0; j < len(runes); {
+				if runes[j] == '[' {
+					n := indexSuffixLen(runes[j:])
+					if n == 0 {
+						return false
+					}
+					j += n
+					continue
+				}
+				if runes[j] != '.' || j+1 == len(runes) {
+					return false
+				}
+				for j++; j < len(runes) && runes[j] != '.' && runes[j] != '['; j++ {
+					if r := runes[j]; !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '_' {
+						return false
+					}
+				}
+				if runes[j-1] == '.' {
+					return false
+				}
+			}
+			return true
+		}
 	)
 
 	for {
 		t, err := nextToken()
 		if err != nil {
-			return p.errWithPos(err, i-len(t))
+			return p.errWithPos(ErrKindInvalidLiteral, err, i-len(t))
 		}
 
 		if t == "" {
 			break
 		}
+		if !strings.HasPrefix(t, ";") {
+			p.lexEnd = i
+		}
 
 		if p.isInfixNotation() && strings.HasPrefix(t, "!") {
 			if isValidIdent(t) {
-				p.tokens = append(p.tokens, token{typ: ident, val: t})
+				p.tokens = append(p.tokens, token{typ: ident, val: t, pos: i - len([]rune(t))})
 				continue
 			}
 
-			if next := t[1:]; isValidIdent(next) {
-				p.tokens = append(p.tokens, token{typ: ident, val: "!"})
-				p.tokens = append(p.tokens, token{typ: ident, val: next})
+			if next := t[1:]; isValidIdent(next) || isValidIndexed(next) {
+				pos := i - len([]rune(t))
+				tk := token{typ: ident, val: p.normalizeIdent(next), pos: pos + 1}
+				if _, exist := boolLiterals[tk.val]; exist {
+					tk.typ = boolean
+				}
+				p.tokens = append(p.tokens, token{typ: ident, val: "!", pos: pos}, tk)
 				continue
 			}
 		}
 
-		tk := token{val: t}
+		tk := token{val: t, pos: i - len([]rune(t))}
 		switch {
 		case t == "(":
 			tk.typ = lParen
@@ -212,20 +360,122 @@ func (p *parser) lex() error {
 		case strings.HasPrefix(t, `"`):
 			tk.val = t[1 : len(t)-1] // remove quotes
 			tk.typ = str
+			// the strings without escapes are used as they are
+			if strings.IndexByte(tk.val, '\\') != -1 {
+				val, offset, err := unescapeStr(tk.val)
+				if err != nil {
+					// skip the opening quote
+					return p.errWithPos(ErrKindInvalidLiteral, err, tk.pos+1+offset)
+				}
+				tk.val = val
+			}
 		case isValidInt(t):
 			tk.typ = integer
-		case isValidIdent(t):
+		case isValidFloat(t):
+			tk.typ = float
+		case isValidIdent(t) || isValidIndexed(t):
 			tk.typ = ident
+			tk.val = p.normalizeIdent(t)
+			if _, exist := boolLiterals[tk.val]; exist {
+				tk.typ = boolean
+			}
 		default:
-			return p.errWithPos(errors.New("can not parse token"), i-len(t))
+			return p.errWithPos(ErrKindInvalidLiteral, errors.New("can not parse token"), i-len(t))
 		}
 
 		p.tokens = append(p.tokens, tk)
+
+		// the content after the first complete expression is not lexed
+		if p.conf.TrailingTokens == TrailingIgnore && !p.isInfixNotation() {
+			switch tk.typ {
+			case lParen:
+				depth++
+			case rParen:
+				if depth--; depth == 0 {
+					return nil
+				}
+			}
+		}
 	}
 
 	return nil
 }
 
+// unescapeStr decodes the escape sequences of the string literal, which are \", \\, \n, \t
+// and \uXXXX. If an escape sequence is invalid, it returns the offset of the sequence in runes.
+func unescapeStr(s string) (string, int, error) {
+	var sb strings.Builder
+	sb.Grow(len(s))
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if r != '\\' {
+			sb.WriteRune(r)
+			continue
+		}
+
+		start := i
+		if i++; i == len(runes) {
+			return "", start, errors.New("invalid escape sequence")
+		}
+		switch runes[i] {
+		case '"', '\\':
+			sb.WriteRune(runes[i])
+		case 'n':
+			sb.WriteByte('\n')
+		case 't':
+			sb.WriteByte('\t')
+		case 'u':
+			if i+4 >= len(runes) {
+				return "", start, fmt.Errorf("invalid escape sequence %s", string(runes[start:]))
+			}
+			hex := string(runes[i+1 : i+5])
+			code, err := strconv.ParseUint(hex, 16, 32)
+			if err != nil {
+				return "", start, fmt.Errorf("invalid escape sequence \\u%s", hex)
+			}
+			sb.WriteRune(rune(code))
+			i += 4
+		default:
+			return "", start, fmt.Errorf("invalid escape sequence \\%c", runes[i])
+		}
+	}
+	return sb.String(), 0, nil
+}
+
+// quoteStr is the reverse of unescapeStr, it quotes the string as a literal which can be lexed
+func quoteStr(s string) string {
+	var sb strings.Builder
+	sb.Grow(len(s) + 2)
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case r == '\n':
+			sb.WriteString(`\n`)
+		case r == '\t':
+			sb.WriteString(`\t`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&sb, `\u%04x`, r)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// consumedLen returns the length in bytes of the source up to the end of the last lexed token
+func (p *parser) consumedLen() int {
+	n := 0
+	for _, r := range p.sourceRunes()[:p.lexEnd] {
+		n += utf8.RuneLen(r)
+	}
+	return n
+}
+
 func (p *parser) parseAstTree() (root *astNode, err error) {
 	n := 0
 	for _, t := range p.tokens {
@@ -236,6 +486,14 @@ func (p *parser) parseAstTree() (root *astNode, err error) {
 	}
 	p.tokens = p.tokens[:n]
 
+	if p.isParseRecovery() {
+		p.balanceParens()
+	}
+
+	if err = p.expandMacros(); err != nil {
+		return nil, err
+	}
+
 	if err = p.check(); err != nil {
 		return nil, err
 	}
@@ -244,6 +502,8 @@ func (p *parser) parseAstTree() (root *astNode, err error) {
 
 	if p.isInfixNotation() {
 		root, err = p.parseInfixExpression()
+	} else if p.isSequence() {
+		root, err = p.parseSequence()
 	} else {
 		root, err = p.parseExpression()
 	}
@@ -260,7 +520,11 @@ func (p *parser) parseAstTree() (root *astNode, err error) {
 
 func (p *parser) setLeafNodeParsers() {
 	fns := []func() (*astNode, error){
-		p.parseInt, p.parseStr, p.parseConst, p.parseVariable, p.parseUnknownVariable}
+		p.parseInt, p.parseFloat, p.parseBool, p.parseStr, p.parseLocal, p.parseConst, p.parseVariable, p.parseUnknownVariable}
+
+	if p.isParseRecovery() {
+		fns = append(fns, p.parsePlaceholder)
+	}
 
 	if p.isInfixNotation() {
 		// For infix expressions only lists with brackets are supported
@@ -273,6 +537,10 @@ func (p *parser) setLeafNodeParsers() {
 }
 
 func (p *parser) check() error {
+	if len(p.tokens) == 0 {
+		// the expression is empty or consists of comments only
+		return p.errWithPos(ErrKindInvalidExpr, errors.New("empty expression error"), 0)
+	}
 	prefixNotation := !p.isInfixNotation()
 
 	last := len(p.tokens) - 1
@@ -302,7 +570,7 @@ func (p *parser) check() error {
 			return p.parenUnmatchedErr(t.pos)
 		}
 
-		if prefixNotation && parenCnt == 0 && i != last {
+		if prefixNotation && parenCnt == 0 && i != last && !p.isSequence() {
 			return p.parenUnmatchedErr(t.pos)
 		}
 
@@ -333,6 +601,10 @@ func (p *parser) parse() (*astNode, *Config, error) {
 	if err != nil {
 		return nil, nil, err
 	}
+	err = p.checkBoolLiterals()
+	if err != nil {
+		return nil, nil, err
+	}
 	ast, err := p.parseAstTree()
 	if err != nil {
 		return nil, nil, err
@@ -340,6 +612,47 @@ func (p *parser) parse() (*astNode, *Config, error) {
 	return ast, p.conf, nil
 }
 
+// checkBoolLiterals returns an error if a registered constant shadows a bool literal with a different value,
+// the error points at the first use of the literal, or the start of the expression if it's not used
+func (p *parser) checkBoolLiterals() error {
+	for name, b := range boolLiterals {
+		val, exist := p.conf.ConstantMap[name]
+		if !exist || val == b {
+			continue
+		}
+		err := fmt.Errorf("constant [%s] conflicts with the bool literal, registered value: %v", name, val)
+		for _, t := range p.tokens {
+			if t.typ == boolean && strings.EqualFold(t.val, name) {
+				return p.errWithToken(ErrKindInvalidConfig, err, t)
+			}
+		}
+		return p.errWithPos(ErrKindInvalidConfig, err, 0)
+	}
+	return nil
+}
+
+// useSelector records the selector referenced by the expression, see unusedSelectors
+func (p *parser) useSelector(name string) {
+	if p.selectors == nil {
+		p.selectors = make(map[string]bool)
+	}
+	p.selectors[name] = true
+}
+
+// unusedSelectors returns the sorted names of the selectors registered in the VariableKeyMap
+// which are not referenced by the expression, the local variables of the keywords, e.g. `x`
+// of map, are not references of the selectors with the same names
+func (p *parser) unusedSelectors() []string {
+	var unused []string
+	for name := range p.conf.VariableKeyMap {
+		if !p.selectors[name] {
+			unused = append(unused, name)
+		}
+	}
+	sort.Strings(unused)
+	return unused
+}
+
 func (p *parser) allowUndefinedVariable() bool {
 	return p.conf.CompileOptions[AllowUndefinedVariable]
 }
@@ -348,6 +661,62 @@ func (p *parser) isInfixNotation() bool {
 	return p.conf.CompileOptions[InfixNotation]
 }
 
+func (p *parser) isCaseInsensitive() bool {
+	return p.conf.CompileOptions[CaseInsensitiveKeywords]
+}
+
+func (p *parser) isSequence() bool {
+	return p.conf.TrailingTokens == TrailingSequence && !p.isInfixNotation()
+}
+
+func (p *parser) isParseRecovery() bool {
+	return p.conf.CompileOptions[ParseRecovery] && !p.isInfixNotation()
+}
+
+// indexSuffixLen returns the length of the index suffix at the beginning of the runes,
+// e.g. `[0]` and `[-1]`, it returns 0 if the runes don't begin with an index suffix
+func indexSuffixLen(rs []rune) int {
+	j := 1
+	if j < len(rs) && rs[j] == '-' {
+		j++
+	}
+	digits := j
+	for j < len(rs) && rs[j] >= '0' && rs[j] <= '9' {
+		j++
+	}
+	if j == digits || j >= len(rs) || rs[j] != ']' || j-digits > 9 {
+		return 0
+	}
+	return j + 1
+}
+
+// normalizeIdent converts the builtin keywords, operators and constants to their
+// canonical lower case names when CaseInsensitiveKeywords is enabled.
+// Only ASCII letters are folded, and the builtin names take precedence over the
+// user-defined ones, so an ident is folded once its lower case is a builtin name,
+// otherwise it is kept as it is, as user-defined names are case-sensitive.
+func (p *parser) normalizeIdent(s string) string {
+	if !p.isCaseInsensitive() {
+		return s
+	}
+
+	lower := toASCIILower(s)
+	if lower == s {
+		return s
+	}
+
+	if _, exist := builtinOperators[lower]; exist {
+		return lower
+	}
+	if _, exist := boolLiterals[lower]; exist {
+		return lower
+	}
+	if _, exist := keywordOf(p.conf, lower); exist {
+		return lower
+	}
+	return s
+}
+
 func (p *parser) peek() (token, error) {
 	if !p.hasNext() {
 		return token{}, p.errNoNextToken()
@@ -391,53 +760,132 @@ func (p *parser) walk() {
 }
 
 func (p *parser) getOperator(opName string) (Operator, bool) {
-	op, exist := builtinOperators[opName]
-	if !exist {
-		op, exist = p.conf.OperatorMap[opName]
+	if isBuiltinOperator(p.conf, opName) {
+		return builtinOperators[opName], true
 	}
+	op, exist := p.conf.OperatorMap[opName]
 	return op, exist
 }
 
+// ParseErrorKind is the kind of the errors found while parsing the expressions
+type ParseErrorKind uint8
+
+const (
+	// ErrKindInvalidExpr is the malformed expressions, e.g. the missing expressions and the trailing tokens
+	ErrKindInvalidExpr ParseErrorKind = iota
+	// ErrKindUnknownToken is the unknown operators, observers and placeholders
+	ErrKindUnknownToken
+	// ErrKindUnmatchedParens is the unmatched parentheses
+	ErrKindUnmatchedParens
+	// ErrKindUnexpectedToken is the tokens of unexpected types, e.g. a number instead of a name
+	ErrKindUnexpectedToken
+	// ErrKindInvalidLiteral is the tokens can not be lexed, e.g. the invalid escapes in strings
+	ErrKindInvalidLiteral
+	// ErrKindParamsCount is the wrong counts of the params of the operators and the keywords
+	ErrKindParamsCount
+	// ErrKindTypeMismatch is the params of unexpected types found when TypeCheck is enabled
+	ErrKindTypeMismatch
+	// ErrKindInvalidParam is the constant params rejected by the operators at compile time
+	ErrKindInvalidParam
+	// ErrKindInvalidConfig is the invalid compile configs in the comments
+	ErrKindInvalidConfig
+)
+
+var parseErrorKindNames = [...]string{
+	ErrKindInvalidExpr:     "invalid expression",
+	ErrKindUnknownToken:    "unknown token",
+	ErrKindUnmatchedParens: "unmatched parentheses",
+	ErrKindUnexpectedToken: "unexpected token",
+	ErrKindInvalidLiteral:  "invalid literal",
+	ErrKindParamsCount:     "parameters count",
+	ErrKindTypeMismatch:    "type mismatch",
+	ErrKindInvalidParam:    "invalid parameter",
+	ErrKindInvalidConfig:   "invalid config",
+}
+
+func (k ParseErrorKind) String() string {
+	if int(k) < len(parseErrorKindNames) {
+		return parseErrorKindNames[k]
+	}
+	return fmt.Sprintf("ParseErrorKind(%d)", k)
+}
+
+// ParseError is the error found while parsing the expressions, with the position of the
+// token causing it, use errors.As to extract it from the errors returned by Compile
+type ParseError struct {
+	Kind ParseErrorKind
+	// Pos is the 0-based offset of the token in runes
+	Pos int
+	// Line and Col are the 1-based line and column numbers of the token, the columns are counted in runes
+	Line, Col int
+	// Snippet is the source around the token, the token is bracketed, e.g. "(> ([a]gee 18)"
+	Snippet string
+	// Err is the cause of the error
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s occurs at line %d, col %d: %s", e.Err, e.Line, e.Col, e.Snippet)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
 func (p *parser) invalidExprErr(pos int) error {
-	return p.errWithPos(errors.New("invalid expression error"), pos)
+	return p.errWithPos(ErrKindInvalidExpr, errors.New("invalid expression error"), pos)
 }
 
 func (p *parser) unknownTokenError(t token) error {
-	return p.errWithToken(errors.New("unknown token error"), t)
+	return p.errWithToken(ErrKindUnknownToken, errors.New("unknown token error"), t)
 }
 
 func (p *parser) tokenTypeError(want tokenType, t token) error {
 	err := fmt.Errorf("token type unexpected error (want: %s, got: %s)", want, t.typ)
-	return p.errWithToken(err, t)
+	return p.errWithToken(ErrKindUnexpectedToken, err, t)
 }
 
 func (p *parser) parenUnmatchedErr(pos int) error {
-	return p.errWithPos(errors.New("parentheses unmatched error"), pos)
+	return p.errWithPos(ErrKindUnmatchedParens, errors.New("parentheses unmatched error"), pos)
 }
 
 func (p *parser) paramsCountErr(want, got int, t token) error {
 	err := fmt.Errorf("%s parameters count error (want: %d, got: %d)", t.val, want, got)
-	return p.errWithToken(err, t)
+	return p.errWithToken(ErrKindParamsCount, err, t)
 }
 
-func (p *parser) errWithToken(err error, t token) error {
-	return p.errWithPos(err, t.pos)
+func (p *parser) errWithToken(kind ParseErrorKind, err error, t token) error {
+	return p.errWithPos(kind, err, t.pos)
 }
 
 func (p *parser) errNoNextToken() error {
-	return p.errWithPos(errors.New("does not have next token error"), len(p.source)-1)
+	return p.errWithPos(ErrKindInvalidExpr, errors.New("does not have next token error"), len(p.source)-1)
 }
 
-func (p *parser) errWithPos(err error, idx int) error {
-	return fmt.Errorf("%w occurs at %s", err, p.pos(idx))
+func (p *parser) errWithPos(kind ParseErrorKind, err error, idx int) error {
+	if A := p.sourceRunes(); idx < 0 || idx >= len(A) {
+		idx = 0
+	}
+	line, col := p.lineCol(idx)
+	return &ParseError{Kind: kind, Pos: idx, Line: line, Col: col, Snippet: p.snippet(idx), Err: err}
 }
 
+// pos returns the line and column numbers of the i-th rune with the snippet around it,
+// e.g. "line 1, col 4: (> ([a]gee 18)"
 func (p *parser) pos(i int) string {
-	A := []rune(p.source)
-
-	if i < 0 || i >= len(A) {
+	if A := p.sourceRunes(); i < 0 || i >= len(A) {
 		i = 0
 	}
+	line, col := p.lineCol(i)
+	return fmt.Sprintf("line %d, col %d: %s", line, col, p.snippet(i))
+}
+
+// snippet returns the source around the i-th rune, the rune is bracketed
+func (p *parser) snippet(i int) string {
+	A := p.sourceRunes()
+	if len(A) == 0 {
+		return "[]"
+	}
 
 	length := 30
 	var left, right string
@@ -455,7 +903,18 @@ func (p *parser) pos(i int) string {
 	} else {
 		right = string(A[i+1:r]) + "..."
 	}
-	return fmt.Sprintf(" %s[%c]%s", left, A[i], right)
+	return fmt.Sprintf("%s[%c]%s", left, A[i], right)
+}
+
+// lineCol returns the 1-based line and column numbers of the i-th rune, the columns are counted in runes
+func (p *parser) lineCol(i int) (line, col int) {
+	// the index of the last line starting at or before i
+	l := sort.Search(len(p.lineStarts), func(j int) bool { return p.lineStarts[j] > i }) - 1
+	if l < 0 {
+		// the source is not lexed
+		return 1, i + 1
+	}
+	return l + 1, i - p.lineStarts[l] + 1
 }
 
 func (p *parser) valNode(v Value) *astNode {
@@ -469,48 +928,103 @@ func (p *parser) valNode(v Value) *astNode {
 
 func (p *parser) parseList(leftType, rightType tokenType) func() (*astNode, error) {
 	return func() (*astNode, error) {
-		i := p.idx
-		T := p.tokens
-		if T[i].typ != leftType {
-			return nil, nil
+		val, next, err := p.listValue(p.idx, leftType, rightType)
+		if val == nil || err != nil {
+			return nil, err
 		}
-		typ := T[i+1].typ
-		if typ != rightType && typ != integer && typ != str {
-			return nil, nil
+		p.idx = next
+		return &astNode{
+			node: &node{flag: constant, value: val},
+		}, nil
+	}
+}
+
+// listValue parses the list starting from the i-th token, and returns the index of the
+// token after the list. The lists of integers or strings are []int64 or []string, and the
+// other ones, such as the lists of mixed types and the nested lists, are []interface{}.
+// It returns nil if the tokens are not a list, e.g. the parenthesized expressions.
+func (p *parser) listValue(i int, leftType, rightType tokenType) (Value, int, error) {
+	T := p.tokens
+	if T[i].typ != leftType {
+		return nil, 0, nil
+	}
+	typ := T[i+1].typ
+	switch typ {
+	case rightType:
+		if !p.conf.CompileOptions[AllowEmptyList] {
+			return nil, 0, p.errWithToken(ErrKindInvalidLiteral, errors.New(
+				"empty list error, the type of the elements can not be inferred"), T[i])
 		}
-		strs := make([]string, 0)
-		for j := i + 1; j < len(T); j++ {
-			if T[j].typ == rightType {
-				i = j
-				break
+		return []string{}, i + 2, nil
+	case integer, str, float, boolean, leftType:
+	default:
+		return nil, 0, nil
+	}
+
+	// the homogeneous lists of integers or strings are built without boxing the elements
+	j := i + 1
+	for T[j].typ == typ {
+		j++
+	}
+	if T[j].typ == rightType && (typ == integer || typ == str) {
+		if typ == str {
+			strs := make([]string, 0, j-i-1)
+			for _, t := range T[i+1 : j] {
+				strs = append(strs, t.val)
 			}
-			if T[j].typ != typ {
-				return nil, p.tokenTypeError(typ, T[j])
+			return strs, j + 1, nil
+		}
+		ints := make([]int64, 0, j-i-1)
+		for _, t := range T[i+1 : j] {
+			v, err := strconv.ParseInt(t.val, 10, 64)
+			if err != nil {
+				return nil, 0, err
 			}
-			strs = append(strs, T[j].val)
+			ints = append(ints, v)
 		}
+		return ints, j + 1, nil
+	}
 
-		// todo: return error when list is empty?
-
-		n := &node{flag: constant}
-		if typ == integer {
-			ints := make([]int64, 0, len(strs))
-			for _, s := range strs {
-				v, err := strconv.ParseInt(s, 10, 64)
-				if err != nil {
-					return nil, err
-				}
-				ints = append(ints, v)
+	elems := make([]interface{}, 0)
+	for j = i + 1; T[j].typ != rightType; {
+		var (
+			elem Value
+			err  error
+		)
+		switch t := T[j]; t.typ {
+		case integer:
+			elem, err = strconv.ParseInt(t.val, 10, 64)
+		case float:
+			elem, err = strconv.ParseFloat(t.val, 64)
+		case str:
+			elem = t.val
+		case boolean:
+			elem = boolLiterals[t.val]
+		case leftType:
+			var next int
+			elem, next, err = p.listValue(j, leftType, rightType)
+			if elem != nil {
+				j = next - 1
 			}
-			n.value = ints
-		} else {
-			n.value = strs
 		}
-		p.idx = i + 1
-		return &astNode{
-			node: n,
-		}, nil
+		if err != nil {
+			return nil, 0, err
+		}
+		if elem == nil {
+			if j == i+1 {
+				// the first element is a parenthesized expression
+				return nil, 0, nil
+			}
+			if T[j].typ == leftType {
+				// the nested one is not a list, point to its first element
+				j++
+			}
+			return nil, 0, p.tokenTypeError(typ, T[j])
+		}
+		elems = append(elems, elem)
+		j++
 	}
+	return elems, j + 1, nil
 }
 
 func (p *parser) parseInt() (*astNode, error) {
@@ -528,6 +1042,35 @@ func (p *parser) parseInt() (*astNode, error) {
 	p.walk()
 	return p.valNode(v), nil
 }
+
+func (p *parser) parseFloat() (*astNode, error) {
+	t, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	if t.typ != float {
+		return nil, nil
+	}
+	v, err := strconv.ParseFloat(t.val, 64)
+	if err != nil {
+		return nil, err
+	}
+	p.walk()
+	return p.valNode(v), nil
+}
+
+func (p *parser) parseBool() (*astNode, error) {
+	t, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	if t.typ != boolean {
+		return nil, nil
+	}
+	p.walk()
+	return p.valNode(boolLiterals[t.val]), nil
+}
+
 func (p *parser) parseStr() (*astNode, error) {
 	t, err := p.peek()
 	if err != nil {
@@ -548,14 +1091,38 @@ func (p *parser) parseConst() (*astNode, error) {
 		return nil, nil
 	}
 
-	if val, ok := builtinConstants[t.val]; ok {
+	if val, ok := p.conf.ConstantMap[t.val]; ok {
 		p.walk()
 		return p.valNode(val), nil
 	}
+	return nil, nil
+}
 
-	if val, ok := p.conf.ConstantMap[t.val]; ok {
-		p.walk()
-		return p.valNode(val), nil
+// parseLocal parses the local variables, they shadow the constants and variables with the same name
+func (p *parser) parseLocal() (*astNode, error) {
+	t, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	if t.typ != ident {
+		return nil, nil
+	}
+
+	// the dotted locals walk the nested maps, e.g. `x.name` of the elements
+	root, isPath := pathRoot(t.val)
+	for i := len(p.locals) - 1; i >= 0; i-- {
+		if p.locals[i] == root {
+			p.walk()
+			n := &node{
+				flag:   variable,
+				value:  t.val,
+				varKey: localVarKey,
+			}
+			if isPath {
+				n.flag |= pathVar
+			}
+			return &astNode{node: n}, nil
+		}
 	}
 	return nil, nil
 }
@@ -568,19 +1135,24 @@ func (p *parser) parseVariable() (*astNode, error) {
 	if t.typ != ident {
 		return nil, nil
 	}
-	key, ok := p.conf.VariableKeyMap[t.val]
+	n := &node{flag: variable, value: t.val}
+	name := t.val
+	key, ok := p.conf.VariableKeyMap[name]
 	if !ok {
-		return nil, nil
+		// the dotted selectors of the registered roots walk the nested maps, e.g. `user.address.city`.
+		// The undefined ones are resolved by the fetchers, see MapVarFetcher and StructVarFetcher.
+		root, isPath := pathRoot(t.val)
+		if key, ok = p.conf.VariableKeyMap[root]; !ok || !isPath || p.allowUndefinedVariable() {
+			return nil, nil
+		}
+		n.flag |= pathVar
+		name = root
 	}
+	n.varKey = key
+	p.useSelector(name)
 
 	p.walk()
-	return &astNode{
-		node: &node{
-			flag:   variable,
-			value:  t.val,
-			varKey: key,
-		},
-	}, nil
+	return &astNode{node: n}, nil
 }
 
 func (p *parser) parseUnknownVariable() (*astNode, error) {
@@ -626,7 +1198,14 @@ func (p *parser) buildLeafNode() (ast *astNode, err error) {
 }
 
 func (p *parser) parseExpression() (ast *astNode, err error) {
+	start := p.idx
 	ast, err = p.buildLeafNode()
+	if err != nil && p.isParseRecovery() && start < len(p.tokens) {
+		// skip the leaf node, e.g. an invalid list
+		p.idx = start
+		p.skipExpr()
+		return p.recover(err, nil)
+	}
 	if ast != nil || err != nil {
 		return ast, err
 	}
@@ -636,7 +1215,8 @@ func (p *parser) parseExpression() (ast *astNode, err error) {
 		return nil, err
 	}
 	if t.typ == ident {
-		return nil, p.unknownTokenError(t)
+		p.walk()
+		return p.recover(p.unknownTokenError(t), nil)
 	}
 
 	err = p.eat(lParen)
@@ -649,7 +1229,30 @@ func (p *parser) parseExpression() (ast *astNode, err error) {
 		return nil, err
 	}
 	if car.typ != ident {
-		return nil, p.tokenTypeError(ident, car)
+		err = p.tokenTypeError(ident, car)
+		if p.isParseRecovery() {
+			// skip the rest of the expression
+			p.idx -= 2
+			p.skipExpr()
+		}
+		return p.recover(err, nil)
+	}
+
+	if kw, _ := keywordOf(p.conf, car.val); kw == keywordLet || kw == keywordCond {
+		if kw == keywordLet {
+			ast, err = p.parseLet(car)
+		} else {
+			ast, err = p.parseCond(car)
+		}
+		if err != nil {
+			if p.isParseRecovery() {
+				p.idx = start
+				p.skipExpr()
+			}
+			return p.recover(err, nil)
+		}
+		ast.span = Span{Start: p.tokens[start].pos, End: p.tokens[p.idx-1].pos + 1}
+		return ast, nil
 	}
 
 	var children []*astNode
@@ -663,7 +1266,11 @@ func (p *parser) parseExpression() (ast *astNode, err error) {
 			break
 		}
 
+		kw, _ := keywordOf(p.conf, car.val)
+		locals := keywordLocals(kw, len(children))
+		p.locals = append(p.locals, locals...)
 		child, err := p.parseExpression()
+		p.locals = p.locals[:len(p.locals)-len(locals)]
 		if err != nil {
 			return nil, err
 		}
@@ -675,7 +1282,122 @@ func (p *parser) parseExpression() (ast *astNode, err error) {
 		return nil, err
 	}
 
-	return p.buildParentNode(car, children)
+	ast, err = p.buildParentNode(car, children)
+	if err != nil {
+		return p.recover(err, children)
+	}
+	ast.span = Span{Start: p.tokens[start].pos, End: p.tokens[p.idx-1].pos + 1}
+	return ast, nil
+}
+
+// parseSequence parses the expressions one by one until the end of the tokens,
+// they're wrapped into a sequence node which returns the result of the last one
+func (p *parser) parseSequence() (*astNode, error) {
+	var exprs []*astNode
+	for p.hasNext() {
+		ast, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, ast)
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+
+	return &astNode{
+		node: &node{
+			flag:     operator,
+			value:    sequenceOp,
+			operator: lastParam,
+		},
+		children: exprs,
+	}, nil
+}
+
+// lastParam is the operator of the sequence nodes, it returns the result of the last expression
+func lastParam(_ *Ctx, params []Value) (Value, error) {
+	return params[len(params)-1], nil
+}
+
+// recover returns a placeholder node in place of the expression that fails to parse
+// if the parse recovery mode is enabled, otherwise it returns the error directly.
+// The placeholder node keeps the parsed children, and returns the error when it's evaluated.
+func (p *parser) recover(err error, children []*astNode) (*astNode, error) {
+	if !p.isParseRecovery() {
+		return nil, err
+	}
+	p.errs = append(p.errs, err)
+	return &astNode{
+		node: &node{
+			flag:  operator,
+			value: placeholderOp,
+			operator: func(_ *Ctx, _ []Value) (Value, error) {
+				return nil, err
+			},
+		},
+		children: children,
+	}, nil
+}
+
+func (p *parser) parsePlaceholder() (*astNode, error) {
+	t, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	if t.typ != placeholder {
+		return nil, nil
+	}
+	p.walk()
+	return p.recover(p.errWithPos(ErrKindInvalidExpr, errors.New("missing expression error"), t.pos), nil)
+}
+
+// skipExpr skips the tokens of the current expression, it's used to recover from parse errors
+func (p *parser) skipExpr() {
+	depth := 0
+	for p.hasNext() {
+		switch p.tokens[p.idx].typ {
+		case lParen:
+			depth++
+		case rParen:
+			depth--
+		}
+		p.walk()
+		if depth <= 0 {
+			return
+		}
+	}
+}
+
+// balanceParens fixes the unmatched parentheses in the parse recovery mode,
+// the redundant right parentheses are dropped, and the missing ones are
+// appended after a placeholder token which marks the truncated expression.
+func (p *parser) balanceParens() {
+	var parenCnt, n int
+	for _, t := range p.tokens {
+		switch t.typ {
+		case lParen:
+			parenCnt++
+		case rParen:
+			if parenCnt == 0 {
+				p.errs = append(p.errs, p.parenUnmatchedErr(t.pos))
+				continue
+			}
+			parenCnt--
+		}
+		p.tokens[n] = t
+		n++
+	}
+	p.tokens = p.tokens[:n]
+
+	if parenCnt == 0 {
+		return
+	}
+	pos := len(p.sourceRunes()) - 1
+	p.tokens = append(p.tokens, token{typ: placeholder, pos: pos})
+	for ; parenCnt > 0; parenCnt-- {
+		p.tokens = append(p.tokens, token{typ: rParen, val: ")", pos: pos})
+	}
 }
 
 func (p *parser) parseInfixExpression() (*astNode, error) {
@@ -829,64 +1551,181 @@ func (p *parser) isInfixOp(op string) bool {
 }
 
 func (p *parser) isKeyword(car token) bool {
-	for _, kw := range keywords {
-		if car.val == string(kw) {
-			return true
-		}
-	}
-	return false
+	_, exist := keywordOf(p.conf, car.val)
+	return exist
 }
 
 func (p *parser) buildParentNode(car token, children []*astNode) (*astNode, error) {
+	var (
+		ast *astNode
+		err error
+	)
 	if p.isKeyword(car) {
-		return p.buildKeywordNode(car, children)
+		ast, err = p.buildKeywordNode(car, children)
 	} else {
-		return p.buildOperatorNode(car, children)
+		ast, err = p.buildOperatorNode(car, children)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if p.conf.CompileOptions[TypeCheck] {
+		if ast.typ, err = p.typeCheck(car, children); err != nil {
+			return nil, err
+		}
+	}
+
+	if ast.wrap = p.operatorWrapper(ast.node, car); ast.wrap != nil {
+		ast.node.operator = ast.wrap(ast.node.operator)
+	}
+	return ast, nil
+}
+
+// wrapOperator wraps the operator of the node with the limits of the config,
+// e.g. MaxResultLen and the timeouts of the operators
+func (p *parser) wrapOperator(n *node, car token) {
+	if wrap := p.operatorWrapper(n, car); wrap != nil {
+		n.operator = wrap(n.operator)
+	}
+}
+
+// operatorWrapper returns the func wrapping the operators of the node with the limits of the config,
+// it's kept by the ast to wrap the operators replacing the built one, e.g. the precomputed operators.
+// It returns nil if there is no limit.
+func (p *parser) operatorWrapper(n *node, car token) func(Operator) Operator {
+	var (
+		maxLen  = p.conf.MaxResultLen
+		timeout = p.conf.OperatorInfos[car.val].Timeout
+		returns = AnyType
+	)
+	if n.getNodeType() != operator {
+		maxLen = 0
+	}
+	if p.conf.CompileOptions[StrictReturns] {
+		returns = p.conf.OperatorInfos[car.val].Returns
+	}
+	if maxLen <= 0 && timeout <= 0 && returns == AnyType {
+		return nil
+	}
+
+	pos := p.pos(car.pos)
+	return func(op Operator) Operator {
+		if maxLen > 0 {
+			op = limitResultLen(op, car.val, maxLen, pos)
+		}
+		if timeout > 0 {
+			op = limitDuration(op, car.val, timeout)
+		}
+		if returns != AnyType {
+			op = checkReturns(op, car.val, returns, pos)
+		}
+		return op
 	}
 }
 
 func (p *parser) buildKeywordNode(car token, children []*astNode) (*astNode, error) {
-	if car.val != string(keywordIf) {
-		return nil, p.errWithToken(fmt.Errorf("[%s] is not currently supported", car.val), car)
+	// the errors report the names in the expression, even if the keywords are renamed
+	kw, _ := keywordOf(p.conf, car.val)
+	ast, err := p.buildKeyword(kw, car, children)
+	if err != nil {
+		return nil, err
+	}
+	if ast.node.getNodeType() != cond {
+		// the keyword nodes are named by the builtin names, e.g. for the streamers and the dumps
+		ast.node.value = string(kw)
+		ast.node.flag |= keywordOp
+	}
+	return ast, nil
+}
+
+func (p *parser) buildKeyword(kw keyword, car token, children []*astNode) (*astNode, error) {
+	switch kw {
+	case keywordIf:
+		return p.buildIfNode(car, children)
+	case keywordFindAll:
+		return p.buildFindAllNode(car, children)
+	case keywordAny, keywordAll:
+		return p.buildQuantifierNode(car, children)
+	case keywordTap:
+		return p.buildTapNode(car, children)
+	case keywordInterp:
+		return p.buildInterpNode(car, children)
+	case keywordIterate:
+		return p.buildIterateNode(car, children)
+	case keywordMap:
+		return p.buildMapNode(car, children)
+	case keywordFilter:
+		return p.buildFilterNode(car, children)
+	case keywordReduce:
+		return p.buildReduceNode(car, children)
+	case keywordMapIf:
+		return p.buildMapIfNode(car, children)
+	case keywordSortBy, keywordSortByDesc:
+		return p.buildSortByNode(car, children)
+	default:
+		return nil, p.errWithToken(ErrKindInvalidExpr, fmt.Errorf("[%s] is not currently supported", car.val), car)
 	}
+}
 
-	if len(children) != 3 {
-		return nil, p.paramsCountErr(3, len(children), car)
+func (p *parser) buildIfNode(car token, children []*astNode) (*astNode, error) {
+	if a := (Arity{Min: 2, Max: 3}); !a.accepts(len(children)) {
+		return nil, p.arityErr(a, len(children), car)
+	}
+	if len(children) == 2 {
+		// the missing false branch returns nil, so the false condition
+		// still jumps over the end if node to the false branch
+		children = append(children, &astNode{node: &node{flag: constant}})
 	}
 
 	return &astNode{
 		node: &node{
-			flag:  cond,
-			value: keywordIf,
-			// trigger short circuit when cond node returns false
-			operator: func(_ *Ctx, params []Value) (Value, error) {
-				if b, ok := params[0].(bool); ok {
-					return !b, nil
-				}
-
-				return nil, fmt.Errorf("condition node returns a non bool result: [%v]", params[0])
-			},
+			flag:     cond,
+			value:    keywordIf,
+			operator: ifCond,
 		},
 
 		// append an end if node
 		children: append(children, &astNode{
 			node: &node{
-				flag:  cond,
-				value: "fi",
-				operator: func(_ *Ctx, _ []Value) (Value, error) {
-					return true, nil
-				},
+				flag:     cond,
+				value:    endIf,
+				operator: endIfJump,
 			},
 		}),
 	}, nil
 }
 
+// endIf is the value of the end if nodes, which jump over the false branches
+const endIf = "fi"
+
+// ifCond triggers short circuit when the cond node returns false
+func ifCond(_ *Ctx, params []Value) (Value, error) {
+	if b, ok := params[0].(bool); ok {
+		return !b, nil
+	}
+
+	return nil, fmt.Errorf("condition node returns a non bool result: [%v]", params[0])
+}
+
+func endIfJump(_ *Ctx, _ []Value) (Value, error) {
+	return true, nil
+}
+
 func (p *parser) buildOperatorNode(car token, children []*astNode) (*astNode, error) {
 	// parse op node
 	op, exist := p.getOperator(car.val)
 	if !exist {
 		return nil, p.unknownTokenError(car)
 	}
+	if err := p.checkArity(car, children); err != nil {
+		return nil, err
+	}
+	if build, ok := builtinOperatorBuilders[car.val]; ok && isBuiltinOperator(p.conf, car.val) {
+		var err error
+		if op, err = build(p.conf, children); err != nil {
+			return nil, p.errWithToken(ErrKindInvalidParam, err, car)
+		}
+	}
 	return &astNode{
 		children: children,
 		node: &node{
@@ -897,6 +1736,13 @@ func (p *parser) buildOperatorNode(car token, children []*astNode) (*astNode, er
 	}, nil
 }
 
+// the declarations in the compile config comments,
+// e.g. `;;;; selector: age, constant: adult = 18`
+const (
+	configSelector CompileOption = "selector"
+	configConstant CompileOption = "constant"
+)
+
 func (p *parser) parseConfig() error {
 	const prefix = ";;;;" // prefix of compile config
 	const separator = "," // separator of compile config
@@ -910,12 +1756,15 @@ func (p *parser) parseConfig() error {
 		if !strings.HasPrefix(cmt, prefix) {
 			continue
 		}
+		if p.conf.CompileOptions[NoInlineConfig] {
+			return p.errWithToken(ErrKindInvalidConfig, errors.New("inline compile config is disabled"), t)
+		}
 		// trim compile config prefix and spaces
 		cmt = strings.TrimPrefix(cmt, prefix)
 		for _, s := range strings.Split(cmt, separator) {
 			pair := strings.Split(s, ":")
 			if len(pair) != 2 {
-				return p.errWithToken(fmt.Errorf("invalid compile format %s", s), t)
+				return p.errWithToken(ErrKindInvalidConfig, fmt.Errorf("invalid compile format %s", s), t)
 			}
 
 			for i := range pair {
@@ -923,22 +1772,106 @@ func (p *parser) parseConfig() error {
 			}
 
 			option := CompileOption(pair[0])
+			switch option {
+			case configSelector:
+				if !isConfigName(pair[1]) {
+					return p.errWithToken(ErrKindInvalidConfig, fmt.Errorf("invalid selector name %s", s), t)
+				}
+				if err := p.checkDeclaration(pair[1]); err != nil {
+					return p.errWithToken(ErrKindInvalidConfig, fmt.Errorf("invalid selector %s, err %w", pair[1], err), t)
+				}
+				GetOrRegisterKey(p.conf, pair[1])
+				continue
+			case configConstant:
+				name, val, err := parseConfigConstant(pair[1])
+				if err == nil {
+					err = p.checkDeclaration(name)
+				}
+				if err != nil {
+					return p.errWithToken(ErrKindInvalidConfig, fmt.Errorf("invalid constant %s, err %w", s, err), t)
+				}
+				p.conf.ConstantMap[name] = val
+				continue
+			}
+
+			if option != Optimize && optimizerMap[option] == nil {
+				return p.errWithToken(ErrKindInvalidConfig, fmt.Errorf("unsupported compile config %s", s), t)
+			}
 			enabled, err := strconv.ParseBool(pair[1])
 			if err != nil {
-				return p.errWithToken(fmt.Errorf("invalid config value %s, err %w", s, err), t)
+				return p.errWithToken(ErrKindInvalidConfig, fmt.Errorf("invalid config value %s, err %w", s, err), t)
 			}
-			switch {
-			case option == Optimize: // switch all optimizations
+			if option == Optimize { // switch all optimizations
 				for _, opt := range optimizations {
 					p.conf.CompileOptions[opt] = enabled
 				}
-			case optimizerMap[option] != nil:
+			} else {
 				p.conf.CompileOptions[option] = enabled
-			default:
-				return p.errWithToken(fmt.Errorf("unsupported compile config %s", s), t)
 			}
 		}
 	}
 
 	return nil
 }
+
+// checkDeclaration checks the name declared in the compile config comments, the declarations
+// can not override the selectors and the constants of the config, nor the earlier declarations
+func (p *parser) checkDeclaration(name string) error {
+	if _, exist := p.conf.VariableKeyMap[name]; exist {
+		return fmt.Errorf("variable already exist %s", name)
+	}
+	if _, exist := p.conf.ConstantMap[name]; exist {
+		return fmt.Errorf("constant already exist %s", name)
+	}
+	return nil
+}
+
+// isConfigName checks the names declared in the compile config comments,
+// they are letters, digits and underscores, optionally separated by dots, e.g. `user.age`
+func isConfigName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, seg := range strings.Split(s, ".") {
+		if seg == "" {
+			return false
+		}
+		for i, r := range seg {
+			if unicode.IsLetter(r) || r == '_' || (i != 0 && unicode.IsNumber(r)) {
+				continue
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// parseConfigConstant parses the constant declarations in the compile config comments,
+// e.g. `adult = 18`, the value is an int, a float, a bool or a double-quoted string,
+// the strings can not contain the separators of the config, which are `,` and `:`
+func parseConfigConstant(decl string) (string, Value, error) {
+	i := strings.IndexByte(decl, '=')
+	if i < 0 {
+		return "", nil, errors.New("missing value")
+	}
+	name, lit := strings.TrimSpace(decl[:i]), strings.TrimSpace(decl[i+1:])
+	if !isConfigName(name) {
+		return "", nil, fmt.Errorf("invalid name %s", name)
+	}
+
+	if v, err := strconv.ParseInt(lit, 10, 64); err == nil {
+		return name, v, nil
+	}
+	if v, err := strconv.ParseFloat(lit, 64); err == nil && strings.ContainsAny(lit, ".eE") {
+		return name, v, nil
+	}
+	if v, exist := boolLiterals[lit]; exist {
+		return name, v, nil
+	}
+	if len(lit) >= 2 && lit[0] == '"' {
+		if v, err := strconv.Unquote(lit); err == nil {
+			return name, v, nil
+		}
+	}
+	return "", nil, fmt.Errorf("invalid value %s", lit)
+}
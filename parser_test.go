@@ -1,8 +1,12 @@
 package eval
 
 import (
+	"errors"
+	"fmt"
 	"math"
 	"reflect"
+	"regexp/syntax"
+	"strings"
 	"testing"
 	"time"
 )
@@ -173,7 +177,7 @@ func TestLex(t *testing.T) {
 			expr: `!true`,
 			tokens: []token{
 				{typ: ident, val: "!"},
-				{typ: ident, val: "true"},
+				{typ: boolean, val: "true"},
 			},
 			cc: NewConfig(EnableInfixNotation),
 		},
@@ -182,7 +186,7 @@ func TestLex(t *testing.T) {
 			expr: `!false`,
 			tokens: []token{
 				{typ: ident, val: "!"},
-				{typ: ident, val: "false"},
+				{typ: boolean, val: "false"},
 			},
 			cc: NewConfig(EnableInfixNotation),
 		},
@@ -398,11 +402,94 @@ func TestLex(t *testing.T) {
 		},
 
 		{
-			expr:   `(< age 18.0)`, // can not parse float
+			expr: `(if true false truth)`,
+			tokens: []token{
+				{typ: lParen, val: "("},
+				{typ: ident, val: "if"},
+				{typ: boolean, val: "true"},
+				{typ: boolean, val: "false"},
+				{typ: ident, val: "truth"},
+				{typ: rParen, val: ")"},
+			},
+		},
+		{
+			expr: `(+ -1 -2)`,
+			tokens: []token{
+				{typ: lParen, val: "("},
+				{typ: ident, val: "+"},
+				{typ: integer, val: "-1"},
+				{typ: integer, val: "-2"},
+				{typ: rParen, val: ")"},
+			},
+		},
+		{
+			expr: `(- 0 5 -3.14)`,
+			tokens: []token{
+				{typ: lParen, val: "("},
+				{typ: ident, val: "-"},
+				{typ: integer, val: "0"},
+				{typ: integer, val: "5"},
+				{typ: float, val: "-3.14"},
+				{typ: rParen, val: ")"},
+			},
+		},
+		{
+			expr:   `(- 0 --5)`,
+			errMsg: "can not parse token",
+		},
+		{
+			expr: `(< age 18.0)`,
+			tokens: []token{
+				{typ: lParen, val: "("},
+				{typ: ident, val: "<"},
+				{typ: ident, val: "age"},
+				{typ: float, val: "18.0"},
+				{typ: rParen, val: ")"},
+			},
+		},
+		{
+			expr: `(+ -2.5 1.5e-3 1E3 .5 -3)`,
+			tokens: []token{
+				{typ: lParen, val: "("},
+				{typ: ident, val: "+"},
+				{typ: float, val: "-2.5"},
+				{typ: float, val: "1.5e-3"},
+				{typ: float, val: "1E3"},
+				{typ: float, val: ".5"},
+				{typ: integer, val: "-3"},
+				{typ: rParen, val: ")"},
+			},
+		},
+		{
+			expr: `1.5 - -2.5`,
+			tokens: []token{
+				{typ: float, val: "1.5"},
+				{typ: ident, val: "-"},
+				{typ: float, val: "-2.5"},
+			},
+			cc: NewConfig(EnableInfixNotation),
+		},
+		{
+			expr: `(< e E1 NaN)`, // not floats
+			tokens: []token{
+				{typ: lParen, val: "("},
+				{typ: ident, val: "<"},
+				{typ: ident, val: "e"},
+				{typ: ident, val: "E1"},
+				{typ: ident, val: "NaN"},
+				{typ: rParen, val: ")"},
+			},
+		},
+		{
+			expr:   `(+ 1 1.2.3)`,
+			errMsg: "can not parse token",
+		},
+		{
+			expr:   `(+ 1 1e)`,
 			errMsg: "can not parse token",
 		},
 		{
-			expr:   `(+ 1 1.0)`, // can not parse float
+			expr:   `(+ 1 1e400)`, // out of range
 			errMsg: "can not parse token",
 		},
 		{
@@ -444,6 +531,35 @@ func TestLex(t *testing.T) {
 			expr:   `"`,
 			errMsg: "unclosed quotes",
 		},
+		{
+			expr: `(= s "he said \"hi\"" "a\\b\n\tc" "\u00e9\u4e2d" "\\")`,
+			tokens: []token{
+				{typ: lParen, val: "("},
+				{typ: ident, val: "="},
+				{typ: ident, val: "s"},
+				{typ: str, val: `he said "hi"`},
+				{typ: str, val: "a\\b\n\tc"},
+				{typ: str, val: "é中"},
+				{typ: str, val: `\`},
+				{typ: rParen, val: ")"},
+			},
+		},
+		{
+			expr:   `(= s "abc\")`,
+			errMsg: "unclosed quotes occurs at line 1, col 6: (= s [\"]abc\\\")",
+		},
+		{
+			expr:   `(= s "ab\x")`,
+			errMsg: "invalid escape sequence \\x occurs at line 1, col 9: (= s \"ab[\\]x\")",
+		},
+		{
+			expr:   `(= s "\u12g4")`,
+			errMsg: "invalid escape sequence \\u12g4 occurs at line 1, col 7: (= s \"[\\]u12g4\")",
+		},
+		{
+			expr:   `(= s "\u12")`,
+			errMsg: "invalid escape sequence \\u12 occurs at",
+		},
 
 		{
 			expr:   `!3`,
@@ -781,6 +897,28 @@ func TestParseConfig(t *testing.T) {
 			},
 			errMsg: "invalid compile format",
 		},
+
+		{
+			expr: `;;;; optimize:false`,
+			origin: map[CompileOption]bool{
+				NoInlineConfig:  true,
+				ConstantFolding: true,
+			},
+			errMsg: "inline compile config is disabled",
+		},
+
+		{
+			expr: `
+;; comments are still allowed
+(+ 1 1)`,
+			origin: map[CompileOption]bool{
+				NoInlineConfig:  true,
+				ConstantFolding: true,
+			},
+			want: map[CompileOption]bool{
+				ConstantFolding: true,
+			},
+		},
 	}
 
 	for _, c := range testCases {
@@ -1025,11 +1163,20 @@ func TestParseAstTree(t *testing.T) {
 		},
 		{
 			expr: `()`,
+			cc:   NewConfig(EnableEmptyList),
 			ast: verifyNode{
 				tpy:  constant,
 				data: []string{},
 			},
 		},
+		{
+			expr:   `(overlap (1) ())`,
+			errMsg: "empty list error, the type of the elements can not be inferred occurs at line 1, col 14: (overlap (1) [(])",
+		},
+		{
+			expr:   `(in "" (   ))`,
+			errMsg: "empty list error",
+		},
 		{
 			expr: `(1)`,
 			ast: verifyNode{
@@ -1037,8 +1184,45 @@ func TestParseAstTree(t *testing.T) {
 				data: []int64{1},
 			},
 		},
+		{
+			expr: `(17 18 "19")`,
+			ast: verifyNode{
+				tpy:  constant,
+				data: []interface{}{int64(17), int64(18), "19"},
+			},
+		},
+		{
+			expr: `(1.5 true -2)`,
+			ast: verifyNode{
+				tpy:  constant,
+				data: []interface{}{1.5, true, int64(-2)},
+			},
+		},
+		{
+			expr: `((1 2) (3 4))`,
+			ast: verifyNode{
+				tpy:  constant,
+				data: []interface{}{[]int64{1, 2}, []int64{3, 4}},
+			},
+		},
+		{
+			expr: `(in ("a" "b") (("a" "b") (1 (2.5 (false "c" (()))))))`,
+			cc:   NewConfig(EnableEmptyList),
+			ast: verifyNode{
+				tpy:  operator,
+				data: "in",
+				children: []verifyNode{
+					{tpy: constant, data: []string{"a", "b"}},
+					{tpy: constant, data: []interface{}{
+						[]string{"a", "b"},
+						[]interface{}{int64(1), []interface{}{2.5, []interface{}{false, "c", []interface{}{[]string{}}}}},
+					}},
+				},
+			},
+		},
 		{
 			expr: `(overlap () (1 2 4))`,
+			cc:   NewConfig(EnableEmptyList),
 			ast: verifyNode{
 				tpy:  operator,
 				data: "overlap",
@@ -1050,6 +1234,7 @@ func TestParseAstTree(t *testing.T) {
 		},
 		{
 			expr: `(in "" ())`,
+			cc:   NewConfig(EnableEmptyList),
 			ast: verifyNode{
 				tpy:  operator,
 				data: "in",
@@ -1064,6 +1249,11 @@ func TestParseAstTree(t *testing.T) {
 			expr:   `(< age 18)`,
 			errMsg: "unknown token error",
 		},
+		{
+			cc:     NewConfig(),
+			expr:   `(< age 18)`,
+			errMsg: "(< [a]ge 18)",
+		},
 		// return an error when expr use unregister variable
 		{
 			cc:   NewConfig(EnableUndefinedVariable),
@@ -1098,6 +1288,58 @@ func TestParseAstTree(t *testing.T) {
 			errMsg: "unknown token error",
 		},
 
+		// builtin keywords, operators and constants are case-insensitive
+		{
+			cc:   NewConfig(EnableCaseInsensitiveKeywords),
+			expr: `(IF TRUE 1 2)`,
+			ast: verifyNode{
+				tpy:  cond,
+				data: keywordIf,
+				children: []verifyNode{
+					{tpy: constant, data: true},
+					{tpy: constant, data: int64(1)},
+					{tpy: constant, data: int64(2)},
+					{tpy: cond, data: "fi"},
+				},
+			},
+		},
+
+		{
+			cc: NewConfig(EnableCaseInsensitiveKeywords, RegVarAndOp(map[string]interface{}{
+				"Age": 18,
+			})),
+			expr: `(And (>= Age 18) False)`,
+			ast: verifyNode{
+				tpy:  operator,
+				data: "and",
+				children: []verifyNode{
+					{
+						tpy:  operator,
+						data: ">=",
+						children: []verifyNode{
+							{tpy: variable, data: "Age"},
+							{tpy: constant, data: int64(18)},
+						},
+					},
+					{tpy: constant, data: false},
+				},
+			},
+		},
+
+		{
+			expr:   `(IF TRUE 1 2)`,
+			errMsg: "unknown token error",
+		},
+
+		// user-defined names are still case-sensitive
+		{
+			cc: NewConfig(EnableCaseInsensitiveKeywords, RegVarAndOp(map[string]interface{}{
+				"age": 18,
+			})),
+			expr:   `(>= AGE 18)`,
+			errMsg: "unknown token error",
+		},
+
 		// return an error when expr use unregister operator
 		{
 			expr:   `(is_child 18)`,
@@ -1109,15 +1351,19 @@ func TestParseAstTree(t *testing.T) {
 			errMsg: "token type unexpected error",
 		},
 
-		// mismatched element types in the list
 		{
-			expr:   `(17 18 "19")`,
-			errMsg: "token type unexpected error",
+			expr:   `(())`,
+			errMsg: "empty list error",
 		},
 
+		// the list elements should be literals or lists
 		{
-			expr:   `(())`,
-			errMsg: "token type unexpected error",
+			expr:   `((1 2) (+ 1 2))`,
+			errMsg: "token type unexpected error (want: lParen, got: ident)",
+		},
+		{
+			expr:   `((+ 1 2))`,
+			errMsg: "token type unexpected error (want: ident, got: lParen)",
 		},
 
 		{
@@ -1976,3 +2222,474 @@ func TestParseInfixAstTree(t *testing.T) {
 		})
 	}
 }
+
+func TestParseRecovery(t *testing.T) {
+	testCases := []struct {
+		expr    string
+		dump    string
+		errs    []string
+		evalErr string
+	}{
+		{
+			expr: `(and (> age 18) (= gender "Male"))`,
+			dump: `(and
+  (> age 18)
+  (= gender "Male"))`,
+		},
+		{
+			// truncated expression
+			expr: `(and (> age 18) (= gender`,
+			dump: `(and
+  (> age 18)
+  (= gender
+    (error)))`,
+			errs:    []string{"missing expression error"},
+			evalErr: "missing expression error",
+		},
+		{
+			expr: `(and (> age 18) (`,
+			dump: `(and
+  (> age 18)
+  (error))`,
+			errs:    []string{"token type unexpected error (want: ident, got: placeholder)"},
+			evalErr: "token type unexpected error",
+		},
+		{
+			expr: `(and (> agee 18) (= gender "Male"))`,
+			dump: `(and
+  (>
+    (error) 18)
+  (= gender "Male"))`,
+			errs:    []string{"unknown token error occurs at line 1, col 9: (and (> [a]gee 18)"},
+			evalErr: "unknown token error",
+		},
+		{
+			expr: `(and (> age 18) (= gender "Male")))`,
+			dump: `(and
+  (> age 18)
+  (= gender "Male"))`,
+			errs: []string{"parentheses unmatched error"},
+		},
+		{
+			expr: `(and (if (> age 18)) (in age (1 age)))`,
+			dump: `(and
+  (error
+    (> age 18))
+  (in age
+    (error)))`,
+			errs: []string{
+				"if parameters count error",
+				"token type unexpected error (want: integer, got: ident)",
+			},
+			evalErr: "if parameters count error",
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			cc := NewConfig(EnableParseRecovery, Optimizations(false), RegVarAndOp(map[string]interface{}{
+				"age":    nil,
+				"gender": nil,
+			}))
+			e, err := Compile(cc, c.expr)
+			assertNil(t, err)
+			assertEquals(t, Dump(e), c.dump)
+
+			errs := e.ParseErrors()
+			assertEquals(t, len(errs), len(c.errs))
+			for i, msg := range c.errs {
+				assertErrStrContains(t, errs[i], msg)
+			}
+
+			// the placeholder nodes return the errors when evaluated
+			_, err = e.Eval(NewCtxFromVars(cc, map[string]interface{}{"age": 20, "gender": "Male"}))
+			if len(c.evalErr) != 0 {
+				assertErrStrContains(t, err, c.evalErr)
+			} else {
+				assertNil(t, err)
+			}
+		})
+	}
+
+	// the errors are returned directly without the parse recovery mode
+	_, err := Compile(NewConfig(), `(and (> age 18) (= gender`)
+	assertErrStrContains(t, err, "parentheses unmatched error")
+}
+
+func TestParser_FloatLiterals(t *testing.T) {
+	cc := NewConfig(Optimizations(false))
+	testCases := []struct {
+		expr string
+		dump string
+	}{
+		{expr: `(ratio 3.0 -2.5)`, dump: "(ratio 3.0 -2.5)"},
+		{expr: `(ratio .5 1.5e-3)`, dump: "(ratio 0.5 0.0015)"},
+		{expr: `(ratio 1e21 2E-7)`, dump: "(ratio 1e+21 2e-07)"},
+		{expr: `(ratio 1.0 -4e0)`, dump: "(ratio 1.0 -4.0)"},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			e, err := Compile(cc, c.expr)
+			assertNil(t, err)
+			assertEquals(t, Dump(e), c.dump)
+
+			// the dumped expression should be parsed to the same value
+			again, err := Compile(cc, Dump(e))
+			assertNil(t, err)
+			want, err := e.Eval(NewCtxFromVars(cc, nil))
+			assertNil(t, err)
+			got, err := again.Eval(NewCtxFromVars(cc, nil))
+			assertNil(t, err)
+			assertEquals(t, got, want)
+		})
+	}
+}
+
+func TestParser_BoolLiterals(t *testing.T) {
+	testCases := []struct {
+		expr   string
+		cc     *Config
+		vals   map[string]interface{}
+		want   Value
+		errMsg string
+	}{
+		{expr: `(if true 1 2)`, want: int64(1)},
+		{expr: `(if false 1 2)`, want: int64(2)},
+		{expr: `(= (not false) true)`, want: true},
+		{expr: `(eq flag false)`, vals: map[string]interface{}{"flag": false}, want: true},
+		{expr: `(= TRUE (not False))`, cc: NewConfig(EnableCaseInsensitiveKeywords), want: true},
+		{expr: `flag && true || false`, cc: NewConfig(EnableInfixNotation), vals: map[string]interface{}{"flag": true}, want: true},
+		{expr: `!true`, cc: NewConfig(EnableInfixNotation), want: false},
+		{expr: `!false && true`, cc: NewConfig(EnableInfixNotation), want: true},
+		{expr: `!TRUE || !flag`, cc: NewConfig(EnableInfixNotation, EnableCaseInsensitiveKeywords), vals: map[string]interface{}{"flag": true}, want: false},
+		{
+			// the same value as the literal
+			expr: `(if true 1 2)`,
+			cc:   &Config{ConstantMap: map[string]Value{"true": true}},
+			want: int64(1),
+		},
+		{
+			expr:   `(if true 1 2)`,
+			cc:     &Config{ConstantMap: map[string]Value{"true": int64(1)}},
+			errMsg: "constant [true] conflicts with the bool literal, registered value: 1 occurs at line 1, col 5",
+		},
+		{
+			expr:   `(if x 1 2)`,
+			cc:     &Config{ConstantMap: map[string]Value{"false": "no"}},
+			errMsg: "constant [false] conflicts with the bool literal",
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			cc := NewConfig(ExtendConf(c.cc), RegVarAndOp(c.vals))
+			if c.cc == nil {
+				cc = NewConfig(RegVarAndOp(c.vals))
+			}
+			e, err := Compile(cc, c.expr)
+			if c.errMsg != "" {
+				assertErrStrContains(t, err, c.errMsg)
+				return
+			}
+			assertNil(t, err)
+			res, err := e.Eval(NewCtxFromVars(cc, c.vals))
+			assertNil(t, err)
+			assertEquals(t, res, c.want)
+		})
+	}
+}
+
+func TestParser_ErrorLineCol(t *testing.T) {
+	testCases := []struct {
+		expr   string
+		errMsg string
+	}{
+		{
+			expr:   `(> agee 18)`,
+			errMsg: "unknown token error occurs at line 1, col 4: (> [a]gee 18)",
+		},
+		{
+			expr: `
+(and
+  (> age 18)
+  (= nmae "a"))`,
+			errMsg: "unknown token error occurs at line 4, col 6:",
+		},
+		{
+			// the columns are counted in runes
+			expr:   "(and (= name \"日本\")\r\n\t(= agee 1))",
+			errMsg: "unknown token error occurs at line 2, col 5:",
+		},
+		{
+			expr:   "(and\n\n  (= name \"a\"\n",
+			errMsg: "parentheses unmatched error occurs at line 1, col 1:",
+		},
+	}
+
+	for _, c := range testCases {
+		cc := NewConfig(RegVarAndOp(map[string]interface{}{"age": nil, "name": nil}))
+		_, err := Compile(cc, c.expr)
+		assertErrStrContains(t, err, c.errMsg, c.expr)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	testCases := []struct {
+		expr      string
+		kind      ParseErrorKind
+		line, col int
+		errMsg    string
+	}{
+		{expr: `(> agee 18)`, kind: ErrKindUnknownToken, line: 1, col: 4, errMsg: "unknown token error"},
+		{expr: "(and\n  (> age 18)\n  (= name \"a\")", kind: ErrKindUnmatchedParens, line: 1, col: 1},
+		{expr: `(> age 18))`, kind: ErrKindUnmatchedParens, line: 1, col: 10},
+		{expr: `(let (1 2) 1)`, kind: ErrKindUnexpectedToken, line: 1, col: 7},
+		{expr: `(= name "a\q")`, kind: ErrKindInvalidLiteral, line: 1, col: 11},
+		{expr: "(between age\n 1)", kind: ErrKindParamsCount, line: 1, col: 2},
+		{expr: `(repeat_str name -1)`, kind: ErrKindInvalidParam, line: 1, col: 2},
+		{expr: `;;;;unknown: true` + "\n" + `(> age 18)`, kind: ErrKindInvalidConfig, line: 1, col: 1},
+	}
+
+	for _, c := range testCases {
+		cc := NewConfig(EnableStrictArity, RegVarAndOp(map[string]interface{}{"age": nil, "name": nil}))
+		_, err := Compile(cc, c.expr)
+
+		var pe *ParseError
+		if !errors.As(err, &pe) {
+			t.Fatalf("expr: %s, want a ParseError, got: %v", c.expr, err)
+		}
+		assertEquals(t, pe.Kind, c.kind, c.expr)
+		assertEquals(t, pe.Line, c.line, c.expr)
+		assertEquals(t, pe.Col, c.col, c.expr)
+		assertEquals(t, pe.Error(), fmt.Sprintf("%s occurs at line %d, col %d: %s", pe.Err, pe.Line, pe.Col, pe.Snippet))
+		if len(c.errMsg) != 0 {
+			assertEquals(t, pe.Err.Error(), c.errMsg, c.expr)
+		}
+	}
+
+	// the constants conflicting with the bool literals
+	for _, c := range []struct {
+		expr      string
+		line, col int
+	}{
+		{expr: "(and\n  (= name \"a\") false)", line: 2, col: 16},
+		{expr: `(= name "a")`, line: 1, col: 1},
+	} {
+		cc := NewConfig(RegVarAndOp(map[string]interface{}{"name": nil}))
+		cc.ConstantMap["false"] = "no"
+		_, err := Compile(cc, c.expr)
+		var pe *ParseError
+		assertEquals(t, errors.As(err, &pe), true, c.expr)
+		assertEquals(t, pe.Kind, ErrKindInvalidConfig, c.expr)
+		assertEquals(t, pe.Line, c.line, c.expr)
+		assertEquals(t, pe.Col, c.col, c.expr)
+	}
+
+	// the causes are unwrapped
+	cc := NewConfig(RegVarAndOp(map[string]interface{}{"name": nil}))
+	_, err := Compile(cc, `(regex name "(")`)
+	var pe *ParseError
+	assertEquals(t, errors.As(err, &pe), true)
+	assertEquals(t, pe.Kind, ErrKindInvalidParam)
+	var se *syntax.Error
+	assertEquals(t, errors.As(err, &se), true)
+}
+
+func TestParser_StringEscapes(t *testing.T) {
+	cc := NewConfig(Optimizations(false))
+	testCases := []struct {
+		expr string
+		want Value
+		dump string
+	}{
+		{
+			expr: `(concat "say \"hi\"" "\\")`,
+			want: `say "hi"\`,
+			dump: `(concat "say \"hi\"" "\\")`,
+		},
+		{
+			expr: `(concat "a\tb" "\u000d\n")`,
+			want: "a\tb\r\n",
+			dump: `(concat "a\tb" "\u000d\n")`,
+		},
+		{
+			expr: `(concat "\u00e9" "中")`,
+			want: "é中",
+			dump: `(concat "é" "中")`,
+		},
+	}
+
+	cc.OperatorMap["concat"] = func(_ *Ctx, params []Value) (Value, error) {
+		var res string
+		for _, p := range params {
+			res += p.(string)
+		}
+		return res, nil
+	}
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			e, err := Compile(cc, c.expr)
+			assertNil(t, err)
+			res, err := e.Eval(NewCtxFromVars(cc, nil))
+			assertNil(t, err)
+			assertEquals(t, res, c.want)
+			assertEquals(t, Dump(e), c.dump)
+
+			// the dumped expression should be parsed to the same value
+			again, err := Compile(cc, Dump(e))
+			assertNil(t, err)
+			res, err = again.Eval(NewCtxFromVars(cc, nil))
+			assertNil(t, err)
+			assertEquals(t, res, c.want)
+		})
+	}
+}
+
+func TestParser_NestedLists(t *testing.T) {
+	cc := NewConfig(Optimizations(false))
+	e, err := Compile(cc, `(1 "a" (2.5 (true ("b" "c") (3 4))))`)
+	assertNil(t, err)
+	assertEquals(t, Dump(e), `(1 "a" (2.5 (true ("b" "c") (3 4))))`)
+	res, err := e.Eval(NewCtxFromVars(cc, nil))
+	assertNil(t, err)
+	assertEquals(t, res, []interface{}{int64(1), "a",
+		[]interface{}{2.5, []interface{}{true, []string{"b", "c"}, []int64{3, 4}}}})
+
+	// deeply nested lists
+	const depth = 100
+	expr := strings.Repeat("(1 ", depth) + strings.Repeat(")", depth)
+	e, err = Compile(cc, expr)
+	assertNil(t, err)
+	res, err = e.Eval(NewCtxFromVars(cc, nil))
+	assertNil(t, err)
+	for i := 0; i < depth-1; i++ {
+		l, ok := res.([]interface{})
+		assertEquals(t, ok, true)
+		assertEquals(t, len(l), 2)
+		assertEquals(t, l[0], int64(1))
+		res = l[1]
+	}
+	assertEquals(t, res, []int64{1})
+}
+
+func TestParser_IfWithoutElse(t *testing.T) {
+	testCases := []struct {
+		expr  string
+		infix bool
+		want  Value
+	}{
+		{expr: `(if (> age 18) "adult")`, want: "adult"},
+		{expr: `(if (< age 18) "minor")`, want: nil},
+		{expr: `(if (< age 18) (+ age 1))`, want: nil},
+		{expr: `(default (if (< age 18) "minor") "adult")`, want: "adult"},
+		{expr: `(+ (if (> age 18) age) 1)`, want: int64(21)},
+		{expr: `(if (> age 18) (if (< age 18) 1))`, want: nil},
+		{expr: `(if (< age 18) (if (> age 18) 1) 2)`, want: int64(2)},
+		{expr: `(if true 1)`, want: int64(1)},
+		{expr: `(if false 1)`, want: nil},
+		{expr: `if(age > 18, "adult")`, infix: true, want: "adult"},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			for _, optimize := range []bool{true, false} {
+				cc := NewConfig(Optimizations(optimize), EnableTypeCheck, RegVarAndOp(map[string]interface{}{"age": 20}))
+				if c.infix {
+					EnableInfixNotation(cc)
+				}
+				e, err := Compile(cc, c.expr)
+				assertNil(t, err)
+				res, err := e.Eval(NewCtxFromVars(cc, map[string]interface{}{"age": 20}))
+				assertNil(t, err)
+				assertEquals(t, res, c.want)
+			}
+		})
+	}
+
+	// the missing false branch is omitted in the dump
+	cc := NewConfig(Optimizations(false), RegVarAndOp(map[string]interface{}{"age": 20}))
+	e, err := Compile(cc, `(if (> age 18) "adult")`)
+	assertNil(t, err)
+	assertEquals(t, Dump(e), `(if
+  (> age 18) "adult")`)
+	again, err := Compile(cc, Dump(e))
+	assertNil(t, err)
+	assertEquals(t, Dump(again), Dump(e))
+
+	_, err = Compile(cc, `(if (> age 18) 1 2 3)`)
+	assertErrStrContains(t, err, "if parameters count error (want: 2 to 3, got: 4)")
+}
+
+func TestParseConfig_Declarations(t *testing.T) {
+	testCases := []struct {
+		expr   string
+		vals   map[string]interface{}
+		want   Value
+		errMsg string
+	}{
+		{
+			expr: `;;;; selector: age, constant: adult = 18
+(>= age adult)`,
+			vals: map[string]interface{}{"age": 20},
+			want: true,
+		},
+		{
+			expr: `;;;; selector: age, selector: name
+;;;; constant: ratio = 1.5, constant: prefix = "Dr. "
+(if (> (* age ratio) 29) (concat prefix name) "")`,
+			vals: map[string]interface{}{"age": 20, "name": "Tom"},
+			want: "Dr. Tom",
+		},
+		{
+			// the registered selectors are still available
+			expr: `;;;; selector: name, optimize: false
+(and (= gender "F") (= name "Ann"))`,
+			vals: map[string]interface{}{"gender": "F", "name": "Ann"},
+			want: true,
+		},
+		{
+			expr: `;;;; constant: ok = true
+(= ok true)`,
+			want: true,
+		},
+		{expr: `;;;; selector: 1st`, errMsg: "invalid selector name"},
+		{expr: `;;;; selector: user..age`, errMsg: "invalid selector name"},
+		{expr: `;;;; constant: adult`, errMsg: "invalid constant"},
+		{expr: `;;;; constant: adult = eighteen`, errMsg: "invalid constant"},
+		{expr: `;;;; constant: 1 = 18`, errMsg: "invalid constant"},
+		{expr: `;;;; variable: age`, errMsg: "unsupported compile config"},
+		{expr: `;;;; constant: LIMIT = 0`, errMsg: "err constant already exist LIMIT"},
+		{expr: `;;;; constant: gender = "F"`, errMsg: "variable already exist gender"},
+		{expr: `;;;; selector: gender`, errMsg: "invalid selector gender, err variable already exist gender"},
+		{expr: `;;;; selector: LIMIT`, errMsg: "constant already exist LIMIT"},
+		{expr: `;;;; selector: age, selector: age`, errMsg: "variable already exist age"},
+		{expr: `;;;; constant: adult = 18, constant: adult = 21`, errMsg: "constant already exist adult"},
+		{expr: `(>= age 18)`, errMsg: "unknown token"},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			cc := NewConfig(RegVarAndOp(map[string]interface{}{"gender": nil}))
+			cc.ConstantMap["LIMIT"] = int64(18)
+			e, err := Compile(cc, c.expr)
+			if len(c.errMsg) != 0 {
+				assertErrStrContains(t, err, c.errMsg)
+				return
+			}
+			assertNil(t, err)
+			res, err := e.Eval(NewCtxFromVars(e.Config(), c.vals))
+			assertNil(t, err)
+			assertEquals(t, res, c.want)
+
+			// the declarations are in the copy of the config only
+			_, exist := cc.VariableKeyMap["age"]
+			assertEquals(t, exist, false)
+			_, exist = cc.ConstantMap["adult"]
+			assertEquals(t, exist, false)
+		})
+	}
+
+	_, err := Compile(NewConfig(DisableInlineConfig), ";;;; selector: age\n(>= age 18)")
+	assertErrStrContains(t, err, "inline compile config is disabled")
+}
@@ -0,0 +1,93 @@
+package eval
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrStopStream can be returned by the callback of EvalStream to stop the streaming,
+// EvalStream returns nil in that case.
+var ErrStopStream = errors.New("stop stream")
+
+// streamer yields the elements of the result of an operator one by one,
+// instead of materializing them into a list
+type streamer func(ctx *Ctx, params []Value, lambdas []*lambda, yield func(Value) error) error
+
+// builtinStreamers are the collection producers which support streaming,
+// they're used only when they are the root of the expression
+var builtinStreamers = map[string]streamer{
+	"range":                listRange{}.stream,
+	string(keywordFindAll): streamFindAll,
+	string(keywordMap):     streamMap,
+	string(keywordFilter):  streamFilter,
+}
+
+// EvalStream evaluates the expression and calls fn with each element of the result list.
+// If the root of the expression is a collection producer, such as `range`, `find_all`, `map` and `filter`,
+// the elements are yielded while they're produced, without materializing the whole list.
+// Otherwise, the expression is evaluated by Eval, and the elements of the result are yielded.
+// The streaming stops at the first error returned by fn, which is returned by EvalStream,
+// except ErrStopStream.
+func (e *Expr) EvalStream(ctx *Ctx, fn func(Value) error) error {
+	var c Ctx
+	if ctx != nil {
+		c = *ctx
+	}
+	c.yield = fn
+
+	res, err := e.Eval(&c)
+	if errors.Is(err, ErrStopStream) {
+		return nil
+	}
+	if err != nil || e.streamRoot {
+		return err
+	}
+
+	elems, ok := listElems(res)
+	if !ok {
+		return fmt.Errorf("stream error: the result [%v] is not a list", res)
+	}
+	for _, elem := range elems {
+		if err = fn(elem); err != nil {
+			if errors.Is(err, ErrStopStream) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// setStreamRoot makes the root operator of the expression yield the elements of
+// its result in EvalStream, if it's a collection producer which supports streaming.
+func setStreamRoot(e *Expr) {
+	for i, n := range e.nodes {
+		if e.parentIdx[i] != -1 {
+			continue
+		}
+		if t := n.getNodeType(); t != operator && t != fastOperator {
+			continue
+		}
+		name, _ := n.value.(string)
+		stream, ok := builtinStreamers[name]
+		if !ok || (!isKeywordNode(n) && !isBuiltinOperator(e.conf, name)) {
+			// the builtin operators overridden by the registered ones are not streamed
+			return
+		}
+
+		var (
+			op      = n.operator
+			lambdas = e.lambdas[n]
+		)
+		n.operator = func(ctx *Ctx, params []Value) (Value, error) {
+			if ctx == nil || ctx.yield == nil {
+				return op(ctx, params)
+			}
+			c := *ctx
+			c.yield = nil
+			return nil, stream(&c, params, lambdas, ctx.yield)
+		}
+		e.streamRoot = true
+		return
+	}
+}
@@ -0,0 +1,176 @@
+package eval
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestExpr_EvalStream(t *testing.T) {
+	testCases := []struct {
+		expr   string
+		vals   map[string]interface{}
+		limit  int
+		want   []Value
+		errMsg string
+	}{
+		{
+			expr: `(range 0 n)`,
+			vals: map[string]interface{}{"n": 5},
+			want: []Value{int64(0), int64(1), int64(2), int64(3), int64(4)},
+		},
+		{
+			expr: `(range n 0 -2)`,
+			vals: map[string]interface{}{"n": 5},
+			want: []Value{int64(5), int64(3), int64(1)},
+		},
+		{
+			// the stream is stopped by the callback, the range is never materialized
+			expr:  `(range 0 n)`,
+			vals:  map[string]interface{}{"n": int64(1) << 62},
+			limit: 3,
+			want:  []Value{int64(0), int64(1), int64(2)},
+		},
+		{
+			expr: `(find_all scores (< x 60))`,
+			vals: map[string]interface{}{"scores": []int{70, 55, 90, 42}},
+			want: []Value{
+				[]interface{}{int64(1), int64(55)},
+				[]interface{}{int64(3), int64(42)},
+			},
+		},
+		{
+			expr: `(map scores (- 100 x))`,
+			vals: map[string]interface{}{"scores": []int{70, 55}},
+			want: []Value{int64(30), int64(45)},
+		},
+		{
+			expr: `(filter scores (< x 60))`,
+			vals: map[string]interface{}{"scores": []int{70, 55, 90, 42}},
+			want: []Value{int64(55), int64(42)},
+		},
+		{
+			// constant folded
+			expr: `(range 0 3)`,
+			want: []Value{int64(0), int64(1), int64(2)},
+		},
+		{
+			// not a collection producer, the result list is yielded
+			expr: `(coerce_list roles)`,
+			vals: map[string]interface{}{"roles": "admin"},
+			want: []Value{"admin"},
+		},
+		{
+			expr:   `(range 0 n 0)`,
+			vals:   map[string]interface{}{"n": 5},
+			errMsg: "step should not be 0",
+		},
+		{
+			expr:   `(+ 1 n)`,
+			vals:   map[string]interface{}{"n": 5},
+			errMsg: "stream error: the result [6] is not a list",
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			cc := NewConfig(RegVarAndOp(c.vals))
+			e, err := Compile(cc, c.expr)
+			assertNil(t, err)
+
+			var got []Value
+			err = e.EvalStream(NewCtxFromVars(cc, c.vals), func(v Value) error {
+				got = append(got, v)
+				if c.limit > 0 && len(got) == c.limit {
+					return ErrStopStream
+				}
+				return nil
+			})
+			if len(c.errMsg) != 0 {
+				assertErrStrContains(t, err, c.errMsg)
+				return
+			}
+			assertNil(t, err)
+			assertEquals(t, got, c.want)
+
+			// the result of Eval is not changed
+			if c.limit == 0 {
+				res, err := e.Eval(NewCtxFromVars(cc, c.vals))
+				assertNil(t, err)
+				elems, _ := listElems(res)
+				assertEquals(t, len(elems), len(c.want))
+			}
+		})
+	}
+}
+
+func TestExpr_EvalStream_Error(t *testing.T) {
+	vals := map[string]interface{}{"n": 10}
+	cc := NewConfig(RegVarAndOp(vals), LimitResultLen(5))
+	e, err := Compile(cc, `(range 0 n)`)
+	assertNil(t, err)
+
+	// the streamed elements are not limited by MaxResultLen, as they are not materialized
+	cnt := 0
+	err = e.EvalStream(NewCtxFromVars(cc, vals), func(v Value) error {
+		cnt++
+		return nil
+	})
+	assertNil(t, err)
+	assertEquals(t, cnt, 10)
+
+	_, err = e.Eval(NewCtxFromVars(cc, vals))
+	assertEquals(t, errors.Is(err, ErrResultLenExceeded), true)
+
+	stop := errors.New("stop")
+	err = e.EvalStream(NewCtxFromVars(cc, vals), func(v Value) error {
+		return stop
+	})
+	assertEquals(t, errors.Is(err, stop), true)
+}
+
+func TestExpr_EvalStream_Override(t *testing.T) {
+	vals := map[string]interface{}{"n": 3}
+	cc := NewConfig(RegVarAndOp(vals))
+	assertNil(t, RegisterOperator(cc, "range", func(_ *Ctx, _ []Value) (Value, error) {
+		return []int64{42, 43}, nil
+	}))
+	e, err := Compile(cc, `(range 0 n)`)
+	assertNil(t, err)
+
+	res, err := e.Eval(NewCtxFromVars(cc, vals))
+	assertNil(t, err)
+	assertEquals(t, res, []int64{42, 43})
+
+	// the registered operator is streamed by its result list, the same as Eval
+	var got []Value
+	err = e.EvalStream(NewCtxFromVars(cc, vals), func(v Value) error {
+		got = append(got, v)
+		return nil
+	})
+	assertNil(t, err)
+	assertEquals(t, got, []Value{int64(42), int64(43)})
+}
+
+func TestExpr_EvalStream_DisabledKeyword(t *testing.T) {
+	vals := map[string]interface{}{"v": []int64{1, 2}}
+	cc := NewConfig(RegVarAndOp(vals))
+	assertNil(t, DisableKeyword(cc, "map"))
+	assertNil(t, RegisterOperator(cc, "map", func(_ *Ctx, _ []Value) (Value, error) {
+		return []int64{7, 8}, nil
+	}))
+	e, err := Compile(cc, `(map v 1)`)
+	assertNil(t, err)
+
+	res, err := e.Eval(NewCtxFromVars(cc, vals))
+	assertNil(t, err)
+	assertEquals(t, res, []int64{7, 8})
+
+	// the registered operator is not streamed as the map keyword
+	var got []Value
+	err = e.EvalStream(NewCtxFromVars(cc, vals), func(v Value) error {
+		got = append(got, v)
+		return nil
+	})
+	assertNil(t, err)
+	assertEquals(t, got, []Value{int64(7), int64(8)})
+}
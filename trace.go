@@ -0,0 +1,166 @@
+package eval
+
+// DecisionTrace is a serializable record of how the result of an expression is reached,
+// it's produced by EvalWithTrace, e.g. for audit storage. The JSON schema is:
+//
+//	{
+//	  "expression": string, the source expression
+//	  "steps": [            the executed operators in the execution order
+//	    {
+//	      "seq":    int,    the sequence number of the step, starts from 0
+//	      "span":   {"start": int, "end": int}, the rune offsets [start, end) of the operator in the expression
+//	      "source": string, the source text of the span
+//	      "op":     string, the operator name
+//	      "inputs": array,  the params of the operator
+//	      "output": any,    the result of the operator, null if it fails
+//	      "error":  string, the error of the operator, omitted if it succeeds
+//	    }
+//	  ],
+//	  "result": any,        the result of the expression
+//	  "error":  string      the error of the evaluation, omitted if it succeeds
+//	}
+//
+// The values are encoded by encoding/json, so the numbers are decoded as float64.
+// The steps skipped by short circuits, the constant folded operators and the
+// sub-expressions of keywords, such as the predicate of find_all, are not recorded.
+type DecisionTrace struct {
+	Expression string      `json:"expression"`
+	Steps      []TraceStep `json:"steps"`
+	Result     Value       `json:"result"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// TraceStep is an executed operator in the DecisionTrace
+type TraceStep struct {
+	Seq    int     `json:"seq"`
+	Span   Span    `json:"span"`
+	Source string  `json:"source"`
+	Op     string  `json:"op"`
+	Inputs []Value `json:"inputs"`
+	Output Value   `json:"output"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// Span is the rune offsets [Start, End) of a sub-expression in the source expression,
+// the spans are only available in the prefix notation.
+type Span struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// EvalWithTrace is like Eval, and it also returns the DecisionTrace of the evaluation.
+// The trace is returned even if the evaluation fails, with the error recorded.
+// The nodes are copied to record the steps, so it's slower than Eval.
+func (e *Expr) EvalWithTrace(ctx *Ctx) (Value, *DecisionTrace, error) {
+	trace := &DecisionTrace{
+		Expression: e.source,
+		Steps:      []TraceStep{},
+	}
+
+	var (
+		src   = []rune(e.source)
+		nodes = make([]*node, len(e.nodes))
+	)
+	for i, n := range e.nodes {
+		if t := n.getNodeType(); t != operator && t != fastOperator {
+			nodes[i] = n
+			continue
+		}
+
+		var source string
+		span, ok := e.spans[n]
+		if ok && span.End <= len(src) {
+			source = string(src[span.Start:span.End])
+		}
+		traced := *n
+		traced.operator = trace.record(n, span, source)
+		nodes[i] = &traced
+	}
+
+	te := *e
+	te.nodes = nodes
+	// the int arithmetic fast path skips the operators, so the steps can't be recorded
+	te.intArith = nil
+	res, err := te.Eval(ctx)
+	trace.Result = res
+	if err != nil {
+		trace.Error = err.Error()
+	}
+	return res, trace, err
+}
+
+func (t *DecisionTrace) record(n *node, span Span, source string) Operator {
+	var (
+		op   = n.operator
+		name = n.value.(string)
+	)
+	return func(ctx *Ctx, params []Value) (Value, error) {
+		res, err := op(ctx, params)
+		step := TraceStep{
+			Seq:    len(t.Steps),
+			Span:   span,
+			Source: source,
+			Op:     name,
+			Inputs: append([]Value{}, params...),
+			Output: res,
+		}
+		if err != nil {
+			step.Error = err.Error()
+		}
+		t.Steps = append(t.Steps, step)
+		return res, err
+	}
+}
+
+// TraceFunc receives the steps of the evaluations, see Ctx.Trace
+type TraceFunc func(step EvalStep)
+
+// EvalStep is a step of the evaluation reported to Ctx.Trace, it's either an evaluated node,
+// or a jump of the short circuits and the if branches. The indexes of the nodes are the same
+// as the ones listed by Expr.Disassemble.
+type EvalStep struct {
+	// Idx is the index of the evaluated node, or the node the jump starts from
+	Idx int
+	// NodeType is the type of the node
+	NodeType NodeType
+	// NodeValue is the name of the variable or the operator, or the value of the constant
+	NodeValue Value
+	// Result is the result of the node, nil if it fails
+	Result Value
+	// Err is the error of the node, the evaluation returns it
+	Err error
+	// Stack is the copy of the operand stack when the node is evaluated,
+	// the params of the operator are popped already
+	Stack []Value
+
+	// Jump is true if the step is a jump
+	Jump bool
+	// JumpTo is the index of the last node skipped by the jump, the evaluation
+	// continues after it, -1 means the result is returned
+	JumpTo int
+}
+
+// traceNode reports the evaluated node at idx to the trace func
+func traceNode(trace TraceFunc, idx int16, n *node, res Value, err error, os []Value, osTop int16) {
+	stack := make([]Value, osTop+1)
+	copy(stack, os[:osTop+1])
+	trace(EvalStep{
+		Idx:       int(idx),
+		NodeType:  NodeType(n.getNodeType()),
+		NodeValue: n.value,
+		Result:    res,
+		Err:       err,
+		Stack:     stack,
+	})
+}
+
+// traceJump reports the jump from the node at idx to the trace func
+func traceJump(trace TraceFunc, idx int16, n *node) {
+	trace(EvalStep{
+		Idx:       int(idx),
+		NodeType:  NodeType(n.getNodeType()),
+		NodeValue: n.value,
+		Jump:      true,
+		JumpTo:    int(n.scIdx),
+	})
+}
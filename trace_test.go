@@ -0,0 +1,249 @@
+package eval
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestExpr_EvalWithTrace(t *testing.T) {
+	vals := map[string]interface{}{"age": 20, "country": "US"}
+	cc := NewConfig(RegVarAndOp(vals))
+	e, err := Compile(cc, `(and (>= age 18) (in country ("US" "CA")) (< (+ age 1) 30))`)
+	assertNil(t, err)
+
+	res, trace, err := e.EvalWithTrace(NewCtxFromVars(cc, vals))
+	assertNil(t, err)
+	assertEquals(t, res, true)
+	assertEquals(t, trace.Result, true)
+	assertEquals(t, trace.Steps, []TraceStep{
+		{
+			Seq:    0,
+			Span:   Span{Start: 5, End: 16},
+			Source: `(>= age 18)`,
+			Op:     ">=",
+			Inputs: []Value{int64(20), int64(18)},
+			Output: true,
+		},
+		{
+			Seq:    1,
+			Span:   Span{Start: 17, End: 41},
+			Source: `(in country ("US" "CA"))`,
+			Op:     "in",
+			Inputs: []Value{"US", []string{"US", "CA"}},
+			Output: true,
+		},
+		{
+			Seq:    2,
+			Span:   Span{Start: 45, End: 54},
+			Source: `(+ age 1)`,
+			Op:     "+",
+			Inputs: []Value{int64(20), int64(1)},
+			Output: int64(21),
+		},
+		{
+			Seq:    3,
+			Span:   Span{Start: 42, End: 58},
+			Source: `(< (+ age 1) 30)`,
+			Op:     "<",
+			Inputs: []Value{int64(21), int64(30)},
+			Output: true,
+		},
+	})
+
+	// the trace is deterministic
+	_, again, err := e.EvalWithTrace(NewCtxFromVars(cc, vals))
+	assertNil(t, err)
+	assertEquals(t, again, trace)
+
+	// the result of Eval is not changed
+	res, err = e.Eval(NewCtxFromVars(cc, vals))
+	assertNil(t, err)
+	assertEquals(t, res, true)
+}
+
+func TestExpr_EvalWithTrace_IntArithmetic(t *testing.T) {
+	vals := map[string]interface{}{"a": 7, "b": 3}
+	cc := NewConfig()
+	assertNil(t, RegisterVariable(cc, "a", IntType))
+	assertNil(t, RegisterVariable(cc, "b", IntType))
+	e, err := Compile(cc, `(+ a (* b 2))`)
+	assertNil(t, err)
+	assertEquals(t, e.intArith != nil, true)
+
+	res, trace, err := e.EvalWithTrace(NewCtxFromVars(cc, vals))
+	assertNil(t, err)
+	assertEquals(t, res, int64(13))
+	assertEquals(t, trace.Result, int64(13))
+	assertEquals(t, len(trace.Steps), 2)
+	assertEquals(t, trace.Steps[0].Op, "*")
+	assertEquals(t, trace.Steps[0].Output, int64(6))
+	assertEquals(t, trace.Steps[1].Op, "+")
+	assertEquals(t, trace.Steps[1].Output, int64(13))
+}
+
+func TestDecisionTrace_JSON(t *testing.T) {
+	vals := map[string]interface{}{"name": "Zoë", "age": 17}
+	cc := NewConfig(RegVarAndOp(vals))
+	e, err := Compile(cc, `(or (= name "Zoë") (>= (parse_int "abc") age))`)
+	assertNil(t, err)
+
+	_, trace, err := e.EvalWithTrace(NewCtxFromVars(cc, vals))
+	assertNil(t, err)
+
+	data, err := json.Marshal(trace)
+	assertNil(t, err)
+	assertEquals(t, string(data), `{"expression":"(or (= name \"Zoë\") (\u003e= (parse_int \"abc\") age))",`+
+		`"steps":[{"seq":0,"span":{"start":4,"end":18},"source":"(= name \"Zoë\")","op":"=","inputs":["Zoë","Zoë"],"output":true}],`+
+		`"result":true}`)
+
+	var decoded DecisionTrace
+	assertNil(t, json.Unmarshal(data, &decoded))
+	assertEquals(t, decoded.Steps[0].Span, Span{Start: 4, End: 18})
+	assertEquals(t, decoded.Steps[0].Source, `(= name "Zoë")`)
+
+	redata, err := json.Marshal(decoded)
+	assertNil(t, err)
+	assertEquals(t, string(redata), string(data))
+
+	// the failed step and the error are recorded
+	e, err = Compile(cc, `(or (!= name "Zoë") (>= (parse_int "abc") age))`)
+	assertNil(t, err)
+	_, trace, err = e.EvalWithTrace(NewCtxFromVars(cc, vals))
+	assertNotNil(t, err)
+	assertEquals(t, trace.Error, err.Error())
+
+	last := trace.Steps[len(trace.Steps)-1]
+	assertEquals(t, last.Op, "parse_int")
+	assertEquals(t, last.Source, `(parse_int "abc")`)
+	assertEquals(t, last.Error, err.Error())
+
+	data, err = json.Marshal(trace)
+	assertNil(t, err)
+	decoded = DecisionTrace{}
+	assertNil(t, json.Unmarshal(data, &decoded))
+	redata, err = json.Marshal(decoded)
+	assertNil(t, err)
+	assertEquals(t, string(redata), string(data))
+}
+
+func TestCtx_Trace(t *testing.T) {
+	vals := map[string]interface{}{"age": 20, "gender": "M", "items": []int{1, 9}}
+	testCases := []struct {
+		expr     string
+		optimize bool
+		res      Value
+		errMsg   string
+		steps    []string
+	}{
+		{
+			expr: `(and (> age 18) (= gender "F"))`,
+			res:  false,
+			steps: []string{
+				"0 age 20 []",
+				"1 18 18 [20]",
+				"2 > true []",
+				"3 gender M [true]",
+				"4 F F [true M]",
+				"5 = false [true]",
+				"5 = jump -1",
+			},
+		},
+		{
+			// the children of the fast operators are evaluated before them
+			expr:     `(and (> age 18) (= gender "F"))`,
+			optimize: true,
+			res:      false,
+			steps: []string{
+				"1 age 20 []",
+				"2 18 18 []",
+				"0 > true []",
+				"4 gender M [true]",
+				"5 F F [true]",
+				"3 = false [true]",
+				"3 = jump -1",
+			},
+		},
+		{
+			expr: `(if (< age 18) "minor" (+ age 1))`,
+			res:  int64(21),
+			steps: []string{
+				"0 age 20 []",
+				"1 18 18 [20]",
+				"2 < false []",
+				"3 if jump 5",
+				"6 age 20 []",
+				"7 1 1 [20]",
+				"8 + 21 []",
+			},
+		},
+		{
+			// the int arithmetic is traced too
+			expr:     `(* (+ age 1) 2)`,
+			optimize: true,
+			res:      int64(42),
+			steps: []string{
+				"1 age 20 []",
+				"2 1 1 []",
+				"0 + 21 []",
+				"3 2 2 [21]",
+				"4 * 42 []",
+			},
+		},
+		{
+			// the steps of the lambdas are not traced
+			expr: `(len (filter items (> x 1)))`,
+			res:  int64(1),
+			steps: []string{
+				"0 items [1 9] []",
+				"1 filter [9] []",
+				"2 len 1 []",
+			},
+		},
+		{
+			expr:   `(+ age gender)`,
+			errMsg: "unexpected param type",
+			steps: []string{
+				"0 age 20 []",
+				"1 gender M [20]",
+				"2 + <nil> [] error",
+			},
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			cc := NewConfig(Optimizations(c.optimize), RegVarAndOp(vals))
+			e, err := Compile(cc, c.expr)
+			assertNil(t, err)
+
+			var steps []string
+			ctx := NewCtxFromVars(cc, vals)
+			ctx.Trace = func(s EvalStep) {
+				switch {
+				case s.Jump:
+					steps = append(steps, fmt.Sprintf("%d %v jump %d", s.Idx, s.NodeValue, s.JumpTo))
+				case s.Err != nil:
+					steps = append(steps, fmt.Sprintf("%d %v %v %v error", s.Idx, s.NodeValue, s.Result, s.Stack))
+				default:
+					steps = append(steps, fmt.Sprintf("%d %v %v %v", s.Idx, s.NodeValue, s.Result, s.Stack))
+				}
+			}
+			res, err := e.Eval(ctx)
+			if len(c.errMsg) != 0 {
+				assertErrStrContains(t, err, c.errMsg)
+			} else {
+				assertNil(t, err)
+				assertEquals(t, res, c.res)
+			}
+			assertEquals(t, steps, c.steps)
+
+			// the result is the same without the trace
+			res, err = e.Eval(NewCtxFromVars(cc, vals))
+			if len(c.errMsg) == 0 {
+				assertNil(t, err)
+				assertEquals(t, res, c.res)
+			}
+		})
+	}
+}
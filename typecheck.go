@@ -0,0 +1,305 @@
+package eval
+
+import (
+	"fmt"
+)
+
+// signature declares the params and the result of an operator, they are checked at
+// compile time when TypeCheck is enabled. The AnyType params are not checked.
+type signature struct {
+	params []ValueType
+	// variadic operators accept at least min params, the type of the params
+	// after the declared ones is the type of the last declared one
+	variadic bool
+	min      int
+	returns  ValueType
+}
+
+// arity returns the counts of the params accepted, it returns false if they are not declared
+func (s signature) arity() (Arity, bool) {
+	switch {
+	case s.variadic:
+		return Arity{Min: s.min, Max: -1}, true
+	case s.params != nil:
+		return Arity{Min: len(s.params), Max: len(s.params)}, true
+	}
+	return Arity{}, false
+}
+
+func fixedSig(returns ValueType, params ...ValueType) signature {
+	return signature{params: params, returns: returns}
+}
+
+func variadicSig(returns ValueType, min int, param ValueType) signature {
+	return signature{params: []ValueType{param}, variadic: true, min: min, returns: returns}
+}
+
+// builtinSignatures are the signatures of the builtin operators, the operators absent here
+// are not checked, and their results are of AnyType. The results of the arithmetic operators
+// are inferred from the params, see arithmeticType.
+var builtinSignatures = map[string]signature{
+	"add": variadicSig(NumberType, 2, NumberType),
+	"sub": variadicSig(NumberType, 2, NumberType),
+	"mul": variadicSig(NumberType, 2, NumberType),
+	"div": variadicSig(NumberType, 2, NumberType),
+	"mod": variadicSig(NumberType, 2, NumberType),
+	"+":   variadicSig(NumberType, 2, NumberType),
+	"-":   variadicSig(NumberType, 2, NumberType),
+	"*":   variadicSig(NumberType, 2, NumberType),
+	"/":   variadicSig(NumberType, 2, NumberType),
+	"%":   variadicSig(NumberType, 2, NumberType),
+
+	"divisible": fixedSig(BoolType, IntType, IntType),
+
+	"and": variadicSig(BoolType, 0, BoolType),
+	"or":  variadicSig(BoolType, 0, BoolType),
+	"xor": variadicSig(BoolType, 2, BoolType),
+	"&":   variadicSig(BoolType, 0, BoolType),
+	"|":   variadicSig(BoolType, 0, BoolType),
+	"&&":  variadicSig(BoolType, 0, BoolType),
+	"||":  variadicSig(BoolType, 0, BoolType),
+	"not": fixedSig(BoolType, BoolType),
+	"!":   fixedSig(BoolType, BoolType),
+
+	"eq":      variadicSig(BoolType, 2, AnyType),
+	"=":       variadicSig(BoolType, 2, AnyType),
+	"==":      variadicSig(BoolType, 2, AnyType),
+	"ne":      fixedSig(BoolType, AnyType, AnyType),
+	"!=":      fixedSig(BoolType, AnyType, AnyType),
+	"gt":      fixedSig(BoolType, AnyType, AnyType),
+	"lt":      fixedSig(BoolType, AnyType, AnyType),
+	"ge":      fixedSig(BoolType, AnyType, AnyType),
+	"le":      fixedSig(BoolType, AnyType, AnyType),
+	">":       fixedSig(BoolType, AnyType, AnyType),
+	"<":       fixedSig(BoolType, AnyType, AnyType),
+	">=":      fixedSig(BoolType, AnyType, AnyType),
+	"<=":      fixedSig(BoolType, AnyType, AnyType),
+	"between": fixedSig(BoolType, NumberType, NumberType, NumberType),
+
+	"in":       fixedSig(BoolType, AnyType, ListType),
+	"overlap":  fixedSig(BoolType, ListType, ListType),
+	"count_of": fixedSig(IntType, ListType, AnyType),
+
+	"sum":        fixedSig(NumberType, ListType),
+	"avg":        fixedSig(FloatType, ListType),
+	"min":        fixedSig(NumberType, ListType),
+	"max":        fixedSig(NumberType, ListType),
+	"median":     fixedSig(FloatType, ListType),
+	"variance":   fixedSig(FloatType, ListType),
+	"stddev":     fixedSig(FloatType, ListType),
+	"percentile": fixedSig(FloatType, ListType, NumberType),
+	"pct_of":     fixedSig(FloatType, NumberType, NumberType),
+	"apply_pct":  fixedSig(FloatType, NumberType, NumberType),
+	"ratio":      fixedSig(FloatType, NumberType, NumberType),
+
+	"concat":          variadicSig(StringType, 0, StringType),
+	"regex":           fixedSig(BoolType, StringType, StringType),
+	"empty":           fixedSig(BoolType, AnyType),
+	"blank":           fixedSig(BoolType, AnyType),
+	"len":             fixedSig(IntType, AnyType),
+	"normalize_space": fixedSig(StringType, StringType),
+	"edit_distance":   fixedSig(IntType, StringType, StringType),
+	"repeat_str":      fixedSig(StringType, StringType, IntType),
+	"is_email":        fixedSig(BoolType, StringType),
+	"is_phone":        fixedSig(BoolType, StringType, StringType),
+}
+
+// typeCheck checks the types of the children of the operator or the keyword against its
+// signature, and returns the type of its result. The children of AnyType, e.g. the results
+// of the selectors registered without types, are not checked.
+func (p *parser) typeCheck(car token, children []*astNode) (ValueType, error) {
+	if kw, ok := keywordOf(p.conf, car.val); ok {
+		return p.typeCheckKeyword(kw, car, children)
+	}
+
+	sig, ok := builtinSignatures[car.val]
+	if !isBuiltinOperator(p.conf, car.val) {
+		info := p.conf.OperatorInfos[car.val]
+		sig = signature{
+			params:   info.Params,
+			variadic: info.Variadic,
+			min:      len(info.Params),
+			returns:  info.Returns,
+		}
+		ok = true
+	}
+	if !ok {
+		return AnyType, nil
+	}
+
+	if err := p.checkParams(car, sig, children); err != nil {
+		return AnyType, err
+	}
+	if _, ok = intArithmeticModes[car.val]; ok {
+		return arithmeticType(p.conf, children), nil
+	}
+	return sig.returns, nil
+}
+
+func (p *parser) checkParams(car token, sig signature, children []*astNode) error {
+	if a, ok := sig.arity(); ok && !a.accepts(len(children)) {
+		return p.arityErr(a, len(children), car)
+	}
+
+	for i, child := range children {
+		want := AnyType
+		if i < len(sig.params) {
+			want = sig.params[i]
+		} else if sig.variadic && len(sig.params) != 0 {
+			want = sig.params[len(sig.params)-1]
+		}
+		if err := p.checkParam(car, i, want, child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkArity checks the count of the params of the operator against its declared arity,
+// see WithArity. The builtin operators are checked by their signatures with StrictArity.
+func (p *parser) checkArity(car token, children []*astNode) error {
+	var (
+		a  Arity
+		ok bool
+	)
+	if isBuiltinOperator(p.conf, car.val) {
+		if !p.conf.CompileOptions[StrictArity] {
+			return nil
+		}
+		a, ok = builtinSignatures[car.val].arity()
+	} else if info := p.conf.OperatorInfos[car.val]; info.Arity != nil {
+		a, ok = *info.Arity, true
+	}
+	if ok && !a.accepts(len(children)) {
+		return p.arityErr(a, len(children), car)
+	}
+	return nil
+}
+
+func (p *parser) arityErr(a Arity, got int, car token) error {
+	var want string
+	switch {
+	case a.Min == a.Max:
+		return p.paramsCountErr(a.Min, got, car)
+	case a.Max < 0:
+		want = fmt.Sprintf("at least %d", a.Min)
+	default:
+		want = fmt.Sprintf("%d to %d", a.Min, a.Max)
+	}
+	err := fmt.Errorf("%s parameters count error (want: %s, got: %d)", car.val, want, got)
+	return p.errWithToken(ErrKindParamsCount, err, car)
+}
+
+func (p *parser) typeCheckKeyword(kw keyword, car token, children []*astNode) (ValueType, error) {
+	switch kw {
+	case keywordIf:
+		if err := p.checkParam(car, 0, BoolType, children[0]); err != nil {
+			return AnyType, err
+		}
+		if len(children) == 2 {
+			// the missing false branch is nil
+			return AnyType, nil
+		}
+		return commonType(staticType(p.conf, children[1]), staticType(p.conf, children[2])), nil
+	case keywordAny, keywordAll, keywordFilter, keywordFindAll:
+		// the predicates
+		if err := p.checkParam(car, 1, BoolType, children[1]); err != nil {
+			return AnyType, err
+		}
+		if kw == keywordAny || kw == keywordAll {
+			return BoolType, nil
+		}
+		return ListType, nil
+	}
+	return AnyType, nil
+}
+
+func (p *parser) checkParam(car token, i int, want ValueType, child *astNode) error {
+	if got := staticType(p.conf, child); !assignable(want, got) {
+		err := fmt.Errorf("type check error, operator: %s, param: %d, expected: %s, got: %s", car.val, i, want, got)
+		return p.errWithToken(ErrKindTypeMismatch, err, car)
+	}
+	return nil
+}
+
+// staticType returns the type of the result of the ast known at compile time,
+// it's AnyType if the type can not be determined
+func staticType(cc *Config, ast *astNode) ValueType {
+	n := ast.node
+	switch n.getNodeType() {
+	case constant:
+		return valueType(n.value)
+	case variable:
+		if n.varKey == localVarKey {
+			return AnyType
+		}
+		name, _ := n.value.(string)
+		return cc.VariableInfos[name].Type
+	}
+	// the operators and the keywords are typed when they are built
+	return ast.typ
+}
+
+// valueType returns the type of the value, it's AnyType for nil and the unknown types
+func valueType(v Value) ValueType {
+	switch v.(type) {
+	case bool:
+		return BoolType
+	case int64:
+		return IntType
+	case float64:
+		return FloatType
+	case string:
+		return StringType
+	case []interface{}, []int64, []string:
+		return ListType
+	case map[string]interface{}:
+		return DictType
+	}
+	return AnyType
+}
+
+// arithmeticType returns IntType if all the params are int64s, FloatType if any of them
+// is a float64, and NumberType otherwise, which is either of them at runtime
+func arithmeticType(cc *Config, children []*astNode) ValueType {
+	res := IntType
+	for _, child := range children {
+		switch staticType(cc, child) {
+		case FloatType:
+			return FloatType
+		case IntType:
+		default:
+			res = NumberType
+		}
+	}
+	return res
+}
+
+// commonType returns the type of the results of the branches
+func commonType(a, b ValueType) ValueType {
+	switch {
+	case a == b:
+		return a
+	case isNumberType(a) && isNumberType(b):
+		return NumberType
+	}
+	return AnyType
+}
+
+// assignable checks if a value of the got type may be passed as a param of the want type
+func assignable(want, got ValueType) bool {
+	switch {
+	case want == AnyType || got == AnyType || want == got:
+		return true
+	case want == NumberType:
+		return got == IntType || got == FloatType
+	case got == NumberType:
+		// the number may be of the want type at runtime
+		return want == IntType || want == FloatType
+	}
+	return false
+}
+
+func isNumberType(t ValueType) bool {
+	return t == IntType || t == FloatType || t == NumberType
+}
@@ -0,0 +1,104 @@
+package eval
+
+import (
+	"testing"
+)
+
+func TestTypeCheck(t *testing.T) {
+	testCases := []struct {
+		expr   string
+		infix  bool
+		errMsg string
+		// the arity is checked by StrictArity even if TypeCheck is disabled
+		arity bool
+	}{
+		{expr: `(+ 1 2.5 age)`},
+		{expr: `(and (> age 18) (regex name "^a"))`},
+		{expr: `(if (> age 18) (* age 1.5) 0)`},
+		{expr: `(concat)`},
+		{expr: `(concat name (concat "a" "b"))`},
+		{expr: `(in name ("a" "b"))`},
+		{expr: `(any scores (> x 60))`},
+		// the selectors without types are not checked
+		{expr: `(+ 1 untyped)`},
+		{expr: `(if untyped 1 2)`},
+		{expr: `(not (custom untyped))`},
+		// the operators without signatures are not checked
+		{expr: `(+ 1 (int "1"))`},
+		// the branches of different types are of any type
+		{expr: `(concat name (if (> age 1) "a" 1))`},
+		{expr: `(+ 1 "a")`, errMsg: `type check error, operator: +, param: 1, expected: number, got: string`},
+		{expr: `(+ 1 name)`, errMsg: `type check error, operator: +, param: 1, expected: number, got: string`},
+		{expr: `(+ 1)`, errMsg: `+ parameters count error (want: at least 2, got: 1)`, arity: true},
+		{expr: `(and true (+ age 1))`, errMsg: `type check error, operator: and, param: 1, expected: bool, got: int64`},
+		{expr: `(not (* 1.5 2))`, errMsg: `type check error, operator: not, param: 0, expected: bool, got: float64`},
+		{expr: `(if (+ age 1) 1 2)`, errMsg: `type check error, operator: if, param: 0, expected: bool, got: int64`},
+		{expr: `(if "yes" 1 2)`, errMsg: `type check error, operator: if, param: 0, expected: bool, got: string`},
+		{expr: `(between age 1 "9")`, errMsg: `type check error, operator: between, param: 2, expected: number, got: string`},
+		{expr: `(between age 1)`, errMsg: `between parameters count error (want: 3, got: 2)`, arity: true},
+		{expr: `(in name "a")`, errMsg: `type check error, operator: in, param: 1, expected: list, got: string`},
+		{expr: `(regex age "^1")`, errMsg: `type check error, operator: regex, param: 0, expected: string, got: int64`},
+		{expr: `(concat name (if (> age 1) 1 2.5))`, errMsg: `type check error, operator: concat, param: 1, expected: string, got: number`},
+		{expr: `(any scores (+ x 60))`, errMsg: `type check error, operator: any, param: 1, expected: bool, got: number`},
+		{expr: `(not (custom 1))`, errMsg: `type check error, operator: custom, param: 0, expected: string, got: int64`},
+		{expr: `(+ 1 (custom "a"))`, errMsg: `type check error, operator: +, param: 1, expected: number, got: bool`},
+		{expr: `(custom "a" "b")`, errMsg: `custom parameters count error (want: 1, got: 2)`},
+		{expr: `(join "," 1)`, errMsg: `type check error, operator: join, param: 1, expected: string, got: int64`},
+		{expr: `(join ",")`},
+		{expr: `(> (len scores) 3)`},
+		{expr: `(+ 1 (len name))`},
+		{expr: `(concat (len name))`, errMsg: `type check error, operator: concat, param: 0, expected: string, got: int64`},
+		{expr: `age + 1 > 2 && name == "a"`, infix: true},
+		{expr: `age + "1" > 2`, infix: true, errMsg: `type check error, operator: +, param: 1, expected: number, got: string`},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			cc := NewConfig(EnableTypeCheck, RegVarAndOp(map[string]interface{}{"untyped": nil}))
+			if c.infix {
+				EnableInfixNotation(cc)
+			}
+			assertNil(t, RegisterVariable(cc, "age", IntType))
+			assertNil(t, RegisterVariable(cc, "name", StringType))
+			assertNil(t, RegisterVariable(cc, "scores", ListType))
+			assertNil(t, RegisterOperator(cc, "custom", func(_ *Ctx, params []Value) (Value, error) {
+				return params[0] == "a", nil
+			}, WithParams(StringType), WithReturns(BoolType)))
+			assertNil(t, RegisterOperator(cc, "join", func(_ *Ctx, params []Value) (Value, error) {
+				return nil, nil
+			}, WithVariadicParams(StringType)))
+
+			_, err := Compile(cc, c.expr)
+			if len(c.errMsg) != 0 {
+				assertErrStrContains(t, err, c.errMsg)
+				assertErrStrContains(t, err, "occurs at")
+			} else {
+				assertNil(t, err)
+			}
+
+			// the types are not checked by default
+			delete(cc.CompileOptions, TypeCheck)
+			_, err = Compile(cc, c.expr)
+			assertNil(t, err)
+
+			EnableStrictArity(cc)
+			_, err = Compile(cc, c.expr)
+			if c.arity {
+				assertErrStrContains(t, err, c.errMsg)
+			} else {
+				assertNil(t, err)
+			}
+		})
+	}
+}
+
+func TestAssignable(t *testing.T) {
+	assertEquals(t, assignable(AnyType, StringType), true)
+	assertEquals(t, assignable(StringType, AnyType), true)
+	assertEquals(t, assignable(NumberType, IntType), true)
+	assertEquals(t, assignable(NumberType, FloatType), true)
+	assertEquals(t, assignable(IntType, NumberType), true)
+	assertEquals(t, assignable(IntType, FloatType), false)
+	assertEquals(t, assignable(ListType, StringType), false)
+	assertEquals(t, assignable(StringType, NumberType), false)
+}
@@ -2,9 +2,12 @@ package eval
 
 import (
 	"fmt"
+	"io"
 	"math/rand"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"unicode"
 )
 
@@ -398,6 +401,53 @@ func IndentByParentheses(s string) string {
 }
 
 func Dump(e *Expr) string {
+	return dump(e, false)
+}
+
+// String returns the expression as an S-expression rebuilt from the compiled nodes, e.g. for checking
+// the results of the optimizations such as the folded constants and the reordered params.
+// The short circuits are annotated with comments, e.g. "; sc if false -> (and)", which is
+// where the evaluation jumps to, or "return" for the end of the evaluation. The result compiles
+// to an equivalent expression, but it's not necessarily the same as the source, e.g. the fully
+// folded expressions are dumped as "(if true <constant>)", since a constant alone doesn't compile.
+func (e *Expr) String() string {
+	res := dump(e, true)
+	if len(e.nodes) == 1 && !strings.HasPrefix(res, "(") {
+		return fmt.Sprintf("(%s true %s)", keywordIf, res)
+	}
+	return res
+}
+
+// scComment returns the comment of the short circuit of the node, it's empty if the node
+// does not short-circuit
+func scComment(e *Expr, n *node) string {
+	if n.getNodeType() == cond {
+		// the if nodes jump to their branches instead, the results of the branches short-circuit
+		return ""
+	}
+
+	var when string
+	switch n.flag & scMask {
+	case scIfTrue | scIfFalse:
+		when = "sc"
+	case scIfTrue:
+		when = "sc if true"
+	case scIfFalse:
+		when = "sc if false"
+	default:
+		return ""
+	}
+
+	target := "return"
+	if n.scIdx >= 0 && int(n.scIdx) < len(e.nodes) {
+		target = fmt.Sprintf("(%v)", e.nodes[n.scIdx].value)
+	}
+	return fmt.Sprintf("; %s -> %s", when, target)
+}
+
+// dump rebuilds the S-expression of the compiled nodes, the short circuits are annotated
+// with comments if annotate is true, then the annotated children are put on separate lines
+func dump(e *Expr, annotate bool) string {
 	var getChildIdxes = func(idx int16) (res []int16) {
 		for i, p := range e.parentIdx {
 			if p == idx && e.nodes[i].getNodeType() != event {
@@ -411,6 +461,10 @@ func Dump(e *Expr) string {
 				res[1], // true branch
 				res[3], // false branch
 			}
+			// the false branch is omitted in the two params form, see buildIfNode
+			if f := e.nodes[res[2]]; f.getNodeType() == constant && f.value == nil {
+				res = res[:2]
+			}
 		}
 		return
 	}
@@ -423,14 +477,34 @@ func Dump(e *Expr) string {
 			return dumpLeafNode(n)
 		}
 
+		if n.value == string(keywordLet) && len(e.lambdas[n]) != 0 {
+			first, isLeaf := helper(getChildIdxes(idx)[0])
+			return dumpLet(e, n, first, isLeaf, annotate), false
+		}
+
 		var sb strings.Builder
 		sb.WriteString(fmt.Sprintf("(%v", n.value))
 
 		childIdxes := getChildIdxes(idx)
 
-		for _, cIdx := range childIdxes {
+		// the children are put on separate lines once any of them is annotated,
+		// since the comments last until the end of the lines
+		var comments []string
+		if annotate {
+			for _, cIdx := range childIdxes {
+				if cmt := scComment(e, e.nodes[cIdx]); len(cmt) != 0 {
+					comments = make([]string, len(childIdxes))
+					break
+				}
+			}
+			for i := range comments {
+				comments[i] = scComment(e, e.nodes[childIdxes[i]])
+			}
+		}
+
+		for i, cIdx := range childIdxes {
 			cc, isLeaf := helper(cIdx)
-			if isLeaf {
+			if isLeaf && comments == nil {
 				sb.WriteString(fmt.Sprintf(" %s", cc))
 				continue
 			}
@@ -438,6 +512,18 @@ func Dump(e *Expr) string {
 			for _, cs := range strings.Split(cc, "\n") {
 				sb.WriteString(fmt.Sprintf("\n  %s", cs))
 			}
+			if comments != nil && len(comments[i]) != 0 {
+				sb.WriteString(" " + comments[i])
+			}
+		}
+
+		for _, l := range e.lambdas[n] {
+			for _, cs := range strings.Split(dump(l.body, annotate), "\n") {
+				sb.WriteString(fmt.Sprintf("\n  %s", cs))
+			}
+		}
+		if comments != nil {
+			sb.WriteString("\n")
 		}
 		sb.WriteString(")")
 		return sb.String(), false
@@ -454,6 +540,136 @@ func Dump(e *Expr) string {
 	return res
 }
 
+// dumpLet dumps the let node with the names of the bindings, the first value
+// is the child of the node, the other values and the body are the lambdas
+func dumpLet(e *Expr, n *node, first string, firstIsLeaf, annotate bool) string {
+	var (
+		sb      strings.Builder
+		lambdas = e.lambdas[n]
+		body    = lambdas[len(lambdas)-1]
+	)
+
+	var writeVal = func(s string, isLeaf bool, indent string) {
+		if isLeaf {
+			sb.WriteString(" " + s)
+			return
+		}
+		for _, cs := range strings.Split(s, "\n") {
+			sb.WriteString("\n" + indent + cs)
+		}
+	}
+
+	sb.WriteString(fmt.Sprintf("(%v (", n.value))
+	for i, name := range body.params {
+		if i != 0 {
+			sb.WriteString("\n  ")
+		}
+		sb.WriteString(name)
+		if i == 0 {
+			writeVal(first, firstIsLeaf, "    ")
+			continue
+		}
+		l := lambdas[i-1].body
+		writeVal(dump(l, annotate), len(l.nodes) == 1, "    ")
+	}
+	sb.WriteString(")")
+	writeVal(dump(body.body, annotate), len(body.body.nodes) == 1, "  ")
+	sb.WriteString(")")
+	return sb.String()
+}
+
+// Disassemble returns a listing of the compiled nodes in the execution order, like a bytecode disassembler.
+// Each line has the node index, the opcode, the operand, the effect on the operand stack,
+// the stack depth after the node, and the jump targets of the short circuits and the if branches.
+// The lambdas are listed after the nodes.
+func (e *Expr) Disassemble() string {
+	var sb strings.Builder
+	disassemble(&sb, e, "")
+	return strings.TrimRight(sb.String(), "\n")
+}
+
+func disassemble(sb *strings.Builder, e *Expr, indent string) {
+	sb.WriteString(fmt.Sprintf("%s; nodes: %d, stack size: %d\n", indent, len(e.nodes), e.maxStackSize))
+
+	var target = func(idx int16) string {
+		switch {
+		case idx == -1:
+			return "return" // the result of the whole expression
+		case int(idx) >= len(e.nodes):
+			return "end"
+		}
+		return fmt.Sprintf("%04d", idx)
+	}
+
+	for i, n := range e.nodes {
+		var (
+			opcode, operand, effect string
+			notes                   []string
+		)
+
+		inline := false
+		if p, pIdx := parentNode(e, int16(i)); pIdx != -1 && p.getNodeType() == fastOperator {
+			inline = true
+		}
+
+		switch n.getNodeType() {
+		case constant:
+			opcode, effect = "CONST", "+1"
+			operand, _ = dumpLeafNode(n)
+		case variable:
+			opcode, effect = "LOAD", "+1"
+			operand = fmt.Sprint(n.value)
+		case operator:
+			opcode, effect = "CALL", fmt.Sprintf("-%d+1", n.childCnt)
+			operand = fmt.Sprintf("%v/%d", n.value, n.childCnt)
+		case fastOperator:
+			// the one or two children are read inline without the operand stack
+			opcode, effect = "FCALL", "+1"
+			operand = fmt.Sprintf("%v/%d", n.value, n.childCnt)
+		case cond:
+			if n.value == keywordIf {
+				opcode, effect = "IF", "-1"
+				notes = append(notes, "jump if false -> "+target(n.scIdx+1))
+			} else {
+				opcode, effect = "FI", "0"
+				notes = append(notes, "jump -> "+target(n.scIdx+1))
+			}
+			operand = fmt.Sprint(n.value)
+		case event:
+			opcode, effect = "EVENT", "0"
+			if data, ok := n.value.(LoopEventData); ok {
+				operand = fmt.Sprint(data.NodeValue)
+			}
+		}
+
+		if inline {
+			effect = "inline"
+		}
+
+		switch n.flag & scMask {
+		case scIfTrue | scIfFalse:
+			notes = append(notes, "sc -> "+target(n.scIdx))
+		case scIfTrue:
+			notes = append(notes, "sc if true -> "+target(n.scIdx))
+		case scIfFalse:
+			notes = append(notes, "sc if false -> "+target(n.scIdx))
+		}
+
+		line := fmt.Sprintf("%s%04d  %-6s %-24s %-7s depth %d", indent, i, opcode, operand, effect, n.osTop+1)
+		if len(notes) != 0 {
+			line += "  ; " + strings.Join(notes, ", ")
+		}
+		sb.WriteString(line + "\n")
+	}
+
+	for i, n := range e.nodes {
+		for j, l := range e.lambdas[n] {
+			sb.WriteString(fmt.Sprintf("%s; lambda %d of %04d, params: %v\n", indent, j, i, l.params))
+			disassemble(sb, l.body, indent+"  ")
+		}
+	}
+}
+
 func dumpLeafNode(node *node) (string, bool) {
 	switch node.getNodeType() {
 	case event:
@@ -464,10 +680,15 @@ func dumpLeafNode(node *node) (string, bool) {
 		return fmt.Sprintf("(%v)", node.value), false
 	}
 
+	return dumpValue(node.value), true
+}
+
+// dumpValue formats the constant value as a literal
+func dumpValue(val Value) string {
 	var res string
-	switch v := node.value.(type) {
+	switch v := val.(type) {
 	case string:
-		res = strconv.Quote(v)
+		res = quoteStr(v)
 	case []string:
 		var sb strings.Builder
 		sb.WriteRune('(')
@@ -475,10 +696,16 @@ func dumpLeafNode(node *node) (string, bool) {
 			if idx != 0 {
 				sb.WriteRune(' ')
 			}
-			sb.WriteString(strconv.Quote(s))
+			sb.WriteString(quoteStr(s))
 		}
 		sb.WriteRune(')')
 		res = sb.String()
+	case float64:
+		// keep the point, so that the float is not parsed as an integer
+		res = strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(res, ".eIN") {
+			res += ".0"
+		}
 	case []int64:
 		var sb strings.Builder
 		sb.WriteRune('(')
@@ -490,10 +717,36 @@ func dumpLeafNode(node *node) (string, bool) {
 		}
 		sb.WriteRune(')')
 		res = sb.String()
+	case []interface{}:
+		var sb strings.Builder
+		sb.WriteRune('(')
+		for idx, elem := range v {
+			if idx != 0 {
+				sb.WriteRune(' ')
+			}
+			sb.WriteString(dumpValue(elem))
+		}
+		sb.WriteRune(')')
+		res = sb.String()
 	default:
 		res = fmt.Sprint(v)
 	}
-	return res, true
+	return res
+}
+
+func toASCIILower(s string) string {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; 'A' <= c && c <= 'Z' {
+			b := []byte(s)
+			for j := i; j < len(b); j++ {
+				if 'A' <= b[j] && b[j] <= 'Z' {
+					b[j] += 'a' - 'A'
+				}
+			}
+			return string(b)
+		}
+	}
+	return s
 }
 
 func max(a, b int) int {
@@ -654,48 +907,83 @@ func DumpTable(expr *Expr, skipEventNode bool) string {
 	return sb.String()
 }
 
+// HandleDebugEvent prints the events of the expression compiled with Debug, which are sent to
+// e.EventChan, to the DebugOutput of the config, os.Stderr by default. The events are handled in
+// a goroutine until e.EventChan is closed, see HandleDebugEventWithDone to wait for it.
+// Without EventChan, the events are printed by the evaluations directly.
 func HandleDebugEvent(e *Expr) {
+	HandleDebugEventWithDone(e)
+}
+
+// HandleDebugEventWithDone handles the events as HandleDebugEvent does, and returns a channel
+// which is closed once e.EventChan is closed and all the events are printed.
+func HandleDebugEventWithDone(e *Expr) <-chan struct{} {
+	p := newDebugPrinter(e.conf)
+	done := make(chan struct{})
 	go func() {
-		var prev LoopEventData
+		defer close(done)
 		for ev := range e.EventChan {
-			switch ev.EventType {
-			case OpExecEvent:
-				data := ev.Data.(OpEventData)
-				fmt.Printf(
-					"%13s: op: %s, isFast: %v, params: %v, res: %v, err: %v\n",
-					"Exec Operator", data.OpName, data.IsFastOp, data.Params, data.Res, data.Err)
-			case LoopEvent:
-				var (
-					sb   strings.Builder
-					curt = ev.Data.(LoopEventData)
-				)
-
-				var minSteps int16 = 2
-				if prev.NodeType == FastOperatorNode {
-					minSteps = 4
-				}
+			p.print(ev)
+		}
+		fmt.Fprintln(p.w, "Event channel closed")
+	}()
+	return done
+}
 
-				if curt.CurtIdx-prev.CurtIdx > minSteps {
-					sb.WriteString(fmt.Sprintf("%13s: [%v] jump to [%v]\n\n", "Short Circuit", prev.NodeValue, curt.NodeValue))
-				} else {
-					sb.WriteString(fmt.Sprintf("\n"))
-				}
+// debugPrinter prints the events in a readable format, the short circuits are
+// detected by the gaps between the indexes of the nodes of the consecutive events
+type debugPrinter struct {
+	mu   sync.Mutex
+	w    io.Writer
+	prev LoopEventData
+}
 
-				sb.WriteString(fmt.Sprintf("%13s: [%v], type:[%s], idx:[%d]\n", "Current Node", curt.NodeValue, curt.NodeType.String(), curt.CurtIdx))
+func newDebugPrinter(cc *Config) *debugPrinter {
+	var w io.Writer = os.Stderr
+	if cc != nil && cc.DebugOutput != nil {
+		w = cc.DebugOutput
+	}
+	return &debugPrinter{w: w}
+}
 
-				sb.WriteString(fmt.Sprintf("%13s: ", "Operand Stack"))
-				for i := len(ev.Stack) - 1; i >= 0; i-- {
-					sb.WriteString(fmt.Sprintf("|%4v", ev.Stack[i]))
-				}
-				sb.WriteString("|")
-				fmt.Println(sb.String())
+func (p *debugPrinter) print(ev Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch ev.EventType {
+	case OpExecEvent:
+		data := ev.Data.(OpEventData)
+		fmt.Fprintf(p.w,
+			"%13s: op: %s, isFast: %v, params: %v, res: %v, err: %v\n",
+			"Exec Operator", data.OpName, data.IsFastOp, data.Params, data.Res, data.Err)
+	case LoopEvent:
+		var (
+			sb   strings.Builder
+			curt = ev.Data.(LoopEventData)
+		)
+
+		var minSteps int16 = 2
+		if p.prev.NodeType == FastOperatorNode {
+			minSteps = 4
+		}
 
-				prev = curt
-			default:
-				fmt.Printf("Unknown event: %+v\n", ev)
-			}
+		if curt.CurtIdx-p.prev.CurtIdx > minSteps {
+			sb.WriteString(fmt.Sprintf("%13s: [%v] jump to [%v]\n\n", "Short Circuit", p.prev.NodeValue, curt.NodeValue))
+		} else {
+			sb.WriteString(fmt.Sprintf("\n"))
 		}
 
-		fmt.Println("Event channel closed")
-	}()
+		sb.WriteString(fmt.Sprintf("%13s: [%v], type:[%s], idx:[%d]\n", "Current Node", curt.NodeValue, curt.NodeType.String(), curt.CurtIdx))
+
+		sb.WriteString(fmt.Sprintf("%13s: ", "Operand Stack"))
+		for i := len(ev.Stack) - 1; i >= 0; i-- {
+			sb.WriteString(fmt.Sprintf("|%4v", ev.Stack[i]))
+		}
+		sb.WriteString("|")
+		fmt.Fprintln(p.w, sb.String())
+
+		p.prev = curt
+	default:
+		fmt.Fprintf(p.w, "Unknown event: %+v\n", ev)
+	}
 }
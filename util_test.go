@@ -1,9 +1,11 @@
 package eval
 
 import (
+	"bytes"
 	"fmt"
 	"math/rand"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -146,6 +148,7 @@ func TestPrintCode(t *testing.T) {
 `
 
 	cc := &Config{
+		CompileOptions: map[CompileOption]bool{AllowEmptyList: true},
 		VariableKeyMap: map[string]VariableKey{
 			"age":         VariableKey(1),
 			"gender":      VariableKey(2),
@@ -407,3 +410,190 @@ func TestGenerateTestCase(t *testing.T) {
 		})
 	}
 }
+
+func TestExpr_Disassemble(t *testing.T) {
+	cc := NewConfig(RegVarAndOp(map[string]interface{}{
+		"age": 1, "vip": true, "country": "", "items": nil,
+	}))
+
+	testCases := []struct {
+		expr string
+		want string
+	}{
+		{
+			expr: `(and (> age 18) (or vip (= country "US")))`,
+			want: `; nodes: 9, stack size: 3
+0000  FCALL  >/2                      +1      depth 1  ; sc if false -> return
+0001  LOAD   age                      inline  depth 1
+0002  CONST  18                       inline  depth 1
+0003  LOAD   vip                      +1      depth 2  ; sc if true -> return
+0004  FCALL  =/2                      +1      depth 3  ; sc -> return
+0005  LOAD   country                  inline  depth 3
+0006  CONST  "US"                     inline  depth 3
+0007  CALL   or/2                     -2+1    depth 2  ; sc -> return
+0008  CALL   and/2                    -2+1    depth 1`,
+		},
+		{
+			expr: `(if (> age 18) (+ age 1) (- age (* 2 age)))`,
+			want: `; nodes: 13, stack size: 2
+0000  FCALL  >/2                      +1      depth 1
+0001  LOAD   age                      inline  depth 1
+0002  CONST  18                       inline  depth 1
+0003  IF     if                       -1      depth 0  ; jump if false -> 0008
+0004  FCALL  +/2                      +1      depth 1
+0005  LOAD   age                      inline  depth 1
+0006  CONST  1                        inline  depth 1
+0007  FI     fi                       0       depth 1  ; jump -> end
+0008  LOAD   age                      +1      depth 1
+0009  FCALL  */2                      +1      depth 2
+0010  CONST  2                        inline  depth 2
+0011  LOAD   age                      inline  depth 2
+0012  CALL   -/2                      -2+1    depth 1`,
+		},
+		{
+			expr: `(find_all items (> x age))`,
+			want: `; nodes: 2, stack size: 1
+0000  LOAD   items                    +1      depth 1
+0001  CALL   find_all/1               -1+1    depth 1
+; lambda 0 of 0001, params: [x]
+  ; nodes: 3, stack size: 1
+  0000  FCALL  >/2                      +1      depth 1
+  0001  LOAD   x                        inline  depth 1
+  0002  LOAD   age                      inline  depth 1`,
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			e, err := Compile(cc, c.expr)
+			assertNil(t, err)
+			assertEquals(t, e.Disassemble(), c.want)
+		})
+	}
+}
+
+func TestExpr_String(t *testing.T) {
+	vals := map[string]interface{}{
+		"age": int64(20), "vip": false, "country": "US", "items": []int64{1, 3, 5},
+	}
+	cc := NewConfig(RegVarAndOp(vals))
+
+	testCases := []struct {
+		expr string
+		want string
+	}{
+		{
+			expr: `(+ age (* 2 3))`,
+			want: `(+ age 6)`,
+		},
+		{
+			// the or node is reordered to the last by the ReduceNesting optimization
+			expr: `(and (or vip (= country "US")) (> age 18))`,
+			want: `(and
+  (> age 18) ; sc if false -> return
+  (or
+    vip ; sc if true -> return
+    (= country "US") ; sc -> return
+  ) ; sc -> return
+)`,
+		},
+		{
+			expr: `(or vip (if (> age 18) (= country "US") false))`,
+			want: `(or
+  vip ; sc if true -> return
+  (if
+    (> age 18)
+    (= country "US") ; sc if true -> return
+    false ; sc if true -> return
+  )
+)`,
+		},
+		{
+			expr: `(find_all items (> x age))`,
+			want: "(find_all items\n  (> x age))",
+		},
+		{
+			// the fully folded expressions are wrapped to be compiled
+			expr: `(in "a" ("a" 1 (2 3)))`,
+			want: `(if true true)`,
+		},
+		{
+			expr: `(concat "a" "b")`,
+			want: `(if true "ab")`,
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			e, err := Compile(cc, c.expr)
+			assertNil(t, err)
+			assertEquals(t, e.String(), c.want)
+
+			// the result should be compiled to an equivalent expression
+			again, err := Compile(cc, e.String())
+			assertNil(t, err)
+			want, err := e.Eval(NewCtxFromVars(cc, vals))
+			assertNil(t, err)
+			got, err := again.Eval(NewCtxFromVars(cc, vals))
+			assertNil(t, err)
+			assertEquals(t, got, want)
+		})
+	}
+}
+
+func TestHandleDebugEvent(t *testing.T) {
+	var buf bytes.Buffer
+	vals := map[string]interface{}{"age": 20}
+	cc := NewConfig(EnableDebug, WriteDebugTo(&buf), RegVarAndOp(vals))
+	e, err := Compile(cc, `(and (> age 18) (< age 30))`)
+	assertNil(t, err)
+
+	e.EventChan = make(chan Event)
+	done := HandleDebugEventWithDone(e)
+	res, err := e.Eval(NewCtxFromVars(cc, vals))
+	assertNil(t, err)
+	assertEquals(t, res, true)
+	close(e.EventChan)
+	<-done
+
+	out := buf.String()
+	for _, want := range []string{
+		"Exec Operator: op: >, isFast: true, params: [20 18], res: true, err: <nil>",
+		"Current Node: [<], type:[fast_operator], idx:[5]\nOperand Stack: |true|",
+		"Event channel closed",
+	} {
+		assertEquals(t, strings.Contains(out, want), true, want)
+	}
+}
+
+func TestDebug_WithoutEventChan(t *testing.T) {
+	var buf bytes.Buffer
+	vals := map[string]interface{}{"age": 20}
+	expr := `(if (> age 18) (+ age 1) 0)`
+	cc := NewConfig(Optimizations(false), EnableDebug, WriteDebugTo(&buf), RegVarAndOp(vals))
+	e, err := Compile(cc, expr)
+	assertNil(t, err)
+
+	// each real node is preceded by an event node, the events are printed by the evaluation
+	res, err := e.Eval(NewCtxFromVars(cc, vals))
+	assertNil(t, err)
+	assertEquals(t, res, int64(21))
+	out := buf.String()
+	for _, want := range []string{
+		"Current Node: [age], type:[variable], idx:[1]",
+		"Exec Operator: op: >, isFast: false, params: [20 18], res: true, err: <nil>",
+		"Exec Operator: op: +, isFast: false, params: [20 1], res: 21, err: <nil>",
+	} {
+		assertEquals(t, strings.Contains(out, want), true, want)
+	}
+	assertEquals(t, strings.Count(out, "Current Node"), 8)
+
+	// the expression compiled without Debug has no event nodes
+	plain, err := Compile(NewConfig(Optimizations(false), RegVarAndOp(vals)), expr)
+	assertNil(t, err)
+	assertEquals(t, len(e.nodes), 2*len(plain.nodes))
+	for _, n := range plain.nodes {
+		assertEquals(t, n.getNodeType() != event, true)
+	}
+	assertEquals(t, plain.debug == nil, true)
+}
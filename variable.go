@@ -4,16 +4,14 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-var (
-	builtinConstants = map[string]Value{
-		"true":  true,
-		"false": false,
-	}
-)
-
 // UndefinedVarKey means that the current key is undefined in the VariableKey type
 // In this case you should use the string type key
 const UndefinedVarKey VariableKey = math.MinInt16
@@ -29,6 +27,9 @@ var DNE = dne{DoesNotExist: "DNE"}
 
 var ErrDNE = errors.New("DNE")
 
+// ErrInvalidInputs is returned by Expr.ValidateInputs if the inputs don't satisfy the declared variables
+var ErrInvalidInputs = errors.New("invalid inputs")
+
 // VariableFetcher is used to fetch values of the expression variables.
 // Note that there are two types of keys in each method parameters,
 // The varKey is of type VariableKey, the strKey is of type string,
@@ -65,6 +66,259 @@ func GetOrRegisterKey(cc *Config, name string) VariableKey {
 	return key
 }
 
+// RegisterVariable registers a typed variable, the type and the default value
+// are used by Expr.ValidateInputs and NewCtxFromVars
+func RegisterVariable(cc *Config, name string, typ ValueType, opts ...VariableOption) error {
+	if _, exist := cc.VariableInfos[name]; exist {
+		return fmt.Errorf("variable already exist %s", name)
+	}
+
+	info := VariableInfo{Type: typ}
+	for _, opt := range opts {
+		opt(&info)
+	}
+	if !typ.matches(info.Default) {
+		return fmt.Errorf("default value of variable %s should be %s, got: %T", name, typ, info.Default)
+	}
+
+	GetOrRegisterKey(cc, name)
+	if cc.VariableInfos == nil {
+		cc.VariableInfos = make(map[string]VariableInfo)
+	}
+	cc.VariableInfos[name] = info
+	return nil
+}
+
+// VariableInfo is the metadata of a registered variable
+type VariableInfo struct {
+	// Type declares the type of the values of the variable, AnyType accepts any value
+	Type ValueType
+
+	// Default is the value of the variable when it's absent in the values
+	// passed to NewCtxFromVars, nil means no default
+	Default Value
+
+	// Lazy loads the value of the variable when it's absent in the values
+	// passed to NewCtxFromVars, see WithLazy
+	Lazy LazySelector
+}
+
+// LazySelector loads the value of a variable on demand, the ctx is the one being evaluated,
+// so the values of the other variables can be fetched from it
+type LazySelector func(ctx *Ctx) (Value, error)
+
+type VariableOption func(info *VariableInfo)
+
+// WithDefault declares the default value of the variable
+func WithDefault(v Value) VariableOption {
+	return func(info *VariableInfo) {
+		info.Default = unifyType(v)
+	}
+}
+
+// WithLazy declares the loader of the value of the variable, it's invoked on the first fetch
+// of the variable in a Ctx built by NewCtxFromVars, so the variables in the branches skipped
+// by short circuit are never loaded. The loaded value is memoized in the Ctx, it lives as long
+// as the Ctx, and the later evaluations with the same Ctx reuse it. The failed loads are not
+// memoized. The values passed to NewCtxFromVars take precedence over the loader.
+func WithLazy(fn LazySelector) VariableOption {
+	return func(info *VariableInfo) {
+		info.Lazy = fn
+	}
+}
+
+// ValidateInputs checks the values before the evaluation, each variable referenced by the expression
+// should be present and not nil unless it has a default value, and it should be of the declared type.
+// All the problems are reported in the returned error, which wraps ErrInvalidInputs.
+func (e *Expr) ValidateInputs(vals map[string]interface{}) error {
+	names := make([]string, 0, len(e.inputs))
+	for name := range e.inputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var problems []string
+	for _, name := range names {
+		info := e.inputs[name]
+		v := unifyType(vals[name])
+		if v == nil {
+			if info.Default == nil && info.Lazy == nil {
+				problems = append(problems, fmt.Sprintf("missing [%s]", name))
+			}
+			continue
+		}
+		if !info.Type.matches(v) {
+			problems = append(problems, fmt.Sprintf("[%s] should be %s, got: %T", name, info.Type, v))
+		}
+	}
+
+	if len(problems) != 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidInputs, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// referencedInputs returns the variables referenced by the expression and its lambdas,
+// with the infos of the registered ones
+func referencedInputs(cc *Config, e *Expr) map[string]VariableInfo {
+	res := make(map[string]VariableInfo)
+	var walk func(e *Expr)
+	walk = func(e *Expr) {
+		for _, n := range e.nodes {
+			if n.getNodeType() == variable && n.varKey != localVarKey {
+				name := n.value.(string)
+				if n.flag&pathVar != 0 {
+					// the dotted selectors read their roots
+					name, _ = pathRoot(name)
+				}
+				res[name] = cc.VariableInfos[name]
+			}
+			for _, l := range e.lambdas[n] {
+				walk(l.body)
+			}
+		}
+	}
+	walk(e)
+	return res
+}
+
+// withDefaults returns the values with the defaults of the absent variables
+func withDefaults(cc *Config, vals map[string]interface{}) map[string]interface{} {
+	var res map[string]interface{}
+	for name, info := range cc.VariableInfos {
+		if info.Default == nil {
+			continue
+		}
+		if v, exist := vals[name]; exist && v != nil {
+			continue
+		}
+		if res == nil {
+			res = make(map[string]interface{}, len(vals)+1)
+			for k, v := range vals {
+				res[k] = v
+			}
+		}
+		res[name] = info.Default
+	}
+	if res == nil {
+		return vals
+	}
+	return res
+}
+
+// getVar fetches the value of the variable node, the dotted selectors are resolved by getPath
+func getVar(ctx *Ctx, n *node) (Value, error) {
+	if n.flag&pathVar != 0 {
+		return getPath(ctx, n.varKey, n.value.(string))
+	}
+	return ctx.Get(n.varKey, n.value.(string))
+}
+
+// pathRoot returns the first segment of the selector path, e.g. `user` of `user.address.city`
+// and `items` of `items[0]`
+func pathRoot(name string) (string, bool) {
+	if i := strings.IndexAny(name, ".["); i > 0 {
+		return name[:i], true
+	}
+	return name, false
+}
+
+// getPath fetches the selector path, e.g. `user.address.city` and `items[0]`, by fetching
+// the root selector and walking the nested maps and lists by the rest segments, see walkPath
+func getPath(ctx *Ctx, varKey VariableKey, path string) (Value, error) {
+	root, _ := pathRoot(path)
+	v, err := ctx.Get(varKey, root)
+	if err != nil {
+		return nil, err
+	}
+	return walkPath(v, path, len(root), false)
+}
+
+// walkPath walks the nested maps and lists from the value of path[:i] by the rest segments
+// of the path. The unknown keys and the values which are not maps or lists in the path are
+// errors, or nil if lenient. The indexes out of range are always errors.
+func walkPath(v Value, path string, i int, lenient bool) (Value, error) {
+	for i < len(path) {
+		if path[i] == '[' {
+			// the index segment is path[i+1:j], it's validated by the lexer
+			j := i + strings.IndexByte(path[i:], ']')
+			idx, _ := strconv.Atoi(path[i+1 : j])
+			elem, err := indexList(unifyType(v), idx)
+			if err == errNotList {
+				if lenient {
+					return nil, nil
+				}
+				return nil, fmt.Errorf("selector %s: %s is not a list, got: %T", path, path[:i], v)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("selector %s: %w", path, err)
+			}
+			v, i = elem, j+1
+			continue
+		}
+
+		// the name segment is path[i+1:j], path[:i] is walked
+		j := strings.IndexAny(path[i+1:], ".[")
+		if j == -1 {
+			j = len(path)
+		} else {
+			j += i + 1
+		}
+		name := path[i+1 : j]
+
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			if lenient {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("selector %s: %s is not a map, got: %T", path, path[:i], v)
+		}
+		if v, ok = m[name]; !ok {
+			if lenient {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("selector %s: key not exist %s", path, name)
+		}
+		i = j
+	}
+	return unifyType(v), nil
+}
+
+var errNotList = errors.New("not a list")
+
+// indexList returns the element of the list at the index,
+// the negative indexes address the elements from the end, e.g. -1 is the last one
+func indexList(v Value, idx int) (Value, error) {
+	var size int
+	switch l := v.(type) {
+	case []interface{}:
+		size = len(l)
+	case []int64:
+		size = len(l)
+	case []string:
+		size = len(l)
+	default:
+		return nil, errNotList
+	}
+
+	i := idx
+	if i < 0 {
+		i += size
+	}
+	if i < 0 || i >= size {
+		return nil, fmt.Errorf("index %d out of range, length: %d", idx, size)
+	}
+
+	switch l := v.(type) {
+	case []interface{}:
+		return l[i], nil
+	case []int64:
+		return l[i], nil
+	default:
+		return v.([]string)[i], nil
+	}
+}
+
 func ToValueMap(m map[string]interface{}) map[string]Value {
 	res := make(map[string]Value)
 	for k, v := range m {
@@ -74,19 +328,89 @@ func ToValueMap(m map[string]interface{}) map[string]Value {
 }
 
 func NewCtxFromVars(cc *Config, vals map[string]interface{}) *Ctx {
-	if cc.CompileOptions[AllowUndefinedVariable] {
-		return &Ctx{VariableFetcher: NewMapVarFetcher(vals)}
-	}
+	vals = withDefaults(cc, vals)
 
 	var fetcher VariableFetcher
 	minKey, maxKey := varKeyRange(cc)
-	if minKey <= maxKey && 0 <= minKey && maxKey < 256 {
+	if cc.CompileOptions[AllowUndefinedVariable] {
+		fetcher = NewMapVarFetcher(vals)
+	} else if minKey <= maxKey && 0 <= minKey && maxKey < 256 {
 		fetcher = NewSliceVarFetcher(cc, vals)
 	} else {
 		fetcher = NewMapVarFetcher(vals)
 	}
 
-	return &Ctx{VariableFetcher: fetcher}
+	ctx := &Ctx{VariableFetcher: fetcher}
+	withLazies(cc, ctx, vals)
+	return ctx
+}
+
+// withLazies makes the ctx load the lazy variables absent in the values on demand, see WithLazy
+func withLazies(cc *Config, ctx *Ctx, vals map[string]interface{}) {
+	var pending map[string]LazySelector
+	for name, info := range cc.VariableInfos {
+		if info.Lazy == nil {
+			continue
+		}
+		if v, exist := vals[name]; exist && v != nil {
+			continue
+		}
+		if pending == nil {
+			pending = make(map[string]LazySelector)
+		}
+		pending[name] = info.Lazy
+	}
+	if pending != nil {
+		ctx.VariableFetcher = &lazyFetcher{VariableFetcher: ctx.VariableFetcher, ctx: ctx, pending: pending}
+	}
+}
+
+// lazyFetcher loads the pending variables on their first fetch, and memoizes
+// the loaded values by setting them to the underlying fetcher
+type lazyFetcher struct {
+	VariableFetcher
+	ctx     *Ctx
+	pending map[string]LazySelector
+}
+
+func (l *lazyFetcher) Get(varKey VariableKey, strKey string) (Value, error) {
+	if len(l.pending) != 0 {
+		// the dotted keys are walked from their roots, see MapVarFetcher.Get
+		name, _ := pathRoot(strKey)
+		if err := l.load(varKey, name); err != nil {
+			return nil, err
+		}
+	}
+	return l.VariableFetcher.Get(varKey, strKey)
+}
+
+func (l *lazyFetcher) load(varKey VariableKey, name string) error {
+	fn, exist := l.pending[name]
+	if !exist {
+		return nil
+	}
+	val, err := fn(l.ctx)
+	if err != nil {
+		return fmt.Errorf("load variable %s error: %w", name, err)
+	}
+	if err = l.VariableFetcher.Set(varKey, name, unifyType(val)); err != nil {
+		return err
+	}
+	delete(l.pending, name)
+	return nil
+}
+
+func (l *lazyFetcher) Set(varKey VariableKey, strKey string, val Value) error {
+	// the values set explicitly take precedence over the loaders
+	delete(l.pending, strKey)
+	return l.VariableFetcher.Set(varKey, strKey, val)
+}
+
+func (l *lazyFetcher) Cached(varKey VariableKey, strKey string) bool {
+	if _, exist := l.pending[strKey]; exist {
+		return false
+	}
+	return l.VariableFetcher.Cached(varKey, strKey)
 }
 
 func varKeyRange(cc *Config) (min, max VariableKey) {
@@ -149,9 +473,16 @@ func NewMapVarFetcher(vals map[string]interface{}) MapVarFetcher {
 	return s
 }
 
+// Get fetches the value of the key, the dotted keys absent in the map walk the nested maps
+// from the value of their roots, e.g. `user.address.city`, the unknown keys in the path are nil
 func (s MapVarFetcher) Get(_ VariableKey, key string) (Value, error) {
 	val, exist := s[key]
 	if !exist {
+		if root, isPath := pathRoot(key); isPath {
+			if val, exist = s[root]; exist {
+				return walkPath(val, key, len(root), true)
+			}
+		}
 		return nil, fmt.Errorf("variableKey not exist %s", key)
 	}
 	return val, nil
@@ -164,9 +495,310 @@ func (s MapVarFetcher) Set(_ VariableKey, key string, val Value) error {
 
 func (s MapVarFetcher) Cached(_ VariableKey, key string) bool {
 	_, exist := s[key]
+	if root, isPath := pathRoot(key); !exist && isPath {
+		_, exist = s[root]
+	}
 	return exist
 }
 
+// structTag is the struct tag to rename the fields in StructVarFetcher, e.g. `eval:"name"`,
+// the fields tagged with `eval:"-"` are ignored
+const structTag = "eval"
+
+// StructVarFetcher fetches the variables from a struct (or a pointer to a struct) by reflection,
+// the variable names are dotted field paths, e.g. `user.address.city`.
+//
+// Each segment of the path is resolved as follows:
+//   - the field whose eval tag or name (if untagged) equals the segment,
+//     the exported fields of the embedded structs are promoted, see structLayout
+//   - the pointers and interfaces are followed, a nil one in the path makes the variable undefined (nil),
+//     including the nil embedded pointers of the promoted fields
+//   - the maps with string keys are also walked, a missing key makes the variable undefined (nil)
+//   - the unexported fields and the unknown fields are errors
+//
+// The values set by Set take precedence over the fields, the struct itself is never modified.
+// The field paths are resolved once per struct type and cached.
+type StructVarFetcher struct {
+	root reflect.Value
+	vals map[string]Value
+}
+
+func NewStructVarFetcher(v interface{}) *StructVarFetcher {
+	return &StructVarFetcher{
+		root: reflect.ValueOf(v),
+		vals: make(map[string]Value),
+	}
+}
+
+// NewCtxFromStruct returns a Ctx fetching the variables from the struct, see StructVarFetcher
+func NewCtxFromStruct(v interface{}) *Ctx {
+	return &Ctx{VariableFetcher: NewStructVarFetcher(v)}
+}
+
+func (s *StructVarFetcher) Get(_ VariableKey, key string) (Value, error) {
+	if val, exist := s.vals[key]; exist {
+		return val, nil
+	}
+
+	v, ok := indirect(s.root)
+	if !ok {
+		return nil, nil
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("struct var fetcher requires a struct, got: %s", v.Type())
+	}
+
+	for _, name := range strings.Split(key, ".") {
+		var err error
+		switch v.Kind() {
+		case reflect.Struct:
+			if v, ok, err = structField(v, name); err != nil {
+				return nil, fmt.Errorf("%w, variable: %s", err, key)
+			}
+			if !ok {
+				return nil, nil
+			}
+		case reflect.Map:
+			if v.Type().Key().Kind() != reflect.String {
+				return nil, fmt.Errorf("map key should be a string, variable: %s", key)
+			}
+			if v = v.MapIndex(reflect.ValueOf(name).Convert(v.Type().Key())); !v.IsValid() {
+				return nil, nil
+			}
+		default:
+			return nil, fmt.Errorf("field not exist %s, variable: %s", name, key)
+		}
+
+		if v, ok = indirect(v); !ok {
+			return nil, nil
+		}
+	}
+	res, err := reflectValue(v)
+	if err != nil {
+		return nil, fmt.Errorf("%w, variable: %s", err, key)
+	}
+	return res, nil
+}
+
+func (s *StructVarFetcher) Set(_ VariableKey, key string, val Value) error {
+	s.vals[key] = val
+	return nil
+}
+
+func (s *StructVarFetcher) Cached(varKey VariableKey, key string) bool {
+	_, err := s.Get(varKey, key)
+	return err == nil
+}
+
+// indirect follows the pointers and interfaces, it returns false if a nil one is met
+func indirect(v reflect.Value) (reflect.Value, bool) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return v, false
+		}
+		v = v.Elem()
+	}
+	return v, v.IsValid()
+}
+
+// fieldPath is the path of a field in a struct type, the index is the one of reflect.Value.FieldByIndex
+type fieldPath struct {
+	index []int
+	// unexported fields are not accessible
+	unexported bool
+	// ambiguous fields are promoted from more than one embedded struct at the same depth
+	ambiguous bool
+}
+
+// structLayouts caches the field paths of the struct types, reflect.Type -> map[string]fieldPath
+var structLayouts sync.Map
+
+// structLayout returns the field paths of the struct type by the eval tags or the field names,
+// the fields of the embedded structs (or pointers to structs) are promoted by the rules of Go:
+// the shallower fields shadow the deeper ones, and the fields at the same depth are ambiguous.
+// The unexported fields of the embedded structs are not accessible, but they still shadow the
+// deeper ones as Go does. The fields of the embedded interfaces are not promoted.
+func structLayout(t reflect.Type) map[string]fieldPath {
+	if layout, exist := structLayouts.Load(t); exist {
+		return layout.(map[string]fieldPath)
+	}
+	layout := buildStructLayout(t, map[reflect.Type]bool{})
+	structLayouts.Store(t, layout)
+	return layout
+}
+
+func buildStructLayout(t reflect.Type, visiting map[reflect.Type]bool) map[string]fieldPath {
+	visiting[t] = true
+	defer delete(visiting, t)
+
+	layout := make(map[string]fieldPath, t.NumField())
+	var embedded []int
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get(structTag)
+		if tag == "-" {
+			continue
+		}
+		if f.Anonymous && tag == "" {
+			embedded = append(embedded, i)
+		}
+		name := tag
+		if name == "" {
+			name = f.Name
+		}
+		if _, exist := layout[name]; !exist {
+			layout[name] = fieldPath{index: []int{i}, unexported: f.PkgPath != ""}
+		}
+	}
+
+	promoted := make(map[string]fieldPath)
+	for _, i := range embedded {
+		et := t.Field(i).Type
+		if et.Kind() == reflect.Ptr {
+			et = et.Elem()
+		}
+		// the recursive embedded structs are not promoted again
+		if et.Kind() != reflect.Struct || visiting[et] {
+			continue
+		}
+		for name, f := range buildStructLayout(et, visiting) {
+			if _, exist := layout[name]; exist {
+				continue
+			}
+			f.index = append([]int{i}, f.index...)
+			old, exist := promoted[name]
+			switch {
+			case !exist || len(f.index) < len(old.index):
+				promoted[name] = f
+			case len(f.index) == len(old.index):
+				old.ambiguous = true
+				promoted[name] = old
+			}
+		}
+	}
+	for name, f := range promoted {
+		layout[name] = f
+	}
+	return layout
+}
+
+// structField finds the field by the eval tag or the field name, see structLayout.
+// It returns false if a nil embedded pointer is met.
+func structField(v reflect.Value, name string) (reflect.Value, bool, error) {
+	f, exist := structLayout(v.Type())[name]
+	if !exist {
+		return reflect.Value{}, false, fmt.Errorf("field not exist %s", name)
+	}
+	if f.ambiguous {
+		return reflect.Value{}, false, fmt.Errorf("field ambiguous %s", name)
+	}
+	if f.unexported {
+		return reflect.Value{}, false, fmt.Errorf("field not accessible %s", name)
+	}
+
+	for j, i := range f.index {
+		if j != 0 {
+			var ok bool
+			if v, ok = indirect(v); !ok {
+				return v, false, nil
+			}
+		}
+		v = v.Field(i)
+	}
+	return v, true, nil
+}
+
+// reflectValue converts the field into a Value of the builtin types,
+// it returns an error if the unsigned integer overflows int64
+func reflectValue(v reflect.Value) (Value, error) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.Type() == reflect.TypeOf(time.Duration(0)) {
+			return int64(time.Duration(v.Int()) / time.Second), nil
+		}
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u := v.Uint()
+		if u > math.MaxInt64 {
+			return nil, fmt.Errorf("integer overflow %d", u)
+		}
+		return int64(u), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.String:
+		return v.String(), nil
+	}
+	if !v.CanInterface() {
+		return nil, nil
+	}
+	return unifyType(v.Interface()), nil
+}
+
+// snapshotCtx returns a copy of the ctx whose variables are fetched at most once,
+// the returned ctx is used in a single evaluation, see Ctx.SnapshotVars
+func snapshotCtx(ctx *Ctx) *Ctx {
+	c := *ctx
+	c.VariableFetcher = &snapshotFetcher{
+		VariableFetcher: ctx.VariableFetcher,
+		snapshots:       make(map[string]Value),
+	}
+	// the variables are already snapshotted, no need to do it again in the nested evaluations
+	c.SnapshotVars = false
+	return &c
+}
+
+type snapshotFetcher struct {
+	VariableFetcher
+	snapshots map[string]Value
+}
+
+func (s *snapshotFetcher) Get(varKey VariableKey, strKey string) (Value, error) {
+	if val, exist := s.snapshots[strKey]; exist {
+		return val, nil
+	}
+	val, err := s.VariableFetcher.Get(varKey, strKey)
+	if err != nil {
+		return nil, err
+	}
+	// DNE is not a real value, it should be fetched again after the value is cached
+	if val != DNE {
+		s.snapshots[strKey] = val
+	}
+	return val, nil
+}
+
+func (s *snapshotFetcher) Set(varKey VariableKey, strKey string, val Value) error {
+	if err := s.VariableFetcher.Set(varKey, strKey, val); err != nil {
+		return err
+	}
+	s.snapshots[strKey] = val
+	return nil
+}
+
+func (s *snapshotFetcher) Cached(varKey VariableKey, strKey string) bool {
+	if _, exist := s.snapshots[strKey]; exist {
+		return true
+	}
+	return s.VariableFetcher.Cached(varKey, strKey)
+}
+
+// inputsRecorder records the values of the variables fetched in an evaluation
+type inputsRecorder struct {
+	VariableFetcher
+	inputs map[string]Value
+}
+
+func (r *inputsRecorder) Get(varKey VariableKey, strKey string) (Value, error) {
+	val, err := r.VariableFetcher.Get(varKey, strKey)
+	if err != nil {
+		return nil, err
+	}
+	r.inputs[strKey] = val
+	return val, nil
+}
+
 func UnifyType(val Value) Value {
 	switch val.(type) {
 	case bool, string, int64, []int64, []string:
@@ -1 +1,544 @@
 package eval
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// counter returns a new value on each fetch of the variable
+type counter struct {
+	MapVarFetcher
+	fetched map[string]int
+}
+
+func (c *counter) Get(varKey VariableKey, strKey string) (Value, error) {
+	c.fetched[strKey]++
+	if strKey == "count" {
+		return int64(c.fetched[strKey]), nil
+	}
+	return c.MapVarFetcher.Get(varKey, strKey)
+}
+
+func TestSnapshotVars(t *testing.T) {
+	testCases := []struct {
+		expr     string
+		snapshot bool
+		want     Value
+		fetched  map[string]int
+	}{
+		{
+			expr:     `(= count count)`,
+			snapshot: true,
+			want:     true,
+			fetched:  map[string]int{"count": 1},
+		},
+		{
+			expr:     `(= count count)`,
+			snapshot: false,
+			want:     false,
+			fetched:  map[string]int{"count": 2},
+		},
+		{
+			expr:     `(+ count count count age)`,
+			snapshot: true,
+			want:     int64(21),
+			fetched:  map[string]int{"count": 1, "age": 1},
+		},
+		{
+			expr:     `(find_all (1 2 3) (= x count))`,
+			snapshot: true,
+			want: []interface{}{
+				[]interface{}{int64(0), int64(1)},
+			},
+			fetched: map[string]int{"count": 1},
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			cc := NewConfig(
+				Optimizations(false),
+				EnableUndefinedVariable,
+				RegVarAndOp(map[string]interface{}{"age": 18}))
+			e, err := Compile(cc, c.expr)
+			assertNil(t, err)
+
+			fetcher := &counter{
+				MapVarFetcher: NewMapVarFetcher(map[string]interface{}{"age": 18}),
+				fetched:       make(map[string]int),
+			}
+			ctx := &Ctx{VariableFetcher: fetcher, SnapshotVars: c.snapshot}
+
+			res, err := e.Eval(ctx)
+			assertNil(t, err)
+			assertEquals(t, res, c.want)
+			assertEquals(t, fetcher.fetched, c.fetched)
+
+			// the snapshots are discarded after the evaluation
+			fetcher.fetched = make(map[string]int)
+			_, err = e.Eval(ctx)
+			assertNil(t, err)
+			assertEquals(t, fetcher.fetched, c.fetched)
+		})
+	}
+}
+
+type address struct {
+	City string
+	Zip  *int
+}
+
+type base struct {
+	ID      int64
+	Created time.Time
+}
+
+type user struct {
+	base
+	Name     string `eval:"name"`
+	Age      uint8
+	Score    float32
+	Address  *address
+	Previous *address
+	Tags     []int
+	Labels   map[string]interface{}
+	Secret   string `eval:"-"`
+	password string
+}
+
+func TestStructVarFetcher(t *testing.T) {
+	zip := 94105
+	u := &user{
+		base:     base{ID: 7, Created: time.Unix(1700000000, 0)},
+		Name:     "alice",
+		Age:      30,
+		Score:    1.5,
+		Address:  &address{City: "SF", Zip: &zip},
+		Tags:     []int{1, 2},
+		Labels:   map[string]interface{}{"tier": "gold", "meta": map[string]interface{}{"level": 3}},
+		Secret:   "s",
+		password: "p",
+	}
+
+	testCases := []struct {
+		key    string
+		want   Value
+		errMsg string
+	}{
+		{key: "name", want: "alice"},
+		{key: "Age", want: int64(30)},
+		{key: "Score", want: 1.5},
+		{key: "Address.City", want: "SF"},
+		{key: "Address.Zip", want: int64(94105)},
+		{key: "Tags", want: []int64{1, 2}},
+		{key: "Labels.tier", want: "gold"},
+		{key: "Labels.meta.level", want: int64(3)},
+		{key: "Labels.unknown", want: nil},
+		// the promoted fields of the embedded struct
+		{key: "ID", want: int64(7)},
+		{key: "base.ID", errMsg: "field not accessible base"},
+		{key: "Created", want: int64(1700000000)},
+		// the nil pointer in the path makes the variable undefined
+		{key: "Previous.City", want: nil},
+		{key: "Previous", want: nil},
+		{key: "Name", errMsg: "field not exist Name, variable: Name"},
+		{key: "Secret", errMsg: "field not exist Secret"},
+		{key: "password", errMsg: "field not accessible password"},
+		{key: "Address.Country", errMsg: "field not exist Country, variable: Address.Country"},
+		{key: "name.first", errMsg: "field not exist first"},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.key, func(t *testing.T) {
+			for _, v := range []interface{}{u, *u} {
+				res, err := NewStructVarFetcher(v).Get(UndefinedVarKey, c.key)
+				if len(c.errMsg) != 0 {
+					assertErrStrContains(t, err, c.errMsg)
+					continue
+				}
+				assertNil(t, err)
+				assertEquals(t, res, c.want)
+			}
+		})
+	}
+
+	e, err := Compile(NewConfig(EnableUndefinedVariable),
+		`(and (= Address.City "SF") (> (+ Age ID) 36) (in "gold" (coerce_list Labels.tier)))`)
+	assertNil(t, err)
+	res, err := e.Eval(&Ctx{VariableFetcher: NewStructVarFetcher(u)})
+	assertNil(t, err)
+	assertEquals(t, res, true)
+
+	fetcher := NewStructVarFetcher(u)
+	assertNil(t, fetcher.Set(UndefinedVarKey, "Address.City", "LA"))
+	res, err = fetcher.Get(UndefinedVarKey, "Address.City")
+	assertNil(t, err)
+	assertEquals(t, res, "LA")
+	assertEquals(t, u.Address.City, "SF")
+	assertEquals(t, fetcher.Cached(UndefinedVarKey, "Address.City"), true)
+	assertEquals(t, fetcher.Cached(UndefinedVarKey, "Address.Country"), false)
+
+	// the nil embedded pointers make the promoted fields undefined
+	type node struct {
+		*node
+		*address
+		Val int
+	}
+	res, err = NewStructVarFetcher(&node{node: &node{Val: 2}, Val: 1}).Get(UndefinedVarKey, "City")
+	assertNil(t, err)
+	assertNil(t, res)
+	_, exist := structLayouts.Load(reflect.TypeOf(node{}))
+	assertEquals(t, exist, true)
+
+	e, err = Compile(NewConfig(EnableUndefinedVariable), `(= Address.City name)`)
+	assertNil(t, err)
+	res, err = e.Eval(NewCtxFromStruct(&user{Name: "SF", Address: &address{City: "SF"}}))
+	assertNil(t, err)
+	assertEquals(t, res, true)
+
+	// the shallower promoted fields shadow the deeper ones, and the ones at the same depth are ambiguous
+	type inner struct {
+		Kind string
+		Size int
+		Name string
+	}
+	type outer struct {
+		inner
+		Size int
+	}
+	type sized struct {
+		Size int
+		Name string
+	}
+	type item struct {
+		outer
+		sized
+		*address
+		Count uint64
+	}
+	it := &item{
+		outer:   outer{inner: inner{Kind: "box", Size: 1, Name: "b"}, Size: 2},
+		sized:   sized{Size: 3, Name: "a"},
+		address: &address{City: "SF"},
+		Count:   math.MaxUint64,
+	}
+	for key, want := range map[string]Value{"Kind": "box", "Name": "a", "City": "SF"} {
+		res, err = NewStructVarFetcher(it).Get(UndefinedVarKey, key)
+		assertNil(t, err, key)
+		assertEquals(t, res, want, key)
+	}
+	_, err = NewStructVarFetcher(it).Get(UndefinedVarKey, "Size")
+	assertErrStrContains(t, err, "field ambiguous Size, variable: Size")
+
+	// the unsigned integers overflowing int64 are errors rather than wrapped
+	_, err = NewStructVarFetcher(it).Get(UndefinedVarKey, "Count")
+	assertErrStrContains(t, err, "integer overflow 18446744073709551615, variable: Count")
+	it.Count = math.MaxInt64
+	res, err = NewStructVarFetcher(it).Get(UndefinedVarKey, "Count")
+	assertNil(t, err)
+	assertEquals(t, res, int64(math.MaxInt64))
+
+	_, err = NewStructVarFetcher(1).Get(UndefinedVarKey, "a")
+	assertErrStrContains(t, err, "struct var fetcher requires a struct, got: int")
+
+	res, err = NewStructVarFetcher((*user)(nil)).Get(UndefinedVarKey, "name")
+	assertNil(t, err)
+	assertNil(t, res)
+}
+
+func TestDottedSelectors(t *testing.T) {
+	vals := map[string]interface{}{
+		"user": map[string]interface{}{
+			"name":    "alice",
+			"age":     30,
+			"address": map[string]interface{}{"city": "SF"},
+		},
+		"users": []interface{}{
+			map[string]interface{}{"name": "bob"},
+			map[string]interface{}{"name": "carol"},
+		},
+		"order.id": "flat",
+	}
+
+	testCases := []struct {
+		expr      string
+		undefined bool
+		want      Value
+		errMsg    string
+	}{
+		{expr: `(= user.address.city "SF")`, want: true},
+		{expr: `(+ user.age 1)`, want: int64(31)},
+		{expr: `(any users (= x.name "carol"))`, want: true},
+		// the registered dotted names are not walked
+		{expr: `(default order.id "none")`, want: "flat"},
+		{expr: `(default user.address.zip "none")`, errMsg: "selector user.address.zip: key not exist zip"},
+		{expr: `(default user.addr.city "none")`, errMsg: "selector user.addr.city: key not exist addr"},
+		{expr: `(default user.name.first "none")`, errMsg: "selector user.name.first: user.name is not a map, got: string"},
+		{expr: `(any users (= x.age 1))`, errMsg: "key not exist age"},
+		{expr: `(= user.address.city "SF")`, undefined: true, want: true},
+		// the unknown keys in the path are nil if the variables are undefined
+		{expr: `(default user.addr.city "none")`, undefined: true, want: "none"},
+		{expr: `(default user.name.first "none")`, undefined: true, want: "none"},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			opts := []Option{RegVarAndOp(vals)}
+			if c.undefined {
+				opts = []Option{EnableUndefinedVariable}
+			}
+			cc := NewConfig(opts...)
+			e, err := Compile(cc, c.expr)
+			assertNil(t, err)
+
+			res, err := e.Eval(NewCtxFromVars(cc, vals))
+			if len(c.errMsg) != 0 {
+				assertErrStrContains(t, err, c.errMsg)
+				return
+			}
+			assertNil(t, err)
+			assertEquals(t, res, c.want)
+		})
+	}
+
+	// the dotted selectors read their roots
+	cc := NewConfig(RegVarAndOp(vals))
+	e, err := Compile(cc, `(= user.address.city "SF")`)
+	assertNil(t, err)
+	assertNil(t, e.ValidateInputs(vals))
+	assertErrStrContains(t, e.ValidateInputs(nil), "missing [user]")
+
+	// the unknown roots are still unknown
+	_, err = Compile(cc, `(= usr.address.city "SF")`)
+	assertErrStrContains(t, err, "unknown token error")
+}
+
+func TestIndexedSelectors(t *testing.T) {
+	vals := map[string]interface{}{
+		"items":  []int{10, 20, 30},
+		"tags":   []string{"a", "b"},
+		"matrix": []interface{}{[]interface{}{1, 2}, []interface{}{3, 4}},
+		"users": []interface{}{
+			map[string]interface{}{"name": "bob", "roles": []string{"admin"}},
+		},
+		"order": map[string]interface{}{"lines": []interface{}{map[string]interface{}{"qty": 2}}},
+		"name":  "alice",
+	}
+
+	testCases := []struct {
+		expr      string
+		infix     bool
+		undefined bool
+		want      Value
+		errMsg    string
+	}{
+		{expr: `(+ items[0] items[2])`, want: int64(40)},
+		{expr: `(= tags[1] "b")`, want: true},
+		{expr: `(+ matrix[1][0] matrix[0][1])`, want: int64(5)},
+		{expr: `(= users[0].name "bob")`, want: true},
+		{expr: `(= users[0].roles[0] "admin")`, want: true},
+		{expr: `(* order.lines[0].qty 2)`, want: int64(4)},
+		// the negative indexes address the elements from the end
+		{expr: `(- items[-1] items[-3])`, want: int64(20)},
+		{expr: `(= matrix[-1][-1] 4)`, want: true},
+		{expr: `(any matrix (= x[0] 3))`, want: true},
+		{expr: `items[1] + matrix[0][0] > 20`, infix: true, want: true},
+		{expr: `(default items[3] 0)`, errMsg: "selector items[3]: index 3 out of range, length: 3"},
+		{expr: `(default items[-4] 0)`, errMsg: "selector items[-4]: index -4 out of range, length: 3"},
+		{expr: `(default matrix[0][2] 0)`, errMsg: "selector matrix[0][2]: index 2 out of range, length: 2"},
+		{expr: `(default name[0] "none")`, errMsg: "selector name[0]: name is not a list, got: string"},
+		{expr: `(+ items[1] 1)`, undefined: true, want: int64(21)},
+		{expr: `(default name[0] "none")`, undefined: true, want: "none"},
+		{expr: `(default items[5] 0)`, undefined: true, errMsg: "index 5 out of range, length: 3"},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expr, func(t *testing.T) {
+			opts := []Option{RegVarAndOp(vals)}
+			if c.undefined {
+				opts = []Option{EnableUndefinedVariable}
+			}
+			if c.infix {
+				opts = append(opts, EnableInfixNotation)
+			}
+			cc := NewConfig(opts...)
+			e, err := Compile(cc, c.expr)
+			assertNil(t, err)
+
+			res, err := e.Eval(NewCtxFromVars(cc, vals))
+			if len(c.errMsg) != 0 {
+				assertErrStrContains(t, err, c.errMsg)
+				return
+			}
+			assertNil(t, err)
+			assertEquals(t, res, c.want)
+		})
+	}
+
+	// the malformed indexes are not selectors
+	cc := NewConfig(RegVarAndOp(vals))
+	for _, expr := range []string{`(+ items[a] 1)`, `(+ items[0]x 1)`, `(+ items[0]. 1)`} {
+		_, err := Compile(cc, expr)
+		assertNotNil(t, err)
+	}
+}
+
+func TestListVariables(t *testing.T) {
+	items := []interface{}{1, int32(2), "a"}
+	vals := map[string]interface{}{"items": items}
+	cc := NewConfig(RegVarAndOp(vals))
+
+	// the lists are not copied on the fetches
+	e, err := Compile(cc, `(default items 0)`)
+	assertNil(t, err)
+	res, err := e.Eval(NewCtxFromVars(cc, vals))
+	assertNil(t, err)
+	assertEquals(t, &res.([]interface{})[0], &items[0])
+
+	// the keywords unify the elements when binding them
+	e, err = Compile(cc, `(filter items (!= x "a"))`)
+	assertNil(t, err)
+	res, err = e.Eval(NewCtxFromVars(cc, vals))
+	assertNil(t, err)
+	assertEquals(t, res, []interface{}{int64(1), int64(2)})
+}
+
+func TestWithLazy(t *testing.T) {
+	var loads int
+	cc := NewConfig()
+	assertNil(t, RegisterVariable(cc, "vip", BoolType))
+	assertNil(t, RegisterVariable(cc, "uid", IntType))
+	assertNil(t, RegisterVariable(cc, "orders", IntType, WithLazy(func(ctx *Ctx) (Value, error) {
+		loads++
+		uid, err := ctx.Get(cc.VariableKeyMap["uid"], "uid")
+		if err != nil {
+			return nil, err
+		}
+		if uid == int64(0) {
+			return nil, errors.New("no user")
+		}
+		return uid.(int64) * 10, nil
+	})))
+
+	e, err := Compile(cc, `(or vip (> (+ orders orders) 100))`)
+	assertNil(t, err)
+
+	testCases := []struct {
+		name   string
+		vals   map[string]interface{}
+		want   Value
+		loads  int
+		errMsg string
+	}{
+		// the variables in the branches skipped by short circuit are not loaded
+		{name: "short circuit", vals: map[string]interface{}{"vip": true, "uid": 7}, want: true, loads: 0},
+		{name: "loaded once", vals: map[string]interface{}{"vip": false, "uid": 7}, want: true, loads: 1},
+		{name: "present", vals: map[string]interface{}{"vip": false, "uid": 7, "orders": 1}, want: false, loads: 0},
+		{name: "error", vals: map[string]interface{}{"vip": false, "uid": 0}, errMsg: "load variable orders error: no user", loads: 1},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			loads = 0
+			ctx := NewCtxFromVars(cc, c.vals)
+			res, err := e.Eval(ctx)
+			assertEquals(t, loads, c.loads)
+			if len(c.errMsg) != 0 {
+				assertErrStrContains(t, err, c.errMsg)
+				return
+			}
+			assertNil(t, err)
+			assertEquals(t, res, c.want)
+
+			// the loaded values are memoized in the ctx
+			_, err = e.Eval(ctx)
+			assertNil(t, err)
+			assertEquals(t, loads, c.loads)
+		})
+	}
+
+	// the lazy variables are not missing
+	assertNil(t, e.ValidateInputs(map[string]interface{}{"vip": true, "uid": 1}))
+
+	// the dotted selectors load their roots
+	cc = NewConfig(EnableUndefinedVariable)
+	assertNil(t, RegisterVariable(cc, "user", DictType, WithLazy(func(*Ctx) (Value, error) {
+		return map[string]interface{}{"name": "alice"}, nil
+	})))
+	e, err = Compile(cc, `(= user.name "alice")`)
+	assertNil(t, err)
+	res, err := e.Eval(NewCtxFromVars(cc, nil))
+	assertNil(t, err)
+	assertEquals(t, res, true)
+}
+
+func TestExpr_ValidateInputs(t *testing.T) {
+	cc := NewConfig()
+	assertNil(t, RegisterVariable(cc, "age", IntType))
+	assertNil(t, RegisterVariable(cc, "country", StringType))
+	assertNil(t, RegisterVariable(cc, "tags", ListType, WithDefault([]string{})))
+	assertNil(t, RegisterVariable(cc, "unused", BoolType))
+	GetOrRegisterKey(cc, "vip")
+
+	e, err := Compile(cc, `(and (>= age 18) (= country "US") (in "a" tags) vip)`)
+	assertNil(t, err)
+
+	testCases := []struct {
+		name   string
+		vals   map[string]interface{}
+		errMsg string
+	}{
+		{
+			name: "valid",
+			vals: map[string]interface{}{"age": 20, "country": "US", "tags": []string{"a"}, "vip": true},
+		},
+		{
+			// the variable with a default value can be absent
+			name: "defaulted",
+			vals: map[string]interface{}{"age": 20, "country": "US", "vip": true},
+		},
+		{
+			name:   "missing and wrong typed",
+			vals:   map[string]interface{}{"age": "20", "tags": 1, "vip": "yes"},
+			errMsg: "invalid inputs: [age] should be int64, got: string, missing [country], [tags] should be list, got: int64",
+		},
+		{
+			// the untyped variable accepts any type, but it's still required
+			name:   "nil",
+			vals:   map[string]interface{}{"age": 20, "country": nil},
+			errMsg: "invalid inputs: missing [country], missing [vip]",
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			err := e.ValidateInputs(c.vals)
+			if len(c.errMsg) != 0 {
+				assertEquals(t, errors.Is(err, ErrInvalidInputs), true)
+				assertEquals(t, err.Error(), c.errMsg)
+				return
+			}
+			assertNil(t, err)
+		})
+	}
+
+	// the default value is used by NewCtxFromVars
+	vals := map[string]interface{}{"age": 20, "country": "US", "vip": true}
+	res, err := e.Eval(NewCtxFromVars(cc, vals))
+	assertNil(t, err)
+	assertEquals(t, res, false)
+	_, exist := vals["tags"]
+	assertEquals(t, exist, false)
+
+	// the variables referenced by the lambdas are validated, but the local variables are not
+	e, err = Compile(cc, `(find_all tags (= x country))`)
+	assertNil(t, err)
+	assertEquals(t, e.ValidateInputs(nil).Error(), "invalid inputs: missing [country]")
+
+	assertErrStrContains(t, RegisterVariable(cc, "age", IntType), "variable already exist age")
+	assertErrStrContains(t, RegisterVariable(cc, "score", IntType, WithDefault("1")),
+		"default value of variable score should be int64, got: string")
+}